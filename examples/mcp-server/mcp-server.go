@@ -109,6 +109,7 @@ func main() {
 
 // createVerifier creates a token verifier function that validates tokens.
 // since tsidp sends an opaque token we need to call the /introspection endpoint to validate it.
+// Clients or resources configured for JWT access tokens (RFC 9068) could verify them against the JWKS instead.
 func createVerifier(introspectionEndpoint string) func(context.Context, string, *http.Request) (*auth.TokenInfo, error) {
 	return func(ctx context.Context, token string, _ *http.Request) (*auth.TokenInfo, error) {
 
@@ -22,11 +22,24 @@ type capRule struct {
 
 	// for sts rules
 	Users     []string `json:"users"`     // list of users allowed to access resources (supports "*" wildcard)
-	Resources []string `json:"resources"` // list of audience/resource URIs the user can access
+	Resources []string `json:"resources"` // list of audience/resource URIs the user can access (patterns, see resourceMatcher)
+
+	// WorkloadAudiences maps a node tag, or "*" for any tag, to the
+	// audiences that tagged nodes may get workload identity tokens for.
+	// Audiences are patterns like Resources.
+	WorkloadAudiences map[string][]string `json:"workload_audiences,omitempty"`
+
+	// Delegation lists the actors that may act on behalf of the users of
+	// the rule, see delegationRule.
+	Delegation []delegationRule `json:"delegation,omitempty"`
 
 	// allow lists
 	AllowAdminUI bool `json:"allow_admin_ui"`
 	AllowDCR     bool `json:"allow_dcr"` // dynamic client registration
+
+	// AllowIntrospection lets the node introspect tokens issued to any
+	// client.
+	AllowIntrospection bool `json:"allow_introspection,omitempty"`
 }
 
 // AccessGrantedRules holds the access rules from granted Application Capabilities.
@@ -11,9 +11,8 @@ import (
 	"net/url"
 	"slices"
 	"strings"
+	"time"
 
-	"tailscale.com/client/tailscale/apitype"
-	"tailscale.com/util/mak"
 	"tailscale.com/util/rands"
 )
 
@@ -52,122 +51,176 @@ func (s *IDPServer) serveAuthorize(w http.ResponseWriter, r *http.Request) {
 	}
 
 	uq := r.URL.Query()
-	state := uq.Get("state")
+	var (
+		ar    *AuthRequest
+		state string
+	)
+	if requestURI := uq.Get("request_uri"); strings.HasPrefix(requestURI, parRequestURIPrefix) {
+		// RFC 9126 Section 4: the parameters were pushed to /par before,
+		// any others are ignored.
+		var err error
+		ar, state, err = s.takePushedAuthRequest(requestURI, uq.Get("client_id"))
+		if err != nil {
+			writeHTTPError(w, r, http.StatusBadRequest, ecInvalidRequestURI, "invalid request_uri", err)
+			return
+		}
+	} else {
+		var aerr *authorizeError
+		ar, state, aerr = s.resolveAuthorizeRequest(r.Context(), uq)
+		if aerr != nil {
+			aerr.write(w, r, state)
+			return
+		}
+		if ar.FunnelRP.RequirePAR {
+			redirectAuthError(w, r, ar.RedirectURI, ecInvalidRequest, "client requires pushed authorization requests", state)
+			return
+		}
+	}
 
-	redirectURI := uq.Get("redirect_uri")
-	if redirectURI == "" {
-		writeHTTPError(w, r, http.StatusBadRequest, ecInvalidRequest, "must specify redirect_uri", nil)
+	// Get user information
+	var remoteAddr string
+	if s.localTSMode {
+		remoteAddr = lastForwardedForAddr(r)
+	} else {
+		remoteAddr = r.RemoteAddr
+	}
+
+	// Check who is visiting the authorize endpoint.
+	who, err := s.lc.WhoIs(r.Context(), remoteAddr)
+	if err != nil {
+		writeHTTPError(w, r, http.StatusInternalServerError, ecServerError, "failed to authenticate user with WhoIs", err)
 		return
 	}
 
-	clientID := uq.Get("client_id")
-	if clientID == "" {
-		writeHTTPError(w, r, http.StatusBadRequest, ecInvalidRequest, "must specify client_id", nil)
+	if who.Node.View().IsTagged() {
+		redirectAuthError(w, r, ar.RedirectURI, ecAccessDenied, "tagged node doesn't have a user identity", state)
+		return
+	}
+	ar.RemoteUser = who
+
+	parsedURL, err := url.Parse(ar.RedirectURI)
+	if err != nil {
+		writeHTTPError(w, r, http.StatusInternalServerError, ecServerError, "invalid redirect URI", err)
 		return
 	}
 
+	// Generate and save a code and Auth Request
+	code := rands.HexString(32)
+	ar.ValidTill = time.Now().Add(authorizationCodeDuration)
 	s.mu.Lock()
-	funnelClient, ok := s.funnelClients[clientID]
+	err = s.code.Set(code, ar)
 	s.mu.Unlock()
-
-	if !ok {
-		writeHTTPError(w, r, http.StatusBadRequest, ecInvalidClient, "invalid client ID", nil)
+	if err != nil {
+		writeHTTPError(w, r, http.StatusInternalServerError, ecServerError, "failed to store authorization code", err)
 		return
 	}
 
-	// Validate client_id matches (public identifier validation)
-	clientIDcmp := subtle.ConstantTimeCompare([]byte(clientID), []byte(funnelClient.ID))
-	if clientIDcmp != 1 {
-		writeHTTPError(w, r, http.StatusBadRequest, ecInvalidClient, "invalid client ID", nil)
-		return
+	queryString := parsedURL.Query()
+	queryString.Set("code", code)
+	if state != "" {
+		queryString.Set("state", state)
 	}
+	parsedURL.RawQuery = queryString.Encode()
+	u := parsedURL.String()
+	slog.Debug("authorize redirect", slog.String("url", u))
+	http.Redirect(w, r, u, http.StatusFound)
+}
 
-	// check for exact match of redirect_uri (OAuth 2.1 requirement)
-	if !slices.Contains(funnelClient.RedirectURIs, redirectURI) {
-		writeHTTPError(w, r, http.StatusBadRequest, ecInvalidRequest, "redirect_uri mismatch", nil)
+// authorizeError is an invalid authorization request. Once the client and
+// redirect_uri are known to be valid, the error is reported to the client by
+// redirecting to it (RFC 6749 Section 4.1.2.1); before that it is shown to
+// the user.
+type authorizeError struct {
+	code        string
+	description string
+	redirectURI string // validated redirect_uri, if any
+	err         error  // cause, logged but not shown
+}
+
+// write reports the error in response to r.
+func (e *authorizeError) write(w http.ResponseWriter, r *http.Request, state string) {
+	if e.redirectURI != "" {
+		redirectAuthError(w, r, e.redirectURI, e.code, e.description, state)
 		return
 	}
+	writeHTTPError(w, r, http.StatusBadRequest, e.code, e.description, e.err)
+}
 
-	// Get user information
-	var remoteAddr string
-	if s.localTSMode {
-		remoteAddr = lastForwardedForAddr(r)
-	} else {
-		remoteAddr = r.RemoteAddr
+// parseAuthorizeRequest validates the parameters q of an authorization
+// request, sent to /authorize or pushed to /par, and returns the AuthRequest
+// and state they describe. The returned AuthRequest has no RemoteUser yet.
+func (s *IDPServer) parseAuthorizeRequest(q url.Values) (*AuthRequest, string, *authorizeError) {
+	state := q.Get("state")
+
+	redirectURI := q.Get("redirect_uri")
+	if redirectURI == "" {
+		return nil, state, &authorizeError{code: ecInvalidRequest, description: "must specify redirect_uri"}
 	}
 
-	// Check who is visiting the authorize endpoint.
-	var who *apitype.WhoIsResponse
-	var err error
-	who, err = s.lc.WhoIs(r.Context(), remoteAddr)
-	if err != nil {
-		writeHTTPError(w, r, http.StatusInternalServerError, ecServerError, "failed to authenticate user with WhoIs", err)
-		return
+	clientID := q.Get("client_id")
+	if clientID == "" {
+		return nil, state, &authorizeError{code: ecInvalidRequest, description: "must specify client_id"}
 	}
 
-	if who.Node.View().IsTagged() {
-		redirectAuthError(w, r, redirectURI, ecAccessDenied, "tagged node doesn't have a user identity", state)
-		return
+	s.mu.Lock()
+	funnelClient, ok := s.funnelClients[clientID]
+	s.mu.Unlock()
+
+	if !ok {
+		return nil, state, &authorizeError{code: ecInvalidClient, description: "invalid client ID"}
+	}
+
+	// Validate client_id matches (public identifier validation)
+	clientIDcmp := subtle.ConstantTimeCompare([]byte(clientID), []byte(funnelClient.ID))
+	if clientIDcmp != 1 {
+		return nil, state, &authorizeError{code: ecInvalidClient, description: "invalid client ID"}
+	}
+
+	// check for exact match of redirect_uri (OAuth 2.1 requirement)
+	if !slices.Contains(funnelClient.RedirectURIs, redirectURI) {
+		return nil, state, &authorizeError{code: ecInvalidRequest, description: "redirect_uri mismatch"}
 	}
 
-	// Generate and save a code and Auth Request
-	code := rands.HexString(32)
 	ar := &AuthRequest{
-		Nonce:       uq.Get("nonce"),
-		RemoteUser:  who,
+		Nonce:       q.Get("nonce"),
 		RedirectURI: redirectURI,
 		ClientID:    clientID,
 		FunnelRP:    funnelClient, // Store the validated client
 	}
 
 	// Parse space-delimited scopes
-	if scopeParam := uq.Get("scope"); scopeParam != "" {
+	if scopeParam := q.Get("scope"); scopeParam != "" {
 		ar.Scopes = strings.Fields(scopeParam)
 	}
 
 	// Validate scopes
 	validatedScopes, err := s.validateScopes(ar.Scopes)
 	if err != nil {
-		redirectAuthError(w, r, redirectURI, ecInvalidScope, fmt.Sprintf("invalid scope: %v", err), state)
-		return
+		return nil, state, &authorizeError{code: ecInvalidScope, description: fmt.Sprintf("invalid scope: %v", err), redirectURI: redirectURI}
 	}
 	ar.Scopes = validatedScopes
 
 	// Handle PKCE parameters (RFC 7636)
-	if codeChallenge := uq.Get("code_challenge"); codeChallenge != "" {
+	if codeChallenge := q.Get("code_challenge"); codeChallenge != "" {
 		ar.CodeChallenge = codeChallenge
 
 		// code_challenge_method defaults to "plain" if not specified
-		ar.CodeChallengeMethod = uq.Get("code_challenge_method")
+		ar.CodeChallengeMethod = q.Get("code_challenge_method")
 		if ar.CodeChallengeMethod == "" {
 			ar.CodeChallengeMethod = "plain"
 		}
 
 		// Validate the code_challenge_method
 		if ar.CodeChallengeMethod != "plain" && ar.CodeChallengeMethod != "S256" {
-			redirectAuthError(w, r, redirectURI, ecInvalidRequest, "unsupported code_challenge_method", state)
-			return
+			return nil, state, &authorizeError{code: ecInvalidRequest, description: "unsupported code_challenge_method", redirectURI: redirectURI}
 		}
 	}
-	parsedURL, err := url.Parse(redirectURI)
-	if err != nil {
-		writeHTTPError(w, r, http.StatusInternalServerError, ecServerError, "invalid redirect URI", err)
-		return
+	// Public clients have no secret, so PKCE is the only thing binding the
+	// code to the client that asked for it.
+	if funnelClient.isPublic() && ar.CodeChallengeMethod != "S256" {
+		return nil, state, &authorizeError{code: ecInvalidRequest, description: "public clients must use PKCE with S256", redirectURI: redirectURI}
 	}
-
-	s.mu.Lock()
-	mak.Set(&s.code, code, ar)
-	s.mu.Unlock()
-
-	queryString := parsedURL.Query()
-	queryString.Set("code", code)
-	if state := uq.Get("state"); state != "" {
-		queryString.Set("state", state)
-	}
-	parsedURL.RawQuery = queryString.Encode()
-	u := parsedURL.String()
-	slog.Debug("authorize redirect", slog.String("url", u))
-	http.Redirect(w, r, u, http.StatusFound)
+	return ar, state, nil
 }
 
 // validateScopes validates the requested OAuth scopes
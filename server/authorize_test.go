@@ -55,11 +55,13 @@ func TestScopeHandling(t *testing.T) {
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 			s := &IDPServer{
-				serverURL:     "https://idp.test.ts.net",
-				code:          make(map[string]*AuthRequest),
-				accessToken:   make(map[string]*AuthRequest),
-				refreshToken:  make(map[string]*AuthRequest),
-				funnelClients: make(map[string]*FunnelClient),
+				serverURL:         "https://idp.test.ts.net",
+				stateDir:          t.TempDir(),
+				code:              newMemTokenStore(),
+				accessToken:       newMemTokenStore(),
+				refreshToken:      newMemTokenStore(),
+				usedRefreshTokens: newMemTokenStore(),
+				funnelClients:     make(map[string]*FunnelClient),
 			}
 
 			// Set up funnel client
@@ -111,7 +113,7 @@ func TestScopeHandling(t *testing.T) {
 			}
 
 			ar.Scopes = validatedScopes
-			s.code[code] = ar
+			s.code.Set(code, ar)
 
 			// Verify scopes match expected
 			if len(ar.Scopes) != len(tt.expectedScopes) {
@@ -154,7 +156,7 @@ func TestScopeHandling(t *testing.T) {
 					t.Fatalf("failed to unmarshal token response: %v", err)
 				}
 
-				if tokenAR, ok := s.accessToken[tokenResp.AccessToken]; ok {
+				if tokenAR, ok := s.accessToken.Get(tokenResp.AccessToken); ok {
 					if len(tokenAR.Scopes) != len(tt.expectedScopes) {
 						t.Errorf("access token has %d scopes, expected %d", len(tokenAR.Scopes), len(tt.expectedScopes))
 					}
@@ -314,11 +316,13 @@ func TestPKCE(t *testing.T) {
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 			s := &IDPServer{
-				serverURL:     "https://idp.test.ts.net",
-				code:          make(map[string]*AuthRequest),
-				accessToken:   make(map[string]*AuthRequest),
-				refreshToken:  make(map[string]*AuthRequest),
-				funnelClients: make(map[string]*FunnelClient),
+				serverURL:         "https://idp.test.ts.net",
+				stateDir:          t.TempDir(),
+				code:              newMemTokenStore(),
+				accessToken:       newMemTokenStore(),
+				refreshToken:      newMemTokenStore(),
+				usedRefreshTokens: newMemTokenStore(),
+				funnelClients:     make(map[string]*FunnelClient),
 			}
 
 			// Set up funnel client
@@ -369,7 +373,7 @@ func TestPKCE(t *testing.T) {
 				}
 			}
 
-			s.code[code] = ar
+			s.code.Set(code, ar)
 
 			// Now test token exchange
 			form := url.Values{
@@ -409,11 +413,13 @@ func TestPKCE(t *testing.T) {
 // TestPKCEWithRefreshToken tests PKCE with refresh token flow
 func TestPKCEWithRefreshToken(t *testing.T) {
 	s := &IDPServer{
-		serverURL:     "https://idp.test.ts.net",
-		code:          make(map[string]*AuthRequest),
-		accessToken:   make(map[string]*AuthRequest),
-		refreshToken:  make(map[string]*AuthRequest),
-		funnelClients: make(map[string]*FunnelClient),
+		serverURL:         "https://idp.test.ts.net",
+		stateDir:          t.TempDir(),
+		code:              newMemTokenStore(),
+		accessToken:       newMemTokenStore(),
+		refreshToken:      newMemTokenStore(),
+		usedRefreshTokens: newMemTokenStore(),
+		funnelClients:     make(map[string]*FunnelClient),
 	}
 
 	// Set up funnel client
@@ -445,7 +451,7 @@ func TestPKCEWithRefreshToken(t *testing.T) {
 		},
 		ValidTill: time.Now().Add(5 * time.Minute),
 	}
-	s.code[code] = ar
+	s.code.Set(code, ar)
 
 	// Step 2: Exchange code for tokens with code_verifier
 	form := url.Values{
@@ -527,6 +533,135 @@ func TestPKCEWithRefreshToken(t *testing.T) {
 	}
 }
 
+// TestPublicClient tests that public clients redeem codes and refresh
+// tokens without a secret, and must use PKCE with S256
+func TestPublicClient(t *testing.T) {
+	const (
+		redirectURI = "http://127.0.0.1:33418/callback"
+		verifier    = "dBjftJeZ4CVP-mB92K27uhbUJU1p1r_wW1gFWFOEjXk"
+		challenge   = "E9Melhoa2OwvFrEMTJguCHaoeK1t8URWbuGJSstw-cM"
+	)
+
+	who := &apitype.WhoIsResponse{
+		Node:        &tailcfg.Node{ID: 1, Name: "node1.example.ts.net", User: tailcfg.UserID(1)},
+		UserProfile: &tailcfg.UserProfile{LoginName: "user@example.com"},
+		CapMap:      tailcfg.PeerCapMap{},
+	}
+
+	tests := []struct {
+		name            string
+		challenge       string
+		challengeMethod string
+		tokenClientID   string
+		expectAuthError bool
+		expectStatus    int
+	}{
+		{
+			name:            "S256 PKCE",
+			challenge:       challenge,
+			challengeMethod: "S256",
+			tokenClientID:   "public-client",
+			expectStatus:    http.StatusOK,
+		},
+		{
+			name:            "no PKCE",
+			expectAuthError: true,
+		},
+		{
+			name:            "plain PKCE",
+			challenge:       verifier,
+			challengeMethod: "plain",
+			expectAuthError: true,
+		},
+		{
+			name:            "client_id mismatch",
+			challenge:       challenge,
+			challengeMethod: "S256",
+			tokenClientID:   "other-client",
+			expectStatus:    http.StatusBadRequest,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := setupTestServer(t, newTestWhoIsClient(t, who, false))
+			s.funnelClients["public-client"] = &FunnelClient{
+				ID:                      "public-client",
+				RedirectURIs:            []string{redirectURI},
+				TokenEndpointAuthMethod: "none",
+			}
+
+			query := url.Values{
+				"client_id":    {"public-client"},
+				"redirect_uri": {redirectURI},
+				"scope":        {"openid"},
+			}
+			if tt.challenge != "" {
+				query.Set("code_challenge", tt.challenge)
+				query.Set("code_challenge_method", tt.challengeMethod)
+			}
+			req := httptest.NewRequest("GET", "/authorize?"+query.Encode(), nil)
+			req.RemoteAddr = "100.64.0.1:12345"
+			rr := httptest.NewRecorder()
+			s.serveAuthorize(rr, req)
+			if rr.Code != http.StatusFound {
+				t.Fatalf("expected redirect, got %d: %s", rr.Code, rr.Body.String())
+			}
+			location, err := url.Parse(rr.Header().Get("Location"))
+			if err != nil {
+				t.Fatalf("failed to parse redirect URL: %v", err)
+			}
+			if tt.expectAuthError {
+				if got := location.Query().Get("error"); got != ecInvalidRequest {
+					t.Errorf("expected invalid_request error, got %q", got)
+				}
+				return
+			}
+
+			form := url.Values{
+				"grant_type":    {"authorization_code"},
+				"code":          {location.Query().Get("code")},
+				"redirect_uri":  {redirectURI},
+				"client_id":     {tt.tokenClientID},
+				"code_verifier": {verifier},
+			}
+			req = httptest.NewRequest("POST", "/token", strings.NewReader(form.Encode()))
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			rr = httptest.NewRecorder()
+			s.serveToken(rr, req)
+			if rr.Code != tt.expectStatus {
+				t.Fatalf("expected status %d, got %d: %s", tt.expectStatus, rr.Code, rr.Body.String())
+			}
+			if tt.expectStatus != http.StatusOK {
+				return
+			}
+
+			var tokenResp struct {
+				RefreshToken string `json:"refresh_token"`
+			}
+			if err := json.Unmarshal(rr.Body.Bytes(), &tokenResp); err != nil {
+				t.Fatalf("failed to unmarshal token response: %v", err)
+			}
+			if tokenResp.RefreshToken == "" {
+				t.Fatal("expected refresh token to be present")
+			}
+
+			form = url.Values{
+				"grant_type":    {"refresh_token"},
+				"refresh_token": {tokenResp.RefreshToken},
+				"client_id":     {"public-client"},
+			}
+			req = httptest.NewRequest("POST", "/token", strings.NewReader(form.Encode()))
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			rr = httptest.NewRecorder()
+			s.serveToken(rr, req)
+			if rr.Code != http.StatusOK {
+				t.Errorf("refresh token request failed with status %d: %s", rr.Code, rr.Body.String())
+			}
+		})
+	}
+}
+
 // TestServeAuthorize verifies OAuth authorization endpoint security and validation logic.
 func TestServeAuthorize(t *testing.T) {
 	tests := []struct {
@@ -713,7 +848,7 @@ func TestServeAuthorize(t *testing.T) {
 
 			// Verify the auth request was stored
 			srv.mu.Lock()
-			ar, ok := srv.code[code]
+			ar, ok := srv.code.Get(code)
 			srv.mu.Unlock()
 
 			if !ok {
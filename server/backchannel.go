@@ -0,0 +1,192 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package server
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"gopkg.in/square/go-jose.v2/jwt"
+	"tailscale.com/util/rands"
+)
+
+const (
+	// backchannelLogoutEvent is the event type of a logout token, as defined
+	// in OpenID Connect Back-Channel Logout 1.0.
+	backchannelLogoutEvent = "http://schemas.openid.net/event/backchannel-logout"
+
+	// logoutTokenDuration is how long a logout token is valid for.
+	logoutTokenDuration = 2 * time.Minute
+
+	// backchannelLogoutTimeout bounds a single delivery attempt.
+	backchannelLogoutTimeout = 10 * time.Second
+
+	// maxBackchannelLogouts bounds the logout tokens being delivered at
+	// once. Logouts beyond it are dropped.
+	maxBackchannelLogouts = 64
+)
+
+// backchannelLogoutRetryDelays are the delays before each attempt to deliver
+// a logout token to a relying party.
+var backchannelLogoutRetryDelays = []time.Duration{0, 10 * time.Second, time.Minute}
+
+// backchannelLogout notifies the relying party that the session ar belongs
+// to has ended, if the relying party registered a backchannel_logout_uri.
+// The logout token is delivered in the background.
+func (s *IDPServer) backchannelLogout(ar *AuthRequest) {
+	client := ar.FunnelRP
+	if client == nil || client.BackchannelLogoutURI == "" {
+		return
+	}
+
+	var sub string
+	if ar.RemoteUser != nil && ar.RemoteUser.Node != nil {
+		sub = ar.RemoteUser.Node.User.String()
+	}
+	if sub == "" && ar.GrantID == "" {
+		return
+	}
+
+	token, err := s.newLogoutToken(client, sub, ar.GrantID)
+	if err != nil {
+		slog.Error("failed to create logout token",
+			slog.String("client_id", client.ID), slog.Any("error", err))
+		return
+	}
+	ctx, sem := s.logoutDeliveries()
+	select {
+	case sem <- struct{}{}:
+	default:
+		slog.Error("too many back-channel logouts in flight, dropping one",
+			slog.String("client_id", client.ID))
+		return
+	}
+	go func() {
+		defer func() { <-sem }()
+		s.deliverLogoutToken(ctx, client.ID, client.BackchannelLogoutURI, token)
+	}()
+}
+
+// logoutDeliveries returns the context of back-channel logout deliveries,
+// canceled by Close, and the semaphore that bounds them.
+func (s *IDPServer) logoutDeliveries() (context.Context, chan struct{}) {
+	s.logoutOnce.Do(func() {
+		s.logoutCtx, s.logoutCancel = context.WithCancel(context.Background())
+		s.logoutSem = make(chan struct{}, maxBackchannelLogouts)
+	})
+	return s.logoutCtx, s.logoutSem
+}
+
+// newLogoutToken returns a logout token for the session sid of user sub,
+// signed with the algorithm the client uses for ID tokens. Its typ header
+// keeps it from being mistaken for an ID token (OpenID Connect Back-Channel
+// Logout 1.0 Section 2.4).
+func (s *IDPServer) newLogoutToken(client *FunnelClient, sub, sid string) (string, error) {
+	now := time.Now()
+	signer, err := s.signerWithType(client.idTokenSigningAlg(), "logout+jwt", now.Add(logoutTokenDuration))
+	if err != nil {
+		return "", err
+	}
+
+	claims := map[string]any{
+		"iss":    s.serverURL,
+		"aud":    jwt.Audience{client.ID},
+		"iat":    jwt.NewNumericDate(now),
+		"exp":    jwt.NewNumericDate(now.Add(logoutTokenDuration)),
+		"jti":    rands.HexString(32),
+		"events": map[string]any{backchannelLogoutEvent: map[string]any{}},
+	}
+	if sub != "" {
+		claims["sub"] = sub
+	}
+	if sid != "" {
+		claims["sid"] = sid
+	}
+	return jwt.Signed(signer).Claims(claims).CompactSerialize()
+}
+
+// deliverLogoutToken POSTs the logout token to the relying party's
+// backchannel_logout_uri, retrying failed attempts until ctx is done.
+func (s *IDPServer) deliverLogoutToken(ctx context.Context, clientID, uri, token string) {
+	body := url.Values{"logout_token": {token}}.Encode()
+	var err error
+	for i, delay := range backchannelLogoutRetryDelays {
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			slog.Warn("back-channel logout canceled",
+				slog.String("client_id", clientID),
+				slog.String("uri", uri),
+			)
+			return
+		}
+		if err = s.postLogoutToken(ctx, uri, body); err == nil {
+			slog.Info("back-channel logout delivered",
+				slog.String("client_id", clientID),
+				slog.Int("attempt", i+1),
+			)
+			return
+		}
+		slog.Warn("back-channel logout delivery failed",
+			slog.String("client_id", clientID),
+			slog.String("uri", uri),
+			slog.Int("attempt", i+1),
+			slog.Any("error", err),
+		)
+	}
+	slog.Error("giving up on back-channel logout",
+		slog.String("client_id", clientID),
+		slog.String("uri", uri),
+		slog.Any("error", err),
+	)
+}
+
+// postLogoutToken makes a single delivery attempt of a logout token.
+func (s *IDPServer) postLogoutToken(ctx context.Context, uri, body string) error {
+	ctx, cancel := context.WithTimeout(ctx, backchannelLogoutTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, "POST", uri, strings.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	resp, err := s.outboundHTTPClient().Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 4096))
+
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusNoContent {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return nil
+}
+
+// validateBackchannelLogoutURI validates a backchannel_logout_uri. It
+// returns an error message, or "" if the URI is valid.
+func validateBackchannelLogoutURI(uri string) string {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return "invalid URL format"
+	}
+	if u.Scheme != "https" && u.Scheme != "http" {
+		return "must use http or https"
+	}
+	if u.Host == "" {
+		return "must have a host"
+	}
+	if u.Fragment != "" {
+		return "must not contain a fragment"
+	}
+	return ""
+}
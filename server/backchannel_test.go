@@ -0,0 +1,358 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"gopkg.in/square/go-jose.v2"
+	"gopkg.in/square/go-jose.v2/jwt"
+	"tailscale.com/client/tailscale/apitype"
+	"tailscale.com/tailcfg"
+)
+
+// logoutTokenClaims are the claims of a logout token checked by the tests.
+type logoutTokenClaims struct {
+	jwt.Claims
+	SessionID string         `json:"sid"`
+	Events    map[string]any `json:"events"`
+	Nonce     string         `json:"nonce"`
+}
+
+// newLogoutReceiver starts a relying party back-channel logout endpoint that
+// replies with the given status codes in turn, and 200 once they run out.
+// Received logout tokens are sent on the returned channel.
+func newLogoutReceiver(t *testing.T, statuses ...int) (string, <-chan string) {
+	t.Helper()
+	tokens := make(chan string, 10)
+	var calls atomic.Int32
+	rp := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			t.Errorf("expected POST, got %s", r.Method)
+		}
+		if ct := r.Header.Get("Content-Type"); ct != "application/x-www-form-urlencoded" {
+			t.Errorf("unexpected Content-Type %q", ct)
+		}
+		tokens <- r.FormValue("logout_token")
+		if n := int(calls.Add(1)); n <= len(statuses) {
+			w.WriteHeader(statuses[n-1])
+		}
+	}))
+	t.Cleanup(rp.Close)
+	return rp.URL + "/backchannel-logout", tokens
+}
+
+// receiveLogoutToken waits for a logout token to be delivered.
+func receiveLogoutToken(t *testing.T, tokens <-chan string) string {
+	t.Helper()
+	select {
+	case tok := <-tokens:
+		return tok
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for logout token")
+		return ""
+	}
+}
+
+// verifyLogoutToken verifies a logout token against the server's JWKS and
+// returns its claims.
+func verifyLogoutToken(t *testing.T, s *IDPServer, token string) *logoutTokenClaims {
+	t.Helper()
+	tok, err := jwt.ParseSigned(token)
+	if err != nil {
+		t.Fatalf("failed to parse logout token: %v", err)
+	}
+
+	rr := httptest.NewRecorder()
+	s.serveJWKS(rr, httptest.NewRequest("GET", "/.well-known/jwks.json", nil))
+	var jwks jose.JSONWebKeySet
+	if err := json.Unmarshal(rr.Body.Bytes(), &jwks); err != nil {
+		t.Fatalf("decoding JWKS: %v", err)
+	}
+	if typ := tok.Headers[0].ExtraHeaders[jose.HeaderType]; typ != "logout+jwt" {
+		t.Errorf("typ = %v, want logout+jwt", typ)
+	}
+	keys := jwks.Key(tok.Headers[0].KeyID)
+	if len(keys) != 1 {
+		t.Fatalf("kid %s not published in JWKS", tok.Headers[0].KeyID)
+	}
+
+	var claims logoutTokenClaims
+	if err := tok.Claims(keys[0].Key, &claims); err != nil {
+		t.Fatalf("logout token does not verify against JWKS: %v", err)
+	}
+	if claims.Issuer != s.serverURL {
+		t.Errorf("iss = %q, want %q", claims.Issuer, s.serverURL)
+	}
+	if claims.IssuedAt == nil || claims.Expiry == nil || claims.ID == "" {
+		t.Error("logout token is missing iat, exp or jti")
+	}
+	if _, ok := claims.Events[backchannelLogoutEvent]; !ok {
+		t.Errorf("logout token is missing the %s event: %v", backchannelLogoutEvent, claims.Events)
+	}
+	if claims.Nonce != "" {
+		t.Error("logout token must not contain a nonce")
+	}
+	return &claims
+}
+
+// newBackchannelTestServer returns a server with a single client whose
+// back-channel logout endpoint is uri, and one session of that client.
+func newBackchannelTestServer(t *testing.T, uri string) (*IDPServer, *FunnelClient) {
+	t.Helper()
+	who := &apitype.WhoIsResponse{
+		Node:        &tailcfg.Node{ID: 1, Name: "node.test.ts.net.", User: 42},
+		UserProfile: &tailcfg.UserProfile{LoginName: "user@example.com"},
+	}
+	s := New(newTestWhoIsClient(t, who, false), t.TempDir(), false, false, false)
+	s.serverURL = "https://idp.test.ts.net"
+	s.bypassAppCapCheck = true
+	client := &FunnelClient{
+		ID:                       "test-client",
+		Secret:                   "test-secret",
+		RedirectURIs:             []string{"https://rp.example.com/callback"},
+		IDTokenSignedResponseAlg: "ES256",
+		BackchannelLogoutURI:     uri,
+	}
+	s.SetFunnelClients(map[string]*FunnelClient{client.ID: client})
+
+	ar := &AuthRequest{
+		ClientID:   client.ID,
+		FunnelRP:   client,
+		JTI:        "jti-1",
+		GrantID:    "grant-1",
+		ValidTill:  time.Now().Add(time.Hour),
+		RemoteUser: who,
+	}
+	s.accessToken.Set("at-1", ar)
+	s.refreshToken.Set("rt-1", ar)
+	return s, client
+}
+
+// TestBackchannelLogout tests that ending a session sends a logout token to
+// the relying party
+func TestBackchannelLogout(t *testing.T) {
+	tests := []struct {
+		name string
+		end  func(t *testing.T, s *IDPServer) *http.Request
+	}{
+		{
+			name: "refresh token revoked",
+			end: func(t *testing.T, s *IDPServer) *http.Request {
+				form := url.Values{"token": {"rt-1"}, "token_type_hint": {"refresh_token"}}
+				req := httptest.NewRequest("POST", "/revoke", strings.NewReader(form.Encode()))
+				req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+				req.SetBasicAuth("test-client", "test-secret")
+				return req
+			},
+		},
+		{
+			name: "end session",
+			end: func(t *testing.T, s *IDPServer) *http.Request {
+				hint := mustSignIDToken(t, s, jwt.Claims{
+					Issuer:   s.serverURL,
+					Subject:  "userid:42",
+					Audience: jwt.Audience{"test-client"},
+					ID:       "jti-1",
+				})
+				return httptest.NewRequest("GET", "/end_session?"+url.Values{"id_token_hint": {hint}}.Encode(), nil)
+			},
+		},
+		{
+			name: "client deleted",
+			end: func(t *testing.T, s *IDPServer) *http.Request {
+				return httptest.NewRequest("DELETE", "/clients/test-client", nil)
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			uri, tokens := newLogoutReceiver(t)
+			s, _ := newBackchannelTestServer(t, uri)
+
+			rr := httptest.NewRecorder()
+			s.ServeHTTP(rr, tt.end(t, s))
+			if rr.Code >= 400 {
+				t.Fatalf("unexpected status %d: %s", rr.Code, rr.Body.String())
+			}
+
+			token := receiveLogoutToken(t, tokens)
+			if alg := mustParseJWTAlg(t, token); alg != "ES256" {
+				t.Errorf("logout token alg = %s, want the client's ID token alg ES256", alg)
+			}
+			claims := verifyLogoutToken(t, s, token)
+			if claims.Subject != "userid:42" {
+				t.Errorf("sub = %q, want userid:42", claims.Subject)
+			}
+			if claims.SessionID != "grant-1" {
+				t.Errorf("sid = %q, want grant-1", claims.SessionID)
+			}
+			if !claims.Audience.Contains("test-client") {
+				t.Errorf("aud = %v, want test-client", claims.Audience)
+			}
+		})
+	}
+}
+
+// TestBackchannelLogoutNotConfigured tests that nothing is sent for clients
+// without a back-channel logout URI, or when no session ended
+func TestBackchannelLogoutNotConfigured(t *testing.T) {
+	uri, tokens := newLogoutReceiver(t)
+	s, client := newBackchannelTestServer(t, uri)
+
+	// Revoking an access token does not end the session.
+	form := url.Values{"token": {"at-1"}}
+	req := httptest.NewRequest("POST", "/revoke", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.SetBasicAuth(client.ID, client.Secret)
+	rr := httptest.NewRecorder()
+	s.ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("unexpected status %d: %s", rr.Code, rr.Body.String())
+	}
+
+	client.BackchannelLogoutURI = ""
+	req = httptest.NewRequest("DELETE", "/clients/test-client", nil)
+	rr = httptest.NewRecorder()
+	s.ServeHTTP(rr, req)
+	if rr.Code != http.StatusNoContent {
+		t.Fatalf("unexpected status %d: %s", rr.Code, rr.Body.String())
+	}
+
+	select {
+	case <-tokens:
+		t.Error("unexpected logout token")
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+// TestBackchannelLogoutRetry tests that failed deliveries are retried
+func TestBackchannelLogoutRetry(t *testing.T) {
+	oldDelays := backchannelLogoutRetryDelays
+	backchannelLogoutRetryDelays = []time.Duration{0, time.Millisecond, time.Millisecond}
+	t.Cleanup(func() { backchannelLogoutRetryDelays = oldDelays })
+
+	uri, tokens := newLogoutReceiver(t, http.StatusInternalServerError, http.StatusBadGateway)
+	s, _ := newBackchannelTestServer(t, uri)
+
+	ar, _ := s.refreshToken.Get("rt-1")
+	s.backchannelLogout(ar)
+
+	first := receiveLogoutToken(t, tokens)
+	receiveLogoutToken(t, tokens)
+	if third := receiveLogoutToken(t, tokens); third != first {
+		t.Error("retries should deliver the same logout token")
+	}
+	select {
+	case <-tokens:
+		t.Error("unexpected delivery after success")
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+// TestBackchannelLogoutClose tests that closing the server stops retrying
+// deliveries
+func TestBackchannelLogoutClose(t *testing.T) {
+	oldDelays := backchannelLogoutRetryDelays
+	backchannelLogoutRetryDelays = []time.Duration{0, time.Hour}
+	t.Cleanup(func() { backchannelLogoutRetryDelays = oldDelays })
+
+	uri, tokens := newLogoutReceiver(t, http.StatusInternalServerError)
+	s, _ := newBackchannelTestServer(t, uri)
+
+	ar, _ := s.refreshToken.Get("rt-1")
+	s.backchannelLogout(ar)
+	receiveLogoutToken(t, tokens)
+
+	_, sem := s.logoutDeliveries()
+	s.Close()
+	deadline := time.Now().Add(5 * time.Second)
+	for len(sem) > 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("delivery still running after Close")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// TestIDTokenSessionID tests that ID tokens carry the session ID that
+// logout tokens refer to
+func TestIDTokenSessionID(t *testing.T) {
+	s := New(nil, t.TempDir(), false, false, false)
+	client := &FunnelClient{
+		ID:           "test-client",
+		Secret:       "test-secret",
+		RedirectURIs: []string{"https://rp.example.com/callback"},
+	}
+	s.SetFunnelClients(map[string]*FunnelClient{client.ID: client})
+	s.code.Set("code", &AuthRequest{
+		ClientID:    client.ID,
+		RedirectURI: "https://rp.example.com/callback",
+		ValidTill:   time.Now().Add(5 * time.Minute),
+		FunnelRP:    client,
+		RemoteUser: &apitype.WhoIsResponse{
+			Node:        &tailcfg.Node{ID: 1, Name: "node.test.ts.net.", User: 1},
+			UserProfile: &tailcfg.UserProfile{LoginName: "user@example.com"},
+		},
+	})
+
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {"code"},
+		"redirect_uri":  {"https://rp.example.com/callback"},
+		"client_id":     {client.ID},
+		"client_secret": {client.Secret},
+	}
+	req := httptest.NewRequest("POST", "/token", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	rr := httptest.NewRecorder()
+	s.serveToken(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected 200 OK, got %d: %s", rr.Code, rr.Body.String())
+	}
+
+	var resp struct {
+		IDToken      string `json:"id_token"`
+		RefreshToken string `json:"refresh_token"`
+	}
+	if err := json.Unmarshal(rr.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("failed to unmarshal response: %v", err)
+	}
+	tok, err := jwt.ParseSigned(resp.IDToken)
+	if err != nil {
+		t.Fatalf("failed to parse ID token: %v", err)
+	}
+	var claims struct {
+		SessionID string `json:"sid"`
+	}
+	if err := tok.UnsafeClaimsWithoutVerification(&claims); err != nil {
+		t.Fatal(err)
+	}
+
+	ar, ok := s.refreshToken.Get(resp.RefreshToken)
+	if !ok {
+		t.Fatal("refresh token not stored")
+	}
+	if claims.SessionID == "" || claims.SessionID != ar.GrantID {
+		t.Errorf("sid = %q, want the grant ID %q", claims.SessionID, ar.GrantID)
+	}
+}
+
+// mustParseJWTAlg returns the signing algorithm of a compact JWS.
+func mustParseJWTAlg(t *testing.T, token string) string {
+	t.Helper()
+	tok, err := jwt.ParseSigned(token)
+	if err != nil {
+		t.Fatalf("failed to parse token: %v", err)
+	}
+	return tok.Headers[0].Algorithm
+}
@@ -12,6 +12,7 @@ import (
 	"slices"
 	"strings"
 	"testing"
+	"time"
 
 	"tailscale.com/util/mak"
 )
@@ -333,6 +334,411 @@ func TestServeDynamicClientRegistration(t *testing.T) {
 				}
 			},
 		},
+		{
+			name:   "POST request - ID token signing algorithm",
+			method: "POST",
+			body: `{
+				"redirect_uris": ["https://example.com/callback"],
+				"id_token_signed_response_alg": "ES256"
+			}`,
+			expectStatus: http.StatusCreated,
+			checkResponse: func(t *testing.T, body []byte) {
+				var resp FunnelClient
+				if err := json.Unmarshal(body, &resp); err != nil {
+					t.Fatalf("failed to unmarshal response: %v", err)
+				}
+
+				if resp.IDTokenSignedResponseAlg != "ES256" {
+					t.Errorf("expected id_token_signed_response_alg ES256, got %q", resp.IDTokenSignedResponseAlg)
+				}
+			},
+		},
+		{
+			name:   "POST request - unsupported ID token signing algorithm",
+			method: "POST",
+			body: `{
+				"redirect_uris": ["https://example.com/callback"],
+				"id_token_signed_response_alg": "HS256"
+			}`,
+			expectStatus: http.StatusBadRequest,
+			checkResponse: func(t *testing.T, body []byte) {
+				var errResp map[string]any
+				if err := json.Unmarshal(body, &errResp); err != nil {
+					t.Fatalf("failed to unmarshal error response: %v", err)
+				}
+				if errResp["error"] != "invalid_client_metadata" {
+					t.Errorf("expected error invalid_client_metadata, got %v", errResp["error"])
+				}
+			},
+		},
+		{
+			name:   "POST request - post logout redirect URIs",
+			method: "POST",
+			body: `{
+				"redirect_uris": ["https://example.com/callback"],
+				"post_logout_redirect_uris": ["https://example.com/signed-out"]
+			}`,
+			expectStatus: http.StatusCreated,
+			checkResponse: func(t *testing.T, body []byte) {
+				var resp FunnelClient
+				if err := json.Unmarshal(body, &resp); err != nil {
+					t.Fatalf("failed to unmarshal response: %v", err)
+				}
+
+				if len(resp.PostLogoutRedirectURIs) != 1 || resp.PostLogoutRedirectURIs[0] != "https://example.com/signed-out" {
+					t.Errorf("unexpected post_logout_redirect_uris: %v", resp.PostLogoutRedirectURIs)
+				}
+			},
+		},
+		{
+			name:   "POST request - invalid post logout redirect URI",
+			method: "POST",
+			body: `{
+				"redirect_uris": ["https://example.com/callback"],
+				"post_logout_redirect_uris": ["javascript:alert(1)"]
+			}`,
+			expectStatus: http.StatusBadRequest,
+		},
+		{
+			name:   "POST request - backchannel logout URI",
+			method: "POST",
+			body: `{
+				"redirect_uris": ["https://example.com/callback"],
+				"backchannel_logout_uri": "https://example.com/backchannel-logout",
+				"backchannel_logout_session_required": true
+			}`,
+			expectStatus: http.StatusCreated,
+			checkResponse: func(t *testing.T, body []byte) {
+				var resp FunnelClient
+				if err := json.Unmarshal(body, &resp); err != nil {
+					t.Fatalf("failed to unmarshal response: %v", err)
+				}
+
+				if resp.BackchannelLogoutURI != "https://example.com/backchannel-logout" {
+					t.Errorf("unexpected backchannel_logout_uri: %q", resp.BackchannelLogoutURI)
+				}
+				if !resp.BackchannelLogoutSessionRequired {
+					t.Error("expected backchannel_logout_session_required to be true")
+				}
+			},
+		},
+		{
+			name:   "POST request - client credentials without redirect URIs",
+			method: "POST",
+			body: `{
+				"grant_types": ["client_credentials"],
+				"scope": "read write"
+			}`,
+			expectStatus: http.StatusCreated,
+			checkResponse: func(t *testing.T, body []byte) {
+				var resp FunnelClient
+				if err := json.Unmarshal(body, &resp); err != nil {
+					t.Fatalf("failed to unmarshal response: %v", err)
+				}
+
+				if !resp.allowsGrantType("client_credentials") || resp.Scope != "read write" {
+					t.Errorf("unexpected client: %+v", resp)
+				}
+			},
+		},
+		{
+			name:   "POST request - public client",
+			method: "POST",
+			body: `{
+				"redirect_uris": ["http://127.0.0.1:33418/callback"],
+				"token_endpoint_auth_method": "none",
+				"application_type": "native"
+			}`,
+			expectStatus: http.StatusCreated,
+			checkResponse: func(t *testing.T, body []byte) {
+				var resp FunnelClient
+				if err := json.Unmarshal(body, &resp); err != nil {
+					t.Fatalf("failed to unmarshal response: %v", err)
+				}
+
+				if !resp.isPublic() {
+					t.Errorf("expected a public client, got token_endpoint_auth_method %q", resp.TokenEndpointAuthMethod)
+				}
+				if resp.Secret != "" {
+					t.Errorf("public client should not get a secret, got %q", resp.Secret)
+				}
+			},
+		},
+		{
+			name:   "POST request - public client with client credentials",
+			method: "POST",
+			body: `{
+				"grant_types": ["client_credentials"],
+				"token_endpoint_auth_method": "none"
+			}`,
+			expectStatus: http.StatusBadRequest,
+		},
+		{
+			name:   "POST request - unsupported token endpoint auth method",
+			method: "POST",
+			body: `{
+				"redirect_uris": ["https://example.com/callback"],
+				"token_endpoint_auth_method": "client_secret_jwt"
+			}`,
+			expectStatus: http.StatusBadRequest,
+		},
+		{
+			name:   "POST request - tls_client_auth",
+			method: "POST",
+			body: `{
+				"redirect_uris": ["https://example.com/callback"],
+				"token_endpoint_auth_method": "tls_client_auth",
+				"tls_client_auth_san_dns": "rp.example.com"
+			}`,
+			expectStatus: http.StatusCreated,
+			checkResponse: func(t *testing.T, body []byte) {
+				var resp FunnelClient
+				if err := json.Unmarshal(body, &resp); err != nil {
+					t.Fatalf("failed to unmarshal response: %v", err)
+				}
+
+				if resp.TLSClientAuthSANDNS != "rp.example.com" || resp.TokenEndpointAuthMethod != "tls_client_auth" {
+					t.Errorf("unexpected client: %+v", resp)
+				}
+				if resp.Secret != "" {
+					t.Errorf("tls_client_auth client should not get a secret, got %q", resp.Secret)
+				}
+			},
+		},
+		{
+			name:   "POST request - require pushed authorization requests",
+			method: "POST",
+			body: `{
+				"redirect_uris": ["https://example.com/callback"],
+				"require_pushed_authorization_requests": true
+			}`,
+			expectStatus: http.StatusCreated,
+			checkResponse: func(t *testing.T, body []byte) {
+				var resp FunnelClient
+				if err := json.Unmarshal(body, &resp); err != nil {
+					t.Fatalf("failed to unmarshal response: %v", err)
+				}
+
+				if !resp.RequirePAR {
+					t.Error("expected require_pushed_authorization_requests to be set")
+				}
+			},
+		},
+		{
+			name:   "POST request - tls_client_auth without subject",
+			method: "POST",
+			body: `{
+				"redirect_uris": ["https://example.com/callback"],
+				"token_endpoint_auth_method": "tls_client_auth"
+			}`,
+			expectStatus: http.StatusBadRequest,
+		},
+		{
+			name:   "POST request - tls_client_auth with two subjects",
+			method: "POST",
+			body: `{
+				"redirect_uris": ["https://example.com/callback"],
+				"token_endpoint_auth_method": "tls_client_auth",
+				"tls_client_auth_san_dns": "rp.example.com",
+				"tls_client_auth_san_email": "rp@example.com"
+			}`,
+			expectStatus: http.StatusBadRequest,
+		},
+		{
+			name:   "POST request - self_signed_tls_client_auth without keys",
+			method: "POST",
+			body: `{
+				"redirect_uris": ["https://example.com/callback"],
+				"token_endpoint_auth_method": "self_signed_tls_client_auth"
+			}`,
+			expectStatus: http.StatusBadRequest,
+		},
+		{
+			name:   "POST request - private_key_jwt with jwks_uri",
+			method: "POST",
+			body: `{
+				"redirect_uris": ["https://example.com/callback"],
+				"token_endpoint_auth_method": "private_key_jwt",
+				"jwks_uri": "https://example.com/jwks.json"
+			}`,
+			expectStatus: http.StatusCreated,
+			checkResponse: func(t *testing.T, body []byte) {
+				var resp FunnelClient
+				if err := json.Unmarshal(body, &resp); err != nil {
+					t.Fatalf("failed to unmarshal response: %v", err)
+				}
+
+				if resp.JWKSURI != "https://example.com/jwks.json" || resp.TokenEndpointAuthMethod != "private_key_jwt" {
+					t.Errorf("unexpected client: %+v", resp)
+				}
+				if resp.Secret != "" {
+					t.Errorf("private_key_jwt client should not get a secret, got %q", resp.Secret)
+				}
+			},
+		},
+		{
+			name:   "POST request - private_key_jwt without keys",
+			method: "POST",
+			body: `{
+				"redirect_uris": ["https://example.com/callback"],
+				"token_endpoint_auth_method": "private_key_jwt"
+			}`,
+			expectStatus: http.StatusBadRequest,
+		},
+		{
+			name:   "POST request - http jwks_uri",
+			method: "POST",
+			body: `{
+				"redirect_uris": ["https://example.com/callback"],
+				"token_endpoint_auth_method": "private_key_jwt",
+				"jwks_uri": "http://example.com/jwks.json"
+			}`,
+			expectStatus: http.StatusBadRequest,
+		},
+		{
+			name:   "POST request - private key in jwks",
+			method: "POST",
+			body: `{
+				"redirect_uris": ["https://example.com/callback"],
+				"token_endpoint_auth_method": "private_key_jwt",
+				"jwks": {"keys": [{"kty": "oct", "k": "c2VjcmV0"}]}
+			}`,
+			expectStatus: http.StatusBadRequest,
+		},
+		{
+			name:   "POST request - require signed request object",
+			method: "POST",
+			body: `{
+				"redirect_uris": ["https://example.com/callback"],
+				"jwks_uri": "https://example.com/jwks.json",
+				"require_signed_request_object": true,
+				"request_uris": ["https://example.com/request.jwt"]
+			}`,
+			expectStatus: http.StatusCreated,
+			checkResponse: func(t *testing.T, body []byte) {
+				var resp FunnelClient
+				if err := json.Unmarshal(body, &resp); err != nil {
+					t.Fatalf("failed to unmarshal response: %v", err)
+				}
+
+				if !resp.RequireSignedRequestObject || len(resp.RequestURIs) != 1 {
+					t.Errorf("unexpected client: %+v", resp)
+				}
+			},
+		},
+		{
+			name:   "POST request - unsupported introspection_signed_response_alg",
+			method: "POST",
+			body: `{
+				"redirect_uris": ["https://example.com/callback"],
+				"introspection_signed_response_alg": "HS256"
+			}`,
+			expectStatus: http.StatusBadRequest,
+		},
+		{
+			name:   "POST request - JWT access tokens",
+			method: "POST",
+			body: `{
+				"redirect_uris": ["https://example.com/callback"],
+				"jwt_access_tokens": true
+			}`,
+			expectStatus: http.StatusCreated,
+			checkResponse: func(t *testing.T, body []byte) {
+				var resp FunnelClient
+				if err := json.Unmarshal(body, &resp); err != nil {
+					t.Fatalf("failed to unmarshal response: %v", err)
+				}
+
+				if !resp.JWTAccessTokens {
+					t.Error("expected jwt_access_tokens to be set")
+				}
+			},
+		},
+		{
+			name:   "POST request - token lifetimes",
+			method: "POST",
+			body: `{
+				"redirect_uris": ["https://example.com/callback"],
+				"access_token_lifetime": 3600,
+				"refresh_token_lifetime": 28800
+			}`,
+			expectStatus: http.StatusCreated,
+			checkResponse: func(t *testing.T, body []byte) {
+				var resp FunnelClient
+				if err := json.Unmarshal(body, &resp); err != nil {
+					t.Fatalf("failed to unmarshal response: %v", err)
+				}
+
+				if resp.AccessTokenLifetime != 3600 || resp.RefreshTokenLifetime != 28800 {
+					t.Errorf("unexpected lifetimes: access %d, refresh %d", resp.AccessTokenLifetime, resp.RefreshTokenLifetime)
+				}
+			},
+		},
+		{
+			name:   "POST request - bind tokens to node",
+			method: "POST",
+			body: `{
+				"redirect_uris": ["https://example.com/callback"],
+				"bind_tokens_to_node": true
+			}`,
+			expectStatus: http.StatusCreated,
+			checkResponse: func(t *testing.T, body []byte) {
+				var resp FunnelClient
+				if err := json.Unmarshal(body, &resp); err != nil {
+					t.Fatalf("failed to unmarshal response: %v", err)
+				}
+
+				if !resp.BindTokensToNode {
+					t.Error("expected bind_tokens_to_node to be set")
+				}
+			},
+		},
+		{
+			name:   "POST request - access token lifetime too long",
+			method: "POST",
+			body: `{
+				"redirect_uris": ["https://example.com/callback"],
+				"access_token_lifetime": 172800
+			}`,
+			expectStatus: http.StatusBadRequest,
+		},
+		{
+			name:   "POST request - negative refresh token idle timeout",
+			method: "POST",
+			body: `{
+				"redirect_uris": ["https://example.com/callback"],
+				"refresh_token_idle_timeout": -1
+			}`,
+			expectStatus: http.StatusBadRequest,
+		},
+		{
+			name:   "POST request - require signed request object without keys",
+			method: "POST",
+			body: `{
+				"redirect_uris": ["https://example.com/callback"],
+				"require_signed_request_object": true
+			}`,
+			expectStatus: http.StatusBadRequest,
+		},
+		{
+			name:   "POST request - http request_uris",
+			method: "POST",
+			body: `{
+				"redirect_uris": ["https://example.com/callback"],
+				"jwks_uri": "https://example.com/jwks.json",
+				"request_uris": ["http://example.com/request.jwt"]
+			}`,
+			expectStatus: http.StatusBadRequest,
+		},
+		{
+			name:   "POST request - backchannel logout URI with fragment",
+			method: "POST",
+			body: `{
+				"redirect_uris": ["https://example.com/callback"],
+				"backchannel_logout_uri": "https://example.com/backchannel-logout#frag"
+			}`,
+			expectStatus: http.StatusBadRequest,
+		},
 		{
 			name:   "POST request - multiple redirect URIs",
 			method: "POST",
@@ -635,9 +1041,13 @@ func TestDeleteClient(t *testing.T) {
 	tempDir := t.TempDir()
 
 	s := &IDPServer{
-		serverURL:     "https://idp.test.ts.net",
-		stateDir:      tempDir,
-		funnelClients: make(map[string]*FunnelClient),
+		serverURL:         "https://idp.test.ts.net",
+		stateDir:          tempDir,
+		code:              newMemTokenStore(),
+		accessToken:       newMemTokenStore(),
+		refreshToken:      newMemTokenStore(),
+		usedRefreshTokens: newMemTokenStore(),
+		funnelClients:     make(map[string]*FunnelClient),
 
 		// Disable app cap for this test to test for the deny-by-default behaviour
 		bypassAppCapCheck: true,
@@ -662,6 +1072,10 @@ func TestDeleteClient(t *testing.T) {
 	s.mu.Lock()
 	mak.Set(&s.funnelClients, client1.ID, client1)
 	mak.Set(&s.funnelClients, client2.ID, client2)
+	validTill := time.Now().Add(time.Hour)
+	s.refreshToken.Set("rt-1", &AuthRequest{ClientID: client1.ID, ValidTill: validTill})
+	s.usedRefreshTokens.Set("used-1", &AuthRequest{ClientID: client1.ID, ValidTill: validTill})
+	s.usedRefreshTokens.Set("used-2", &AuthRequest{ClientID: client2.ID, ValidTill: validTill})
 	s.mu.Unlock()
 
 	// Test deleting client1
@@ -685,6 +1099,17 @@ func TestDeleteClient(t *testing.T) {
 	if _, exists := s.funnelClients["test-client-2"]; !exists {
 		t.Error("client2 should still exist")
 	}
+
+	// Tokens of client1 are removed, including used refresh tokens.
+	if _, ok := s.refreshToken.Get("rt-1"); ok {
+		t.Error("refresh token of client1 should have been removed")
+	}
+	if _, ok := s.usedRefreshTokens.Get("used-1"); ok {
+		t.Error("used refresh token of client1 should have been removed")
+	}
+	if _, ok := s.usedRefreshTokens.Get("used-2"); !ok {
+		t.Error("used refresh token of client2 should remain")
+	}
 }
 
 // TestGetClientsList tests the client list endpoint
@@ -915,6 +1340,10 @@ func TestClientApiCSRF(t *testing.T) {
 			s := &IDPServer{
 				serverURL:         "https://idp.test.ts.net",
 				stateDir:          tempDir,
+				code:              newMemTokenStore(),
+				accessToken:       newMemTokenStore(),
+				refreshToken:      newMemTokenStore(),
+				usedRefreshTokens: newMemTokenStore(),
 				funnelClients:     make(map[string]*FunnelClient),
 				bypassAppCapCheck: true,
 			}
@@ -0,0 +1,224 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package server
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"slices"
+	"time"
+
+	"gopkg.in/square/go-jose.v2"
+	"gopkg.in/square/go-jose.v2/jwt"
+	"tailscale.com/types/views"
+)
+
+const (
+	// clientAssertionType is the client_assertion_type of private_key_jwt
+	// client authentication (RFC 7523 Section 2.2).
+	clientAssertionType = "urn:ietf:params:oauth:client-assertion-type:jwt-bearer"
+
+	// clientAssertionMaxLifetime bounds how far in the future the exp of a
+	// client assertion may be. Used jti values are remembered until exp, so
+	// this also bounds how long they are kept.
+	clientAssertionMaxLifetime = 10 * time.Minute
+
+	// jwksFetchTimeout is the timeout for fetching a jwks_uri or request_uri.
+	jwksFetchTimeout = 10 * time.Second
+
+	// maxJWKSSize is the maximum size of a JWKS fetched from a jwks_uri.
+	maxJWKSSize = 1 << 20
+)
+
+// authenticateClient verifies that r is authenticated as client, using the
+// authentication method the client registered. clientSecret is the secret
+// sent with HTTP Basic auth or the client_secret form parameter, if any.
+func (s *IDPServer) authenticateClient(r *http.Request, client *FunnelClient, clientSecret string) error {
+	switch client.TokenEndpointAuthMethod {
+	case "private_key_jwt":
+		return s.verifyClientAssertion(r, client)
+	case "tls_client_auth", "self_signed_tls_client_auth":
+		return s.verifyClientCertificate(r, client)
+	case "none":
+		return fmt.Errorf("tsidp: public client %q can't authenticate", client.ID)
+	}
+	if clientSecret == "" {
+		return fmt.Errorf("tsidp: missing client credentials")
+	}
+	if subtle.ConstantTimeCompare([]byte(clientSecret), []byte(client.Secret)) != 1 {
+		return fmt.Errorf("tsidp: invalid client secret for %q", client.ID)
+	}
+	return nil
+}
+
+// clientCredentials returns the client ID and secret sent with r, using
+// HTTP Basic auth or form parameters. If r carries a client assertion and
+// no client_id, the client ID is taken from the (not yet verified)
+// assertion.
+func clientCredentials(r *http.Request) (clientID, clientSecret string) {
+	clientID, clientSecret, ok := r.BasicAuth()
+	if !ok {
+		clientID = r.FormValue("client_id")
+		clientSecret = r.FormValue("client_secret")
+	}
+	if clientID == "" {
+		clientID = clientAssertionSubject(r)
+	}
+	return clientID, clientSecret
+}
+
+// clientAssertionSubject returns the subject of the client assertion in r
+// without verifying it, or "" if there is none.
+func clientAssertionSubject(r *http.Request) string {
+	assertion := r.FormValue("client_assertion")
+	if assertion == "" {
+		return ""
+	}
+	tok, err := jwt.ParseSigned(assertion)
+	if err != nil {
+		return ""
+	}
+	var claims jwt.Claims
+	if err := tok.UnsafeClaimsWithoutVerification(&claims); err != nil {
+		return ""
+	}
+	return claims.Subject
+}
+
+// verifyClientAssertion verifies the private_key_jwt client assertion in r
+// (RFC 7523 Section 3). The assertion must be signed with one of the keys
+// the client registered, be issued by and for the client, be addressed to
+// tsidp and not have been used before.
+func (s *IDPServer) verifyClientAssertion(r *http.Request, client *FunnelClient) error {
+	if r.FormValue("client_assertion_type") != clientAssertionType {
+		return fmt.Errorf("tsidp: missing or unsupported client_assertion_type")
+	}
+	assertion := r.FormValue("client_assertion")
+	if assertion == "" {
+		return fmt.Errorf("tsidp: missing client_assertion")
+	}
+	tok, err := jwt.ParseSigned(assertion)
+	if err != nil {
+		return fmt.Errorf("tsidp: invalid client_assertion: %w", err)
+	}
+	if len(tok.Headers) != 1 {
+		return fmt.Errorf("tsidp: client_assertion must have one signature")
+	}
+	header := tok.Headers[0]
+	if !views.SliceContains(oauthTokenEndpointAuthSigningAlgs, header.Algorithm) {
+		return fmt.Errorf("tsidp: unsupported client_assertion algorithm %q", header.Algorithm)
+	}
+
+	var claims jwt.Claims
+	if err := s.verifyClientSignature(r.Context(), client, tok, &claims); err != nil {
+		return fmt.Errorf("tsidp: client_assertion: %w", err)
+	}
+
+	if claims.Issuer != client.ID || claims.Subject != client.ID {
+		return fmt.Errorf("tsidp: client_assertion iss and sub must be the client ID")
+	}
+	// The audience may be the issuer, the token endpoint or the endpoint
+	// the assertion is sent to (RFC 7523 Section 3).
+	if !slices.ContainsFunc([]string{s.serverURL, s.serverURL + "/token", s.serverURL + r.URL.Path}, claims.Audience.Contains) {
+		return fmt.Errorf("tsidp: client_assertion audience %v does not include %s", claims.Audience, s.serverURL)
+	}
+	now := time.Now()
+	if claims.Expiry == nil {
+		return fmt.Errorf("tsidp: client_assertion has no exp")
+	}
+	if err := claims.ValidateWithLeeway(jwt.Expected{Time: now}, NotValidBeforeClockSkew); err != nil {
+		return fmt.Errorf("tsidp: invalid client_assertion: %w", err)
+	}
+	exp := claims.Expiry.Time()
+	if exp.After(now.Add(clientAssertionMaxLifetime)) {
+		return fmt.Errorf("tsidp: client_assertion expires too far in the future")
+	}
+	if claims.ID == "" {
+		return fmt.Errorf("tsidp: client_assertion has no jti")
+	}
+
+	// Each assertion can only be used once.
+	jtiKey := client.ID + "/" + claims.ID
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, used := s.clientAssertionJTIs[jtiKey]; used {
+		return fmt.Errorf("tsidp: client_assertion jti %q has already been used", claims.ID)
+	}
+	if s.clientAssertionJTIs == nil {
+		s.clientAssertionJTIs = make(map[string]time.Time)
+	}
+	s.clientAssertionJTIs[jtiKey] = exp.Add(NotValidBeforeClockSkew)
+	return nil
+}
+
+// verifyClientSignature verifies that tok is signed with one of the keys
+// client registered, and decodes its claims into dest.
+func (s *IDPServer) verifyClientSignature(ctx context.Context, client *FunnelClient, tok *jwt.JSONWebToken, dest ...any) error {
+	kid := tok.Headers[0].KeyID
+	jwks, err := s.clientJWKS(ctx, client, kid)
+	if err != nil {
+		return err
+	}
+	keys := jwks.Keys
+	if kid != "" {
+		keys = jwks.Key(kid)
+	}
+	for _, k := range keys {
+		// Only public signing keys are accepted.
+		if k.Use == "enc" || !k.IsPublic() {
+			continue
+		}
+		if err := tok.Claims(k.Key, dest...); err == nil {
+			return nil
+		}
+	}
+	return fmt.Errorf("signature does not verify for %q", client.ID)
+}
+
+// clientJWKS returns the keys client registered for private_key_jwt,
+// self_signed_tls_client_auth or signed request objects, fetching them from
+// its jwks_uri if needed. kid is the key ID of the token to verify, if any,
+// see fetchJWKS.
+func (s *IDPServer) clientJWKS(ctx context.Context, client *FunnelClient, kid string) (*jose.JSONWebKeySet, error) {
+	if client.JWKS != nil {
+		return client.JWKS, nil
+	}
+	if client.JWKSURI == "" {
+		return nil, fmt.Errorf("tsidp: client %q has no registered keys", client.ID)
+	}
+	jwks, err := s.fetchJWKS(ctx, client.JWKSURI, kid)
+	if err != nil {
+		return nil, fmt.Errorf("tsidp: jwks_uri of %q: %w", client.ID, err)
+	}
+	return jwks, nil
+}
+
+// validateClientKeys validates the jwks and jwks_uri registered by a client
+// for the token endpoint auth method authMethod.
+func validateClientKeys(authMethod string, jwks *jose.JSONWebKeySet, jwksURI string) error {
+	if jwks != nil && jwksURI != "" {
+		return errors.New("jwks and jwks_uri are mutually exclusive")
+	}
+	if jwksURI != "" {
+		u, err := url.Parse(jwksURI)
+		if err != nil || u.Scheme != "https" || u.Host == "" {
+			return errors.New("jwks_uri must be an https URL")
+		}
+	}
+	if jwks != nil {
+		for _, k := range jwks.Keys {
+			if !k.Valid() || !k.IsPublic() {
+				return errors.New("jwks must only contain valid public keys")
+			}
+		}
+	}
+	if (authMethod == "private_key_jwt" || authMethod == "self_signed_tls_client_auth") && (jwks == nil || len(jwks.Keys) == 0) && jwksURI == "" {
+		return fmt.Errorf("%s requires jwks or jwks_uri", authMethod)
+	}
+	return nil
+}
@@ -0,0 +1,358 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package server
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"gopkg.in/square/go-jose.v2"
+	"gopkg.in/square/go-jose.v2/jwt"
+	"tailscale.com/client/tailscale/apitype"
+	"tailscale.com/tailcfg"
+	"tailscale.com/util/rands"
+)
+
+// newClientAssertionKey returns an ECDSA key for signing client assertions
+// and a JWKS holding its public key under kid.
+func newClientAssertionKey(t *testing.T, kid string) (*ecdsa.PrivateKey, *jose.JSONWebKeySet) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key, &jose.JSONWebKeySet{Keys: []jose.JSONWebKey{{
+		Key:       &key.PublicKey,
+		KeyID:     kid,
+		Algorithm: string(jose.ES256),
+		Use:       "sig",
+	}}}
+}
+
+// mustSignClientAssertion returns a client assertion with claims, signed
+// with key.
+func mustSignClientAssertion(t *testing.T, key *ecdsa.PrivateKey, kid string, claims jwt.Claims) string {
+	t.Helper()
+	signer, err := jose.NewSigner(jose.SigningKey{Algorithm: jose.ES256, Key: key},
+		(&jose.SignerOptions{}).WithType("JWT").WithHeader("kid", kid))
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, err := jwt.Signed(signer).Claims(claims).CompactSerialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+// clientAssertionClaims returns valid claims of a client assertion by
+// clientID for s.
+func clientAssertionClaims(s *IDPServer, clientID string) jwt.Claims {
+	now := time.Now()
+	return jwt.Claims{
+		Issuer:   clientID,
+		Subject:  clientID,
+		Audience: jwt.Audience{s.serverURL + "/token"},
+		Expiry:   jwt.NewNumericDate(now.Add(time.Minute)),
+		IssuedAt: jwt.NewNumericDate(now),
+		ID:       rands.HexString(16),
+	}
+}
+
+// assertionForm returns form values authenticating with assertion.
+func assertionForm(assertion string) url.Values {
+	return url.Values{
+		"client_assertion_type": {clientAssertionType},
+		"client_assertion":      {assertion},
+	}
+}
+
+// TestClientAssertionValidation tests the checks done on private_key_jwt
+// client assertions
+func TestClientAssertionValidation(t *testing.T) {
+	key, jwks := newClientAssertionKey(t, "key-1")
+	otherKey, _ := newClientAssertionKey(t, "key-1")
+
+	tests := []struct {
+		name          string
+		modify        func(*jwt.Claims)
+		key           *ecdsa.PrivateKey
+		kid           string
+		assertionType string
+		clientID      string
+		wantErr       bool
+	}{
+		{
+			name: "valid",
+		},
+		{
+			name:   "issuer as audience",
+			modify: func(c *jwt.Claims) { c.Audience = jwt.Audience{"https://test.ts.net"} },
+		},
+		{
+			name:     "matching client_id parameter",
+			clientID: "pkj-client",
+		},
+		{
+			name:     "other client_id parameter",
+			clientID: "secret-client",
+			wantErr:  true,
+		},
+		{
+			name:    "wrong audience",
+			modify:  func(c *jwt.Claims) { c.Audience = jwt.Audience{"https://other.example.com/token"} },
+			wantErr: true,
+		},
+		{
+			name:    "expired",
+			modify:  func(c *jwt.Claims) { c.Expiry = jwt.NewNumericDate(time.Now().Add(-time.Hour)) },
+			wantErr: true,
+		},
+		{
+			name:    "no expiry",
+			modify:  func(c *jwt.Claims) { c.Expiry = nil },
+			wantErr: true,
+		},
+		{
+			name:    "expiry too far in the future",
+			modify:  func(c *jwt.Claims) { c.Expiry = jwt.NewNumericDate(time.Now().Add(time.Hour)) },
+			wantErr: true,
+		},
+		{
+			name:    "no jti",
+			modify:  func(c *jwt.Claims) { c.ID = "" },
+			wantErr: true,
+		},
+		{
+			name:    "issuer is not the client",
+			modify:  func(c *jwt.Claims) { c.Issuer = "someone-else" },
+			wantErr: true,
+		},
+		{
+			name:    "signed with another key",
+			key:     otherKey,
+			wantErr: true,
+		},
+		{
+			name:    "unknown kid",
+			kid:     "key-2",
+			wantErr: true,
+		},
+		{
+			name:          "wrong assertion type",
+			assertionType: "urn:ietf:params:oauth:client-assertion-type:saml2-bearer",
+			wantErr:       true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := setupTestServer(t, nil)
+			s.funnelClients["pkj-client"] = &FunnelClient{
+				ID:                      "pkj-client",
+				TokenEndpointAuthMethod: "private_key_jwt",
+				JWKS:                    jwks,
+			}
+			s.funnelClients["secret-client"] = &FunnelClient{ID: "secret-client", Secret: "secret"}
+
+			claims := clientAssertionClaims(s, "pkj-client")
+			if tt.modify != nil {
+				tt.modify(&claims)
+			}
+			signKey, kid := key, "key-1"
+			if tt.key != nil {
+				signKey = tt.key
+			}
+			if tt.kid != "" {
+				kid = tt.kid
+			}
+			form := assertionForm(mustSignClientAssertion(t, signKey, kid, claims))
+			if tt.assertionType != "" {
+				form.Set("client_assertion_type", tt.assertionType)
+			}
+			if tt.clientID != "" {
+				form.Set("client_id", tt.clientID)
+			}
+			req := httptest.NewRequest("POST", "/token", strings.NewReader(form.Encode()))
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+			client, err := s.authenticateFunnelClient(req)
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("expected error, authenticated as %q", client.ID)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("authenticateFunnelClient: %v", err)
+			}
+			if client.ID != "pkj-client" {
+				t.Errorf("authenticated as %q, want pkj-client", client.ID)
+			}
+
+			// The same assertion can't be used again.
+			req = httptest.NewRequest("POST", "/token", strings.NewReader(form.Encode()))
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			if _, err := s.authenticateFunnelClient(req); err == nil {
+				t.Error("replayed client assertion was accepted")
+			}
+		})
+	}
+}
+
+// TestClientJWKSCache tests that keys from a jwks_uri are cached, and
+// fetched again when an assertion is signed with an unknown key
+func TestClientJWKSCache(t *testing.T) {
+	key1, jwks1 := newClientAssertionKey(t, "key-1")
+	key2, jwks2 := newClientAssertionKey(t, "key-2")
+	jwks := jwks1
+	fetches := 0
+	jwksServer := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetches++
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(jwks)
+	}))
+	t.Cleanup(jwksServer.Close)
+
+	s := setupTestServer(t, nil)
+	s.SetHTTPClient(jwksServer.Client())
+	client := &FunnelClient{
+		ID:                      "pkj-client",
+		TokenEndpointAuthMethod: "private_key_jwt",
+		JWKSURI:                 jwksServer.URL + "/jwks.json",
+	}
+	authenticate := func(key *ecdsa.PrivateKey, kid string) error {
+		form := assertionForm(mustSignClientAssertion(t, key, kid, clientAssertionClaims(s, client.ID)))
+		req := httptest.NewRequest("POST", "/token", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		return s.verifyClientAssertion(req, client)
+	}
+
+	for range 3 {
+		if err := authenticate(key1, "key-1"); err != nil {
+			t.Fatalf("authenticate: %v", err)
+		}
+	}
+	if fetches != 1 {
+		t.Errorf("jwks_uri fetched %d times, want once", fetches)
+	}
+
+	// The client rotates its keys. Unknown keys don't cause a fetch right
+	// after the last one.
+	jwks = jwks2
+	if err := authenticate(key2, "key-2"); err == nil {
+		t.Error("authenticated with a key that isn't in the cached key set")
+	}
+	if fetches != 1 {
+		t.Errorf("jwks_uri fetched %d times, want once", fetches)
+	}
+
+	s.docMu.Lock()
+	doc := s.docs[client.JWKSURI]
+	doc.fetched = doc.fetched.Add(-jwksRefetchInterval)
+	s.docs[client.JWKSURI] = doc
+	s.docMu.Unlock()
+	if err := authenticate(key2, "key-2"); err != nil {
+		t.Errorf("authenticate with the new key: %v", err)
+	}
+	if fetches != 2 {
+		t.Errorf("jwks_uri fetched %d times, want twice", fetches)
+	}
+}
+
+// TestPrivateKeyJWTEndpoints tests private_key_jwt client authentication at
+// the token, introspection and revocation endpoints, with keys from a
+// jwks_uri
+func TestPrivateKeyJWTEndpoints(t *testing.T) {
+	key, jwks := newClientAssertionKey(t, "key-1")
+	jwksServer := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(jwks)
+	}))
+	t.Cleanup(jwksServer.Close)
+
+	s := setupTestServer(t, nil)
+	s.SetHTTPClient(jwksServer.Client())
+	client := &FunnelClient{
+		ID:                      "pkj-client",
+		RedirectURIs:            []string{"https://rp.example.com/callback"},
+		TokenEndpointAuthMethod: "private_key_jwt",
+		JWKSURI:                 jwksServer.URL + "/jwks.json",
+	}
+	s.funnelClients[client.ID] = client
+	s.code.Set("code", &AuthRequest{
+		ClientID:    client.ID,
+		RedirectURI: "https://rp.example.com/callback",
+		ValidTill:   time.Now().Add(5 * time.Minute),
+		FunnelRP:    client,
+		RemoteUser: &apitype.WhoIsResponse{
+			Node:        &tailcfg.Node{ID: 1, Name: "node.test.ts.net.", User: 1},
+			UserProfile: &tailcfg.UserProfile{LoginName: "user@example.com"},
+		},
+	})
+
+	post := func(handler http.HandlerFunc, path string, form url.Values) *httptest.ResponseRecorder {
+		claims := clientAssertionClaims(s, client.ID)
+		claims.Audience = jwt.Audience{s.serverURL + path}
+		for k, v := range assertionForm(mustSignClientAssertion(t, key, "key-1", claims)) {
+			form[k] = v
+		}
+		req := httptest.NewRequest("POST", path, strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		rr := httptest.NewRecorder()
+		handler(rr, req)
+		return rr
+	}
+
+	rr := post(s.serveToken, "/token", url.Values{
+		"grant_type":   {"authorization_code"},
+		"code":         {"code"},
+		"redirect_uri": {"https://rp.example.com/callback"},
+	})
+	if rr.Code != http.StatusOK {
+		t.Fatalf("token: expected status 200, got %d: %s", rr.Code, rr.Body.String())
+	}
+	var tokens struct {
+		AccessToken  string `json:"access_token"`
+		RefreshToken string `json:"refresh_token"`
+	}
+	if err := json.Unmarshal(rr.Body.Bytes(), &tokens); err != nil {
+		t.Fatal(err)
+	}
+
+	rr = post(s.serveIntrospect, "/introspect", url.Values{"token": {tokens.AccessToken}})
+	var introspection struct {
+		Active bool `json:"active"`
+	}
+	if err := json.Unmarshal(rr.Body.Bytes(), &introspection); err != nil {
+		t.Fatal(err)
+	}
+	if !introspection.Active {
+		t.Errorf("introspection: expected active token, got %s", rr.Body.String())
+	}
+
+	rr = post(s.serveRevoke, "/revoke", url.Values{"token": {tokens.RefreshToken}})
+	if rr.Code != http.StatusOK {
+		t.Fatalf("revoke: expected status 200, got %d: %s", rr.Code, rr.Body.String())
+	}
+	if _, ok := s.accessToken.Get(tokens.AccessToken); ok {
+		t.Error("access token still valid after revoking the grant")
+	}
+
+	// A client secret is not accepted in place of an assertion.
+	form := url.Values{"token": {tokens.AccessToken}, "client_id": {client.ID}, "client_secret": {""}}
+	req := httptest.NewRequest("POST", "/revoke", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if _, err := s.authenticateFunnelClient(req); err == nil {
+		t.Error("private_key_jwt client authenticated without an assertion")
+	}
+}
@@ -10,29 +10,53 @@ import (
 	"log/slog"
 	"net/http"
 	"os"
-	"path/filepath"
+	"slices"
 	"strings"
 	"time"
 
+	"gopkg.in/square/go-jose.v2"
+	"tailscale.com/types/views"
 	"tailscale.com/util/rands"
 )
 
 // FunnelClient represents an OAuth/OIDC client configuration
 type FunnelClient struct {
-	ID                      string    `json:"client_id"`
-	Secret                  string    `json:"client_secret,omitempty"`
-	Name                    string    `json:"client_name,omitempty"`
-	RedirectURIs            []string  `json:"redirect_uris"`
-	TokenEndpointAuthMethod string    `json:"token_endpoint_auth_method,omitempty"`
-	GrantTypes              []string  `json:"grant_types,omitempty"`
-	ResponseTypes           []string  `json:"response_types,omitempty"`
-	Scope                   string    `json:"scope,omitempty"`
-	ClientURI               string    `json:"client_uri,omitempty"`
-	LogoURI                 string    `json:"logo_uri,omitempty"`
-	Contacts                []string  `json:"contacts,omitempty"`
-	ApplicationType         string    `json:"application_type,omitempty"`
-	DynamicallyRegistered   bool      `json:"dynamically_registered,omitempty"`
-	CreatedAt               time.Time `json:"created_at"`
+	ID                               string              `json:"client_id"`
+	Secret                           string              `json:"client_secret,omitempty"`
+	Name                             string              `json:"client_name,omitempty"`
+	RedirectURIs                     []string            `json:"redirect_uris"`
+	TokenEndpointAuthMethod          string              `json:"token_endpoint_auth_method,omitempty"`
+	JWKS                             *jose.JSONWebKeySet `json:"jwks,omitempty"`     // keys for private_key_jwt
+	JWKSURI                          string              `json:"jwks_uri,omitempty"` // URL of the keys for private_key_jwt
+	TLSClientAuthSubjectDN           string              `json:"tls_client_auth_subject_dn,omitempty"`
+	TLSClientAuthSANDNS              string              `json:"tls_client_auth_san_dns,omitempty"`
+	TLSClientAuthSANURI              string              `json:"tls_client_auth_san_uri,omitempty"`
+	TLSClientAuthSANIP               string              `json:"tls_client_auth_san_ip,omitempty"`
+	TLSClientAuthSANEmail            string              `json:"tls_client_auth_san_email,omitempty"`
+	GrantTypes                       []string            `json:"grant_types,omitempty"`
+	ResponseTypes                    []string            `json:"response_types,omitempty"`
+	Scope                            string              `json:"scope,omitempty"`
+	Resources                        []string            `json:"resources,omitempty"`
+	ClientURI                        string              `json:"client_uri,omitempty"`
+	LogoURI                          string              `json:"logo_uri,omitempty"`
+	Contacts                         []string            `json:"contacts,omitempty"`
+	ApplicationType                  string              `json:"application_type,omitempty"`
+	IDTokenSignedResponseAlg         string              `json:"id_token_signed_response_alg,omitempty"`
+	IntrospectionSignedResponseAlg   string              `json:"introspection_signed_response_alg,omitempty"`
+	PostLogoutRedirectURIs           []string            `json:"post_logout_redirect_uris,omitempty"`
+	BackchannelLogoutURI             string              `json:"backchannel_logout_uri,omitempty"`
+	BackchannelLogoutSessionRequired bool                `json:"backchannel_logout_session_required,omitempty"`
+	RequirePAR                       bool                `json:"require_pushed_authorization_requests,omitempty"` // only accept pushed authorization requests
+	RequireSignedRequestObject       bool                `json:"require_signed_request_object,omitempty"`         // only accept signed request objects
+	RequestURIs                      []string            `json:"request_uris,omitempty"`                          // URLs request objects may be fetched from
+	JWTAccessTokens                  bool                `json:"jwt_access_tokens,omitempty"`                     // issue RFC 9068 JWT access tokens
+	BindTokensToNode                 bool                `json:"bind_tokens_to_node,omitempty"`                   // tokens only work from the node that requested them
+	AccessTokenLifetime              int                 `json:"access_token_lifetime,omitempty"`                 // seconds, overrides the server setting
+	IDTokenLifetime                  int                 `json:"id_token_lifetime,omitempty"`                     // seconds, overrides the server setting
+	RefreshTokenIdleTimeout          int                 `json:"refresh_token_idle_timeout,omitempty"`            // seconds, overrides the server setting
+	RefreshTokenLifetime             int                 `json:"refresh_token_lifetime,omitempty"`                // seconds from sign-in, overrides the server setting
+	DynamicallyRegistered            bool                `json:"dynamically_registered,omitempty"`
+	CreatedAt                        time.Time           `json:"created_at"`
 
 	// backwards compatibility for old clients that used a single string
 	RedirectURI string `json:"redirect_uri"`
@@ -49,10 +73,7 @@ func (s *IDPServer) SetFunnelClients(clients map[string]*FunnelClient) {
 
 // getFunnelClientsPath returns the path to the funnel clients file
 func (s *IDPServer) getFunnelClientsPath() string {
-	if s.stateDir != "" {
-		return filepath.Join(s.stateDir, funnelClientsFile)
-	}
-	return funnelClientsFile
+	return s.statePath(funnelClientsFile)
 }
 
 // LoadFunnelClients loads funnel clients from disk
@@ -251,28 +272,41 @@ func (s *IDPServer) serveDeleteClient(w http.ResponseWriter, r *http.Request, cl
 
 	delete(s.funnelClients, clientID)
 
-	// Clean up any tokens associated with this client
-	for code, ar := range s.code {
-		if ar.ClientID == clientID {
-			delete(s.code, code)
+	// Clean up any tokens associated with this client, and remember the
+	// sessions they belong to so the client can be told they have ended.
+	sessions := make(map[string]*AuthRequest) // keyed by grant ID
+	issuedToClient := func(_ string, ar *AuthRequest) bool {
+		if ar.ClientID != clientID {
+			return false
 		}
-	}
-	for token, ar := range s.accessToken {
-		if ar.ClientID == clientID {
-			delete(s.accessToken, token)
+		if ar.GrantID != "" {
+			sessions[ar.GrantID] = ar
 		}
+		return true
 	}
-	for token, ar := range s.refreshToken {
-		if ar.ClientID == clientID {
-			delete(s.refreshToken, token)
+	for _, ts := range []tokenStore{s.code, s.accessToken, s.refreshToken} {
+		if err := ts.DeleteFunc(issuedToClient); err != nil {
+			slog.Warn("failed to persist token cleanup for deleted client",
+				slog.String("client_id", clientID), slog.Any("error", err))
 		}
 	}
+	// The grants of used refresh tokens ended with the tokens above.
+	if err := s.usedRefreshTokens.DeleteFunc(func(_ string, ar *AuthRequest) bool {
+		return ar.ClientID == clientID
+	}); err != nil {
+		slog.Warn("failed to persist used refresh token cleanup for deleted client",
+			slog.String("client_id", clientID), slog.Any("error", err))
+	}
 
 	if err := s.storeFunnelClientsLocked(); err != nil {
 		writeHTTPError(w, r, http.StatusInternalServerError, ecServerError, "failed to store clients", err)
 		return
 	}
 
+	for _, ar := range sessions {
+		s.backchannelLogout(ar)
+	}
+
 	w.WriteHeader(http.StatusNoContent)
 }
 
@@ -311,16 +345,37 @@ func (s *IDPServer) serveDynamicClientRegistration(w http.ResponseWriter, r *htt
 	}
 
 	var registrationRequest struct {
-		RedirectURIs            []string `json:"redirect_uris"`
-		TokenEndpointAuthMethod string   `json:"token_endpoint_auth_method,omitempty"`
-		GrantTypes              []string `json:"grant_types,omitempty"`
-		ResponseTypes           []string `json:"response_types,omitempty"`
-		ClientName              string   `json:"client_name,omitempty"`
-		ClientURI               string   `json:"client_uri,omitempty"`
-		LogoURI                 string   `json:"logo_uri,omitempty"`
-		Scope                   string   `json:"scope,omitempty"`
-		Contacts                []string `json:"contacts,omitempty"`
-		ApplicationType         string   `json:"application_type,omitempty"`
+		RedirectURIs                     []string            `json:"redirect_uris"`
+		TokenEndpointAuthMethod          string              `json:"token_endpoint_auth_method,omitempty"`
+		JWKS                             *jose.JSONWebKeySet `json:"jwks,omitempty"`
+		JWKSURI                          string              `json:"jwks_uri,omitempty"`
+		TLSClientAuthSubjectDN           string              `json:"tls_client_auth_subject_dn,omitempty"`
+		TLSClientAuthSANDNS              string              `json:"tls_client_auth_san_dns,omitempty"`
+		TLSClientAuthSANURI              string              `json:"tls_client_auth_san_uri,omitempty"`
+		TLSClientAuthSANIP               string              `json:"tls_client_auth_san_ip,omitempty"`
+		TLSClientAuthSANEmail            string              `json:"tls_client_auth_san_email,omitempty"`
+		GrantTypes                       []string            `json:"grant_types,omitempty"`
+		ResponseTypes                    []string            `json:"response_types,omitempty"`
+		ClientName                       string              `json:"client_name,omitempty"`
+		ClientURI                        string              `json:"client_uri,omitempty"`
+		LogoURI                          string              `json:"logo_uri,omitempty"`
+		Scope                            string              `json:"scope,omitempty"`
+		Contacts                         []string            `json:"contacts,omitempty"`
+		ApplicationType                  string              `json:"application_type,omitempty"`
+		IDTokenSignedResponseAlg         string              `json:"id_token_signed_response_alg,omitempty"`
+		IntrospectionSignedResponseAlg   string              `json:"introspection_signed_response_alg,omitempty"`
+		PostLogoutRedirectURIs           []string            `json:"post_logout_redirect_uris,omitempty"`
+		BackchannelLogoutURI             string              `json:"backchannel_logout_uri,omitempty"`
+		BackchannelLogoutSessionRequired bool                `json:"backchannel_logout_session_required,omitempty"`
+		RequirePAR                       bool                `json:"require_pushed_authorization_requests,omitempty"`
+		RequireSignedRequestObject       bool                `json:"require_signed_request_object,omitempty"`
+		RequestURIs                      []string            `json:"request_uris,omitempty"`
+		JWTAccessTokens                  bool                `json:"jwt_access_tokens,omitempty"`
+		BindTokensToNode                 bool                `json:"bind_tokens_to_node,omitempty"`
+		AccessTokenLifetime              int                 `json:"access_token_lifetime,omitempty"`
+		IDTokenLifetime                  int                 `json:"id_token_lifetime,omitempty"`
+		RefreshTokenIdleTimeout          int                 `json:"refresh_token_idle_timeout,omitempty"`
+		RefreshTokenLifetime             int                 `json:"refresh_token_lifetime,omitempty"`
 	}
 
 	if err := json.NewDecoder(r.Body).Decode(&registrationRequest); err != nil {
@@ -328,19 +383,68 @@ func (s *IDPServer) serveDynamicClientRegistration(w http.ResponseWriter, r *htt
 		return
 	}
 
-	// Validate required fields
-	if len(registrationRequest.RedirectURIs) == 0 {
+	// Validate required fields. Redirect URIs are only needed by the
+	// authorization code grant, which is the default.
+	redirects := len(registrationRequest.GrantTypes) == 0 ||
+		slices.Contains(registrationRequest.GrantTypes, "authorization_code")
+	if len(registrationRequest.RedirectURIs) == 0 && redirects {
 		writeHTTPError(w, r, http.StatusBadRequest, "invalid_client_metadata", "redirect_uris is required", nil)
 		return
 	}
-
-	clientID := generateClientID()
-	clientSecret := generateClientSecret()
+	if alg := registrationRequest.IDTokenSignedResponseAlg; alg != "" && !views.SliceContains(openIDSupportedSigningAlgos, alg) {
+		writeHTTPError(w, r, http.StatusBadRequest, "invalid_client_metadata", "unsupported id_token_signed_response_alg", nil)
+		return
+	}
+	if alg := registrationRequest.IntrospectionSignedResponseAlg; alg != "" && !views.SliceContains(openIDSupportedSigningAlgos, alg) {
+		writeHTTPError(w, r, http.StatusBadRequest, "invalid_client_metadata", "unsupported introspection_signed_response_alg", nil)
+		return
+	}
+	for _, uri := range registrationRequest.PostLogoutRedirectURIs {
+		if errMsg := validateRedirectURI(uri); errMsg != "" {
+			writeHTTPError(w, r, http.StatusBadRequest, "invalid_client_metadata", "invalid post_logout_redirect_uris", fmt.Errorf("%s: %s", uri, errMsg))
+			return
+		}
+	}
+	if uri := registrationRequest.BackchannelLogoutURI; uri != "" {
+		if errMsg := validateBackchannelLogoutURI(uri); errMsg != "" {
+			writeHTTPError(w, r, http.StatusBadRequest, "invalid_client_metadata", "invalid backchannel_logout_uri", fmt.Errorf("%s: %s", uri, errMsg))
+			return
+		}
+	}
 
 	// Set defaults
 	if registrationRequest.TokenEndpointAuthMethod == "" {
 		registrationRequest.TokenEndpointAuthMethod = "client_secret_basic"
 	}
+	if !views.SliceContains(oauthSupportedTokenEndpointAuthMethods, registrationRequest.TokenEndpointAuthMethod) {
+		writeHTTPError(w, r, http.StatusBadRequest, "invalid_client_metadata", "unsupported token_endpoint_auth_method", nil)
+		return
+	}
+
+	if err := validateClientKeys(registrationRequest.TokenEndpointAuthMethod, registrationRequest.JWKS, registrationRequest.JWKSURI); err != nil {
+		writeHTTPError(w, r, http.StatusBadRequest, "invalid_client_metadata", err.Error(), nil)
+		return
+	}
+
+	if err := validateRequestObjectMetadata(registrationRequest.RequireSignedRequestObject, registrationRequest.RequestURIs, registrationRequest.JWKS, registrationRequest.JWKSURI); err != nil {
+		writeHTTPError(w, r, http.StatusBadRequest, "invalid_client_metadata", err.Error(), nil)
+		return
+	}
+
+	clientID := generateClientID()
+	clientSecret := generateClientSecret()
+	switch registrationRequest.TokenEndpointAuthMethod {
+	case "private_key_jwt", "tls_client_auth", "self_signed_tls_client_auth":
+		// The client authenticates with its keys or certificate instead.
+		clientSecret = ""
+	case "none":
+		// Public clients can't keep a secret, see isPublic.
+		if slices.Contains(registrationRequest.GrantTypes, "client_credentials") {
+			writeHTTPError(w, r, http.StatusBadRequest, "invalid_client_metadata", "public clients can't use the client_credentials grant", nil)
+			return
+		}
+		clientSecret = ""
+	}
 	if len(registrationRequest.GrantTypes) == 0 {
 		registrationRequest.GrantTypes = []string{"authorization_code"}
 	}
@@ -352,20 +456,49 @@ func (s *IDPServer) serveDynamicClientRegistration(w http.ResponseWriter, r *htt
 	}
 
 	client := &FunnelClient{
-		ID:                      clientID,
-		Secret:                  clientSecret,
-		Name:                    registrationRequest.ClientName,
-		RedirectURIs:            registrationRequest.RedirectURIs,
-		TokenEndpointAuthMethod: registrationRequest.TokenEndpointAuthMethod,
-		GrantTypes:              registrationRequest.GrantTypes,
-		ResponseTypes:           registrationRequest.ResponseTypes,
-		Scope:                   registrationRequest.Scope,
-		ClientURI:               registrationRequest.ClientURI,
-		LogoURI:                 registrationRequest.LogoURI,
-		Contacts:                registrationRequest.Contacts,
-		ApplicationType:         registrationRequest.ApplicationType,
-		DynamicallyRegistered:   true,
-		CreatedAt:               time.Now(),
+		ID:                               clientID,
+		Secret:                           clientSecret,
+		Name:                             registrationRequest.ClientName,
+		RedirectURIs:                     registrationRequest.RedirectURIs,
+		TokenEndpointAuthMethod:          registrationRequest.TokenEndpointAuthMethod,
+		JWKS:                             registrationRequest.JWKS,
+		JWKSURI:                          registrationRequest.JWKSURI,
+		TLSClientAuthSubjectDN:           registrationRequest.TLSClientAuthSubjectDN,
+		TLSClientAuthSANDNS:              registrationRequest.TLSClientAuthSANDNS,
+		TLSClientAuthSANURI:              registrationRequest.TLSClientAuthSANURI,
+		TLSClientAuthSANIP:               registrationRequest.TLSClientAuthSANIP,
+		TLSClientAuthSANEmail:            registrationRequest.TLSClientAuthSANEmail,
+		GrantTypes:                       registrationRequest.GrantTypes,
+		ResponseTypes:                    registrationRequest.ResponseTypes,
+		Scope:                            registrationRequest.Scope,
+		ClientURI:                        registrationRequest.ClientURI,
+		LogoURI:                          registrationRequest.LogoURI,
+		Contacts:                         registrationRequest.Contacts,
+		ApplicationType:                  registrationRequest.ApplicationType,
+		IDTokenSignedResponseAlg:         registrationRequest.IDTokenSignedResponseAlg,
+		IntrospectionSignedResponseAlg:   registrationRequest.IntrospectionSignedResponseAlg,
+		PostLogoutRedirectURIs:           registrationRequest.PostLogoutRedirectURIs,
+		BackchannelLogoutURI:             registrationRequest.BackchannelLogoutURI,
+		BackchannelLogoutSessionRequired: registrationRequest.BackchannelLogoutSessionRequired,
+		RequirePAR:                       registrationRequest.RequirePAR,
+		RequireSignedRequestObject:       registrationRequest.RequireSignedRequestObject,
+		RequestURIs:                      registrationRequest.RequestURIs,
+		JWTAccessTokens:                  registrationRequest.JWTAccessTokens,
+		BindTokensToNode:                 registrationRequest.BindTokensToNode,
+		AccessTokenLifetime:              registrationRequest.AccessTokenLifetime,
+		IDTokenLifetime:                  registrationRequest.IDTokenLifetime,
+		RefreshTokenIdleTimeout:          registrationRequest.RefreshTokenIdleTimeout,
+		RefreshTokenLifetime:             registrationRequest.RefreshTokenLifetime,
+		DynamicallyRegistered:            true,
+		CreatedAt:                        time.Now(),
+	}
+	if err := client.tokenLifetimes().validate(); err != nil {
+		writeHTTPError(w, r, http.StatusBadRequest, "invalid_client_metadata", err.Error(), nil)
+		return
+	}
+	if client.TokenEndpointAuthMethod == "tls_client_auth" && client.tlsClientAuthSubjects() != 1 {
+		writeHTTPError(w, r, http.StatusBadRequest, "invalid_client_metadata", "tls_client_auth requires exactly one tls_client_auth_* subject", nil)
+		return
 	}
 
 	s.mu.Lock()
@@ -388,6 +521,41 @@ func (s *IDPServer) serveDynamicClientRegistration(w http.ResponseWriter, r *htt
 	json.NewEncoder(w).Encode(client)
 }
 
+// isPublic reports whether c is a public client (RFC 6749 Section 2.1),
+// such as a native app or SPA. Public clients have no secret and must use
+// PKCE with S256 to redeem authorization codes.
+func (c *FunnelClient) isPublic() bool {
+	return c.TokenEndpointAuthMethod == "none"
+}
+
+// allowsGrantType reports whether c registered the grant type gt.
+func (c *FunnelClient) allowsGrantType(gt string) bool {
+	return slices.Contains(c.GrantTypes, gt)
+}
+
+// setGrantType returns a copy of grantTypes with gt added if on is true, or
+// removed otherwise.
+func setGrantType(grantTypes []string, gt string, on bool) []string {
+	grantTypes = slices.DeleteFunc(slices.Clone(grantTypes), func(g string) bool { return g == gt })
+	if on {
+		grantTypes = append(grantTypes, gt)
+	}
+	if len(grantTypes) == 0 {
+		return nil
+	}
+	return grantTypes
+}
+
+// idTokenSigningAlg returns the algorithm used to sign ID tokens issued to c.
+// Tokens issued to local clients, and to funnel clients that did not
+// register a preference, are signed with RS256.
+func (c *FunnelClient) idTokenSigningAlg() jose.SignatureAlgorithm {
+	if c == nil || c.IDTokenSignedResponseAlg == "" {
+		return jose.RS256
+	}
+	return jose.SignatureAlgorithm(c.IDTokenSignedResponseAlg)
+}
+
 // Helper functions for redirect URI handling
 
 // splitRedirectURIs splits a multi-line string of redirect URIs into a slice
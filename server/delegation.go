@@ -0,0 +1,153 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package server
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+
+	"tailscale.com/tailcfg"
+)
+
+// maxDelegationDepth caps the number of actors in a delegation chain,
+// whatever the delegation rules allow.
+const maxDelegationDepth = 5
+
+// delegationRule lets actors act on behalf of the users of the capability
+// rule it is part of, by exchanging their tokens with an actor_token (RFC
+// 8693 Section 1.1). Tokens are delegated to no one by default.
+type delegationRule struct {
+	// ActorClients are the client IDs whose tokens may act ("*" for any).
+	ActorClients []string `json:"actor_clients,omitempty"`
+
+	// ActorUsers are the login names of the users whose tokens may act
+	// ("*" for any).
+	ActorUsers []string `json:"actor_users,omitempty"`
+
+	// Audiences are the audiences actors may get tokens for ("*" for any),
+	// within the resources of the capability rule.
+	Audiences []string `json:"audiences"`
+
+	// MaxDepth is the number of actors the delegation chain may have,
+	// counting the actor and those it acts after. It defaults to 1, which
+	// doesn't allow delegated tokens to be delegated further.
+	MaxDepth int `json:"max_depth,omitempty"`
+}
+
+// matches reports whether the delegation rule allows the holder of the
+// actor token actor to act.
+func (d *delegationRule) matches(actor *AuthRequest) bool {
+	if slices.Contains(d.ActorClients, "*") || (actor.ClientID != "" && slices.Contains(d.ActorClients, actor.ClientID)) {
+		return true
+	}
+	if slices.Contains(d.ActorUsers, "*") {
+		return actor.RemoteUser != nil
+	}
+	return actor.RemoteUser != nil && actor.RemoteUser.UserProfile != nil &&
+		slices.Contains(d.ActorUsers, actor.RemoteUser.UserProfile.LoginName)
+}
+
+// maxDepth returns the delegation chain length d allows.
+func (d *delegationRule) maxDepth() int {
+	return min(max(d.MaxDepth, 1), maxDelegationDepth)
+}
+
+// delegationRulesFor returns the delegation rules of the capability rules
+// that apply to the user loginName.
+func delegationRulesFor(rules []capRule, loginName string) []delegationRule {
+	var delegation []delegationRule
+	for _, rule := range rules {
+		if slices.Contains(rule.Users, "*") || slices.Contains(rule.Users, loginName) {
+			delegation = append(delegation, rule.Delegation...)
+		}
+	}
+	return delegation
+}
+
+// depth returns the number of actors in the delegation chain a.
+func (a *ActorClaim) depth() int {
+	n := 0
+	for ; a != nil; a = a.Actor {
+		n++
+	}
+	return n
+}
+
+// delegatedAudiences checks that the capability rules of the user loginName
+// let the holder of the actor token actor act for them with the delegation
+// chain chain, and returns the audiences among audiences it may get tokens
+// for, as matched by m.
+func delegatedAudiences(m *resourceMatcher, rules []capRule, loginName string, actor *AuthRequest, chain *ActorClaim, audiences []string) ([]string, error) {
+	depth := chain.depth()
+	if depth > maxDelegationDepth {
+		return nil, fmt.Errorf("delegation chain of %d actors is too long", depth)
+	}
+	var matched, deep bool
+	var allowed []string
+	for _, d := range delegationRulesFor(rules, loginName) {
+		if !d.matches(actor) {
+			continue
+		}
+		matched = true
+		if depth > d.maxDepth() {
+			deep = true
+			continue
+		}
+		for _, aud := range audiences {
+			if slices.Contains(allowed, aud) {
+				continue
+			}
+			if m.matchAny(d.Audiences, aud) {
+				allowed = append(allowed, aud)
+			}
+		}
+	}
+	switch {
+	case !matched:
+		return nil, fmt.Errorf("%q may not act for %q", actor.subject(), loginName)
+	case len(allowed) == 0 && deep:
+		return nil, fmt.Errorf("delegation chain of %d actors is too long", depth)
+	case len(allowed) == 0:
+		return nil, errors.New("actor may not act for the requested audiences")
+	}
+	return allowed, nil
+}
+
+// mayActClaim returns the may_act claim (RFC 8693 Section 4.4) of tokens
+// for the user loginName, or nil. The claim names a single party, in the
+// form of the act claim of tokens it acts with, so it is only set when the
+// delegation rules allow exactly one actor, and that actor is a client:
+// users are named by login name in the rules but by user ID in act.
+func mayActClaim(rules []capRule, loginName string) *ActorClaim {
+	var clients []string
+	for _, d := range delegationRulesFor(rules, loginName) {
+		if len(d.ActorUsers) > 0 {
+			return nil
+		}
+		for _, c := range d.ActorClients {
+			if !slices.Contains(clients, c) {
+				clients = append(clients, c)
+			}
+		}
+	}
+	if len(clients) != 1 || clients[0] == "*" {
+		return nil
+	}
+	// The subject of client credentials tokens is the client.
+	return &ActorClaim{Subject: clients[0], ClientID: clients[0]}
+}
+
+// mayAct returns the may_act claim of the token of ar, see mayActClaim.
+func (ar *AuthRequest) mayAct() *ActorClaim {
+	who := ar.RemoteUser
+	if who == nil || who.UserProfile == nil {
+		return nil
+	}
+	rules, err := tailcfg.UnmarshalCapJSON[capRule](who.CapMap, tailcfg.PeerCapabilityTsIDP)
+	if err != nil {
+		return nil
+	}
+	return mayActClaim(rules, who.UserProfile.LoginName)
+}
@@ -0,0 +1,246 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"tailscale.com/client/tailscale/apitype"
+	"tailscale.com/tailcfg"
+)
+
+// TestTokenExchangeDelegation tests the delegation rules that decide who may
+// act for a user in token exchange
+func TestTokenExchangeDelegation(t *testing.T) {
+	user := func(delegation ...delegationRule) *apitype.WhoIsResponse {
+		return &apitype.WhoIsResponse{
+			Node:        &tailcfg.Node{ID: 1, Name: "node.test.ts.net.", User: 1},
+			UserProfile: &tailcfg.UserProfile{LoginName: "user@example.com"},
+			CapMap: tailcfg.PeerCapMap{
+				tailcfg.PeerCapabilityTsIDP: marshalCapRules([]capRule{{
+					Users:      []string{"user@example.com"},
+					Resources:  []string{"https://api.example.com", "https://admin.example.com"},
+					Delegation: delegation,
+				}}),
+			},
+		}
+	}
+	gateway := delegationRule{ActorClients: []string{"gateway"}, Audiences: []string{"https://api.example.com"}}
+	bot := &AuthRequest{
+		ClientID:   "bot-client",
+		RemoteUser: &apitype.WhoIsResponse{UserProfile: &tailcfg.UserProfile{LoginName: "bot@example.com"}},
+	}
+	prior := &ActorClaim{Subject: "first-agent", ClientID: "first-agent"}
+
+	tests := []struct {
+		name         string
+		subject      *apitype.WhoIsResponse
+		subjectChain *ActorClaim // actors of the subject token
+		actor        *AuthRequest
+		audience     string
+		expectStatus int
+		expectChain  int
+	}{
+		{
+			name:         "no delegation rules",
+			subject:      user(),
+			expectStatus: http.StatusForbidden,
+		},
+		{
+			name:         "allowed client",
+			subject:      user(gateway),
+			expectStatus: http.StatusOK,
+			expectChain:  1,
+		},
+		{
+			name:         "other client",
+			subject:      user(delegationRule{ActorClients: []string{"other"}, Audiences: []string{"*"}}),
+			expectStatus: http.StatusForbidden,
+		},
+		{
+			name:         "audience not delegated",
+			subject:      user(gateway),
+			audience:     "https://admin.example.com",
+			expectStatus: http.StatusForbidden,
+		},
+		{
+			name:         "allowed user",
+			subject:      user(delegationRule{ActorUsers: []string{"bot@example.com"}, Audiences: []string{"*"}}),
+			actor:        bot,
+			expectStatus: http.StatusOK,
+			expectChain:  1,
+		},
+		{
+			name:         "chain too long",
+			subject:      user(gateway),
+			subjectChain: prior,
+			expectStatus: http.StatusForbidden,
+		},
+		{
+			name: "chain within maxDepth",
+			subject: user(delegationRule{
+				ActorClients: []string{"gateway"},
+				Audiences:    []string{"*"},
+				MaxDepth:     2,
+			}),
+			subjectChain: prior,
+			expectStatus: http.StatusOK,
+			expectChain:  2,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := setupTestServer(t, nil)
+			client := s.funnelClients["test-client"]
+			s.accessToken.Set("subject-token", &AuthRequest{
+				ClientID:   client.ID,
+				FunnelRP:   client,
+				RemoteUser: tt.subject,
+				ActorInfo:  tt.subjectChain,
+				ValidTill:  time.Now().Add(5 * time.Minute),
+			})
+			actor := tt.actor
+			if actor == nil {
+				actor = &AuthRequest{ClientID: "gateway", IsClientCredentials: true}
+			}
+			actor.ValidTill = time.Now().Add(5 * time.Minute)
+			s.accessToken.Set("actor-token", actor)
+
+			form := url.Values{
+				"grant_type":         {"urn:ietf:params:oauth:grant-type:token-exchange"},
+				"subject_token":      {"subject-token"},
+				"subject_token_type": {tokenTypeAccessToken},
+				"actor_token":        {"actor-token"},
+				"actor_token_type":   {tokenTypeAccessToken},
+				"audience":           {tt.audience},
+				"client_id":          {client.ID},
+				"client_secret":      {client.Secret},
+			}
+			if tt.audience == "" {
+				form.Set("audience", "https://api.example.com")
+			}
+			req := httptest.NewRequest("POST", "/token", strings.NewReader(form.Encode()))
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			rr := httptest.NewRecorder()
+			s.serveTokenExchange(rr, req)
+			if rr.Code != tt.expectStatus {
+				t.Fatalf("expected status %d, got %d: %s", tt.expectStatus, rr.Code, rr.Body.String())
+			}
+			if tt.expectStatus != http.StatusOK {
+				return
+			}
+			ar := exchangedToken(t, s, rr)
+			if ar.ActorInfo.Subject != actor.subject() {
+				t.Errorf("act.sub = %q, want %q", ar.ActorInfo.Subject, actor.subject())
+			}
+			if got := ar.ActorInfo.depth(); got != tt.expectChain {
+				t.Errorf("delegation chain of %d actors, want %d", got, tt.expectChain)
+			}
+		})
+	}
+}
+
+// TestTokenExchangeKeepsActors tests that exchanging a delegated token
+// without an actor token doesn't drop its actors
+func TestTokenExchangeKeepsActors(t *testing.T) {
+	s := setupTestServer(t, nil)
+	client := s.funnelClients["test-client"]
+	s.accessToken.Set("subject-token", &AuthRequest{
+		ClientID: client.ID,
+		RemoteUser: &apitype.WhoIsResponse{
+			Node:        &tailcfg.Node{ID: 1, Name: "node.test.ts.net.", User: 1},
+			UserProfile: &tailcfg.UserProfile{LoginName: "user@example.com"},
+			CapMap: tailcfg.PeerCapMap{
+				tailcfg.PeerCapabilityTsIDP: marshalCapRules([]capRule{{
+					Users:     []string{"*"},
+					Resources: []string{"https://api.example.com"},
+				}}),
+			},
+		},
+		ActorInfo: &ActorClaim{Subject: "gateway", ClientID: "gateway"},
+		ValidTill: time.Now().Add(5 * time.Minute),
+	})
+
+	rr := exchangeToken(t, s, client.ID, "subject-token", tokenTypeAccessToken)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", rr.Code, rr.Body.String())
+	}
+	if ar := exchangedToken(t, s, rr); ar.ActorInfo == nil || ar.ActorInfo.Subject != "gateway" {
+		t.Errorf("act = %+v, want the actor of the subject token", ar.ActorInfo)
+	}
+}
+
+// TestMayActClaim tests the may_act claims of the actors delegation rules
+// allow
+func TestMayActClaim(t *testing.T) {
+	tests := []struct {
+		name  string
+		rules []capRule
+		want  *ActorClaim
+	}{
+		{
+			name:  "no delegation",
+			rules: []capRule{{Users: []string{"*"}}},
+		},
+		{
+			name: "single client",
+			rules: []capRule{{
+				Users:      []string{"user@example.com"},
+				Delegation: []delegationRule{{ActorClients: []string{"gateway"}}},
+			}},
+			want: &ActorClaim{Subject: "gateway", ClientID: "gateway"},
+		},
+		{
+			name: "same client in several rules",
+			rules: []capRule{
+				{Users: []string{"*"}, Delegation: []delegationRule{{ActorClients: []string{"gateway"}}}},
+				{Users: []string{"user@example.com"}, Delegation: []delegationRule{{ActorClients: []string{"gateway"}}}},
+			},
+			want: &ActorClaim{Subject: "gateway", ClientID: "gateway"},
+		},
+		{
+			name: "several clients",
+			rules: []capRule{{
+				Users:      []string{"*"},
+				Delegation: []delegationRule{{ActorClients: []string{"gateway", "agent"}}},
+			}},
+		},
+		{
+			name: "any client",
+			rules: []capRule{{
+				Users:      []string{"*"},
+				Delegation: []delegationRule{{ActorClients: []string{"*"}}},
+			}},
+		},
+		{
+			name: "user actor",
+			rules: []capRule{{
+				Users:      []string{"*"},
+				Delegation: []delegationRule{{ActorUsers: []string{"bot@example.com"}}},
+			}},
+		},
+		{
+			name: "rule for another user",
+			rules: []capRule{{
+				Users:      []string{"other@example.com"},
+				Delegation: []delegationRule{{ActorClients: []string{"gateway"}}},
+			}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := mayActClaim(tt.rules, "user@example.com"); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("mayActClaim() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
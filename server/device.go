@@ -0,0 +1,406 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package server
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"tailscale.com/util/rands"
+)
+
+const (
+	// deviceCodeGrantType is the grant type used to poll for the tokens of
+	// a device authorization request.
+	deviceCodeGrantType = "urn:ietf:params:oauth:grant-type:device_code"
+
+	// deviceCodeDuration is how long a device and user code pair is valid.
+	deviceCodeDuration = 10 * time.Minute
+
+	// devicePollInterval is the minimum time clients have to wait between
+	// polls of the token endpoint. It is increased by deviceSlowDownStep
+	// every time a client polls too fast (RFC 8628 Section 3.5).
+	devicePollInterval = 5 * time.Second
+	deviceSlowDownStep = 5 * time.Second
+
+	// userCodeAlphabet has no vowels, to avoid spelling words, and no
+	// characters that are easily confused (RFC 8628 Section 6.1).
+	userCodeAlphabet = "BCDFGHJKLMNPQRSTVWXZ"
+	userCodeLength   = 8
+)
+
+// deviceAuthorization is a device authorization request (RFC 8628) waiting
+// for the user to approve it and for the device to collect its tokens.
+type deviceAuthorization struct {
+	ar       *AuthRequest // RemoteUser is set once the user approves
+	userCode string
+	interval time.Duration // minimum time between polls
+	lastPoll time.Time
+	denied   bool
+}
+
+// pending reports whether the request still awaits the user's decision.
+func (da *deviceAuthorization) pending(now time.Time) bool {
+	return !da.denied && da.ar.RemoteUser == nil && now.Before(da.ar.ValidTill)
+}
+
+// serveDeviceAuthorization implements the device authorization endpoint
+// (RFC 8628 Section 3.1). It hands out a device code for the client to poll
+// the token endpoint with, and a user code for the user to enter at the
+// verification page.
+func (s *IDPServer) serveDeviceAuthorization(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		writeHTTPError(w, r, http.StatusMethodNotAllowed, ecInvalidRequest, "method not allowed", nil)
+		return
+	}
+
+	if err := r.ParseForm(); err != nil {
+		writeHTTPError(w, r, http.StatusBadRequest, ecInvalidRequest, "failed to parse form", err)
+		return
+	}
+
+	client, err := s.identifyFunnelClient(r)
+	if err != nil {
+		writeHTTPError(w, r, http.StatusUnauthorized, ecInvalidClient, "client authentication failed", err)
+		return
+	}
+	if !client.allowsGrantType(deviceCodeGrantType) {
+		writeHTTPError(w, r, http.StatusBadRequest, ecUnauthorizedClient, "client is not allowed to use the device authorization grant", nil)
+		return
+	}
+
+	scopes, err := s.validateScopes(strings.Fields(r.FormValue("scope")))
+	if err != nil {
+		writeHTTPError(w, r, http.StatusBadRequest, ecInvalidScope, "invalid scope", err)
+		return
+	}
+
+	userCode, err := newUserCode()
+	if err != nil {
+		writeHTTPError(w, r, http.StatusInternalServerError, ecServerError, "failed to generate user code", err)
+		return
+	}
+	deviceCode := rands.HexString(32)
+	da := &deviceAuthorization{
+		ar: &AuthRequest{
+			ClientID:  client.ID,
+			FunnelRP:  client,
+			Scopes:    scopes,
+			Resources: r.Form["resource"],
+			ValidTill: time.Now().Add(deviceCodeDuration),
+		},
+		userCode: userCode,
+		interval: devicePollInterval,
+	}
+
+	s.mu.Lock()
+	if s.deviceAuths == nil {
+		s.deviceAuths = make(map[string]*deviceAuthorization)
+	}
+	s.deviceAuths[deviceCode] = da
+	s.mu.Unlock()
+
+	verificationURI := s.serverURL + "/device"
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	if err := json.NewEncoder(w).Encode(map[string]any{
+		"device_code":               deviceCode,
+		"user_code":                 formatUserCode(userCode),
+		"verification_uri":          verificationURI,
+		"verification_uri_complete": verificationURI + "?" + url.Values{"user_code": {formatUserCode(userCode)}}.Encode(),
+		"expires_in":                int(deviceCodeDuration.Seconds()),
+		"interval":                  int(devicePollInterval.Seconds()),
+	}); err != nil {
+		writeHTTPError(w, r, http.StatusInternalServerError, ecServerError, "internal server error", err)
+	}
+}
+
+// handleDeviceCodeGrant handles the device code grant type (RFC 8628
+// Section 3.4). Until the user has approved the request, clients are told
+// to keep polling.
+func (s *IDPServer) handleDeviceCodeGrant(w http.ResponseWriter, r *http.Request) {
+	deviceCode := r.FormValue("device_code")
+	if deviceCode == "" {
+		writeHTTPError(w, r, http.StatusBadRequest, ecInvalidRequest, "device_code is required", nil)
+		return
+	}
+
+	client, err := s.identifyFunnelClient(r)
+	if err != nil {
+		writeHTTPError(w, r, http.StatusUnauthorized, ecInvalidClient, "client authentication failed", err)
+		return
+	}
+	if !client.allowsGrantType(deviceCodeGrantType) {
+		writeHTTPError(w, r, http.StatusBadRequest, ecUnauthorizedClient, "client is not allowed to use the device authorization grant", nil)
+		return
+	}
+
+	now := time.Now()
+	s.mu.Lock()
+	da, ok := s.deviceAuths[deviceCode]
+	if !ok || da.ar.ClientID != client.ID {
+		s.mu.Unlock()
+		writeHTTPError(w, r, http.StatusBadRequest, ecInvalidGrant, "invalid device code", nil)
+		return
+	}
+	switch {
+	case now.After(da.ar.ValidTill):
+		delete(s.deviceAuths, deviceCode)
+		s.mu.Unlock()
+		writeHTTPError(w, r, http.StatusBadRequest, ecExpiredToken, "device code expired", nil)
+		return
+	case da.denied:
+		delete(s.deviceAuths, deviceCode)
+		s.mu.Unlock()
+		writeHTTPError(w, r, http.StatusBadRequest, ecAccessDenied, "authorization denied by the user", nil)
+		return
+	case da.ar.RemoteUser == nil:
+		tooFast := now.Sub(da.lastPoll) < da.interval
+		if tooFast {
+			da.interval += deviceSlowDownStep
+		}
+		da.lastPoll = now
+		s.mu.Unlock()
+		if tooFast {
+			writeHTTPError(w, r, http.StatusBadRequest, ecSlowDown, "polling too frequently", nil)
+		} else {
+			writeHTTPError(w, r, http.StatusBadRequest, ecAuthorizationPending, "authorization pending", nil)
+		}
+		return
+	}
+	// The device code can only be exchanged once.
+	delete(s.deviceAuths, deviceCode)
+	s.mu.Unlock()
+
+	s.issueTokens(w, r, da.ar)
+}
+
+// devicePageData holds data for rendering the device verification page
+type devicePageData struct {
+	UserCode   string
+	ClientName string
+	Scopes     []string
+	Confirm    bool // the user code is valid and awaits approval
+	Success    string
+	Error      string
+}
+
+// serveDevice serves the device verification page, where users in the
+// tailnet enter the user code shown by a device and approve or deny its
+// request.
+func (s *IDPServer) serveDevice(w http.ResponseWriter, r *http.Request) {
+	// Like /authorize, this page is visited by the user who is being
+	// authenticated, who must be in the tailnet.
+	if isFunnelRequest(r) {
+		writeHTTPError(w, r, http.StatusUnauthorized, ecAccessDenied, "not allowed over funnel", nil)
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		userCode := r.URL.Query().Get("user_code")
+		if userCode == "" {
+			s.renderDevicePage(w, r, devicePageData{})
+			return
+		}
+		s.renderDevicePage(w, r, s.deviceConfirmPage(userCode))
+	case "POST":
+		s.handleDeviceDecision(w, r)
+	default:
+		writeHTTPError(w, r, http.StatusMethodNotAllowed, ecInvalidRequest, "method not allowed", nil)
+	}
+}
+
+// handleDeviceDecision records the user's approval or denial of a device
+// authorization request.
+func (s *IDPServer) handleDeviceDecision(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		writeHTTPError(w, r, http.StatusBadRequest, ecInvalidRequest, "failed to parse form", err)
+		return
+	}
+	userCode := r.FormValue("user_code")
+	action := r.FormValue("action")
+
+	if action == "" {
+		// The user submitted a code, show what it is for.
+		s.renderDevicePage(w, r, s.deviceConfirmPage(userCode))
+		return
+	}
+
+	if s.lc == nil {
+		writeHTTPError(w, r, http.StatusInternalServerError, ecServerError, "WhoIs not available", nil)
+		return
+	}
+	var remoteAddr string
+	if s.localTSMode {
+		remoteAddr = lastForwardedForAddr(r)
+	} else {
+		remoteAddr = r.RemoteAddr
+	}
+	who, err := s.lc.WhoIs(r.Context(), remoteAddr)
+	if err != nil {
+		writeHTTPError(w, r, http.StatusInternalServerError, ecServerError, "failed to authenticate user with WhoIs", err)
+		return
+	}
+	if who.Node.View().IsTagged() {
+		s.renderDevicePage(w, r, devicePageData{Error: "Tagged nodes don't have a user identity and can't approve devices."})
+		return
+	}
+
+	s.mu.Lock()
+	da := s.deviceAuthForUserCodeLocked(userCode)
+	if da == nil {
+		s.mu.Unlock()
+		s.renderDevicePage(w, r, devicePageData{UserCode: userCode, Error: "Invalid or expired code."})
+		return
+	}
+	data := deviceConfirmData(da)
+	data.Confirm = false
+
+	if action != "approve" {
+		da.denied = true
+		s.mu.Unlock()
+		slog.Info("device authorization denied",
+			slog.String("for", who.UserProfile.LoginName),
+			slog.String("client_id", da.ar.ClientID),
+		)
+		data.Success = "Request denied. The device will not be signed in."
+		s.renderDevicePage(w, r, data)
+		return
+	}
+
+	requested := da.ar.Resources
+	s.mu.Unlock()
+
+	// Resources are matched without holding s.mu, as patterns may need the
+	// tailnet status. The token only gets the allowed resources.
+	var resources []string
+	if len(requested) > 0 {
+		resources, err = s.validateResourcesForUser(r.Context(), who, requested)
+		if err != nil {
+			data.Error = fmt.Sprintf("You are not allowed to access the requested resources: %v", err)
+			s.renderDevicePage(w, r, data)
+			return
+		}
+	}
+
+	s.mu.Lock()
+	if s.deviceAuthForUserCodeLocked(userCode) != da {
+		s.mu.Unlock()
+		s.renderDevicePage(w, r, devicePageData{UserCode: userCode, Error: "Invalid or expired code."})
+		return
+	}
+	da.ar.Resources = resources
+	da.ar.RemoteUser = who
+	s.mu.Unlock()
+
+	slog.Info("device authorization approved",
+		slog.String("for", who.UserProfile.LoginName),
+		slog.String("client_id", da.ar.ClientID),
+	)
+	data.Success = "Device approved. You can return to your device."
+	s.renderDevicePage(w, r, data)
+}
+
+// deviceAuthForUserCodeLocked returns the pending device authorization
+// request for userCode, or nil if there is none.
+// Caller must hold s.mu lock
+func (s *IDPServer) deviceAuthForUserCodeLocked(userCode string) *deviceAuthorization {
+	userCode = normalizeUserCode(userCode)
+	if userCode == "" {
+		return nil
+	}
+	now := time.Now()
+	for _, da := range s.deviceAuths {
+		if da.userCode == userCode && da.pending(now) {
+			return da
+		}
+	}
+	return nil
+}
+
+// deviceConfirmPage returns the page data asking the user to approve the
+// request for userCode, or an error if there is no such request.
+func (s *IDPServer) deviceConfirmPage(userCode string) devicePageData {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	da := s.deviceAuthForUserCodeLocked(userCode)
+	if da == nil {
+		return devicePageData{UserCode: userCode, Error: "Invalid or expired code."}
+	}
+	return deviceConfirmData(da)
+}
+
+// deviceConfirmData returns the page data asking the user to approve da.
+func deviceConfirmData(da *deviceAuthorization) devicePageData {
+	name := da.ar.FunnelRP.Name
+	if name == "" {
+		name = da.ar.ClientID
+	}
+	return devicePageData{
+		UserCode:   formatUserCode(da.userCode),
+		ClientName: name,
+		Scopes:     da.ar.Scopes,
+		Confirm:    true,
+	}
+}
+
+// renderDevicePage renders the device verification page
+func (s *IDPServer) renderDevicePage(w http.ResponseWriter, r *http.Request, data devicePageData) {
+	var buf bytes.Buffer
+	if err := deviceTmpl.ExecuteTemplate(&buf, "base", data); err != nil {
+		writeHTTPError(w, r, http.StatusInternalServerError, ecServerError, "failed to render device page", err)
+		return
+	}
+	if _, err := buf.WriteTo(w); err != nil {
+		slog.Error("failed to write device page response", slog.Any("error", err))
+	}
+}
+
+// newUserCode returns a random user code of userCodeLength characters from
+// userCodeAlphabet.
+func newUserCode() (string, error) {
+	code := make([]byte, 0, userCodeLength)
+	buf := make([]byte, 1)
+	for len(code) < userCodeLength {
+		if _, err := rand.Read(buf); err != nil {
+			return "", err
+		}
+		// Reject values that would bias the distribution.
+		if int(buf[0]) >= 256-256%len(userCodeAlphabet) {
+			continue
+		}
+		code = append(code, userCodeAlphabet[int(buf[0])%len(userCodeAlphabet)])
+	}
+	return string(code), nil
+}
+
+// formatUserCode formats a user code for display, like "BCDF-GHJK".
+func formatUserCode(code string) string {
+	if len(code) != userCodeLength {
+		return code
+	}
+	return code[:userCodeLength/2] + "-" + code[userCodeLength/2:]
+}
+
+// normalizeUserCode undoes formatUserCode and the changes users commonly
+// make when typing a code: lower case letters, spaces and dashes.
+func normalizeUserCode(code string) string {
+	return strings.Map(func(r rune) rune {
+		if r == '-' || r == ' ' {
+			return -1
+		}
+		if r >= 'a' && r <= 'z' {
+			return r - 'a' + 'A'
+		}
+		return r
+	}, code)
+}
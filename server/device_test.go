@@ -0,0 +1,401 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"tailscale.com/client/tailscale/apitype"
+	"tailscale.com/tailcfg"
+)
+
+// deviceTestClient is the funnel client used by the device flow tests.
+var deviceTestClient = &FunnelClient{
+	ID:         "tv-client",
+	Secret:     "tv-secret",
+	Name:       "Living Room TV",
+	GrantTypes: []string{deviceCodeGrantType},
+}
+
+// newDeviceTestServer returns a test server with deviceTestClient, whose
+// WhoIs identifies requests as who.
+func newDeviceTestServer(t *testing.T, who *apitype.WhoIsResponse) *IDPServer {
+	t.Helper()
+	s := setupTestServer(t, newTestWhoIsClient(t, who, false))
+	c := *deviceTestClient
+	s.funnelClients[c.ID] = &c
+	return s
+}
+
+// deviceTestUser returns a WhoIs response for a tailnet user.
+func deviceTestUser() *apitype.WhoIsResponse {
+	return &apitype.WhoIsResponse{
+		Node:        &tailcfg.Node{ID: 1, Name: "laptop.test.ts.net.", User: 42},
+		UserProfile: &tailcfg.UserProfile{LoginName: "user@example.com"},
+		CapMap:      tailcfg.PeerCapMap{},
+	}
+}
+
+type deviceAuthResponse struct {
+	DeviceCode              string `json:"device_code"`
+	UserCode                string `json:"user_code"`
+	VerificationURI         string `json:"verification_uri"`
+	VerificationURIComplete string `json:"verification_uri_complete"`
+	ExpiresIn               int    `json:"expires_in"`
+	Interval                int    `json:"interval"`
+}
+
+// startDeviceAuth starts a device authorization request for client, for
+// resources if any.
+func startDeviceAuth(t *testing.T, s *IDPServer, clientID, clientSecret string, resources ...string) deviceAuthResponse {
+	t.Helper()
+	form := url.Values{
+		"client_id":     {clientID},
+		"client_secret": {clientSecret},
+		"scope":         {"openid email"},
+		"resource":      resources,
+	}
+	req := httptest.NewRequest("POST", "/device_authorization", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	rr := httptest.NewRecorder()
+	s.serveDeviceAuthorization(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("device authorization: expected status 200, got %d: %s", rr.Code, rr.Body.String())
+	}
+	var resp deviceAuthResponse
+	if err := json.Unmarshal(rr.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("failed to unmarshal response: %v", err)
+	}
+	return resp
+}
+
+// pollDeviceToken polls the token endpoint with deviceCode.
+func pollDeviceToken(t *testing.T, s *IDPServer, deviceCode, clientID, clientSecret string) *httptest.ResponseRecorder {
+	t.Helper()
+	form := url.Values{
+		"grant_type":    {deviceCodeGrantType},
+		"device_code":   {deviceCode},
+		"client_id":     {clientID},
+		"client_secret": {clientSecret},
+	}
+	req := httptest.NewRequest("POST", "/token", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	rr := httptest.NewRecorder()
+	s.serveToken(rr, req)
+	return rr
+}
+
+// submitDeviceDecision posts the user's decision on userCode to the
+// verification page.
+func submitDeviceDecision(t *testing.T, s *IDPServer, userCode, action string) *httptest.ResponseRecorder {
+	t.Helper()
+	form := url.Values{"user_code": {userCode}, "action": {action}}
+	req := httptest.NewRequest("POST", "/device", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.RemoteAddr = "100.64.0.1:12345"
+	rr := httptest.NewRecorder()
+	s.serveDevice(rr, req)
+	return rr
+}
+
+// deviceErrorCode returns the OAuth error code of the JSON error in rr.
+func deviceErrorCode(t *testing.T, rr *httptest.ResponseRecorder) string {
+	t.Helper()
+	var resp struct {
+		Error string `json:"error"`
+	}
+	if err := json.Unmarshal(rr.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("failed to unmarshal error response %q: %v", rr.Body.String(), err)
+	}
+	return resp.Error
+}
+
+// TestDeviceAuthorizationFlow tests the device flow from the device
+// authorization request to the token response
+func TestDeviceAuthorizationFlow(t *testing.T) {
+	s := newDeviceTestServer(t, deviceTestUser())
+
+	da := startDeviceAuth(t, s, "tv-client", "tv-secret")
+	if da.DeviceCode == "" {
+		t.Fatal("missing device_code")
+	}
+	if len(da.UserCode) != userCodeLength+1 || da.UserCode[4] != '-' {
+		t.Errorf("user_code = %q, want XXXX-XXXX format", da.UserCode)
+	}
+	if da.VerificationURI != "https://test.ts.net/device" {
+		t.Errorf("verification_uri = %q", da.VerificationURI)
+	}
+	if want := "https://test.ts.net/device?user_code=" + da.UserCode; da.VerificationURIComplete != want {
+		t.Errorf("verification_uri_complete = %q, want %q", da.VerificationURIComplete, want)
+	}
+	if da.ExpiresIn != int(deviceCodeDuration.Seconds()) || da.Interval != int(devicePollInterval.Seconds()) {
+		t.Errorf("expires_in = %d, interval = %d", da.ExpiresIn, da.Interval)
+	}
+
+	// The user hasn't approved yet.
+	rr := pollDeviceToken(t, s, da.DeviceCode, "tv-client", "tv-secret")
+	if rr.Code != http.StatusBadRequest || deviceErrorCode(t, rr) != "authorization_pending" {
+		t.Fatalf("expected authorization_pending, got %d: %s", rr.Code, rr.Body.String())
+	}
+
+	// Polling again right away is too fast.
+	rr = pollDeviceToken(t, s, da.DeviceCode, "tv-client", "tv-secret")
+	if rr.Code != http.StatusBadRequest || deviceErrorCode(t, rr) != "slow_down" {
+		t.Fatalf("expected slow_down, got %d: %s", rr.Code, rr.Body.String())
+	}
+	s.mu.Lock()
+	interval := s.deviceAuths[da.DeviceCode].interval
+	// Pretend the last poll was long enough ago.
+	s.deviceAuths[da.DeviceCode].lastPoll = time.Now().Add(-time.Minute)
+	s.mu.Unlock()
+	if want := devicePollInterval + deviceSlowDownStep; interval != want {
+		t.Errorf("interval = %v, want %v", interval, want)
+	}
+
+	// The verification page shows the client asking for access.
+	req := httptest.NewRequest("GET", "/device?user_code="+url.QueryEscape(strings.ToLower(da.UserCode)), nil)
+	rr = httptest.NewRecorder()
+	s.serveDevice(rr, req)
+	if rr.Code != http.StatusOK || !strings.Contains(rr.Body.String(), "Living Room TV") {
+		t.Fatalf("expected confirmation page for client, got %d: %s", rr.Code, rr.Body.String())
+	}
+
+	rr = submitDeviceDecision(t, s, da.UserCode, "approve")
+	if !strings.Contains(rr.Body.String(), "Device approved") {
+		t.Fatalf("expected approval, got %d: %s", rr.Code, rr.Body.String())
+	}
+
+	rr = pollDeviceToken(t, s, da.DeviceCode, "tv-client", "tv-secret")
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", rr.Code, rr.Body.String())
+	}
+	var tokens struct {
+		AccessToken  string `json:"access_token"`
+		IDToken      string `json:"id_token"`
+		RefreshToken string `json:"refresh_token"`
+	}
+	if err := json.Unmarshal(rr.Body.Bytes(), &tokens); err != nil {
+		t.Fatalf("failed to unmarshal token response: %v", err)
+	}
+	if tokens.AccessToken == "" || tokens.IDToken == "" {
+		t.Errorf("missing tokens: %s", rr.Body.String())
+	}
+	ar, ok := s.accessToken.Get(tokens.AccessToken)
+	if !ok || ar.RemoteUser.UserProfile.LoginName != "user@example.com" || ar.ClientID != "tv-client" {
+		t.Errorf("access token not issued to the approving user: %+v", ar)
+	}
+
+	// The device code can only be used once.
+	rr = pollDeviceToken(t, s, da.DeviceCode, "tv-client", "tv-secret")
+	if rr.Code != http.StatusBadRequest || deviceErrorCode(t, rr) != "invalid_grant" {
+		t.Errorf("expected invalid_grant on reuse, got %d: %s", rr.Code, rr.Body.String())
+	}
+}
+
+// TestDeviceAuthorizationPublicClient tests the device flow of a public
+// client, which only identifies itself with its client_id
+func TestDeviceAuthorizationPublicClient(t *testing.T) {
+	s := newDeviceTestServer(t, deviceTestUser())
+	s.funnelClients["cli"] = &FunnelClient{
+		ID:                      "cli",
+		Name:                    "CLI",
+		TokenEndpointAuthMethod: "none",
+		GrantTypes:              []string{deviceCodeGrantType},
+	}
+
+	da := startDeviceAuth(t, s, "cli", "")
+	rr := submitDeviceDecision(t, s, da.UserCode, "approve")
+	if !strings.Contains(rr.Body.String(), "Device approved") {
+		t.Fatalf("expected approval, got %d: %s", rr.Code, rr.Body.String())
+	}
+
+	// Another client can't collect the tokens, public or not.
+	rr = pollDeviceToken(t, s, da.DeviceCode, "tv-client", "tv-secret")
+	if rr.Code != http.StatusBadRequest || deviceErrorCode(t, rr) != "invalid_grant" {
+		t.Errorf("expected invalid_grant for another client, got %d: %s", rr.Code, rr.Body.String())
+	}
+
+	rr = pollDeviceToken(t, s, da.DeviceCode, "cli", "")
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", rr.Code, rr.Body.String())
+	}
+	var tokens struct {
+		AccessToken string `json:"access_token"`
+	}
+	if err := json.Unmarshal(rr.Body.Bytes(), &tokens); err != nil {
+		t.Fatal(err)
+	}
+	if ar, ok := s.accessToken.Get(tokens.AccessToken); !ok || ar.ClientID != "cli" {
+		t.Errorf("access token not issued to the public client: %+v", ar)
+	}
+}
+
+// TestDeviceAuthorizationErrors tests the errors returned while polling the
+// token endpoint and approving a device
+func TestDeviceAuthorizationErrors(t *testing.T) {
+	t.Run("denied", func(t *testing.T) {
+		s := newDeviceTestServer(t, deviceTestUser())
+		da := startDeviceAuth(t, s, "tv-client", "tv-secret")
+		rr := submitDeviceDecision(t, s, da.UserCode, "deny")
+		if !strings.Contains(rr.Body.String(), "Request denied") {
+			t.Fatalf("expected denial, got %d: %s", rr.Code, rr.Body.String())
+		}
+		rr = pollDeviceToken(t, s, da.DeviceCode, "tv-client", "tv-secret")
+		if rr.Code != http.StatusBadRequest || deviceErrorCode(t, rr) != "access_denied" {
+			t.Errorf("expected access_denied, got %d: %s", rr.Code, rr.Body.String())
+		}
+	})
+
+	t.Run("expired", func(t *testing.T) {
+		s := newDeviceTestServer(t, deviceTestUser())
+		da := startDeviceAuth(t, s, "tv-client", "tv-secret")
+		s.mu.Lock()
+		s.deviceAuths[da.DeviceCode].ar.ValidTill = time.Now().Add(-time.Second)
+		s.mu.Unlock()
+
+		rr := submitDeviceDecision(t, s, da.UserCode, "approve")
+		if !strings.Contains(rr.Body.String(), "Invalid or expired code") {
+			t.Errorf("expected expired code error, got %d: %s", rr.Code, rr.Body.String())
+		}
+		rr = pollDeviceToken(t, s, da.DeviceCode, "tv-client", "tv-secret")
+		if rr.Code != http.StatusBadRequest || deviceErrorCode(t, rr) != "expired_token" {
+			t.Errorf("expected expired_token, got %d: %s", rr.Code, rr.Body.String())
+		}
+	})
+
+	t.Run("other client", func(t *testing.T) {
+		s := newDeviceTestServer(t, deviceTestUser())
+		s.funnelClients["other"] = &FunnelClient{ID: "other", Secret: "other-secret", GrantTypes: []string{deviceCodeGrantType}}
+		da := startDeviceAuth(t, s, "tv-client", "tv-secret")
+		rr := pollDeviceToken(t, s, da.DeviceCode, "other", "other-secret")
+		if rr.Code != http.StatusBadRequest || deviceErrorCode(t, rr) != "invalid_grant" {
+			t.Errorf("expected invalid_grant, got %d: %s", rr.Code, rr.Body.String())
+		}
+	})
+
+	t.Run("bad client secret", func(t *testing.T) {
+		s := newDeviceTestServer(t, deviceTestUser())
+		form := url.Values{"client_id": {"tv-client"}, "client_secret": {"wrong"}}
+		req := httptest.NewRequest("POST", "/device_authorization", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		rr := httptest.NewRecorder()
+		s.serveDeviceAuthorization(rr, req)
+		if rr.Code != http.StatusUnauthorized {
+			t.Errorf("expected status 401, got %d: %s", rr.Code, rr.Body.String())
+		}
+	})
+
+	t.Run("grant type not registered", func(t *testing.T) {
+		s := newDeviceTestServer(t, deviceTestUser())
+		form := url.Values{"client_id": {"test-client"}, "client_secret": {"test-secret"}}
+		req := httptest.NewRequest("POST", "/device_authorization", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.Header.Set("Accept", "application/json")
+		rr := httptest.NewRecorder()
+		s.serveDeviceAuthorization(rr, req)
+		if rr.Code != http.StatusBadRequest || deviceErrorCode(t, rr) != "unauthorized_client" {
+			t.Errorf("expected unauthorized_client, got %d: %s", rr.Code, rr.Body.String())
+		}
+
+		da := startDeviceAuth(t, s, "tv-client", "tv-secret")
+		s.funnelClients["tv-client"].GrantTypes = nil
+		rr = pollDeviceToken(t, s, da.DeviceCode, "tv-client", "tv-secret")
+		if rr.Code != http.StatusBadRequest || deviceErrorCode(t, rr) != "unauthorized_client" {
+			t.Errorf("expected unauthorized_client when polling, got %d: %s", rr.Code, rr.Body.String())
+		}
+	})
+
+	t.Run("resources", func(t *testing.T) {
+		who := deviceTestUser()
+		who.CapMap[tailcfg.PeerCapabilityTsIDP] = marshalCapRules([]capRule{{
+			Users:     []string{"user@example.com"},
+			Resources: []string{"https://api.example.com"},
+		}})
+		s := newDeviceTestServer(t, who)
+		da := startDeviceAuth(t, s, "tv-client", "tv-secret", "https://api.example.com", "https://admin.example.com")
+		rr := submitDeviceDecision(t, s, da.UserCode, "approve")
+		if !strings.Contains(rr.Body.String(), "Device approved") {
+			t.Fatalf("expected approval, got %d: %s", rr.Code, rr.Body.String())
+		}
+		s.mu.Lock()
+		s.deviceAuths[da.DeviceCode].lastPoll = time.Time{}
+		s.mu.Unlock()
+		rr = pollDeviceToken(t, s, da.DeviceCode, "tv-client", "tv-secret")
+		if rr.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d: %s", rr.Code, rr.Body.String())
+		}
+		var tokens struct {
+			AccessToken string `json:"access_token"`
+		}
+		if err := json.Unmarshal(rr.Body.Bytes(), &tokens); err != nil {
+			t.Fatal(err)
+		}
+		ar, _ := s.accessToken.Get(tokens.AccessToken)
+		if ar == nil || !slices.Equal(ar.Resources, []string{"https://api.example.com"}) {
+			t.Errorf("token resources = %v, want only the allowed one", ar)
+		}
+	})
+
+	t.Run("tagged node cannot approve", func(t *testing.T) {
+		who := deviceTestUser()
+		who.Node.Tags = []string{"tag:server"}
+		s := newDeviceTestServer(t, who)
+		da := startDeviceAuth(t, s, "tv-client", "tv-secret")
+		rr := submitDeviceDecision(t, s, da.UserCode, "approve")
+		if !strings.Contains(rr.Body.String(), "Tagged nodes") {
+			t.Errorf("expected tagged node error, got %d: %s", rr.Code, rr.Body.String())
+		}
+		rr = pollDeviceToken(t, s, da.DeviceCode, "tv-client", "tv-secret")
+		if deviceErrorCode(t, rr) != "authorization_pending" {
+			t.Errorf("expected authorization_pending, got %d: %s", rr.Code, rr.Body.String())
+		}
+	})
+
+	t.Run("funnel", func(t *testing.T) {
+		s := newDeviceTestServer(t, deviceTestUser())
+		req := httptest.NewRequest("GET", "/device", nil)
+		req.Header.Set("Tailscale-Funnel-Request", "true")
+		rr := httptest.NewRecorder()
+		s.serveDevice(rr, req)
+		if rr.Code != http.StatusUnauthorized {
+			t.Errorf("expected status 401, got %d", rr.Code)
+		}
+	})
+}
+
+// TestUserCode tests generating and normalizing user codes
+func TestUserCode(t *testing.T) {
+	code, err := newUserCode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(code) != userCodeLength || strings.Trim(code, userCodeAlphabet) != "" {
+		t.Errorf("newUserCode() = %q", code)
+	}
+
+	tests := []struct {
+		in, want string
+	}{
+		{"BCDF-GHJK", "BCDFGHJK"},
+		{"bcdf-ghjk", "BCDFGHJK"},
+		{" bcdf ghjk ", "BCDFGHJK"},
+		{"", ""},
+	}
+	for _, tt := range tests {
+		if got := normalizeUserCode(tt.in); got != tt.want {
+			t.Errorf("normalizeUserCode(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+	if got := formatUserCode("BCDFGHJK"); got != "BCDF-GHJK" {
+		t.Errorf("formatUserCode() = %q, want BCDF-GHJK", got)
+	}
+}
@@ -0,0 +1,203 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package server
+
+import (
+	"context"
+	"crypto"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"gopkg.in/square/go-jose.v2"
+	"gopkg.in/square/go-jose.v2/jwt"
+	"tailscale.com/types/views"
+	"tailscale.com/util/rands"
+)
+
+const (
+	// dpopProofMaxAge bounds how far the iat of a DPoP proof may be from
+	// now. Used jti values are remembered for this long on both sides.
+	dpopProofMaxAge = 5 * time.Minute
+
+	// dpopNonceLifetime is how long a DPoP nonce is handed out before it is
+	// rotated. The previous nonce stays valid for another lifetime.
+	dpopNonceLifetime = 5 * time.Minute
+)
+
+// errUseDPoPNonce is returned by verifyDPoPProof when the proof does not
+// carry a current server-provided nonce (RFC 9449 Section 8).
+var errUseDPoPNonce = errors.New("tsidp: DPoP proof must carry a current nonce")
+
+// ctxDPoPJKT is the context key of the thumbprint of the key of a DPoP
+// proof verified by serveToken.
+type ctxDPoPJKT struct{}
+
+// withDPoPJKT returns r with the thumbprint of its verified DPoP proof.
+func withDPoPJKT(r *http.Request, jkt string) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), ctxDPoPJKT{}, jkt))
+}
+
+// dpopJKT returns the JWK SHA-256 thumbprint of the DPoP proof of r
+// verified by serveToken, or "" if r has none.
+func dpopJKT(r *http.Request) string {
+	jkt, _ := r.Context().Value(ctxDPoPJKT{}).(string)
+	return jkt
+}
+
+// tokenType returns the token_type of the access token of ar.
+func (ar *AuthRequest) tokenType() string {
+	if ar.DPoPJKT != "" {
+		return "DPoP"
+	}
+	return "Bearer"
+}
+
+// currentDPoPNonce returns the nonce DPoP proofs have to carry, rotating it
+// when it gets too old.
+func (s *IDPServer) currentDPoPNonce() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.dpopNonce == "" || time.Since(s.dpopNonceRotated) > dpopNonceLifetime {
+		s.prevDPoPNonce = s.dpopNonce
+		s.dpopNonce = rands.HexString(32)
+		s.dpopNonceRotated = time.Now()
+	}
+	return s.dpopNonce
+}
+
+// validDPoPNonce reports whether nonce is the current or previous nonce.
+func (s *IDPServer) validDPoPNonce(nonce string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if nonce == "" || s.dpopNonce == "" {
+		return false
+	}
+	if time.Since(s.dpopNonceRotated) > 2*dpopNonceLifetime {
+		return false
+	}
+	return nonce == s.dpopNonce || (nonce == s.prevDPoPNonce && time.Since(s.dpopNonceRotated) <= dpopNonceLifetime)
+}
+
+// dpopClaims are the claims of a DPoP proof (RFC 9449 Section 4.2).
+type dpopClaims struct {
+	jwt.Claims
+	HTM   string `json:"htm"`
+	HTU   string `json:"htu"`
+	ATH   string `json:"ath,omitempty"`
+	Nonce string `json:"nonce,omitempty"`
+}
+
+// verifyDPoPProof verifies the DPoP proof of r (RFC 9449 Section 4.3) and
+// returns the JWK SHA-256 thumbprint of its key. accessToken is the token
+// the proof is presented with, or "" at the token endpoint. If
+// requireNonce is set, the proof must carry a nonce from currentDPoPNonce;
+// otherwise a nonce is only checked if present.
+func (s *IDPServer) verifyDPoPProof(r *http.Request, accessToken string, requireNonce bool) (string, error) {
+	proofs := r.Header.Values("DPoP")
+	if len(proofs) != 1 {
+		return "", fmt.Errorf("tsidp: expected one DPoP header, got %d", len(proofs))
+	}
+	tok, err := jwt.ParseSigned(proofs[0])
+	if err != nil {
+		return "", fmt.Errorf("tsidp: invalid DPoP proof: %w", err)
+	}
+	if len(tok.Headers) != 1 {
+		return "", fmt.Errorf("tsidp: DPoP proof must have one signature")
+	}
+	header := tok.Headers[0]
+	if typ, _ := header.ExtraHeaders[jose.HeaderType].(string); typ != "dpop+jwt" {
+		return "", fmt.Errorf("tsidp: DPoP proof has typ %q, want dpop+jwt", typ)
+	}
+	if !views.SliceContains(oauthDPoPSigningAlgs, header.Algorithm) {
+		return "", fmt.Errorf("tsidp: unsupported DPoP proof algorithm %q", header.Algorithm)
+	}
+	jwk := header.JSONWebKey
+	if jwk == nil || !jwk.Valid() || !jwk.IsPublic() {
+		return "", fmt.Errorf("tsidp: DPoP proof must carry a public jwk")
+	}
+	var claims dpopClaims
+	if err := tok.Claims(jwk.Key, &claims); err != nil {
+		return "", fmt.Errorf("tsidp: DPoP proof signature does not verify: %w", err)
+	}
+
+	if claims.ID == "" {
+		return "", fmt.Errorf("tsidp: DPoP proof has no jti")
+	}
+	if claims.HTM != r.Method {
+		return "", fmt.Errorf("tsidp: DPoP proof htm %q does not match %s", claims.HTM, r.Method)
+	}
+	if !s.dpopTargetMatches(r, claims.HTU) {
+		return "", fmt.Errorf("tsidp: DPoP proof htu %q does not match the request", claims.HTU)
+	}
+	if claims.IssuedAt == nil {
+		return "", fmt.Errorf("tsidp: DPoP proof has no iat")
+	}
+	now := time.Now()
+	iat := claims.IssuedAt.Time()
+	if iat.Before(now.Add(-dpopProofMaxAge)) || iat.After(now.Add(dpopProofMaxAge)) {
+		return "", fmt.Errorf("tsidp: DPoP proof iat is out of range")
+	}
+	if accessToken != "" {
+		sum := sha256.Sum256([]byte(accessToken))
+		if claims.ATH != base64.RawURLEncoding.EncodeToString(sum[:]) {
+			return "", fmt.Errorf("tsidp: DPoP proof ath does not match the access token")
+		}
+	}
+	if (requireNonce || claims.Nonce != "") && !s.validDPoPNonce(claims.Nonce) {
+		return "", errUseDPoPNonce
+	}
+
+	thumb, err := jwk.Thumbprint(crypto.SHA256)
+	if err != nil {
+		return "", fmt.Errorf("tsidp: DPoP proof jwk thumbprint: %w", err)
+	}
+	jkt := base64.RawURLEncoding.EncodeToString(thumb)
+
+	// Each proof can only be used once.
+	jtiKey := jkt + "/" + claims.ID
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, used := s.dpopJTIs[jtiKey]; used {
+		return "", fmt.Errorf("tsidp: DPoP proof jti %q has already been used", claims.ID)
+	}
+	if s.dpopJTIs == nil {
+		s.dpopJTIs = make(map[string]time.Time)
+	}
+	s.dpopJTIs[jtiKey] = iat.Add(dpopProofMaxAge)
+	return jkt, nil
+}
+
+// dpopTargetMatches reports whether htu is the URL r was sent to, ignoring
+// query and fragment (RFC 9449 Section 4.3). tsidp can be reached at its
+// server URL, its mTLS URL and its loopback URL.
+func (s *IDPServer) dpopTargetMatches(r *http.Request, htu string) bool {
+	u, err := url.Parse(htu)
+	if err != nil {
+		return false
+	}
+	u.RawQuery, u.Fragment = "", ""
+	for _, base := range []string{s.serverURL, s.mtlsURL, s.loopbackURL} {
+		if base != "" && strings.EqualFold(u.String(), base+r.URL.Path) {
+			return true
+		}
+	}
+	return false
+}
+
+// writeDPoPError writes an error response for a request to a protected
+// resource with a DPoP token (RFC 9449 Section 7.1).
+func writeDPoPError(w http.ResponseWriter, statusCode int, errorCode, errorDescription string) {
+	authHeader := fmt.Sprintf(`DPoP algs="%s", error="%s"`, strings.Join(oauthDPoPSigningAlgs.AsSlice(), " "), errorCode)
+	if errorDescription != "" {
+		authHeader += fmt.Sprintf(`, error_description="%s"`, errorDescription)
+	}
+	w.Header().Set("WWW-Authenticate", authHeader)
+	w.WriteHeader(statusCode)
+}
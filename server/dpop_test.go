@@ -0,0 +1,319 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package server
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"gopkg.in/square/go-jose.v2"
+	"gopkg.in/square/go-jose.v2/jwt"
+	"tailscale.com/client/tailscale/apitype"
+	"tailscale.com/tailcfg"
+	"tailscale.com/util/rands"
+)
+
+// newDPoPKey returns an ECDSA key for signing DPoP proofs.
+func newDPoPKey(t *testing.T) *ecdsa.PrivateKey {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+// dpopProofClaims returns valid claims of a DPoP proof for a request with
+// method to the tsidp endpoint path.
+func dpopProofClaims(s *IDPServer, method, path string) dpopClaims {
+	return dpopClaims{
+		Claims: jwt.Claims{
+			ID:       rands.HexString(16),
+			IssuedAt: jwt.NewNumericDate(time.Now()),
+		},
+		HTM: method,
+		HTU: s.serverURL + path,
+	}
+}
+
+// mustSignDPoPProof returns a DPoP proof with claims, signed with key and
+// carrying its public key.
+func mustSignDPoPProof(t *testing.T, key *ecdsa.PrivateKey, typ string, claims dpopClaims) string {
+	t.Helper()
+	opts := &jose.SignerOptions{EmbedJWK: true}
+	signer, err := jose.NewSigner(jose.SigningKey{Algorithm: jose.ES256, Key: key}, opts.WithType(jose.ContentType(typ)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	proof, err := jwt.Signed(signer).Claims(claims).CompactSerialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return proof
+}
+
+// accessTokenHash returns the ath claim of a DPoP proof for accessToken.
+func accessTokenHash(accessToken string) string {
+	sum := sha256.Sum256([]byte(accessToken))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// TestDPoPProofValidation tests the checks done on DPoP proofs
+func TestDPoPProofValidation(t *testing.T) {
+	key := newDPoPKey(t)
+
+	tests := []struct {
+		name         string
+		modify       func(*dpopClaims)
+		typ          string
+		accessToken  string
+		requireNonce bool
+		wantErr      bool
+		wantNonceErr bool
+	}{
+		{
+			name: "valid",
+		},
+		{
+			name:   "query and fragment ignored",
+			modify: func(c *dpopClaims) { c.HTU += "?foo=bar#frag" },
+		},
+		{
+			name:        "matching ath",
+			modify:      func(c *dpopClaims) { c.ATH = accessTokenHash("token") },
+			accessToken: "token",
+		},
+		{
+			name:        "other ath",
+			modify:      func(c *dpopClaims) { c.ATH = accessTokenHash("other-token") },
+			accessToken: "token",
+			wantErr:     true,
+		},
+		{
+			name:    "wrong htm",
+			modify:  func(c *dpopClaims) { c.HTM = "GET" },
+			wantErr: true,
+		},
+		{
+			name:    "wrong htu",
+			modify:  func(c *dpopClaims) { c.HTU = "https://other.example.com/token" },
+			wantErr: true,
+		},
+		{
+			name:    "no jti",
+			modify:  func(c *dpopClaims) { c.ID = "" },
+			wantErr: true,
+		},
+		{
+			name:    "old iat",
+			modify:  func(c *dpopClaims) { c.IssuedAt = jwt.NewNumericDate(time.Now().Add(-time.Hour)) },
+			wantErr: true,
+		},
+		{
+			name:    "wrong typ",
+			typ:     "JWT",
+			wantErr: true,
+		},
+		{
+			name:         "missing nonce",
+			requireNonce: true,
+			wantErr:      true,
+			wantNonceErr: true,
+		},
+		{
+			name:         "unknown nonce",
+			modify:       func(c *dpopClaims) { c.Nonce = "made-up" },
+			wantErr:      true,
+			wantNonceErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := setupTestServer(t, nil)
+			claims := dpopProofClaims(s, "POST", "/token")
+			if tt.modify != nil {
+				tt.modify(&claims)
+			}
+			typ := "dpop+jwt"
+			if tt.typ != "" {
+				typ = tt.typ
+			}
+			req := httptest.NewRequest("POST", "/token", nil)
+			req.Header.Set("DPoP", mustSignDPoPProof(t, key, typ, claims))
+
+			jkt, err := s.verifyDPoPProof(req, tt.accessToken, tt.requireNonce)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("expected error")
+				}
+				if tt.wantNonceErr != errors.Is(err, errUseDPoPNonce) {
+					t.Errorf("got error %v, want nonce error: %v", err, tt.wantNonceErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("verifyDPoPProof: %v", err)
+			}
+			if jkt == "" {
+				t.Error("expected a key thumbprint")
+			}
+
+			// The same proof can't be used again.
+			if _, err := s.verifyDPoPProof(req, tt.accessToken, tt.requireNonce); err == nil {
+				t.Error("replayed DPoP proof was accepted")
+			}
+		})
+	}
+}
+
+// TestDPoPBoundTokens tests that tokens requested with a DPoP proof are
+// bound to its key (RFC 9449)
+func TestDPoPBoundTokens(t *testing.T) {
+	key, otherKey := newDPoPKey(t), newDPoPKey(t)
+	s := setupTestServer(t, nil)
+	client := s.funnelClients["test-client"]
+	client.RedirectURIs = []string{"https://rp.example.com/callback"}
+	s.code.Set("code", &AuthRequest{
+		ClientID:    client.ID,
+		RedirectURI: "https://rp.example.com/callback",
+		ValidTill:   time.Now().Add(5 * time.Minute),
+		FunnelRP:    client,
+		RemoteUser: &apitype.WhoIsResponse{
+			Node:        &tailcfg.Node{ID: 1, Name: "node.test.ts.net.", User: 1},
+			UserProfile: &tailcfg.UserProfile{LoginName: "user@example.com"},
+		},
+	})
+
+	requestToken := func(nonce string) *httptest.ResponseRecorder {
+		form := url.Values{
+			"grant_type":    {"authorization_code"},
+			"code":          {"code"},
+			"redirect_uri":  {"https://rp.example.com/callback"},
+			"client_id":     {client.ID},
+			"client_secret": {client.Secret},
+		}
+		claims := dpopProofClaims(s, "POST", "/token")
+		claims.Nonce = nonce
+		req := httptest.NewRequest("POST", "/token", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.Header.Set("Accept", "application/json")
+		req.Header.Set("DPoP", mustSignDPoPProof(t, key, "dpop+jwt", claims))
+		rr := httptest.NewRecorder()
+		s.serveToken(rr, req)
+		return rr
+	}
+
+	// The first request is answered with a nonce to use.
+	rr := requestToken("")
+	if rr.Code != http.StatusBadRequest || !strings.Contains(rr.Body.String(), ecUseDPoPNonce) {
+		t.Fatalf("token without nonce: expected use_dpop_nonce, got %d: %s", rr.Code, rr.Body.String())
+	}
+	nonce := rr.Header().Get("DPoP-Nonce")
+	if nonce == "" {
+		t.Fatal("expected a DPoP-Nonce header")
+	}
+
+	rr = requestToken(nonce)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("token: expected status 200, got %d: %s", rr.Code, rr.Body.String())
+	}
+	var tokens oidcTokenResponse
+	if err := json.Unmarshal(rr.Body.Bytes(), &tokens); err != nil {
+		t.Fatal(err)
+	}
+	if tokens.TokenType != "DPoP" {
+		t.Errorf("token_type = %q, want DPoP", tokens.TokenType)
+	}
+
+	t.Run("userinfo", func(t *testing.T) {
+		for _, tt := range []struct {
+			name       string
+			scheme     string
+			key        *ecdsa.PrivateKey
+			wantStatus int
+		}{
+			{"DPoP proof", "DPoP", key, http.StatusOK},
+			{"bearer", "Bearer", nil, http.StatusUnauthorized},
+			{"no proof", "DPoP", nil, http.StatusUnauthorized},
+			{"proof with other key", "DPoP", otherKey, http.StatusUnauthorized},
+		} {
+			req := httptest.NewRequest("GET", "/userinfo", nil)
+			req.Header.Set("Authorization", tt.scheme+" "+tokens.AccessToken)
+			if tt.key != nil {
+				claims := dpopProofClaims(s, "GET", "/userinfo")
+				claims.ATH = accessTokenHash(tokens.AccessToken)
+				req.Header.Set("DPoP", mustSignDPoPProof(t, tt.key, "dpop+jwt", claims))
+			}
+			rr := httptest.NewRecorder()
+			s.serveUserInfo(rr, req)
+			if rr.Code != tt.wantStatus {
+				t.Errorf("%s: expected status %d, got %d: %s", tt.name, tt.wantStatus, rr.Code, rr.Body.String())
+			}
+			if tt.wantStatus == http.StatusUnauthorized && !strings.HasPrefix(rr.Header().Get("WWW-Authenticate"), "DPoP ") {
+				t.Errorf("%s: expected a DPoP challenge, got %q", tt.name, rr.Header().Get("WWW-Authenticate"))
+			}
+		}
+	})
+
+	t.Run("introspect", func(t *testing.T) {
+		form := url.Values{"token": {tokens.AccessToken}, "client_id": {client.ID}, "client_secret": {client.Secret}}
+		req := httptest.NewRequest("POST", "/introspect", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		rr := httptest.NewRecorder()
+		s.serveIntrospect(rr, req)
+		var resp struct {
+			Active    bool              `json:"active"`
+			TokenType string            `json:"token_type"`
+			Cnf       map[string]string `json:"cnf"`
+		}
+		if err := json.Unmarshal(rr.Body.Bytes(), &resp); err != nil {
+			t.Fatal(err)
+		}
+		if !resp.Active || resp.TokenType != "DPoP" || resp.Cnf["jkt"] == "" {
+			t.Errorf("expected an active DPoP token with cnf.jkt, got %s", rr.Body.String())
+		}
+	})
+
+	t.Run("public client refresh", func(t *testing.T) {
+		public := &FunnelClient{ID: "public-client", TokenEndpointAuthMethod: "none"}
+		s.funnelClients[public.ID] = public
+		ar, _ := s.accessToken.Get(tokens.AccessToken)
+		rtAuth := *ar
+		rtAuth.ClientID = public.ID
+		rtAuth.FunnelRP = public
+		rtAuth.ValidTill = time.Now().Add(time.Hour)
+		s.refreshToken.Set("rt-1", &rtAuth)
+		s.refreshToken.Set("rt-2", &rtAuth)
+
+		refresh := func(rt string, key *ecdsa.PrivateKey) *httptest.ResponseRecorder {
+			form := url.Values{"grant_type": {"refresh_token"}, "refresh_token": {rt}, "client_id": {public.ID}}
+			claims := dpopProofClaims(s, "POST", "/token")
+			claims.Nonce = s.currentDPoPNonce()
+			req := httptest.NewRequest("POST", "/token", strings.NewReader(form.Encode()))
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			req.Header.Set("DPoP", mustSignDPoPProof(t, key, "dpop+jwt", claims))
+			rr := httptest.NewRecorder()
+			s.serveToken(rr, req)
+			return rr
+		}
+		if rr := refresh("rt-1", otherKey); rr.Code != http.StatusBadRequest {
+			t.Errorf("refresh with other key: expected status 400, got %d: %s", rr.Code, rr.Body.String())
+		}
+		if rr := refresh("rt-2", key); rr.Code != http.StatusOK {
+			t.Errorf("refresh: expected status 200, got %d: %s", rr.Code, rr.Body.String())
+		}
+	})
+}
@@ -27,12 +27,14 @@ func setupTestServer(t *testing.T, lc *local.Client) *IDPServer {
 	t.Helper()
 
 	srv := &IDPServer{
-		code:          make(map[string]*AuthRequest),
-		accessToken:   make(map[string]*AuthRequest),
-		funnelClients: make(map[string]*FunnelClient),
-		serverURL:     "https://test.ts.net",
-		stateDir:      t.TempDir(),
-		lc:            lc,
+		code:              newMemTokenStore(),
+		accessToken:       newMemTokenStore(),
+		refreshToken:      newMemTokenStore(),
+		usedRefreshTokens: newMemTokenStore(),
+		funnelClients:     make(map[string]*FunnelClient),
+		serverURL:         "https://test.ts.net",
+		stateDir:          t.TempDir(),
+		lc:                lc,
 	}
 
 	// Add a test client
@@ -43,8 +45,8 @@ func setupTestServer(t *testing.T, lc *local.Client) *IDPServer {
 		RedirectURI: "https://rp.example.com/callback",
 	}
 
-	// Inject a working signer for token tests
-	srv.lazySigner.Set(oidcTestingSigner(t))
+	// Inject a working signing key for token tests
+	srv.keys = oidcTestingKeyRing(t)
 
 	return srv
 }
@@ -54,7 +56,8 @@ func setupTestServer(t *testing.T, lc *local.Client) *IDPServer {
 // needing a running tailscaled.
 type whoisRoundTripper struct {
 	response *apitype.WhoIsResponse
-	err      bool // if true, return HTTP 500
+	err      bool   // if true, return HTTP 500
+	addr     string // address of the last WhoIs call
 }
 
 func (rt *whoisRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
@@ -64,6 +67,7 @@ func (rt *whoisRoundTripper) RoundTrip(req *http.Request) (*http.Response, error
 			Body:       io.NopCloser(bytes.NewReader(nil)),
 		}, nil
 	}
+	rt.addr = req.URL.Query().Get("addr")
 	if rt.err {
 		return &http.Response{
 			StatusCode: http.StatusInternalServerError,
@@ -99,14 +103,15 @@ func mustMarshalJSON(t *testing.T, v any) tailcfg.RawMessage {
 
 var privateKey *rsa.PrivateKey = nil
 
-func oidcTestingSigner(t *testing.T) jose.Signer {
+// oidcTestingKeyRing returns a signing key ring whose only, active key is
+// the private key returned by mustGeneratePrivateKey.
+func oidcTestingKeyRing(t *testing.T) *signingKeyRing {
 	t.Helper()
-	privKey := mustGeneratePrivateKey(t)
-	sig, err := jose.NewSigner(jose.SigningKey{Algorithm: jose.RS256, Key: privKey}, nil)
-	if err != nil {
-		t.Fatalf("failed to create signer: %v", err)
-	}
-	return sig
+	return &signingKeyRing{Keys: []*signingKey{{
+		Kid: 1,
+		Alg: jose.RS256,
+		Key: mustGeneratePrivateKey(t),
+	}}}
 }
 
 func oidcTestingPublicKey(t *testing.T) *rsa.PublicKey {
@@ -173,3 +178,12 @@ func marshalCapRules(rules []capRule) []tailcfg.RawMessage {
 	}
 	return msgs
 }
+
+// tokenCount returns the number of entries in a tokenStore.
+func tokenCount(ts tokenStore) int {
+	n := 0
+	for range ts.All() {
+		n++
+	}
+	return n
+}
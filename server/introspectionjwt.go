@@ -0,0 +1,80 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+
+	"gopkg.in/square/go-jose.v2"
+	"gopkg.in/square/go-jose.v2/jwt"
+)
+
+// introspectionJWTType is the media type, and the typ header, of signed
+// introspection responses (RFC 9701 Section 5).
+const introspectionJWTType = "token-introspection+jwt"
+
+// wantsSignedIntrospection reports whether the caller of r asked for a
+// signed introspection response.
+func wantsSignedIntrospection(r *http.Request) bool {
+	return strings.Contains(r.Header.Get("Accept"), "application/"+introspectionJWTType)
+}
+
+// introspectionClaims are the claims of a signed introspection response
+// (RFC 9701 Section 5).
+type introspectionClaims struct {
+	jwt.Claims
+	TokenIntrospection map[string]any `json:"token_introspection"`
+}
+
+// writeIntrospectionResponse writes the introspection response resp for
+// the caller callerID, as a JWT signed with the tsidp signing key if signed
+// is set and as plain JSON otherwise.
+func (s *IDPServer) writeIntrospectionResponse(w http.ResponseWriter, r *http.Request, callerID string, signed bool, resp map[string]any) {
+	if !signed {
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(resp); err != nil {
+			writeHTTPError(w, r, http.StatusInternalServerError, ecServerError, "failed to encode response", err)
+		}
+		return
+	}
+
+	alg := jose.RS256
+	s.mu.Lock()
+	if client, ok := s.funnelClients[callerID]; ok {
+		alg = client.introspectionSigningAlg()
+	}
+	s.mu.Unlock()
+	// Introspection responses have no expiry; they are verified on receipt.
+	signer, err := s.signerWithType(alg, introspectionJWTType, time.Now())
+	if err != nil {
+		writeHTTPError(w, r, http.StatusInternalServerError, ecServerError, "internal server error - could not get signer", err)
+		return
+	}
+	token, err := jwt.Signed(signer).Claims(introspectionClaims{
+		Claims: jwt.Claims{
+			Issuer:   s.serverURL,
+			Audience: jwt.Audience{callerID},
+			IssuedAt: jwt.NewNumericDate(time.Now()),
+		},
+		TokenIntrospection: resp,
+	}).CompactSerialize()
+	if err != nil {
+		writeHTTPError(w, r, http.StatusInternalServerError, ecServerError, "failed to sign introspection response", err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/"+introspectionJWTType)
+	w.Write([]byte(token))
+}
+
+// introspectionSigningAlg returns the algorithm signed introspection
+// responses for c are signed with.
+func (c *FunnelClient) introspectionSigningAlg() jose.SignatureAlgorithm {
+	if c == nil || c.IntrospectionSignedResponseAlg == "" {
+		return jose.RS256
+	}
+	return jose.SignatureAlgorithm(c.IntrospectionSignedResponseAlg)
+}
@@ -0,0 +1,138 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"gopkg.in/square/go-jose.v2"
+	"gopkg.in/square/go-jose.v2/jwt"
+)
+
+// TestSignedIntrospection tests introspection responses signed as JWTs
+// (RFC 9701)
+func TestSignedIntrospection(t *testing.T) {
+	tests := []struct {
+		name       string
+		token      string
+		alg        string // introspection_signed_response_alg of the caller
+		noAuth     bool
+		wantStatus int
+		wantActive bool
+		wantAlg    jose.SignatureAlgorithm
+	}{
+		{
+			name:       "active token",
+			token:      "active-token",
+			wantStatus: http.StatusOK,
+			wantActive: true,
+			wantAlg:    jose.RS256,
+		},
+		{
+			name:       "unknown token",
+			token:      "unknown-token",
+			wantStatus: http.StatusOK,
+			wantActive: false,
+			wantAlg:    jose.RS256,
+		},
+		{
+			name:       "registered alg",
+			token:      "active-token",
+			alg:        string(jose.ES256),
+			wantStatus: http.StatusOK,
+			wantActive: true,
+			wantAlg:    jose.ES256,
+		},
+		{
+			name:       "unauthenticated",
+			token:      "active-token",
+			noAuth:     true,
+			wantStatus: http.StatusUnauthorized,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := setupTestServer(t, nil)
+			client := s.funnelClients["test-client"]
+			client.IntrospectionSignedResponseAlg = tt.alg
+			if tt.alg != "" {
+				// The testing key ring only has an RS256 key; let tsidp
+				// generate keys for all algorithms.
+				s.keys = nil
+			}
+			now := time.Now()
+			s.accessToken.Set("active-token", &AuthRequest{
+				ClientID:       client.ID,
+				FunnelRP:       client,
+				Scopes:         []string{"openid"},
+				IssuedAt:       now,
+				ValidTill:      now.Add(5 * time.Minute),
+				NotValidBefore: now,
+			})
+
+			form := url.Values{"token": {tt.token}}
+			if !tt.noAuth {
+				form.Set("client_id", client.ID)
+				form.Set("client_secret", client.Secret)
+			}
+			req := httptest.NewRequest("POST", "/introspect", strings.NewReader(form.Encode()))
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			req.Header.Set("Accept", "application/token-introspection+jwt")
+			rr := httptest.NewRecorder()
+			s.serveIntrospect(rr, req)
+			if rr.Code != tt.wantStatus {
+				t.Fatalf("expected status %d, got %d: %s", tt.wantStatus, rr.Code, rr.Body.String())
+			}
+			if tt.wantStatus != http.StatusOK {
+				return
+			}
+			if ct := rr.Header().Get("Content-Type"); ct != "application/token-introspection+jwt" {
+				t.Errorf("Content-Type = %q", ct)
+			}
+
+			tok, err := jwt.ParseSigned(rr.Body.String())
+			if err != nil {
+				t.Fatalf("failed to parse introspection response: %v", err)
+			}
+			header := tok.Headers[0]
+			if typ := header.ExtraHeaders[jose.HeaderType]; typ != "token-introspection+jwt" {
+				t.Errorf("typ = %v, want token-introspection+jwt", typ)
+			}
+			if header.Algorithm != string(tt.wantAlg) {
+				t.Errorf("alg = %s, want %s", header.Algorithm, tt.wantAlg)
+			}
+
+			rr = httptest.NewRecorder()
+			s.serveJWKS(rr, httptest.NewRequest("GET", "/.well-known/jwks.json", nil))
+			var jwks jose.JSONWebKeySet
+			if err := json.Unmarshal(rr.Body.Bytes(), &jwks); err != nil {
+				t.Fatalf("decoding JWKS: %v", err)
+			}
+			keys := jwks.Key(header.KeyID)
+			if len(keys) != 1 {
+				t.Fatalf("kid %s not published in JWKS", header.KeyID)
+			}
+			var claims introspectionClaims
+			if err := tok.Claims(keys[0].Key, &claims); err != nil {
+				t.Fatalf("introspection response does not verify against JWKS: %v", err)
+			}
+			if claims.Issuer != s.serverURL || !claims.Audience.Contains(client.ID) || claims.IssuedAt == nil {
+				t.Errorf("unexpected claims: %+v", claims.Claims)
+			}
+			if active, _ := claims.TokenIntrospection["active"].(bool); active != tt.wantActive {
+				t.Errorf("active = %v, want %v", active, tt.wantActive)
+			}
+			if tt.wantActive && claims.TokenIntrospection["client_id"] != client.ID {
+				t.Errorf("token_introspection = %v", claims.TokenIntrospection)
+			}
+		})
+	}
+}
@@ -0,0 +1,99 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"gopkg.in/square/go-jose.v2"
+	"tailscale.com/util/mak"
+)
+
+const (
+	// jwksCacheTTL is how long fetched key sets and discovery documents
+	// are used before they are fetched again.
+	jwksCacheTTL = 5 * time.Minute
+
+	// jwksRefetchInterval is how long a key set without the key a token
+	// was signed with is used before it is fetched again, in case the
+	// keys were rotated. It bounds the fetches tokens with unknown key IDs
+	// can cause.
+	jwksRefetchInterval = 30 * time.Second
+)
+
+// cachedDocument is a JSON document fetched from a URL.
+type cachedDocument struct {
+	body    []byte
+	fetched time.Time
+}
+
+// fetchJWKS returns the key set at uri. If it has no key kid, and kid is
+// not empty, it is fetched again if it is older than jwksRefetchInterval.
+func (s *IDPServer) fetchJWKS(ctx context.Context, uri, kid string) (*jose.JSONWebKeySet, error) {
+	var jwks jose.JSONWebKeySet
+	if err := s.fetchCachedJSON(ctx, uri, jwksCacheTTL, &jwks); err != nil {
+		return nil, err
+	}
+	if kid == "" || len(jwks.Key(kid)) > 0 {
+		return &jwks, nil
+	}
+	jwks = jose.JSONWebKeySet{}
+	if err := s.fetchCachedJSON(ctx, uri, jwksRefetchInterval, &jwks); err != nil {
+		return nil, err
+	}
+	return &jwks, nil
+}
+
+// fetchCachedJSON decodes the JSON document at uri into v. The document is
+// fetched if it wasn't, or was fetched more than maxAge ago.
+func (s *IDPServer) fetchCachedJSON(ctx context.Context, uri string, maxAge time.Duration, v any) error {
+	now := time.Now()
+	s.docMu.Lock()
+	doc, ok := s.docs[uri]
+	s.docMu.Unlock()
+	if ok && now.Sub(doc.fetched) < maxAge {
+		return json.Unmarshal(doc.body, v)
+	}
+
+	body, err := s.fetchDocument(ctx, uri)
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(body, v); err != nil {
+		return fmt.Errorf("tsidp: decoding %s: %w", uri, err)
+	}
+	s.docMu.Lock()
+	mak.Set(&s.docs, uri, cachedDocument{body: body, fetched: now})
+	s.docMu.Unlock()
+	return nil
+}
+
+// fetchDocument GETs the JSON document at uri.
+func (s *IDPServer) fetchDocument(ctx context.Context, uri string) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, jwksFetchTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "GET", uri, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/json")
+	resp, err := s.outboundHTTPClient().Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("tsidp: fetching %s: %w", uri, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("tsidp: fetching %s: unexpected status %s", uri, resp.Status)
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxJWKSSize))
+	if err != nil {
+		return nil, fmt.Errorf("tsidp: fetching %s: %w", uri, err)
+	}
+	return body, nil
+}
@@ -0,0 +1,107 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package server
+
+import (
+	"slices"
+	"strings"
+
+	"gopkg.in/square/go-jose.v2"
+	"gopkg.in/square/go-jose.v2/jwt"
+	"tailscale.com/util/rands"
+)
+
+// SetJWTAccessTokenResources sets the resources that get JWT access tokens
+// (RFC 9068), in addition to the clients configured for them.
+func (s *IDPServer) SetJWTAccessTokenResources(resources []string) {
+	s.jwtAccessTokenResources = resources
+}
+
+// jwtAccessTokenClaims are the claims of a JWT access token (RFC 9068
+// Section 2.2).
+type jwtAccessTokenClaims struct {
+	jwt.Claims
+	ClientID string            `json:"client_id"`
+	Scope    string            `json:"scope,omitempty"`
+	Actor    *ActorClaim       `json:"act,omitempty"`
+	MayAct   *ActorClaim       `json:"may_act,omitempty"`
+	Cnf      map[string]string `json:"cnf,omitempty"`
+}
+
+// newAccessToken returns a new access token for ar, whose IssuedAt,
+// ValidTill, NotValidBefore, JTI and key bindings must already be set. The
+// token is a signed JWT if ar's client or one of its resources is configured
+// for them, and random hex otherwise. Either way it is the key ar is stored
+// under.
+func (s *IDPServer) newAccessToken(ar *AuthRequest) (string, error) {
+	aud := ar.accessTokenAudience()
+	if !ar.FunnelRP.wantsJWTAccessTokens() && !slices.ContainsFunc(aud, s.isJWTAccessTokenResource) {
+		return rands.HexString(32), nil
+	}
+	// No resource was requested, so the token is meant for tsidp itself
+	// (RFC 9068 Section 3).
+	if len(aud) == 0 {
+		aud = []string{s.serverURL}
+	}
+
+	// RFC 9068 Section 4 requires resource servers to support RS256.
+	signer, err := s.accessTokenSigner(jose.RS256, ar.ValidTill)
+	if err != nil {
+		return "", err
+	}
+	claims := jwtAccessTokenClaims{
+		Claims: jwt.Claims{
+			Issuer:    s.serverURL,
+			Subject:   ar.subject(),
+			Audience:  aud,
+			IssuedAt:  jwt.NewNumericDate(ar.IssuedAt),
+			Expiry:    jwt.NewNumericDate(ar.ValidTill),
+			NotBefore: jwt.NewNumericDate(ar.NotValidBefore),
+			ID:        ar.JTI,
+		},
+		ClientID: ar.ClientID,
+		Scope:    strings.Join(ar.Scopes, " "),
+		Actor:    ar.ActorInfo,
+		MayAct:   ar.mayAct(),
+		Cnf:      ar.confirmation(),
+	}
+	return jwt.Signed(signer).Claims(claims).CompactSerialize()
+}
+
+// isJWTAccessTokenResource reports whether resource gets JWT access tokens.
+func (s *IDPServer) isJWTAccessTokenResource(resource string) bool {
+	return slices.Contains(s.jwtAccessTokenResources, resource)
+}
+
+// wantsJWTAccessTokens reports whether c is configured for JWT access
+// tokens.
+func (c *FunnelClient) wantsJWTAccessTokens() bool {
+	return c != nil && c.JWTAccessTokens
+}
+
+// accessTokenAudience returns the resource servers the access token of ar
+// is meant for: the audiences of an exchanged token, or the requested
+// resources (RFC 8707).
+func (ar *AuthRequest) accessTokenAudience() []string {
+	if ar.IsExchangedToken && len(ar.Audiences) > 0 {
+		return ar.Audiences
+	}
+	return ar.Resources
+}
+
+// confirmation returns the cnf claim of the key the token of ar is bound
+// to, or nil if it isn't bound (RFC 8705 Section 3.1, RFC 9449 Section 6).
+func (ar *AuthRequest) confirmation() map[string]string {
+	cnf := map[string]string{}
+	if ar.CertThumbprint != "" {
+		cnf["x5t#S256"] = ar.CertThumbprint
+	}
+	if ar.DPoPJKT != "" {
+		cnf["jkt"] = ar.DPoPJKT
+	}
+	if len(cnf) == 0 {
+		return nil
+	}
+	return cnf
+}
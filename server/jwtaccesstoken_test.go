@@ -0,0 +1,207 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"gopkg.in/square/go-jose.v2"
+	"gopkg.in/square/go-jose.v2/jwt"
+	"tailscale.com/client/tailscale/apitype"
+	"tailscale.com/tailcfg"
+)
+
+// verifyJWTAccessToken verifies a JWT access token against the server's
+// JWKS and returns its claims.
+func verifyJWTAccessToken(t *testing.T, s *IDPServer, token string) *jwtAccessTokenClaims {
+	t.Helper()
+	tok, err := jwt.ParseSigned(token)
+	if err != nil {
+		t.Fatalf("failed to parse access token: %v", err)
+	}
+	if typ := tok.Headers[0].ExtraHeaders[jose.HeaderType]; typ != "at+jwt" {
+		t.Errorf("typ = %v, want at+jwt", typ)
+	}
+
+	rr := httptest.NewRecorder()
+	s.serveJWKS(rr, httptest.NewRequest("GET", "/.well-known/jwks.json", nil))
+	var jwks jose.JSONWebKeySet
+	if err := json.Unmarshal(rr.Body.Bytes(), &jwks); err != nil {
+		t.Fatalf("decoding JWKS: %v", err)
+	}
+	keys := jwks.Key(tok.Headers[0].KeyID)
+	if len(keys) != 1 {
+		t.Fatalf("kid %s not published in JWKS", tok.Headers[0].KeyID)
+	}
+
+	var claims jwtAccessTokenClaims
+	if err := tok.Claims(keys[0].Key, &claims); err != nil {
+		t.Fatalf("access token does not verify against JWKS: %v", err)
+	}
+	if claims.Issuer != s.serverURL {
+		t.Errorf("iss = %q, want %q", claims.Issuer, s.serverURL)
+	}
+	if claims.IssuedAt == nil || claims.Expiry == nil || claims.ID == "" {
+		t.Error("access token is missing iat, exp or jti")
+	}
+	return &claims
+}
+
+// TestJWTAccessTokens tests that clients and resources configured for them
+// get RFC 9068 JWT access tokens
+func TestJWTAccessTokens(t *testing.T) {
+	const resource = "https://api.example.com"
+	tests := []struct {
+		name      string
+		clientJWT bool
+		resources []string // configured with SetJWTAccessTokenResources
+		requested []string
+		wantJWT   bool
+		wantAud   []string
+	}{
+		{
+			name:    "opaque by default",
+			wantJWT: false,
+		},
+		{
+			name:      "client option",
+			clientJWT: true,
+			wantJWT:   true,
+			wantAud:   []string{"https://test.ts.net"},
+		},
+		{
+			name:      "client option with resource",
+			clientJWT: true,
+			requested: []string{resource},
+			wantJWT:   true,
+			wantAud:   []string{resource},
+		},
+		{
+			name:      "resource option",
+			resources: []string{resource},
+			requested: []string{resource},
+			wantJWT:   true,
+			wantAud:   []string{resource},
+		},
+		{
+			name:      "other resource",
+			resources: []string{"https://other.example.com"},
+			requested: []string{resource},
+			wantJWT:   false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := setupTestServer(t, nil)
+			s.SetJWTAccessTokenResources(tt.resources)
+			client := &FunnelClient{
+				ID:              "ci-client",
+				Secret:          "ci-secret",
+				GrantTypes:      []string{"client_credentials"},
+				Scope:           "read write",
+				Resources:       []string{resource},
+				JWTAccessTokens: tt.clientJWT,
+			}
+			s.funnelClients[client.ID] = client
+
+			form := url.Values{
+				"grant_type":    {"client_credentials"},
+				"client_id":     {client.ID},
+				"client_secret": {client.Secret},
+				"resource":      tt.requested,
+			}
+			req := httptest.NewRequest("POST", "/token", strings.NewReader(form.Encode()))
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			rr := httptest.NewRecorder()
+			s.serveToken(rr, req)
+			if rr.Code != http.StatusOK {
+				t.Fatalf("token: expected status 200, got %d: %s", rr.Code, rr.Body.String())
+			}
+			var resp struct {
+				AccessToken string `json:"access_token"`
+			}
+			if err := json.Unmarshal(rr.Body.Bytes(), &resp); err != nil {
+				t.Fatal(err)
+			}
+
+			if !tt.wantJWT {
+				if strings.Contains(resp.AccessToken, ".") {
+					t.Errorf("expected an opaque access token, got %q", resp.AccessToken)
+				}
+				return
+			}
+			claims := verifyJWTAccessToken(t, s, resp.AccessToken)
+			if claims.Subject != client.ID || claims.ClientID != client.ID || claims.Scope != "read write" {
+				t.Errorf("unexpected claims: %+v", claims)
+			}
+			if strings.Join(claims.Audience, " ") != strings.Join(tt.wantAud, " ") {
+				t.Errorf("aud = %v, want %v", claims.Audience, tt.wantAud)
+			}
+
+			// The JWT still works at the introspection endpoint.
+			form = url.Values{"token": {resp.AccessToken}, "client_id": {client.ID}, "client_secret": {client.Secret}}
+			req = httptest.NewRequest("POST", "/introspect", strings.NewReader(form.Encode()))
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			rr = httptest.NewRecorder()
+			s.serveIntrospect(rr, req)
+			if !strings.Contains(rr.Body.String(), `"active":true`) {
+				t.Errorf("introspect: expected an active token, got %s", rr.Body.String())
+			}
+		})
+	}
+}
+
+// TestJWTAccessTokenClaims tests the claims of JWT access tokens issued to
+// users, for exchanged and bound tokens
+func TestJWTAccessTokenClaims(t *testing.T) {
+	s := setupTestServer(t, nil)
+	client := &FunnelClient{ID: "rp-client", JWTAccessTokens: true}
+	now := time.Now()
+	ar := &AuthRequest{
+		ClientID:         client.ID,
+		FunnelRP:         client,
+		IsExchangedToken: true,
+		Audiences:        []string{"https://api.example.com"},
+		Resources:        []string{"https://api.example.com"},
+		Scopes:           []string{"openid", "email"},
+		IssuedAt:         now,
+		ValidTill:        now.Add(TokenDuration),
+		NotValidBefore:   now.Add(-NotValidBeforeClockSkew),
+		JTI:              "jti-1",
+		DPoPJKT:          "thumbprint",
+		ActorInfo:        &ActorClaim{Subject: "agent", ClientID: "agent-client"},
+		RemoteUser: &apitype.WhoIsResponse{
+			Node:        &tailcfg.Node{ID: 1, Name: "node.test.ts.net.", User: 42},
+			UserProfile: &tailcfg.UserProfile{LoginName: "user@example.com"},
+		},
+	}
+
+	token, err := s.newAccessToken(ar)
+	if err != nil {
+		t.Fatalf("newAccessToken: %v", err)
+	}
+	claims := verifyJWTAccessToken(t, s, token)
+	if claims.Subject != "userid:42" {
+		t.Errorf("sub = %q, want the user ID", claims.Subject)
+	}
+	if claims.ID != "jti-1" || claims.Scope != "openid email" {
+		t.Errorf("unexpected claims: %+v", claims)
+	}
+	if claims.Actor == nil || claims.Actor.Subject != "agent" {
+		t.Errorf("act = %+v, want the actor", claims.Actor)
+	}
+	if claims.Cnf["jkt"] != "thumbprint" {
+		t.Errorf("cnf = %v, want the DPoP key thumbprint", claims.Cnf)
+	}
+	if len(claims.Audience) != 1 || claims.Audience[0] != "https://api.example.com" {
+		t.Errorf("aud = %v, want the exchanged audience", claims.Audience)
+	}
+}
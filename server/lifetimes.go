@@ -0,0 +1,149 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package server
+
+import (
+	"fmt"
+	"time"
+)
+
+// MaxTokenLifetime is the longest lifetime access and ID tokens can be
+// configured with. It bounds how long retired signing keys stay published.
+const MaxTokenLifetime = 24 * time.Hour
+
+// TokenLifetimes are the lifetimes of the tokens tsidp issues. Zero fields
+// fall back to the server-wide setting, then to the defaults.
+type TokenLifetimes struct {
+	AccessToken time.Duration // default TokenDuration
+	IDToken     time.Duration // default the access token lifetime
+
+	// RefreshTokenIdle is how long a refresh token stays valid if it isn't
+	// used. Every refresh issues a new one. Defaults to RefreshTokenDuration.
+	RefreshTokenIdle time.Duration
+
+	// RefreshTokenAbsolute caps the tokens issued from an authorization,
+	// counted from the user's sign-in. Zero means no cap.
+	RefreshTokenAbsolute time.Duration
+}
+
+// validate returns an error if l has a negative lifetime, or access or ID
+// token lifetimes longer than MaxTokenLifetime.
+func (l TokenLifetimes) validate() error {
+	for _, d := range []struct {
+		name  string
+		value time.Duration
+		max   time.Duration
+	}{
+		{"access token lifetime", l.AccessToken, MaxTokenLifetime},
+		{"ID token lifetime", l.IDToken, MaxTokenLifetime},
+		{"refresh token idle timeout", l.RefreshTokenIdle, 0},
+		{"refresh token lifetime", l.RefreshTokenAbsolute, 0},
+	} {
+		if d.value < 0 {
+			return fmt.Errorf("%s must not be negative", d.name)
+		}
+		if d.max > 0 && d.value > d.max {
+			return fmt.Errorf("%s must be at most %v", d.name, d.max)
+		}
+	}
+	return nil
+}
+
+// orElse returns l with its zero fields taken from def.
+func (l TokenLifetimes) orElse(def TokenLifetimes) TokenLifetimes {
+	if l.AccessToken == 0 {
+		l.AccessToken = def.AccessToken
+	}
+	if l.IDToken == 0 {
+		l.IDToken = def.IDToken
+	}
+	if l.RefreshTokenIdle == 0 {
+		l.RefreshTokenIdle = def.RefreshTokenIdle
+	}
+	if l.RefreshTokenAbsolute == 0 {
+		l.RefreshTokenAbsolute = def.RefreshTokenAbsolute
+	}
+	return l
+}
+
+// SetTokenLifetimes sets the server-wide token lifetimes, which funnel
+// clients can override.
+func (s *IDPServer) SetTokenLifetimes(l TokenLifetimes) error {
+	if err := l.validate(); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.lifetimes = l
+	return nil
+}
+
+// tokenLifetimes returns the lifetimes of the tokens issued to c, which
+// may be nil.
+func (s *IDPServer) tokenLifetimes(c *FunnelClient) TokenLifetimes {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.tokenLifetimesLocked(c)
+}
+
+// tokenLifetimesLocked is tokenLifetimes for callers holding s.mu.
+// Caller must hold s.mu lock
+func (s *IDPServer) tokenLifetimesLocked(c *FunnelClient) TokenLifetimes {
+	l := c.tokenLifetimes().orElse(s.lifetimes)
+	if l.AccessToken == 0 {
+		l.AccessToken = TokenDuration
+	}
+	if l.IDToken == 0 {
+		l.IDToken = l.AccessToken
+	}
+	if l.RefreshTokenIdle == 0 {
+		l.RefreshTokenIdle = RefreshTokenDuration
+	}
+	return l
+}
+
+// longestSignedTokenLifetime returns the longest lifetime of the access, ID
+// and workload tokens tsidp may have signed with the current settings.
+func (s *IDPServer) longestSignedTokenLifetime() time.Duration {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	l := s.tokenLifetimesLocked(nil)
+	longest := max(l.AccessToken, l.IDToken, TokenDuration)
+	for _, c := range s.funnelClients {
+		l := s.tokenLifetimesLocked(c)
+		longest = max(longest, l.AccessToken, l.IDToken)
+	}
+	return longest
+}
+
+// tokenLifetimes returns the lifetimes configured on c, zero for those it
+// doesn't override.
+func (c *FunnelClient) tokenLifetimes() TokenLifetimes {
+	if c == nil {
+		return TokenLifetimes{}
+	}
+	return TokenLifetimes{
+		AccessToken:          time.Duration(c.AccessTokenLifetime) * time.Second,
+		IDToken:              time.Duration(c.IDTokenLifetime) * time.Second,
+		RefreshTokenIdle:     time.Duration(c.RefreshTokenIdleTimeout) * time.Second,
+		RefreshTokenAbsolute: time.Duration(c.RefreshTokenLifetime) * time.Second,
+	}
+}
+
+// setTokenLifetimes sets the lifetimes c overrides from l.
+func (c *FunnelClient) setTokenLifetimes(l TokenLifetimes) {
+	c.AccessTokenLifetime = int(l.AccessToken / time.Second)
+	c.IDTokenLifetime = int(l.IDToken / time.Second)
+	c.RefreshTokenIdleTimeout = int(l.RefreshTokenIdle / time.Second)
+	c.RefreshTokenLifetime = int(l.RefreshTokenAbsolute / time.Second)
+}
+
+// capToSession returns exp, or the end of the session of ar if that is
+// earlier.
+func (ar *AuthRequest) capToSession(exp time.Time) time.Time {
+	if !ar.SessionExpiry.IsZero() && ar.SessionExpiry.Before(exp) {
+		return ar.SessionExpiry
+	}
+	return exp
+}
@@ -0,0 +1,239 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"gopkg.in/square/go-jose.v2/jwt"
+	"tailscale.com/client/tailscale/apitype"
+	"tailscale.com/tailcfg"
+)
+
+// TestTokenLifetimes tests the lifetimes of the tokens issued from an
+// authorization code, with server-wide and client settings
+func TestTokenLifetimes(t *testing.T) {
+	tests := []struct {
+		name        string
+		server      TokenLifetimes
+		client      TokenLifetimes
+		wantAccess  time.Duration
+		wantIDToken time.Duration
+		wantRefresh time.Duration
+		wantSession bool // whether the grant has a session expiry
+	}{
+		{
+			name:        "defaults",
+			wantAccess:  TokenDuration,
+			wantIDToken: TokenDuration,
+			wantRefresh: RefreshTokenDuration,
+		},
+		{
+			name:        "server setting",
+			server:      TokenLifetimes{AccessToken: time.Hour, RefreshTokenIdle: 24 * time.Hour},
+			wantAccess:  time.Hour,
+			wantIDToken: time.Hour,
+			wantRefresh: 24 * time.Hour,
+		},
+		{
+			name:        "client override",
+			server:      TokenLifetimes{AccessToken: time.Hour},
+			client:      TokenLifetimes{AccessToken: 10 * time.Minute, IDToken: 2 * time.Hour},
+			wantAccess:  10 * time.Minute,
+			wantIDToken: 2 * time.Hour,
+			wantRefresh: RefreshTokenDuration,
+		},
+		{
+			name:        "absolute lifetime caps all tokens",
+			server:      TokenLifetimes{AccessToken: 2 * time.Hour},
+			client:      TokenLifetimes{RefreshTokenAbsolute: time.Hour},
+			wantAccess:  time.Hour,
+			wantIDToken: time.Hour,
+			wantRefresh: time.Hour,
+			wantSession: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := setupTestServer(t, nil)
+			if err := s.SetTokenLifetimes(tt.server); err != nil {
+				t.Fatalf("SetTokenLifetimes: %v", err)
+			}
+			client := s.funnelClients["test-client"]
+			client.RedirectURIs = []string{"https://rp.example.com/callback"}
+			client.setTokenLifetimes(tt.client)
+			s.code.Set("code", &AuthRequest{
+				ClientID:    client.ID,
+				FunnelRP:    client,
+				RedirectURI: "https://rp.example.com/callback",
+				ValidTill:   time.Now().Add(5 * time.Minute),
+				RemoteUser: &apitype.WhoIsResponse{
+					Node:        &tailcfg.Node{ID: 1, Name: "node.test.ts.net.", User: 1},
+					UserProfile: &tailcfg.UserProfile{LoginName: "user@example.com"},
+				},
+			})
+
+			form := url.Values{
+				"grant_type":    {"authorization_code"},
+				"code":          {"code"},
+				"redirect_uri":  {"https://rp.example.com/callback"},
+				"client_id":     {client.ID},
+				"client_secret": {client.Secret},
+			}
+			req := httptest.NewRequest("POST", "/token", strings.NewReader(form.Encode()))
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			rr := httptest.NewRecorder()
+			start := time.Now()
+			s.serveToken(rr, req)
+			if rr.Code != http.StatusOK {
+				t.Fatalf("expected status 200, got %d: %s", rr.Code, rr.Body.String())
+			}
+			var resp oidcTokenResponse
+			if err := json.Unmarshal(rr.Body.Bytes(), &resp); err != nil {
+				t.Fatal(err)
+			}
+
+			if resp.ExpiresIn != int(tt.wantAccess.Seconds()) {
+				t.Errorf("expires_in = %d, want %d", resp.ExpiresIn, int(tt.wantAccess.Seconds()))
+			}
+			checkExpiry := func(what string, got time.Time, want time.Duration) {
+				t.Helper()
+				if d := got.Sub(start); d < want-time.Second || d > want+time.Second {
+					t.Errorf("%s expires after %v, want %v", what, d, want)
+				}
+			}
+			at, ok := s.accessToken.Get(resp.AccessToken)
+			if !ok {
+				t.Fatal("access token not stored")
+			}
+			checkExpiry("access token", at.ValidTill, tt.wantAccess)
+			rt, ok := s.refreshToken.Get(resp.RefreshToken)
+			if !ok {
+				t.Fatal("refresh token not stored")
+			}
+			checkExpiry("refresh token", rt.ValidTill, tt.wantRefresh)
+			if rt.SessionExpiry.IsZero() == tt.wantSession {
+				t.Errorf("session expiry = %v, want set: %v", rt.SessionExpiry, tt.wantSession)
+			}
+
+			idToken, err := jwt.ParseSigned(resp.IDToken)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var claims jwt.Claims
+			if err := idToken.UnsafeClaimsWithoutVerification(&claims); err != nil {
+				t.Fatal(err)
+			}
+			checkExpiry("ID token", claims.Expiry.Time(), tt.wantIDToken)
+		})
+	}
+}
+
+// TestSessionExpiryOnRefresh tests that refreshing doesn't extend the
+// absolute lifetime of a session
+func TestSessionExpiryOnRefresh(t *testing.T) {
+	s := setupTestServer(t, nil)
+	client := s.funnelClients["test-client"]
+	client.RefreshTokenLifetime = int((8 * time.Hour).Seconds())
+	sessionExpiry := time.Now().Add(time.Minute)
+	s.refreshToken.Set("rt", &AuthRequest{
+		ClientID:      client.ID,
+		FunnelRP:      client,
+		GrantID:       "grant-1",
+		SessionExpiry: sessionExpiry,
+		ValidTill:     sessionExpiry,
+		RemoteUser: &apitype.WhoIsResponse{
+			Node:        &tailcfg.Node{ID: 1, Name: "node.test.ts.net.", User: 1},
+			UserProfile: &tailcfg.UserProfile{LoginName: "user@example.com"},
+		},
+	})
+
+	form := url.Values{
+		"grant_type":    {"refresh_token"},
+		"refresh_token": {"rt"},
+		"client_id":     {client.ID},
+		"client_secret": {client.Secret},
+	}
+	req := httptest.NewRequest("POST", "/token", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	rr := httptest.NewRecorder()
+	s.serveToken(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", rr.Code, rr.Body.String())
+	}
+	var resp oidcTokenResponse
+	if err := json.Unmarshal(rr.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp.ExpiresIn > 60 {
+		t.Errorf("expires_in = %d, want at most the remaining session of 60s", resp.ExpiresIn)
+	}
+	rt, ok := s.refreshToken.Get(resp.RefreshToken)
+	if !ok {
+		t.Fatal("refresh token not stored")
+	}
+	if !rt.ValidTill.Equal(sessionExpiry) || !rt.SessionExpiry.Equal(sessionExpiry) {
+		t.Errorf("refresh token valid till %v, session expiry %v, want %v", rt.ValidTill, rt.SessionExpiry, sessionExpiry)
+	}
+}
+
+// TestTokenLifetimeFields tests parsing the token lifetimes of the client
+// form
+func TestTokenLifetimeFields(t *testing.T) {
+	tests := []struct {
+		name    string
+		fields  tokenLifetimeFields
+		want    TokenLifetimes
+		wantErr bool
+	}{
+		{
+			name: "empty",
+		},
+		{
+			name:   "durations",
+			fields: tokenLifetimeFields{AccessTokenLifetime: "1h", RefreshTokenLifetime: "8h"},
+			want:   TokenLifetimes{AccessToken: time.Hour, RefreshTokenAbsolute: 8 * time.Hour},
+		},
+		{
+			name:    "not a duration",
+			fields:  tokenLifetimeFields{IDTokenLifetime: "1 hour"},
+			wantErr: true,
+		},
+		{
+			name:    "too long",
+			fields:  tokenLifetimeFields{AccessTokenLifetime: "48h"},
+			wantErr: true,
+		},
+		{
+			name:    "negative",
+			fields:  tokenLifetimeFields{RefreshTokenIdleTimeout: "-1h"},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.fields.parse()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parse() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil && got != tt.want {
+				t.Errorf("parse() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+
+	for seconds, want := range map[int]string{0: "", 90: "1m30s", 3600: "1h", 28800: "8h", 5400: "1h30m"} {
+		if got := formatLifetime(seconds); got != want {
+			t.Errorf("formatLifetime(%d) = %q, want %q", seconds, got, want)
+		}
+	}
+}
@@ -0,0 +1,203 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package server
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"slices"
+
+	"gopkg.in/square/go-jose.v2"
+	"gopkg.in/square/go-jose.v2/jwt"
+)
+
+// serveEndSession implements OpenID Connect RP-Initiated Logout 1.0. It
+// revokes the tokens of the session identified by id_token_hint, if the
+// user of that session is the one visiting, and sends the user back to the
+// relying party if a registered post_logout_redirect_uri was given.
+func (s *IDPServer) serveEndSession(w http.ResponseWriter, r *http.Request) {
+	// Like /authorize, this URL is visited by the user's browser, which is
+	// expected to be in the tailnet.
+	if isFunnelRequest(r) {
+		writeHTTPError(w, r, http.StatusUnauthorized, ecAccessDenied, "not allowed over funnel", nil)
+		return
+	}
+
+	if r.Method != "GET" && r.Method != "POST" {
+		writeHTTPError(w, r, http.StatusMethodNotAllowed, ecInvalidRequest, "method not allowed", nil)
+		return
+	}
+
+	if err := r.ParseForm(); err != nil {
+		writeHTTPError(w, r, http.StatusBadRequest, ecInvalidRequest, "failed to parse form", err)
+		return
+	}
+
+	clientID := r.FormValue("client_id")
+	var hint *idTokenHintClaims
+	if idTokenHint := r.FormValue("id_token_hint"); idTokenHint != "" {
+		claims, err := s.verifyIDTokenHint(idTokenHint)
+		if err != nil {
+			writeHTTPError(w, r, http.StatusBadRequest, ecInvalidRequest, "invalid id_token_hint", err)
+			return
+		}
+		if len(claims.Audience) == 0 {
+			writeHTTPError(w, r, http.StatusBadRequest, ecInvalidRequest, "invalid id_token_hint", fmt.Errorf("id_token_hint has no audience"))
+			return
+		}
+		if clientID == "" {
+			clientID = claims.Audience[0]
+		} else if !claims.Audience.Contains(clientID) {
+			writeHTTPError(w, r, http.StatusBadRequest, ecInvalidRequest, "client_id does not match id_token_hint", nil)
+			return
+		}
+		hint = claims
+	}
+
+	// The redirect target must be registered by the client, which is
+	// identified by client_id or the audience of id_token_hint.
+	redirectURI := r.FormValue("post_logout_redirect_uri")
+	if redirectURI != "" {
+		if clientID == "" {
+			writeHTTPError(w, r, http.StatusBadRequest, ecInvalidRequest, "post_logout_redirect_uri requires client_id or id_token_hint", nil)
+			return
+		}
+		s.mu.Lock()
+		client, ok := s.funnelClients[clientID]
+		s.mu.Unlock()
+		if !ok || !slices.Contains(client.PostLogoutRedirectURIs, redirectURI) {
+			writeHTTPError(w, r, http.StatusBadRequest, ecInvalidRequest, "post_logout_redirect_uri mismatch", nil)
+			return
+		}
+	}
+
+	// id_token_hint is held by relying parties, and may be leaked by them,
+	// so it only ends the session when the user of the session asks.
+	if hint != nil && !s.callerIsSubject(r, hint.Subject) {
+		slog.Info("session not ended, id_token_hint is of another user",
+			slog.String("sub", hint.Subject),
+			slog.String("client_id", clientID),
+		)
+		hint = nil
+	}
+	if hint != nil {
+		s.mu.Lock()
+		grantID := hint.SessionID
+		if grantID == "" {
+			// ID tokens issued before sid was added
+			grantID = s.grantIDForJTILocked(hint.ID)
+		}
+		ended := s.revokeGrantLocked(grantID)
+		s.mu.Unlock()
+		if ended != nil {
+			s.backchannelLogout(ended)
+		}
+		slog.Info("session ended",
+			slog.String("sub", hint.Subject),
+			slog.String("client_id", clientID),
+		)
+	}
+
+	if redirectURI == "" {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		io.WriteString(w, "You have been signed out.\n")
+		return
+	}
+
+	u, err := url.Parse(redirectURI)
+	if err != nil {
+		writeHTTPError(w, r, http.StatusBadRequest, ecInvalidRequest, "invalid post_logout_redirect_uri", err)
+		return
+	}
+	if state := r.FormValue("state"); state != "" {
+		q := u.Query()
+		q.Set("state", state)
+		u.RawQuery = q.Encode()
+	}
+	http.Redirect(w, r, u.String(), http.StatusFound)
+}
+
+// callerIsSubject reports whether r comes from a node of the user sub, the
+// subject of tsidp's ID tokens.
+func (s *IDPServer) callerIsSubject(r *http.Request, sub string) bool {
+	who := s.callerWhoIs(r)
+	return who != nil && !who.Node.IsTagged() && who.Node.User.String() == sub
+}
+
+// idTokenHintClaims are the claims of an id_token_hint used for logout.
+type idTokenHintClaims struct {
+	jwt.Claims
+	SessionID string `json:"sid,omitempty"`
+}
+
+// verifyIDTokenHint verifies that hint is an ID token issued by this server
+// and returns its claims. Expired tokens are accepted, as relying parties
+// commonly hold on to an expired ID token until the user logs out.
+func (s *IDPServer) verifyIDTokenHint(hint string) (*idTokenHintClaims, error) {
+	tok, err := jwt.ParseSigned(hint)
+	if err != nil {
+		return nil, err
+	}
+	if !isIDToken(tok) {
+		return nil, fmt.Errorf("unexpected token type %v", tok.Headers[0].ExtraHeaders[jose.HeaderType])
+	}
+	var claims idTokenHintClaims
+	if err := s.verifyOwnSignature(tok, &claims); err != nil {
+		return nil, err
+	}
+	if claims.Issuer != s.serverURL {
+		return nil, fmt.Errorf("unexpected issuer %q", claims.Issuer)
+	}
+	return &claims, nil
+}
+
+// isIDToken reports whether tok has a single signature with the typ header
+// of ID tokens.
+func isIDToken(tok *jwt.JSONWebToken) bool {
+	return len(tok.Headers) == 1 && tok.Headers[0].ExtraHeaders[jose.HeaderType] == idTokenType
+}
+
+// verifyOwnSignature verifies that tok is signed with one of the signing
+// keys of this server and decodes its claims into dest.
+func (s *IDPServer) verifyOwnSignature(tok *jwt.JSONWebToken, dest ...any) error {
+	if len(tok.Headers) != 1 {
+		return fmt.Errorf("expected a single signature, got %d", len(tok.Headers))
+	}
+	header := tok.Headers[0]
+
+	keys, err := s.publishedSigningKeys()
+	if err != nil {
+		return err
+	}
+	i := slices.IndexFunc(keys, func(k *signingKey) bool {
+		return fmt.Sprint(k.Kid) == header.KeyID
+	})
+	if i < 0 {
+		return fmt.Errorf("unknown signing key %q", header.KeyID)
+	}
+	if header.Algorithm != string(keys[i].Alg) {
+		return fmt.Errorf("unexpected algorithm %q for key %q", header.Algorithm, header.KeyID)
+	}
+	return tok.Claims(keys[i].Key.Public(), dest...)
+}
+
+// grantIDForJTILocked returns the authorization grant of the tokens issued
+// together with the ID token jti, or "" if none of them is still stored.
+// Caller must hold s.mu lock
+func (s *IDPServer) grantIDForJTILocked(jti string) string {
+	if jti == "" {
+		return ""
+	}
+	for _, ts := range []tokenStore{s.accessToken, s.refreshToken} {
+		for _, ar := range ts.All() {
+			if ar.JTI == jti {
+				return ar.GrantID
+			}
+		}
+	}
+	return ""
+}
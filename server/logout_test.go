@@ -0,0 +1,273 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"gopkg.in/square/go-jose.v2"
+	"gopkg.in/square/go-jose.v2/jwt"
+	"tailscale.com/client/tailscale/apitype"
+	"tailscale.com/tailcfg"
+)
+
+// TestServeEndSession tests RP-initiated logout
+func TestServeEndSession(t *testing.T) {
+	user := &apitype.WhoIsResponse{
+		Node:        &tailcfg.Node{ID: 1, Name: "node.test.ts.net.", User: 123},
+		UserProfile: &tailcfg.UserProfile{ID: 123, LoginName: "user@example.com"},
+	}
+	s := New(newTestWhoIsClient(t, user, false), t.TempDir(), false, false, false)
+	s.serverURL = "https://idp.test.ts.net"
+	client := &FunnelClient{
+		ID:                     "test-client",
+		Secret:                 "test-secret",
+		RedirectURIs:           []string{"https://rp.example.com/callback"},
+		PostLogoutRedirectURIs: []string{"https://rp.example.com/signed-out"},
+	}
+	s.SetFunnelClients(map[string]*FunnelClient{
+		client.ID:      client,
+		"other-client": {ID: "other-client", PostLogoutRedirectURIs: []string{"https://other.example.com/"}},
+	})
+
+	now := time.Now()
+	validHint := mustSignIDToken(t, s, jwt.Claims{
+		Issuer:   s.serverURL,
+		Subject:  tailcfg.UserID(123).String(),
+		Audience: jwt.Audience{client.ID},
+		Expiry:   jwt.NewNumericDate(now.Add(time.Hour)),
+		ID:       "jti-1",
+	})
+	expiredHint := mustSignIDToken(t, s, jwt.Claims{
+		Issuer:   s.serverURL,
+		Subject:  tailcfg.UserID(123).String(),
+		Audience: jwt.Audience{client.ID},
+		Expiry:   jwt.NewNumericDate(now.Add(-time.Hour)),
+		ID:       "jti-1",
+	})
+	otherUserHint := mustSignIDToken(t, s, jwt.Claims{
+		Issuer:   s.serverURL,
+		Subject:  tailcfg.UserID(456).String(),
+		Audience: jwt.Audience{client.ID},
+		Expiry:   jwt.NewNumericDate(now.Add(time.Hour)),
+		ID:       "jti-1",
+	})
+	wrongIssuerHint := mustSignIDToken(t, s, jwt.Claims{
+		Issuer:   "https://evil.example.com",
+		Audience: jwt.Audience{client.ID},
+		ID:       "jti-1",
+	})
+
+	// A workload identity token is signed with our key but isn't an ID token.
+	workloadHint, err := s.newWorkloadToken(&apitype.WhoIsResponse{
+		Node: &tailcfg.Node{ID: 7, StableID: "nStable7", Name: "server.test.ts.net.", Tags: []string{"tag:server"}},
+	}, client.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A token signed by a key that only claims to be ours.
+	s.keyMu.Lock()
+	kid := s.keys.active(jose.RS256, now).Kid
+	s.keyMu.Unlock()
+	forger, err := jose.NewSigner(jose.SigningKey{Algorithm: jose.RS256, Key: mustGeneratePrivateKey(t)},
+		&jose.SignerOptions{ExtraHeaders: map[jose.HeaderKey]any{"kid": fmt.Sprint(kid)}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	forgedHint, err := jwt.Signed(forger).Claims(jwt.Claims{
+		Issuer:   s.serverURL,
+		Audience: jwt.Audience{client.ID},
+		ID:       "jti-1",
+	}).CompactSerialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name         string
+		params       url.Values
+		funnel       bool
+		expectStatus int
+		expectLoc    string
+		expectRevoke bool
+	}{
+		{
+			name: "logout with redirect",
+			params: url.Values{
+				"id_token_hint":            {validHint},
+				"post_logout_redirect_uri": {"https://rp.example.com/signed-out"},
+				"state":                    {"xyz"},
+			},
+			expectStatus: http.StatusFound,
+			expectLoc:    "https://rp.example.com/signed-out?state=xyz",
+			expectRevoke: true,
+		},
+		{
+			name:         "expired hint is accepted",
+			params:       url.Values{"id_token_hint": {expiredHint}},
+			expectStatus: http.StatusOK,
+			expectRevoke: true,
+		},
+		{
+			name: "hint of another user",
+			params: url.Values{
+				"id_token_hint":            {otherUserHint},
+				"post_logout_redirect_uri": {"https://rp.example.com/signed-out"},
+			},
+			expectStatus: http.StatusFound,
+			expectLoc:    "https://rp.example.com/signed-out",
+		},
+		{
+			name: "client_id without hint",
+			params: url.Values{
+				"client_id":                {client.ID},
+				"post_logout_redirect_uri": {"https://rp.example.com/signed-out"},
+			},
+			expectStatus: http.StatusFound,
+			expectLoc:    "https://rp.example.com/signed-out",
+		},
+		{
+			name:         "no parameters",
+			expectStatus: http.StatusOK,
+		},
+		{
+			name:         "malformed hint",
+			params:       url.Values{"id_token_hint": {"not-a-jwt"}},
+			expectStatus: http.StatusBadRequest,
+		},
+		{
+			name:         "forged hint",
+			params:       url.Values{"id_token_hint": {forgedHint}},
+			expectStatus: http.StatusBadRequest,
+		},
+		{
+			name:         "workload token as hint",
+			params:       url.Values{"id_token_hint": {workloadHint}},
+			expectStatus: http.StatusBadRequest,
+		},
+		{
+			name:         "hint from another issuer",
+			params:       url.Values{"id_token_hint": {wrongIssuerHint}},
+			expectStatus: http.StatusBadRequest,
+		},
+		{
+			name: "client_id does not match hint",
+			params: url.Values{
+				"id_token_hint": {validHint},
+				"client_id":     {"other-client"},
+			},
+			expectStatus: http.StatusBadRequest,
+		},
+		{
+			name: "unregistered redirect",
+			params: url.Values{
+				"id_token_hint":            {validHint},
+				"post_logout_redirect_uri": {"https://evil.example.com/"},
+			},
+			expectStatus: http.StatusBadRequest,
+		},
+		{
+			name: "redirect registered by another client",
+			params: url.Values{
+				"id_token_hint":            {validHint},
+				"post_logout_redirect_uri": {"https://other.example.com/"},
+			},
+			expectStatus: http.StatusBadRequest,
+		},
+		{
+			name:         "redirect without client",
+			params:       url.Values{"post_logout_redirect_uri": {"https://rp.example.com/signed-out"}},
+			expectStatus: http.StatusBadRequest,
+		},
+		{
+			name:         "funnel request",
+			params:       url.Values{"id_token_hint": {validHint}},
+			funnel:       true,
+			expectStatus: http.StatusUnauthorized,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			validTill := time.Now().Add(time.Hour)
+			s.mu.Lock()
+			s.accessToken = &memTokenStore{m: map[string]*AuthRequest{
+				"at-1": {ClientID: client.ID, FunnelRP: client, JTI: "jti-1", GrantID: "grant-1", ValidTill: validTill},
+				"at-0": {ClientID: client.ID, FunnelRP: client, JTI: "jti-0", GrantID: "grant-1", ValidTill: validTill},
+				"at-2": {ClientID: client.ID, FunnelRP: client, JTI: "jti-2", GrantID: "grant-2", ValidTill: validTill},
+			}}
+			s.refreshToken = &memTokenStore{m: map[string]*AuthRequest{
+				"rt-1": {ClientID: client.ID, FunnelRP: client, JTI: "jti-1", GrantID: "grant-1", ValidTill: validTill},
+				"rt-2": {ClientID: client.ID, FunnelRP: client, JTI: "jti-2", GrantID: "grant-2", ValidTill: validTill},
+			}}
+			s.mu.Unlock()
+
+			req := httptest.NewRequest("GET", "/end_session?"+tt.params.Encode(), nil)
+			if tt.funnel {
+				req.Header.Set("Tailscale-Funnel-Request", "true")
+			}
+			rr := httptest.NewRecorder()
+			s.ServeHTTP(rr, req)
+
+			if rr.Code != tt.expectStatus {
+				t.Fatalf("expected status %d, got %d: %s", tt.expectStatus, rr.Code, rr.Body.String())
+			}
+			if got := rr.Header().Get("Location"); got != tt.expectLoc {
+				t.Errorf("Location = %q, want %q", got, tt.expectLoc)
+			}
+
+			_, at0 := s.accessToken.Get("at-0")
+			_, at1 := s.accessToken.Get("at-1")
+			_, rt1 := s.refreshToken.Get("rt-1")
+			if revoked := !at0 && !at1 && !rt1; revoked != tt.expectRevoke {
+				t.Errorf("session tokens revoked = %v, want %v", revoked, tt.expectRevoke)
+			}
+			if tokenCount(s.accessToken)+tokenCount(s.refreshToken) < 2 {
+				t.Error("tokens of another session were revoked")
+			}
+		})
+	}
+}
+
+// TestEndSessionPOST tests that logout parameters can be sent as a form
+func TestEndSessionPOST(t *testing.T) {
+	s := New(nil, t.TempDir(), false, false, false)
+	s.SetFunnelClients(map[string]*FunnelClient{
+		"test-client": {ID: "test-client", PostLogoutRedirectURIs: []string{"https://rp.example.com/signed-out"}},
+	})
+
+	form := url.Values{
+		"client_id":                {"test-client"},
+		"post_logout_redirect_uri": {"https://rp.example.com/signed-out"},
+	}
+	req := httptest.NewRequest("POST", "/end_session", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	rr := httptest.NewRecorder()
+	s.ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusFound || rr.Header().Get("Location") != "https://rp.example.com/signed-out" {
+		t.Errorf("expected redirect to post_logout_redirect_uri, got %d %q", rr.Code, rr.Header().Get("Location"))
+	}
+}
+
+// mustSignIDToken signs claims with the server's active RS256 key.
+func mustSignIDToken(t *testing.T, s *IDPServer, claims jwt.Claims) string {
+	t.Helper()
+	signer, err := s.oidcSigner(jose.RS256, claims.Expiry.Time())
+	if err != nil {
+		t.Fatalf("oidcSigner: %v", err)
+	}
+	tok, err := jwt.Signed(signer).Claims(claims).CompactSerialize()
+	if err != nil {
+		t.Fatalf("signing ID token: %v", err)
+	}
+	return tok
+}
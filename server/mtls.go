@@ -0,0 +1,166 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package server
+
+import (
+	"crypto"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"slices"
+	"time"
+)
+
+// SetMTLSURL sets the URL of the listener that requests TLS client
+// certificates, advertised as mtls_endpoint_aliases (RFC 8705 Section 5).
+func (s *IDPServer) SetMTLSURL(hostname string, port int) {
+	if port != 443 {
+		s.mtlsURL = fmt.Sprintf("https://%s:%d", hostname, port)
+	} else {
+		s.mtlsURL = fmt.Sprintf("https://%s", hostname)
+	}
+}
+
+// SetMTLSClientCAs sets the CAs trusted to issue certificates for clients
+// using tls_client_auth. Without them, only self_signed_tls_client_auth can
+// be used.
+func (s *IDPServer) SetMTLSClientCAs(pool *x509.CertPool) {
+	s.mtlsClientCAs = pool
+}
+
+// mtlsEndpointAliases returns the endpoints that accept TLS client
+// certificates, or nil if there is no such listener.
+func (s *IDPServer) mtlsEndpointAliases() map[string]string {
+	if s.mtlsURL == "" {
+		return nil
+	}
+	return map[string]string{
+		"token_endpoint":                        s.mtlsURL + "/token",
+		"revocation_endpoint":                   s.mtlsURL + "/revoke",
+		"introspection_endpoint":                s.mtlsURL + "/introspect",
+		"device_authorization_endpoint":         s.mtlsURL + "/device_authorization",
+		"pushed_authorization_request_endpoint": s.mtlsURL + "/par",
+		"userinfo_endpoint":                     s.mtlsURL + "/userinfo",
+	}
+}
+
+// clientCertificates returns the certificate chain the client presented on
+// the TLS connection of r, leaf first.
+func clientCertificates(r *http.Request) []*x509.Certificate {
+	if tlsConn, ok := r.Context().Value(CtxConn{}).(*tls.Conn); ok {
+		return tlsConn.ConnectionState().PeerCertificates
+	}
+	if r.TLS != nil {
+		return r.TLS.PeerCertificates
+	}
+	return nil
+}
+
+// certThumbprint returns the x5t#S256 confirmation of the client
+// certificate of r (RFC 8705 Section 3.1), or "" if r has no certificate.
+func certThumbprint(r *http.Request) string {
+	certs := clientCertificates(r)
+	if len(certs) == 0 {
+		return ""
+	}
+	sum := sha256.Sum256(certs[0].Raw)
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// certBindingMatches reports whether a token bound to the certificate
+// thumbprint boundTo may be used by r. Unbound tokens can be used by
+// anyone.
+func certBindingMatches(r *http.Request, boundTo string) bool {
+	return boundTo == "" || certThumbprint(r) == boundTo
+}
+
+// verifyClientCertificate authenticates r as client with the TLS client
+// certificate of its connection (RFC 8705 Section 2). With tls_client_auth
+// the certificate must be issued by a trusted CA and match the subject the
+// client registered; with self_signed_tls_client_auth its public key must
+// be one of the client's registered keys.
+func (s *IDPServer) verifyClientCertificate(r *http.Request, client *FunnelClient) error {
+	certs := clientCertificates(r)
+	if len(certs) == 0 {
+		return fmt.Errorf("tsidp: no client certificate presented")
+	}
+	cert := certs[0]
+	now := time.Now()
+	if now.Before(cert.NotBefore) || now.After(cert.NotAfter) {
+		return fmt.Errorf("tsidp: client certificate is not valid at this time")
+	}
+
+	if client.TokenEndpointAuthMethod == "self_signed_tls_client_auth" {
+		jwks, err := s.clientJWKS(r.Context(), client, "")
+		if err != nil {
+			return err
+		}
+		pub, ok := cert.PublicKey.(interface{ Equal(crypto.PublicKey) bool })
+		if !ok {
+			return fmt.Errorf("tsidp: unsupported client certificate key type %T", cert.PublicKey)
+		}
+		for _, k := range jwks.Keys {
+			if k.Use != "enc" && pub.Equal(k.Key) {
+				return nil
+			}
+		}
+		return fmt.Errorf("tsidp: client certificate does not match the keys of %q", client.ID)
+	}
+
+	if s.mtlsClientCAs == nil {
+		return fmt.Errorf("tsidp: no trusted client CAs configured for tls_client_auth")
+	}
+	intermediates := x509.NewCertPool()
+	for _, c := range certs[1:] {
+		intermediates.AddCert(c)
+	}
+	if _, err := cert.Verify(x509.VerifyOptions{
+		Roots:         s.mtlsClientCAs,
+		Intermediates: intermediates,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}); err != nil {
+		return fmt.Errorf("tsidp: client certificate not trusted: %w", err)
+	}
+	if !client.matchesCertificate(cert) {
+		return fmt.Errorf("tsidp: client certificate subject does not match %q", client.ID)
+	}
+	return nil
+}
+
+// matchesCertificate reports whether cert has the subject c registered for
+// tls_client_auth.
+func (c *FunnelClient) matchesCertificate(cert *x509.Certificate) bool {
+	switch {
+	case c.TLSClientAuthSubjectDN != "":
+		return cert.Subject.String() == c.TLSClientAuthSubjectDN
+	case c.TLSClientAuthSANDNS != "":
+		return slices.Contains(cert.DNSNames, c.TLSClientAuthSANDNS)
+	case c.TLSClientAuthSANURI != "":
+		return slices.ContainsFunc(cert.URIs, func(u *url.URL) bool { return u.String() == c.TLSClientAuthSANURI })
+	case c.TLSClientAuthSANIP != "":
+		ip := net.ParseIP(c.TLSClientAuthSANIP)
+		return ip != nil && slices.ContainsFunc(cert.IPAddresses, ip.Equal)
+	case c.TLSClientAuthSANEmail != "":
+		return slices.Contains(cert.EmailAddresses, c.TLSClientAuthSANEmail)
+	}
+	return false
+}
+
+// tlsClientAuthSubjects returns how many of the certificate subject fields
+// for tls_client_auth c has set. Exactly one must be set (RFC 8705 Section
+// 2.1.2).
+func (c *FunnelClient) tlsClientAuthSubjects() int {
+	n := 0
+	for _, v := range []string{c.TLSClientAuthSubjectDN, c.TLSClientAuthSANDNS, c.TLSClientAuthSANURI, c.TLSClientAuthSANIP, c.TLSClientAuthSANEmail} {
+		if v != "" {
+			n++
+		}
+	}
+	return n
+}
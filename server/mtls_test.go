@@ -0,0 +1,308 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package server
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"gopkg.in/square/go-jose.v2"
+	"tailscale.com/client/tailscale/apitype"
+	"tailscale.com/tailcfg"
+)
+
+// newTestCertificate returns a certificate for tmpl and its key, signed by
+// parent and parentKey, or self-signed if parent is nil.
+func newTestCertificate(t *testing.T, tmpl *x509.Certificate, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serial, err := rand.Int(rand.Reader, big.NewInt(1<<62))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl.SerialNumber = serial
+	if tmpl.NotBefore.IsZero() {
+		tmpl.NotBefore = time.Now().Add(-time.Hour)
+	}
+	if tmpl.NotAfter.IsZero() {
+		tmpl.NotAfter = time.Now().Add(time.Hour)
+	}
+	if parent == nil {
+		parent, parentKey = tmpl, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert, key
+}
+
+// newTestCA returns a CA certificate and its key.
+func newTestCA(t *testing.T) (*x509.Certificate, *ecdsa.PrivateKey) {
+	t.Helper()
+	return newTestCertificate(t, &x509.Certificate{
+		Subject:               pkix.Name{CommonName: "Test CA"},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}, nil, nil)
+}
+
+// newTestClientCert returns a client certificate for dnsName issued by ca.
+func newTestClientCert(t *testing.T, ca *x509.Certificate, caKey *ecdsa.PrivateKey, dnsName string) *x509.Certificate {
+	t.Helper()
+	cert, _ := newTestCertificate(t, &x509.Certificate{
+		Subject:     pkix.Name{CommonName: dnsName, Organization: []string{"Example"}},
+		DNSNames:    []string{dnsName},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}, ca, caKey)
+	return cert
+}
+
+// withClientCert makes r look like it was received on a TLS connection on
+// which certs were presented.
+func withClientCert(r *http.Request, certs ...*x509.Certificate) *http.Request {
+	r.TLS = &tls.ConnectionState{PeerCertificates: certs}
+	return r
+}
+
+// TestVerifyClientCertificate tests tls_client_auth and
+// self_signed_tls_client_auth client authentication
+func TestVerifyClientCertificate(t *testing.T) {
+	ca, caKey := newTestCA(t)
+	otherCA, otherCAKey := newTestCA(t)
+	rpCert := newTestClientCert(t, ca, caKey, "rp.example.com")
+	expiredCert, _ := newTestCertificate(t, &x509.Certificate{
+		DNSNames:    []string{"rp.example.com"},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		NotBefore:   time.Now().Add(-2 * time.Hour),
+		NotAfter:    time.Now().Add(-time.Hour),
+	}, ca, caKey)
+	selfSigned, selfSignedKey := newTestCertificate(t, &x509.Certificate{
+		Subject: pkix.Name{CommonName: "rp"},
+	}, nil, nil)
+	otherSelfSigned, _ := newTestCertificate(t, &x509.Certificate{
+		Subject: pkix.Name{CommonName: "rp"},
+	}, nil, nil)
+	pool := x509.NewCertPool()
+	pool.AddCert(ca)
+
+	tests := []struct {
+		name    string
+		client  *FunnelClient
+		certs   []*x509.Certificate
+		noCAs   bool
+		wantErr bool
+	}{
+		{
+			name:   "tls_client_auth SAN DNS",
+			client: &FunnelClient{TokenEndpointAuthMethod: "tls_client_auth", TLSClientAuthSANDNS: "rp.example.com"},
+			certs:  []*x509.Certificate{rpCert},
+		},
+		{
+			name:   "tls_client_auth subject DN",
+			client: &FunnelClient{TokenEndpointAuthMethod: "tls_client_auth", TLSClientAuthSubjectDN: "CN=rp.example.com,O=Example"},
+			certs:  []*x509.Certificate{rpCert},
+		},
+		{
+			name:    "tls_client_auth other SAN DNS",
+			client:  &FunnelClient{TokenEndpointAuthMethod: "tls_client_auth", TLSClientAuthSANDNS: "other.example.com"},
+			certs:   []*x509.Certificate{rpCert},
+			wantErr: true,
+		},
+		{
+			name:    "tls_client_auth untrusted CA",
+			client:  &FunnelClient{TokenEndpointAuthMethod: "tls_client_auth", TLSClientAuthSANDNS: "rp.example.com"},
+			certs:   []*x509.Certificate{newTestClientCert(t, otherCA, otherCAKey, "rp.example.com")},
+			wantErr: true,
+		},
+		{
+			name:    "tls_client_auth without trusted CAs",
+			client:  &FunnelClient{TokenEndpointAuthMethod: "tls_client_auth", TLSClientAuthSANDNS: "rp.example.com"},
+			certs:   []*x509.Certificate{rpCert},
+			noCAs:   true,
+			wantErr: true,
+		},
+		{
+			name:    "tls_client_auth expired certificate",
+			client:  &FunnelClient{TokenEndpointAuthMethod: "tls_client_auth", TLSClientAuthSANDNS: "rp.example.com"},
+			certs:   []*x509.Certificate{expiredCert},
+			wantErr: true,
+		},
+		{
+			name:    "no certificate",
+			client:  &FunnelClient{TokenEndpointAuthMethod: "tls_client_auth", TLSClientAuthSANDNS: "rp.example.com"},
+			wantErr: true,
+		},
+		{
+			name: "self_signed_tls_client_auth",
+			client: &FunnelClient{
+				TokenEndpointAuthMethod: "self_signed_tls_client_auth",
+				JWKS:                    &jose.JSONWebKeySet{Keys: []jose.JSONWebKey{{Key: &selfSignedKey.PublicKey}}},
+			},
+			certs: []*x509.Certificate{selfSigned},
+		},
+		{
+			name: "self_signed_tls_client_auth other key",
+			client: &FunnelClient{
+				TokenEndpointAuthMethod: "self_signed_tls_client_auth",
+				JWKS:                    &jose.JSONWebKeySet{Keys: []jose.JSONWebKey{{Key: &selfSignedKey.PublicKey}}},
+			},
+			certs:   []*x509.Certificate{otherSelfSigned},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := setupTestServer(t, nil)
+			if !tt.noCAs {
+				s.SetMTLSClientCAs(pool)
+			}
+			tt.client.ID = "mtls-client"
+			s.funnelClients[tt.client.ID] = tt.client
+
+			form := url.Values{"client_id": {tt.client.ID}}
+			req := httptest.NewRequest("POST", "/token", strings.NewReader(form.Encode()))
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			withClientCert(req, tt.certs...)
+
+			client, err := s.authenticateFunnelClient(req)
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("expected error, authenticated as %q", client.ID)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("authenticateFunnelClient: %v", err)
+			}
+		})
+	}
+}
+
+// TestCertificateBoundTokens tests that tokens issued over a connection
+// with a client certificate are bound to it (RFC 8705 Section 3)
+func TestCertificateBoundTokens(t *testing.T) {
+	ca, caKey := newTestCA(t)
+	rpCert := newTestClientCert(t, ca, caKey, "rp.example.com")
+	otherCert := newTestClientCert(t, ca, caKey, "other.example.com")
+	pool := x509.NewCertPool()
+	pool.AddCert(ca)
+
+	s := setupTestServer(t, nil)
+	s.SetMTLSClientCAs(pool)
+	client := &FunnelClient{
+		ID:                      "mtls-client",
+		RedirectURIs:            []string{"https://rp.example.com/callback"},
+		TokenEndpointAuthMethod: "tls_client_auth",
+		TLSClientAuthSANDNS:     "rp.example.com",
+	}
+	s.funnelClients[client.ID] = client
+	s.funnelClients["other-client"] = &FunnelClient{
+		ID:                      "other-client",
+		TokenEndpointAuthMethod: "tls_client_auth",
+		TLSClientAuthSANDNS:     "other.example.com",
+	}
+	s.code.Set("code", &AuthRequest{
+		ClientID:    client.ID,
+		RedirectURI: "https://rp.example.com/callback",
+		ValidTill:   time.Now().Add(5 * time.Minute),
+		FunnelRP:    client,
+		RemoteUser: &apitype.WhoIsResponse{
+			Node:        &tailcfg.Node{ID: 1, Name: "node.test.ts.net.", User: 1},
+			UserProfile: &tailcfg.UserProfile{LoginName: "user@example.com"},
+		},
+	})
+
+	form := url.Values{
+		"grant_type":   {"authorization_code"},
+		"code":         {"code"},
+		"redirect_uri": {"https://rp.example.com/callback"},
+		"client_id":    {client.ID},
+	}
+	req := httptest.NewRequest("POST", "/token", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	rr := httptest.NewRecorder()
+	s.serveToken(rr, withClientCert(req, rpCert))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("token: expected status 200, got %d: %s", rr.Code, rr.Body.String())
+	}
+	var tokens struct {
+		AccessToken string `json:"access_token"`
+	}
+	if err := json.Unmarshal(rr.Body.Bytes(), &tokens); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("userinfo", func(t *testing.T) {
+		for _, tt := range []struct {
+			name       string
+			certs      []*x509.Certificate
+			wantStatus int
+		}{
+			{"same certificate", []*x509.Certificate{rpCert}, http.StatusOK},
+			{"other certificate", []*x509.Certificate{otherCert}, http.StatusUnauthorized},
+			{"no certificate", nil, http.StatusUnauthorized},
+		} {
+			req := httptest.NewRequest("GET", "/userinfo", nil)
+			req.Header.Set("Authorization", "Bearer "+tokens.AccessToken)
+			if tt.certs != nil {
+				withClientCert(req, tt.certs...)
+			}
+			rr := httptest.NewRecorder()
+			s.serveUserInfo(rr, req)
+			if rr.Code != tt.wantStatus {
+				t.Errorf("%s: expected status %d, got %d: %s", tt.name, tt.wantStatus, rr.Code, rr.Body.String())
+			}
+		}
+	})
+
+	t.Run("introspect", func(t *testing.T) {
+		introspect := func(clientID string, cert *x509.Certificate) map[string]any {
+			form := url.Values{"token": {tokens.AccessToken}, "client_id": {clientID}}
+			req := httptest.NewRequest("POST", "/introspect", strings.NewReader(form.Encode()))
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			rr := httptest.NewRecorder()
+			s.serveIntrospect(rr, withClientCert(req, cert))
+			var resp map[string]any
+			if err := json.Unmarshal(rr.Body.Bytes(), &resp); err != nil {
+				t.Fatal(err)
+			}
+			return resp
+		}
+
+		resp := introspect(client.ID, rpCert)
+		if resp["active"] != true {
+			t.Fatalf("expected active token, got %v", resp)
+		}
+		cnf, _ := resp["cnf"].(map[string]any)
+		if cnf["x5t#S256"] == "" || cnf["x5t#S256"] == nil {
+			t.Errorf("expected cnf x5t#S256, got %v", resp["cnf"])
+		}
+
+		if resp := introspect("other-client", otherCert); resp["active"] != false {
+			t.Errorf("expected inactive token for another certificate, got %v", resp)
+		}
+	})
+}
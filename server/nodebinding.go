@@ -0,0 +1,55 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package server
+
+import (
+	"net/http"
+
+	"tailscale.com/client/tailscale/apitype"
+	"tailscale.com/tailcfg"
+)
+
+// callerWhoIs returns the WhoIs response for the tailnet node r comes from,
+// or nil if that isn't known, such as for requests through Funnel.
+func (s *IDPServer) callerWhoIs(r *http.Request) *apitype.WhoIsResponse {
+	if s.lc == nil || isFunnelRequest(r) {
+		return nil
+	}
+	remoteAddr := r.RemoteAddr
+	if s.localTSMode {
+		remoteAddr = lastForwardedForAddr(r)
+	}
+	who, err := s.lc.WhoIs(r.Context(), remoteAddr)
+	if err != nil || who.Node == nil {
+		return nil
+	}
+	return who
+}
+
+// callerNodeID returns the ID of the tailnet node r comes from. It reports
+// false if that isn't known, see callerWhoIs.
+func (s *IDPServer) callerNodeID(r *http.Request) (tailcfg.NodeID, bool) {
+	who := s.callerWhoIs(r)
+	if who == nil {
+		return 0, false
+	}
+	return who.Node.ID, true
+}
+
+// nodeBindingMatches reports whether a token bound to the node boundTo may
+// be used by r. Unbound tokens, with a zero boundTo, can be used from
+// anywhere.
+func (s *IDPServer) nodeBindingMatches(r *http.Request, boundTo tailcfg.NodeID) bool {
+	if boundTo == 0 {
+		return true
+	}
+	id, ok := s.callerNodeID(r)
+	return ok && id == boundTo
+}
+
+// bindsTokensToNode reports whether tokens issued to c are bound to the
+// node that requested them.
+func (c *FunnelClient) bindsTokensToNode() bool {
+	return c != nil && c.BindTokensToNode
+}
@@ -0,0 +1,162 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"tailscale.com/client/local"
+	"tailscale.com/client/tailscale/apitype"
+	"tailscale.com/tailcfg"
+)
+
+// newNodeWhoIsClient returns a WhoIs client that reports every caller as
+// the node id.
+func newNodeWhoIsClient(t *testing.T, id tailcfg.NodeID) *local.Client {
+	return newTestWhoIsClient(t, &apitype.WhoIsResponse{
+		Node:        &tailcfg.Node{ID: id, Name: "rp.test.ts.net."},
+		UserProfile: &tailcfg.UserProfile{LoginName: "rp@example.com"},
+		CapMap:      tailcfg.PeerCapMap{},
+	}, false)
+}
+
+// TestNodeBoundTokens tests that the tokens of clients with
+// BindTokensToNode only work from the node that requested them
+func TestNodeBoundTokens(t *testing.T) {
+	s := setupTestServer(t, newNodeWhoIsClient(t, 7))
+	client := s.funnelClients["test-client"]
+	client.RedirectURIs = []string{"https://rp.example.com/callback"}
+	client.BindTokensToNode = true
+	s.code.Set("code", &AuthRequest{
+		ClientID:    client.ID,
+		FunnelRP:    client,
+		RedirectURI: "https://rp.example.com/callback",
+		ValidTill:   time.Now().Add(5 * time.Minute),
+		RemoteUser: &apitype.WhoIsResponse{
+			Node:        &tailcfg.Node{ID: 1, Name: "node.test.ts.net.", User: 1},
+			UserProfile: &tailcfg.UserProfile{LoginName: "user@example.com"},
+			CapMap:      tailcfg.PeerCapMap{},
+		},
+	})
+
+	post := func(path string, handler http.HandlerFunc, form url.Values) *httptest.ResponseRecorder {
+		t.Helper()
+		form.Set("client_id", client.ID)
+		form.Set("client_secret", client.Secret)
+		req := httptest.NewRequest("POST", path, strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		rr := httptest.NewRecorder()
+		handler(rr, req)
+		return rr
+	}
+	userinfo := func(token string) int {
+		req := httptest.NewRequest("GET", "/userinfo", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		rr := httptest.NewRecorder()
+		s.serveUserInfo(rr, req)
+		return rr.Code
+	}
+	introspectActive := func(token string) bool {
+		t.Helper()
+		rr := post("/introspect", s.serveIntrospect, url.Values{"token": {token}})
+		var resp map[string]any
+		if err := json.Unmarshal(rr.Body.Bytes(), &resp); err != nil {
+			t.Fatalf("introspect: %v: %s", err, rr.Body.String())
+		}
+		active, _ := resp["active"].(bool)
+		return active
+	}
+
+	rr := post("/token", s.serveToken, url.Values{
+		"grant_type":   {"authorization_code"},
+		"code":         {"code"},
+		"redirect_uri": {"https://rp.example.com/callback"},
+	})
+	if rr.Code != http.StatusOK {
+		t.Fatalf("token: expected status 200, got %d: %s", rr.Code, rr.Body.String())
+	}
+	var resp oidcTokenResponse
+	if err := json.Unmarshal(rr.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	if ar, _ := s.accessToken.Get(resp.AccessToken); ar.RPNodeID != 7 {
+		t.Fatalf("access token bound to node %v, want 7", ar.RPNodeID)
+	}
+
+	// The requesting node can use the token.
+	if code := userinfo(resp.AccessToken); code != http.StatusOK {
+		t.Errorf("userinfo from the bound node: expected status 200, got %d", code)
+	}
+	if !introspectActive(resp.AccessToken) {
+		t.Error("introspect from the bound node: expected an active token")
+	}
+
+	// Any other node can't.
+	s.lc = newNodeWhoIsClient(t, 8)
+	if code := userinfo(resp.AccessToken); code != http.StatusUnauthorized {
+		t.Errorf("userinfo from another node: expected status 401, got %d", code)
+	}
+	if introspectActive(resp.AccessToken) {
+		t.Error("introspect from another node: expected an inactive token")
+	}
+	rr = post("/token", s.serveTokenExchange, url.Values{
+		"grant_type":         {"urn:ietf:params:oauth:grant-type:token-exchange"},
+		"subject_token":      {resp.AccessToken},
+		"subject_token_type": {"urn:ietf:params:oauth:token-type:access_token"},
+		"audience":           {"https://api.example.com"},
+	})
+	if rr.Code != http.StatusBadRequest || !strings.Contains(rr.Body.String(), "bound to another node") {
+		t.Errorf("token exchange from another node: expected status 400, got %d: %s", rr.Code, rr.Body.String())
+	}
+	rr = post("/token", s.serveToken, url.Values{
+		"grant_type":    {"refresh_token"},
+		"refresh_token": {resp.RefreshToken},
+	})
+	if rr.Code != http.StatusBadRequest {
+		t.Errorf("refresh from another node: expected status 400, got %d: %s", rr.Code, rr.Body.String())
+	}
+}
+
+// TestNodeBoundTokensNeedNode tests that node-bound tokens aren't issued to
+// callers that aren't known tailnet nodes
+func TestNodeBoundTokensNeedNode(t *testing.T) {
+	s := setupTestServer(t, nil)
+	client := s.funnelClients["test-client"]
+	client.RedirectURIs = []string{"https://rp.example.com/callback"}
+	client.BindTokensToNode = true
+	s.code.Set("code", &AuthRequest{
+		ClientID:    client.ID,
+		FunnelRP:    client,
+		RedirectURI: "https://rp.example.com/callback",
+		ValidTill:   time.Now().Add(5 * time.Minute),
+		RemoteUser: &apitype.WhoIsResponse{
+			Node:        &tailcfg.Node{ID: 1, Name: "node.test.ts.net.", User: 1},
+			UserProfile: &tailcfg.UserProfile{LoginName: "user@example.com"},
+		},
+	})
+
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {"code"},
+		"redirect_uri":  {"https://rp.example.com/callback"},
+		"client_id":     {client.ID},
+		"client_secret": {client.Secret},
+	}
+	req := httptest.NewRequest("POST", "/token", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	rr := httptest.NewRecorder()
+	s.serveToken(rr, req)
+	if rr.Code != http.StatusBadRequest {
+		t.Errorf("expected status 400, got %d: %s", rr.Code, rr.Body.String())
+	}
+	if n := tokenCount(s.accessToken); n != 0 {
+		t.Errorf("expected no access tokens, got %d", n)
+	}
+}
@@ -14,46 +14,71 @@ import (
 
 // openIDProviderMetadata is a partial representation of OpenID Provider Metadata.
 type openIDProviderMetadata struct {
-	Issuer                            string              `json:"issuer"`
-	AuthorizationEndpoint             string              `json:"authorization_endpoint,omitempty"`
-	TokenEndpoint                     string              `json:"token_endpoint,omitempty"`
-	UserInfoEndpoint                  string              `json:"userinfo_endpoint,omitempty"`
-	IntrospectionEndpoint             string              `json:"introspection_endpoint,omitempty"`
-	RegistrationEndpoint              string              `json:"registration_endpoint,omitempty"`
-	JWKS_URI                          string              `json:"jwks_uri"`
-	ScopesSupported                   views.Slice[string] `json:"scopes_supported"`
-	ResponseTypesSupported            views.Slice[string] `json:"response_types_supported"`
-	SubjectTypesSupported             views.Slice[string] `json:"subject_types_supported"`
-	ClaimsSupported                   views.Slice[string] `json:"claims_supported"`
-	IDTokenSigningAlgValuesSupported  views.Slice[string] `json:"id_token_signing_alg_values_supported"`
-	GrantTypesSupported               views.Slice[string] `json:"grant_types_supported,omitempty"`
-	TokenEndpointAuthMethodsSupported views.Slice[string] `json:"token_endpoint_auth_methods_supported,omitempty"`
-	CodeChallengeMethodsSupported     views.Slice[string] `json:"code_challenge_methods_supported,omitempty"`
+	Issuer                                     string              `json:"issuer"`
+	AuthorizationEndpoint                      string              `json:"authorization_endpoint,omitempty"`
+	TokenEndpoint                              string              `json:"token_endpoint,omitempty"`
+	UserInfoEndpoint                           string              `json:"userinfo_endpoint,omitempty"`
+	IntrospectionEndpoint                      string              `json:"introspection_endpoint,omitempty"`
+	RevocationEndpoint                         string              `json:"revocation_endpoint,omitempty"`
+	DeviceAuthorizationEndpoint                string              `json:"device_authorization_endpoint,omitempty"`
+	PushedAuthorizationRequestEndpoint         string              `json:"pushed_authorization_request_endpoint,omitempty"`
+	EndSessionEndpoint                         string              `json:"end_session_endpoint,omitempty"`
+	RegistrationEndpoint                       string              `json:"registration_endpoint,omitempty"`
+	JWKS_URI                                   string              `json:"jwks_uri"`
+	ScopesSupported                            views.Slice[string] `json:"scopes_supported"`
+	ResponseTypesSupported                     views.Slice[string] `json:"response_types_supported"`
+	SubjectTypesSupported                      views.Slice[string] `json:"subject_types_supported"`
+	ClaimsSupported                            views.Slice[string] `json:"claims_supported"`
+	IDTokenSigningAlgValuesSupported           views.Slice[string] `json:"id_token_signing_alg_values_supported"`
+	GrantTypesSupported                        views.Slice[string] `json:"grant_types_supported,omitempty"`
+	TokenEndpointAuthMethodsSupported          views.Slice[string] `json:"token_endpoint_auth_methods_supported,omitempty"`
+	TokenEndpointAuthSigningAlgValuesSupported views.Slice[string] `json:"token_endpoint_auth_signing_alg_values_supported,omitempty"`
+	CodeChallengeMethodsSupported              views.Slice[string] `json:"code_challenge_methods_supported,omitempty"`
+	BackchannelLogoutSupported                 bool                `json:"backchannel_logout_supported,omitempty"`
+	BackchannelLogoutSessionSupported          bool                `json:"backchannel_logout_session_supported,omitempty"`
+	TLSClientCertificateBoundAccessTokens      bool                `json:"tls_client_certificate_bound_access_tokens,omitempty"`
+	MTLSEndpointAliases                        map[string]string   `json:"mtls_endpoint_aliases,omitempty"`
+	DPoPSigningAlgValuesSupported              views.Slice[string] `json:"dpop_signing_alg_values_supported,omitempty"`
+	RequestObjectSigningAlgValuesSupported     views.Slice[string] `json:"request_object_signing_alg_values_supported,omitempty"`
+	RequestParameterSupported                  bool                `json:"request_parameter_supported,omitempty"`
+	RequestURIParameterSupported               bool                `json:"request_uri_parameter_supported,omitempty"`
+	RequireRequestURIRegistration              bool                `json:"require_request_uri_registration,omitempty"`
 }
 
 // oauthAuthorizationServerMetadata is a representation of
 // OAuth 2.0 Authorization Server Metadata as defined in RFC 8414.
 type oauthAuthorizationServerMetadata struct {
-	Issuer                             string              `json:"issuer"`
-	AuthorizationEndpoint              string              `json:"authorization_endpoint"`
-	TokenEndpoint                      string              `json:"token_endpoint"`
-	IntrospectionEndpoint              string              `json:"introspection_endpoint,omitempty"`
-	RegistrationEndpoint               string              `json:"registration_endpoint,omitempty"`
-	JWKS_URI                           string              `json:"jwks_uri"`
-	ResponseTypesSupported             views.Slice[string] `json:"response_types_supported"`
-	GrantTypesSupported                views.Slice[string] `json:"grant_types_supported"`
-	ScopesSupported                    views.Slice[string] `json:"scopes_supported,omitempty"`
-	TokenEndpointAuthMethodsSupported  views.Slice[string] `json:"token_endpoint_auth_methods_supported"`
-	AuthorizationDetailsTypesSupported views.Slice[string] `json:"authorization_details_types_supported,omitempty"`
-	ResourceIndicatorsSupported        bool                `json:"resource_indicators_supported,omitempty"`
-	CodeChallengeMethodsSupported      views.Slice[string] `json:"code_challenge_methods_supported,omitempty"`
+	Issuer                                     string              `json:"issuer"`
+	AuthorizationEndpoint                      string              `json:"authorization_endpoint"`
+	TokenEndpoint                              string              `json:"token_endpoint"`
+	IntrospectionEndpoint                      string              `json:"introspection_endpoint,omitempty"`
+	IntrospectionSigningAlgValuesSupported     views.Slice[string] `json:"introspection_signing_alg_values_supported,omitempty"`
+	RevocationEndpoint                         string              `json:"revocation_endpoint,omitempty"`
+	DeviceAuthorizationEndpoint                string              `json:"device_authorization_endpoint,omitempty"`
+	PushedAuthorizationRequestEndpoint         string              `json:"pushed_authorization_request_endpoint,omitempty"`
+	RegistrationEndpoint                       string              `json:"registration_endpoint,omitempty"`
+	JWKS_URI                                   string              `json:"jwks_uri"`
+	ResponseTypesSupported                     views.Slice[string] `json:"response_types_supported"`
+	GrantTypesSupported                        views.Slice[string] `json:"grant_types_supported"`
+	ScopesSupported                            views.Slice[string] `json:"scopes_supported,omitempty"`
+	TokenEndpointAuthMethodsSupported          views.Slice[string] `json:"token_endpoint_auth_methods_supported"`
+	TokenEndpointAuthSigningAlgValuesSupported views.Slice[string] `json:"token_endpoint_auth_signing_alg_values_supported,omitempty"`
+	AuthorizationDetailsTypesSupported         views.Slice[string] `json:"authorization_details_types_supported,omitempty"`
+	ResourceIndicatorsSupported                bool                `json:"resource_indicators_supported,omitempty"`
+	CodeChallengeMethodsSupported              views.Slice[string] `json:"code_challenge_methods_supported,omitempty"`
+	TLSClientCertificateBoundAccessTokens      bool                `json:"tls_client_certificate_bound_access_tokens,omitempty"`
+	MTLSEndpointAliases                        map[string]string   `json:"mtls_endpoint_aliases,omitempty"`
+	DPoPSigningAlgValuesSupported              views.Slice[string] `json:"dpop_signing_alg_values_supported,omitempty"`
+	RequestObjectSigningAlgValuesSupported     views.Slice[string] `json:"request_object_signing_alg_values_supported,omitempty"`
+	RequestParameterSupported                  bool                `json:"request_parameter_supported,omitempty"`
+	RequestURIParameterSupported               bool                `json:"request_uri_parameter_supported,omitempty"`
 }
 
 // Supported OpenID/OAuth metadata constants
 var (
 	openIDSupportedClaims = views.SliceOf([]string{
 		// Standard claims, these correspond to fields in jwt.Claims.
-		"sub", "aud", "exp", "iat", "iss", "jti", "nbf", "username", "email",
+		"sub", "aud", "exp", "iat", "iss", "jti", "nbf", "sid", "username", "email",
 
 		// Tailscale claims, these correspond to fields in tailscaleClaims.
 		"key", "addresses", "nid", "node", "tailnet", "tags", "user", "uid",
@@ -68,12 +93,21 @@ var (
 	// The type of the "sub" field in the JWT, which means it is globally unique identifier.
 	openIDSupportedSubjectTypes = views.SliceOf([]string{"public"})
 
-	// The algo used for signing. The OpenID spec says "The algorithm RS256 MUST be included."
-	openIDSupportedSigningAlgos = views.SliceOf([]string{string(jose.RS256)})
+	// The algos used for signing ID tokens. The OpenID spec says "The algorithm RS256 MUST be included."
+	openIDSupportedSigningAlgos = views.SliceOf([]string{string(jose.RS256), string(jose.ES256), string(jose.EdDSA)})
 
 	// OAuth 2.0 specific metadata constants
-	oauthSupportedGrantTypes               = views.SliceOf([]string{"authorization_code", "refresh_token"})
-	oauthSupportedTokenEndpointAuthMethods = views.SliceOf([]string{"client_secret_post", "client_secret_basic"})
+	oauthSupportedGrantTypes               = views.SliceOf([]string{"authorization_code", "refresh_token", "client_credentials", deviceCodeGrantType})
+	oauthSupportedTokenEndpointAuthMethods = views.SliceOf([]string{"client_secret_post", "client_secret_basic", "private_key_jwt", "tls_client_auth", "self_signed_tls_client_auth", "none"})
+
+	// The algos accepted for private_key_jwt client assertions (RFC 7523).
+	oauthTokenEndpointAuthSigningAlgs = views.SliceOf([]string{string(jose.RS256), string(jose.PS256), string(jose.ES256), string(jose.EdDSA)})
+
+	// The algos accepted for DPoP proofs (RFC 9449).
+	oauthDPoPSigningAlgs = views.SliceOf([]string{string(jose.RS256), string(jose.PS256), string(jose.ES256), string(jose.EdDSA)})
+
+	// The algos accepted for signed request objects (RFC 9101).
+	oauthRequestObjectSigningAlgs = views.SliceOf([]string{string(jose.RS256), string(jose.PS256), string(jose.ES256), string(jose.EdDSA)})
 
 	// PKCE support (RFC 7636)
 	pkceCodeChallengeMethodsSupported = views.SliceOf([]string{"plain", "S256"})
@@ -96,28 +130,46 @@ func (s *IDPServer) serveOpenIDConfig(w http.ResponseWriter, r *http.Request) {
 	je := json.NewEncoder(w)
 	je.SetIndent("", "  ")
 	metadata := openIDProviderMetadata{
-		AuthorizationEndpoint:             s.serverURL + "/authorize",
-		Issuer:                            s.serverURL,
-		JWKS_URI:                          s.serverURL + "/.well-known/jwks.json",
-		UserInfoEndpoint:                  s.serverURL + "/userinfo",
-		TokenEndpoint:                     s.serverURL + "/token",
-		IntrospectionEndpoint:             s.serverURL + "/introspect",
-		ScopesSupported:                   openIDSupportedScopes,
-		ResponseTypesSupported:            openIDSupportedReponseTypes,
-		SubjectTypesSupported:             openIDSupportedSubjectTypes,
-		ClaimsSupported:                   openIDSupportedClaims,
-		IDTokenSigningAlgValuesSupported:  openIDSupportedSigningAlgos,
-		CodeChallengeMethodsSupported:     pkceCodeChallengeMethodsSupported,
-		TokenEndpointAuthMethodsSupported: oauthSupportedTokenEndpointAuthMethods,
+		AuthorizationEndpoint:                      s.serverURL + "/authorize",
+		Issuer:                                     s.serverURL,
+		JWKS_URI:                                   s.serverURL + "/.well-known/jwks.json",
+		UserInfoEndpoint:                           s.serverURL + "/userinfo",
+		TokenEndpoint:                              s.serverURL + "/token",
+		IntrospectionEndpoint:                      s.serverURL + "/introspect",
+		RevocationEndpoint:                         s.serverURL + "/revoke",
+		DeviceAuthorizationEndpoint:                s.serverURL + "/device_authorization",
+		PushedAuthorizationRequestEndpoint:         s.serverURL + "/par",
+		EndSessionEndpoint:                         s.serverURL + "/end_session",
+		ScopesSupported:                            openIDSupportedScopes,
+		ResponseTypesSupported:                     openIDSupportedReponseTypes,
+		SubjectTypesSupported:                      openIDSupportedSubjectTypes,
+		ClaimsSupported:                            openIDSupportedClaims,
+		IDTokenSigningAlgValuesSupported:           openIDSupportedSigningAlgos,
+		CodeChallengeMethodsSupported:              pkceCodeChallengeMethodsSupported,
+		TokenEndpointAuthMethodsSupported:          oauthSupportedTokenEndpointAuthMethods,
+		TokenEndpointAuthSigningAlgValuesSupported: oauthTokenEndpointAuthSigningAlgs,
+		DPoPSigningAlgValuesSupported:              oauthDPoPSigningAlgs,
+		RequestObjectSigningAlgValuesSupported:     oauthRequestObjectSigningAlgs,
+		RequestParameterSupported:                  true,
+		RequestURIParameterSupported:               true,
+		RequireRequestURIRegistration:              true,
+		BackchannelLogoutSupported:                 true,
+		BackchannelLogoutSessionSupported:          true,
 	}
 
 	// Add grant types supported
-	grantTypes := []string{"authorization_code", "refresh_token"}
+	grantTypes := oauthSupportedGrantTypes.AsSlice()
 	if s.enableSTS {
 		grantTypes = append(grantTypes, "urn:ietf:params:oauth:grant-type:token-exchange")
 	}
 	metadata.GrantTypesSupported = views.SliceOf(grantTypes)
 
+	// RFC 8705: certificate-bound tokens need the mTLS listener
+	if s.mtlsURL != "" {
+		metadata.TLSClientCertificateBoundAccessTokens = true
+		metadata.MTLSEndpointAliases = s.mtlsEndpointAliases()
+	}
+
 	// Only expose registration endpoint over tailnet, not funnel
 	if !isFunnelRequest(r) {
 		metadata.RegistrationEndpoint = s.serverURL + "/register"
@@ -146,24 +198,39 @@ func (s *IDPServer) serveOAuthMetadata(w http.ResponseWriter, r *http.Request) {
 	je.SetIndent("", "  ")
 
 	// Build grant types list
-	grantTypes := []string{"authorization_code", "refresh_token"}
+	grantTypes := oauthSupportedGrantTypes.AsSlice()
 	if s.enableSTS {
 		grantTypes = append(grantTypes, "urn:ietf:params:oauth:grant-type:token-exchange")
 	}
 
 	metadata := oauthAuthorizationServerMetadata{
-		Issuer:                             s.serverURL,
-		AuthorizationEndpoint:              s.serverURL + "/authorize",
-		TokenEndpoint:                      s.serverURL + "/token",
-		IntrospectionEndpoint:              s.serverURL + "/introspect",
-		JWKS_URI:                           s.serverURL + "/.well-known/jwks.json",
-		ResponseTypesSupported:             openIDSupportedReponseTypes,
-		GrantTypesSupported:                views.SliceOf(grantTypes),
-		ScopesSupported:                    openIDSupportedScopes,
-		TokenEndpointAuthMethodsSupported:  oauthSupportedTokenEndpointAuthMethods,
-		ResourceIndicatorsSupported:        true, // RFC 8707 support
-		AuthorizationDetailsTypesSupported: views.SliceOf([]string{"resource_indicators"}),
-		CodeChallengeMethodsSupported:      pkceCodeChallengeMethodsSupported,
+		Issuer:                                     s.serverURL,
+		AuthorizationEndpoint:                      s.serverURL + "/authorize",
+		TokenEndpoint:                              s.serverURL + "/token",
+		IntrospectionEndpoint:                      s.serverURL + "/introspect",
+		IntrospectionSigningAlgValuesSupported:     openIDSupportedSigningAlgos,
+		RevocationEndpoint:                         s.serverURL + "/revoke",
+		DeviceAuthorizationEndpoint:                s.serverURL + "/device_authorization",
+		PushedAuthorizationRequestEndpoint:         s.serverURL + "/par",
+		JWKS_URI:                                   s.serverURL + "/.well-known/jwks.json",
+		ResponseTypesSupported:                     openIDSupportedReponseTypes,
+		GrantTypesSupported:                        views.SliceOf(grantTypes),
+		ScopesSupported:                            openIDSupportedScopes,
+		TokenEndpointAuthMethodsSupported:          oauthSupportedTokenEndpointAuthMethods,
+		TokenEndpointAuthSigningAlgValuesSupported: oauthTokenEndpointAuthSigningAlgs,
+		DPoPSigningAlgValuesSupported:              oauthDPoPSigningAlgs,
+		RequestObjectSigningAlgValuesSupported:     oauthRequestObjectSigningAlgs,
+		RequestParameterSupported:                  true,
+		RequestURIParameterSupported:               true,
+		ResourceIndicatorsSupported:                true, // RFC 8707 support
+		AuthorizationDetailsTypesSupported:         views.SliceOf([]string{"resource_indicators"}),
+		CodeChallengeMethodsSupported:              pkceCodeChallengeMethodsSupported,
+	}
+
+	// RFC 8705: certificate-bound tokens need the mTLS listener
+	if s.mtlsURL != "" {
+		metadata.TLSClientCertificateBoundAccessTokens = true
+		metadata.MTLSEndpointAliases = s.mtlsEndpointAliases()
 	}
 
 	// Only expose registration endpoint over tailnet, not funnel
@@ -190,25 +257,27 @@ func (s *IDPServer) serveJWKS(w http.ResponseWriter, r *http.Request) {
 	}
 
 	w.Header().Set("Content-Type", "application/json")
-	sk, err := s.oidcPrivateKey()
+	keys, err := s.publishedSigningKeys()
 	if err != nil {
 		writeHTTPError(w, r, http.StatusInternalServerError, ecServerError, "internal server error", err)
 		return
 	}
+
+	// Publish pending and retired keys alongside the active one, so that
+	// relying parties can verify tokens across a key rotation.
 	// TODO(maisem): maybe only marshal this once and reuse?
-	// TODO(maisem): implement key rotation.
+	jwks := jose.JSONWebKeySet{Keys: make([]jose.JSONWebKey, 0, len(keys))}
+	for _, sk := range keys {
+		jwks.Keys = append(jwks.Keys, jose.JSONWebKey{
+			Key:       sk.Key.Public(),
+			Algorithm: string(sk.Alg),
+			Use:       "sig",
+			KeyID:     fmt.Sprint(sk.Kid),
+		})
+	}
 	je := json.NewEncoder(w)
 	je.SetIndent("", "  ")
-	if err := je.Encode(jose.JSONWebKeySet{
-		Keys: []jose.JSONWebKey{
-			{
-				Key:       sk.Key.Public(),
-				Algorithm: string(jose.RS256),
-				Use:       "sig",
-				KeyID:     fmt.Sprint(sk.Kid),
-			},
-		},
-	}); err != nil {
+	if err := je.Encode(jwks); err != nil {
 		writeHTTPError(w, r, http.StatusInternalServerError, ecServerError, "internal server error", err)
 	}
 }
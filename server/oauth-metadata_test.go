@@ -5,6 +5,7 @@ package server
 
 import (
 	"encoding/json"
+	"fmt"
 	"net/http"
 	"net/http/httptest"
 	"strings"
@@ -85,11 +86,14 @@ func TestMetadataEndpoints(t *testing.T) {
 				"authorization_endpoint",
 				"token_endpoint",
 				"jwks_uri",
+				"revocation_endpoint",
+				"device_authorization_endpoint",
+				"pushed_authorization_request_endpoint",
 			}
 
 			// OpenID specific endpoints
 			if strings.Contains(tt.endpoint, "openid") {
-				expectedEndpoints = append(expectedEndpoints, "userinfo_endpoint")
+				expectedEndpoints = append(expectedEndpoints, "userinfo_endpoint", "end_session_endpoint")
 			}
 
 			for _, ep := range expectedEndpoints {
@@ -98,6 +102,25 @@ func TestMetadataEndpoints(t *testing.T) {
 				}
 			}
 
+			// Request objects (RFC 9101) are supported at both endpoints.
+			for _, k := range []string{"request_parameter_supported", "request_uri_parameter_supported"} {
+				if metadata[k] != true {
+					t.Errorf("%s = %v, want true", k, metadata[k])
+				}
+			}
+
+			if strings.Contains(tt.endpoint, "openid") {
+				algs, _ := metadata["id_token_signing_alg_values_supported"].([]any)
+				if fmt.Sprint(algs) != "[RS256 ES256 EdDSA]" {
+					t.Errorf("id_token_signing_alg_values_supported = %v, want [RS256 ES256 EdDSA]", algs)
+				}
+				for _, k := range []string{"backchannel_logout_supported", "backchannel_logout_session_supported"} {
+					if metadata[k] != true {
+						t.Errorf("%s = %v, want true", k, metadata[k])
+					}
+				}
+			}
+
 			// Check registration endpoint based on funnel status
 			if tt.expectRegURL {
 				if _, ok := metadata["registration_endpoint"]; !ok {
@@ -140,15 +163,17 @@ func TestOAuthMetadataRefreshTokenSupport(t *testing.T) {
 		t.Fatal("grant_types_supported not found or wrong type")
 	}
 
-	found := false
-	for _, gt := range grantTypes {
-		if gtStr, ok := gt.(string); ok && gtStr == "refresh_token" {
-			found = true
-			break
+	for _, want := range []string{"refresh_token", "client_credentials", deviceCodeGrantType} {
+		found := false
+		for _, gt := range grantTypes {
+			if gtStr, ok := gt.(string); ok && gtStr == want {
+				found = true
+				break
+			}
+		}
+		if !found {
+			t.Errorf("expected %s in grant_types_supported", want)
 		}
-	}
-	if !found {
-		t.Error("expected refresh_token in grant_types_supported")
 	}
 }
 
@@ -298,6 +323,35 @@ func TestTokenEndpointAuthMethods(t *testing.T) {
 			if !methodSet["client_secret_post"] {
 				t.Error("expected client_secret_post in token_endpoint_auth_methods_supported")
 			}
+			if !methodSet["none"] {
+				t.Error("expected none in token_endpoint_auth_methods_supported")
+			}
+			if !methodSet["private_key_jwt"] {
+				t.Error("expected private_key_jwt in token_endpoint_auth_methods_supported")
+			}
+			for _, m := range []string{"tls_client_auth", "self_signed_tls_client_auth"} {
+				if !methodSet[m] {
+					t.Errorf("expected %s in token_endpoint_auth_methods_supported", m)
+				}
+			}
+			algs, _ := metadata["token_endpoint_auth_signing_alg_values_supported"].([]any)
+			if fmt.Sprint(algs) != "[RS256 PS256 ES256 EdDSA]" {
+				t.Errorf("token_endpoint_auth_signing_alg_values_supported = %v", algs)
+			}
+			dpopAlgs, _ := metadata["dpop_signing_alg_values_supported"].([]any)
+			if fmt.Sprint(dpopAlgs) != "[RS256 PS256 ES256 EdDSA]" {
+				t.Errorf("dpop_signing_alg_values_supported = %v", dpopAlgs)
+			}
+			requestAlgs, _ := metadata["request_object_signing_alg_values_supported"].([]any)
+			if fmt.Sprint(requestAlgs) != "[RS256 PS256 ES256 EdDSA]" {
+				t.Errorf("request_object_signing_alg_values_supported = %v", requestAlgs)
+			}
+			if tt.endpoint == "/.well-known/oauth-authorization-server" {
+				introspectionAlgs, _ := metadata["introspection_signing_alg_values_supported"].([]any)
+				if fmt.Sprint(introspectionAlgs) != "[RS256 ES256 EdDSA]" {
+					t.Errorf("introspection_signing_alg_values_supported = %v", introspectionAlgs)
+				}
+			}
 		})
 	}
 }
@@ -368,6 +422,43 @@ func TestMetadataSTSSupport(t *testing.T) {
 	}
 }
 
+// TestMetadataMTLS tests that mTLS endpoint aliases and certificate-bound
+// tokens are only advertised when the mTLS listener is configured
+func TestMetadataMTLS(t *testing.T) {
+	for _, mtlsPort := range []int{0, 8443} {
+		s := &IDPServer{serverURL: "https://idp.test.ts.net"}
+		if mtlsPort != 0 {
+			s.SetMTLSURL("idp.test.ts.net", mtlsPort)
+		}
+		for _, serveFn := range []http.HandlerFunc{s.serveOpenIDConfig, s.serveOAuthMetadata} {
+			req := httptest.NewRequest("GET", "/.well-known/openid-configuration", nil)
+			req.RemoteAddr = "127.0.0.1:12345"
+			rr := httptest.NewRecorder()
+			serveFn(rr, req)
+
+			var metadata struct {
+				BoundTokens bool              `json:"tls_client_certificate_bound_access_tokens"`
+				Aliases     map[string]string `json:"mtls_endpoint_aliases"`
+			}
+			if err := json.Unmarshal(rr.Body.Bytes(), &metadata); err != nil {
+				t.Fatalf("failed to unmarshal metadata: %v", err)
+			}
+			if mtlsPort == 0 {
+				if metadata.BoundTokens || metadata.Aliases != nil {
+					t.Errorf("mTLS advertised without an mTLS listener: %s", rr.Body.String())
+				}
+				continue
+			}
+			if !metadata.BoundTokens {
+				t.Error("expected tls_client_certificate_bound_access_tokens")
+			}
+			if got, want := metadata.Aliases["token_endpoint"], "https://idp.test.ts.net:8443/token"; got != want {
+				t.Errorf("mtls_endpoint_aliases token_endpoint = %q, want %q", got, want)
+			}
+		}
+	}
+}
+
 // TestJWKSEndpoint tests the JWKS endpoint
 func TestJWKSEndpoint(t *testing.T) {
 	s := &IDPServer{
@@ -403,33 +494,45 @@ func TestJWKSEndpoint(t *testing.T) {
 		t.Fatal("keys not found in JWKS or wrong type")
 	}
 
-	if len(keys) != 1 {
-		t.Errorf("expected 1 key in JWKS, got %d", len(keys))
+	if len(keys) != len(signingAlgs) {
+		t.Errorf("expected %d keys in JWKS, got %d", len(signingAlgs), len(keys))
 	}
 
-	// Check the key has required fields
-	if len(keys) > 0 {
-		key, ok := keys[0].(map[string]any)
+	// Check each key has the required fields for its algorithm
+	wantFields := map[string][]string{
+		"RS256": {"kty", "use", "kid", "n", "e"},
+		"ES256": {"kty", "use", "kid", "crv", "x", "y"},
+		"EdDSA": {"kty", "use", "kid", "crv", "x"},
+	}
+	wantKty := map[string]string{"RS256": "RSA", "ES256": "EC", "EdDSA": "OKP"}
+	for _, k := range keys {
+		key, ok := k.(map[string]any)
 		if !ok {
 			t.Fatal("key is not a map")
 		}
 
-		requiredFields := []string{"kty", "use", "kid", "n", "e"}
+		alg, _ := key["alg"].(string)
+		requiredFields, ok := wantFields[alg]
+		if !ok {
+			t.Errorf("unexpected alg %q in JWK", alg)
+			continue
+		}
 		for _, field := range requiredFields {
 			if _, ok := key[field]; !ok {
-				t.Errorf("missing required field %s in JWK", field)
+				t.Errorf("missing required field %s in %s JWK", field, alg)
 			}
 		}
 
 		// Check specific values
-		if kty, ok := key["kty"].(string); !ok || kty != "RSA" {
-			t.Error("expected kty to be RSA")
+		if kty, ok := key["kty"].(string); !ok || kty != wantKty[alg] {
+			t.Errorf("expected kty of %s key to be %s, got %v", alg, wantKty[alg], key["kty"])
 		}
 		if use, ok := key["use"].(string); !ok || use != "sig" {
 			t.Error("expected use to be sig")
 		}
 	}
 }
+
 func TestMetadataCORSHeaders(t *testing.T) {
 	s := &IDPServer{
 		serverURL:   "https://idp.test.ts.net",
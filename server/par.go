@@ -0,0 +1,110 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"tailscale.com/util/rands"
+)
+
+const (
+	// parRequestURIPrefix is the prefix of the request_uri values handed out
+	// by the pushed authorization request endpoint (RFC 9126 Section 2.2).
+	parRequestURIPrefix = "urn:ietf:params:oauth:request_uri:"
+
+	// parRequestLifetime is how long a pushed authorization request can be
+	// used at /authorize.
+	parRequestLifetime = 60 * time.Second
+)
+
+// pushedAuthRequest is an authorization request pushed to /par.
+type pushedAuthRequest struct {
+	ar    *AuthRequest // ValidTill is when the request_uri expires
+	state string
+}
+
+// servePushedAuthorizationRequest implements the pushed authorization
+// request endpoint (RFC 9126). The client authenticates as it would at the
+// token endpoint and posts the parameters of an authorization request,
+// which are validated like at /authorize. It gets back a request_uri that
+// it sends the user to /authorize with instead of the parameters.
+func (s *IDPServer) servePushedAuthorizationRequest(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		writeHTTPError(w, r, http.StatusMethodNotAllowed, ecInvalidRequest, "method not allowed", nil)
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		writeHTTPError(w, r, http.StatusBadRequest, ecInvalidRequest, "failed to parse form", err)
+		return
+	}
+	if r.PostForm.Has("request_uri") {
+		writeHTTPError(w, r, http.StatusBadRequest, ecInvalidRequest, "request_uri can't be pushed", nil)
+		return
+	}
+
+	// Public clients only identify themselves, like at the token endpoint.
+	client, err := s.identifyFunnelClient(r)
+	if err != nil {
+		writeHTTPError(w, r, http.StatusUnauthorized, ecInvalidClient, "client authentication failed", err)
+		return
+	}
+	if id := r.PostForm.Get("client_id"); id != "" && id != client.ID {
+		writeHTTPError(w, r, http.StatusBadRequest, ecInvalidRequest, "client_id does not match the authenticated client", nil)
+		return
+	}
+
+	params := r.PostForm
+	params.Set("client_id", client.ID)
+	ar, state, aerr := s.resolveAuthorizeRequest(r.Context(), params)
+	if aerr != nil {
+		writeHTTPError(w, r, http.StatusBadRequest, aerr.code, aerr.description, aerr.err)
+		return
+	}
+	ar.ValidTill = time.Now().Add(parRequestLifetime)
+
+	requestURI := parRequestURIPrefix + rands.HexString(32)
+	s.mu.Lock()
+	if s.pushedAuthRequests == nil {
+		s.pushedAuthRequests = make(map[string]*pushedAuthRequest)
+	}
+	s.pushedAuthRequests[requestURI] = &pushedAuthRequest{ar: ar, state: state}
+	s.mu.Unlock()
+
+	slog.Debug("authorization request pushed", slog.String("client_id", client.ID))
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusCreated)
+	if err := json.NewEncoder(w).Encode(map[string]any{
+		"request_uri": requestURI,
+		"expires_in":  int(parRequestLifetime.Seconds()),
+	}); err != nil {
+		slog.Error("failed to encode PAR response", slog.Any("error", err))
+	}
+}
+
+// takePushedAuthRequest returns the AuthRequest and state pushed by
+// clientID as requestURI. Each request_uri can only be used once.
+func (s *IDPServer) takePushedAuthRequest(requestURI, clientID string) (*AuthRequest, string, error) {
+	if !strings.HasPrefix(requestURI, parRequestURIPrefix) {
+		return nil, "", fmt.Errorf("tsidp: unknown request_uri %q", requestURI)
+	}
+	s.mu.Lock()
+	par, ok := s.pushedAuthRequests[requestURI]
+	delete(s.pushedAuthRequests, requestURI)
+	s.mu.Unlock()
+	if !ok || time.Now().After(par.ar.ValidTill) {
+		return nil, "", fmt.Errorf("tsidp: unknown or expired request_uri")
+	}
+	if clientID != par.ar.ClientID {
+		return nil, "", fmt.Errorf("tsidp: request_uri was pushed by another client")
+	}
+	return par.ar, par.state, nil
+}
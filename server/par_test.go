@@ -0,0 +1,242 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"tailscale.com/client/tailscale/apitype"
+	"tailscale.com/tailcfg"
+)
+
+// newPARTestServer returns a test server with a confidential client that
+// requires pushed authorization requests and a public client.
+func newPARTestServer(t *testing.T) *IDPServer {
+	t.Helper()
+	who := &apitype.WhoIsResponse{
+		Node:        &tailcfg.Node{ID: 1, Name: "node1.example.ts.net", User: tailcfg.UserID(1)},
+		UserProfile: &tailcfg.UserProfile{LoginName: "user@example.com"},
+		CapMap:      tailcfg.PeerCapMap{},
+	}
+	s := setupTestServer(t, newTestWhoIsClient(t, who, false))
+	s.funnelClients["par-client"] = &FunnelClient{
+		ID:           "par-client",
+		Secret:       "par-secret",
+		RedirectURIs: []string{"https://rp.example.com/callback"},
+		RequirePAR:   true,
+	}
+	s.funnelClients["public-client"] = &FunnelClient{
+		ID:                      "public-client",
+		RedirectURIs:            []string{"http://127.0.0.1:33418/callback"},
+		TokenEndpointAuthMethod: "none",
+	}
+	return s
+}
+
+// pushAuthRequest posts form to /par and returns the response.
+func pushAuthRequest(s *IDPServer, form url.Values) *httptest.ResponseRecorder {
+	req := httptest.NewRequest("POST", "/par", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	rr := httptest.NewRecorder()
+	s.servePushedAuthorizationRequest(rr, req)
+	return rr
+}
+
+// authorizeWithQuery visits /authorize with query and returns the response.
+func authorizeWithQuery(s *IDPServer, query url.Values) *httptest.ResponseRecorder {
+	req := httptest.NewRequest("GET", "/authorize?"+query.Encode(), nil)
+	req.RemoteAddr = "100.64.0.1:12345"
+	rr := httptest.NewRecorder()
+	s.serveAuthorize(rr, req)
+	return rr
+}
+
+// TestPushedAuthorizationRequest tests the PAR flow from pushing the
+// request to getting a code at /authorize
+func TestPushedAuthorizationRequest(t *testing.T) {
+	s := newPARTestServer(t)
+
+	rr := pushAuthRequest(s, url.Values{
+		"client_id":             {"par-client"},
+		"client_secret":         {"par-secret"},
+		"redirect_uri":          {"https://rp.example.com/callback"},
+		"scope":                 {"openid email"},
+		"state":                 {"pushed-state"},
+		"nonce":                 {"pushed-nonce"},
+		"code_challenge":        {"E9Melhoa2OwvFrEMTJguCHaoeK1t8URWbuGJSstw-cM"},
+		"code_challenge_method": {"S256"},
+	})
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("par: expected status 201, got %d: %s", rr.Code, rr.Body.String())
+	}
+	var resp struct {
+		RequestURI string `json:"request_uri"`
+		ExpiresIn  int    `json:"expires_in"`
+	}
+	if err := json.Unmarshal(rr.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(resp.RequestURI, parRequestURIPrefix) || resp.ExpiresIn != 60 {
+		t.Fatalf("unexpected PAR response: %s", rr.Body.String())
+	}
+
+	// Other clients can't use the request_uri.
+	rr = authorizeWithQuery(s, url.Values{"client_id": {"public-client"}, "request_uri": {resp.RequestURI}})
+	if rr.Code != http.StatusBadRequest {
+		t.Errorf("request_uri of another client: expected status 400, got %d", rr.Code)
+	}
+
+	// That attempt used up the request_uri, so push again.
+	rr = pushAuthRequest(s, url.Values{
+		"client_id":     {"par-client"},
+		"client_secret": {"par-secret"},
+		"redirect_uri":  {"https://rp.example.com/callback"},
+		"state":         {"pushed-state"},
+		"nonce":         {"pushed-nonce"},
+	})
+	if err := json.Unmarshal(rr.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+
+	// Parameters in the query are ignored in favor of the pushed ones.
+	rr = authorizeWithQuery(s, url.Values{
+		"client_id":    {"par-client"},
+		"request_uri":  {resp.RequestURI},
+		"redirect_uri": {"https://evil.example.com/callback"},
+		"state":        {"query-state"},
+	})
+	if rr.Code != http.StatusFound {
+		t.Fatalf("authorize: expected redirect, got %d: %s", rr.Code, rr.Body.String())
+	}
+	loc, err := url.Parse(rr.Header().Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loc.Host != "rp.example.com" || loc.Query().Get("state") != "pushed-state" {
+		t.Errorf("unexpected redirect %s", loc)
+	}
+	ar, ok := s.code.Get(loc.Query().Get("code"))
+	if !ok {
+		t.Fatal("code not stored")
+	}
+	if ar.Nonce != "pushed-nonce" || ar.RemoteUser == nil {
+		t.Errorf("unexpected auth request: %+v", ar)
+	}
+	if d := time.Until(ar.ValidTill); d <= 0 || d > authorizationCodeDuration {
+		t.Errorf("code valid for %v, want up to %v", d, authorizationCodeDuration)
+	}
+
+	// Each request_uri can only be used once.
+	rr = authorizeWithQuery(s, url.Values{"client_id": {"par-client"}, "request_uri": {resp.RequestURI}})
+	if rr.Code != http.StatusBadRequest {
+		t.Errorf("reused request_uri: expected status 400, got %d", rr.Code)
+	}
+}
+
+// TestPushedAuthorizationRequestErrors tests the requests rejected at /par
+// and /authorize
+func TestPushedAuthorizationRequestErrors(t *testing.T) {
+	t.Run("bad client secret", func(t *testing.T) {
+		s := newPARTestServer(t)
+		rr := pushAuthRequest(s, url.Values{
+			"client_id":     {"par-client"},
+			"client_secret": {"wrong"},
+			"redirect_uri":  {"https://rp.example.com/callback"},
+		})
+		if rr.Code != http.StatusUnauthorized {
+			t.Errorf("expected status 401, got %d: %s", rr.Code, rr.Body.String())
+		}
+	})
+
+	t.Run("invalid redirect_uri", func(t *testing.T) {
+		s := newPARTestServer(t)
+		rr := pushAuthRequest(s, url.Values{
+			"client_id":     {"par-client"},
+			"client_secret": {"par-secret"},
+			"redirect_uri":  {"https://evil.example.com/callback"},
+		})
+		if rr.Code != http.StatusBadRequest {
+			t.Errorf("expected status 400, got %d: %s", rr.Code, rr.Body.String())
+		}
+	})
+
+	t.Run("request_uri pushed", func(t *testing.T) {
+		s := newPARTestServer(t)
+		rr := pushAuthRequest(s, url.Values{
+			"client_id":     {"par-client"},
+			"client_secret": {"par-secret"},
+			"redirect_uri":  {"https://rp.example.com/callback"},
+			"request_uri":   {parRequestURIPrefix + "abc"},
+		})
+		if rr.Code != http.StatusBadRequest {
+			t.Errorf("expected status 400, got %d: %s", rr.Code, rr.Body.String())
+		}
+	})
+
+	t.Run("public client without PKCE", func(t *testing.T) {
+		s := newPARTestServer(t)
+		rr := pushAuthRequest(s, url.Values{
+			"client_id":    {"public-client"},
+			"redirect_uri": {"http://127.0.0.1:33418/callback"},
+		})
+		if rr.Code != http.StatusBadRequest || !strings.Contains(rr.Body.String(), ecInvalidRequest) {
+			t.Errorf("expected invalid_request, got %d: %s", rr.Code, rr.Body.String())
+		}
+	})
+
+	t.Run("public client with PKCE", func(t *testing.T) {
+		s := newPARTestServer(t)
+		rr := pushAuthRequest(s, url.Values{
+			"client_id":             {"public-client"},
+			"redirect_uri":          {"http://127.0.0.1:33418/callback"},
+			"code_challenge":        {"E9Melhoa2OwvFrEMTJguCHaoeK1t8URWbuGJSstw-cM"},
+			"code_challenge_method": {"S256"},
+		})
+		if rr.Code != http.StatusCreated {
+			t.Errorf("expected status 201, got %d: %s", rr.Code, rr.Body.String())
+		}
+	})
+
+	t.Run("expired request_uri", func(t *testing.T) {
+		s := newPARTestServer(t)
+		const requestURI = parRequestURIPrefix + "expired"
+		s.pushedAuthRequests = map[string]*pushedAuthRequest{
+			requestURI: {ar: &AuthRequest{
+				ClientID:    "par-client",
+				RedirectURI: "https://rp.example.com/callback",
+				FunnelRP:    s.funnelClients["par-client"],
+				ValidTill:   time.Now().Add(-time.Second),
+			}},
+		}
+		rr := authorizeWithQuery(s, url.Values{"client_id": {"par-client"}, "request_uri": {requestURI}})
+		if rr.Code != http.StatusBadRequest {
+			t.Errorf("expected status 400, got %d", rr.Code)
+		}
+	})
+
+	t.Run("PAR required", func(t *testing.T) {
+		s := newPARTestServer(t)
+		rr := authorizeWithQuery(s, url.Values{
+			"client_id":    {"par-client"},
+			"redirect_uri": {"https://rp.example.com/callback"},
+		})
+		if rr.Code != http.StatusFound {
+			t.Fatalf("expected redirect, got %d: %s", rr.Code, rr.Body.String())
+		}
+		loc, err := url.Parse(rr.Header().Get("Location"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := loc.Query().Get("error"); got != ecInvalidRequest {
+			t.Errorf("expected error %q, got %q", ecInvalidRequest, got)
+		}
+	})
+}
@@ -0,0 +1,225 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/square/go-jose.v2"
+	"gopkg.in/square/go-jose.v2/jwt"
+	"tailscale.com/types/views"
+)
+
+const (
+	// requestObjectMaxLifetime bounds how far in the future the exp of a
+	// request object may be.
+	requestObjectMaxLifetime = time.Hour
+
+	// maxRequestObjectSize is the maximum size of a request object fetched
+	// from a request_uri.
+	maxRequestObjectSize = 64 << 10
+)
+
+// requestObjectClaims are the JWT claims of a request object that are not
+// authorization request parameters.
+var requestObjectClaims = []string{"iss", "aud", "exp", "nbf", "iat", "jti"}
+
+// resolveAuthorizeRequest validates the authorization request q, sent to
+// /authorize or pushed to /par, like parseAuthorizeRequest. If q passes a
+// request object by value or by reference, only the parameters in the
+// request object are used (RFC 9101 Section 6.3).
+func (s *IDPServer) resolveAuthorizeRequest(ctx context.Context, q url.Values) (*AuthRequest, string, *authorizeError) {
+	params, signed, aerr := s.requestObjectParams(ctx, q)
+	if aerr != nil {
+		return nil, q.Get("state"), aerr
+	}
+	ar, state, aerr := s.parseAuthorizeRequest(params)
+	if aerr != nil {
+		return nil, state, aerr
+	}
+	if ar.FunnelRP.RequireSignedRequestObject && !signed {
+		return nil, state, &authorizeError{code: ecInvalidRequest, description: "client requires a signed request object", redirectURI: ar.RedirectURI}
+	}
+	return ar, state, nil
+}
+
+// requestObjectParams returns the parameters of the authorization request
+// q and whether they come from a signed request object. A request object is
+// passed by value in the request parameter or by reference in request_uri,
+// which must be one of the request_uris the client registered.
+func (s *IDPServer) requestObjectParams(ctx context.Context, q url.Values) (url.Values, bool, *authorizeError) {
+	request, requestURI := q.Get("request"), q.Get("request_uri")
+	if request == "" && requestURI == "" {
+		return q, false, nil
+	}
+	if request != "" && requestURI != "" {
+		return nil, false, &authorizeError{code: ecInvalidRequest, description: "request and request_uri are mutually exclusive"}
+	}
+
+	// client_id must also be sent outside the request object, to know
+	// which keys it is signed with (RFC 9101 Section 5).
+	clientID := q.Get("client_id")
+	if clientID == "" {
+		return nil, false, &authorizeError{code: ecInvalidRequest, description: "must specify client_id"}
+	}
+	s.mu.Lock()
+	client, ok := s.funnelClients[clientID]
+	s.mu.Unlock()
+	if !ok {
+		return nil, false, &authorizeError{code: ecInvalidClient, description: "invalid client ID"}
+	}
+
+	if requestURI != "" {
+		var err error
+		request, err = s.fetchRequestObject(ctx, client, requestURI)
+		if err != nil {
+			return nil, false, &authorizeError{code: ecInvalidRequestURI, description: "failed to fetch request object", err: err}
+		}
+	}
+	params, err := s.verifyRequestObject(ctx, client, request)
+	if err != nil {
+		return nil, false, &authorizeError{code: ecInvalidRequestObject, description: "invalid request object", err: err}
+	}
+	return params, true, nil
+}
+
+// verifyRequestObject verifies the request object request (RFC 9101
+// Section 6) and returns the authorization request parameters it carries.
+// The request object must be signed with one of the keys client registered,
+// be issued by the client and be addressed to tsidp.
+func (s *IDPServer) verifyRequestObject(ctx context.Context, client *FunnelClient, request string) (url.Values, error) {
+	tok, err := jwt.ParseSigned(request)
+	if err != nil {
+		return nil, fmt.Errorf("tsidp: invalid request object: %w", err)
+	}
+	if len(tok.Headers) != 1 {
+		return nil, fmt.Errorf("tsidp: request object must have one signature")
+	}
+	header := tok.Headers[0]
+	if !views.SliceContains(oauthRequestObjectSigningAlgs, header.Algorithm) {
+		return nil, fmt.Errorf("tsidp: unsupported request object algorithm %q", header.Algorithm)
+	}
+	// Keep other JWTs of the client, such as client assertions, from being
+	// used as request objects (RFC 9101 Section 10.8).
+	if typ, _ := header.ExtraHeaders[jose.HeaderType].(string); typ != "" && typ != "oauth-authz-req+jwt" && typ != "JWT" {
+		return nil, fmt.Errorf("tsidp: request object has typ %q", typ)
+	}
+
+	var (
+		claims jwt.Claims
+		raw    map[string]any
+	)
+	if err := s.verifyClientSignature(ctx, client, tok, &claims, &raw); err != nil {
+		return nil, fmt.Errorf("tsidp: request object: %w", err)
+	}
+
+	if claims.Issuer != client.ID {
+		return nil, fmt.Errorf("tsidp: request object iss must be the client ID")
+	}
+	if !claims.Audience.Contains(s.serverURL) {
+		return nil, fmt.Errorf("tsidp: request object audience %v does not include %s", claims.Audience, s.serverURL)
+	}
+	now := time.Now()
+	if claims.Expiry == nil {
+		return nil, fmt.Errorf("tsidp: request object has no exp")
+	}
+	if err := claims.ValidateWithLeeway(jwt.Expected{Time: now}, NotValidBeforeClockSkew); err != nil {
+		return nil, fmt.Errorf("tsidp: invalid request object: %w", err)
+	}
+	if claims.Expiry.Time().After(now.Add(requestObjectMaxLifetime)) {
+		return nil, fmt.Errorf("tsidp: request object expires too far in the future")
+	}
+
+	params := url.Values{}
+	for name, v := range raw {
+		if slices.Contains(requestObjectClaims, name) {
+			continue
+		}
+		if name == "request" || name == "request_uri" {
+			return nil, fmt.Errorf("tsidp: request object must not contain %s", name)
+		}
+		switch v := v.(type) {
+		case string:
+			params.Set(name, v)
+		case float64:
+			params.Set(name, strconv.FormatFloat(v, 'f', -1, 64))
+		case bool:
+			params.Set(name, strconv.FormatBool(v))
+		case []any:
+			// Parameters that can be repeated, like resource.
+			for _, e := range v {
+				es, ok := e.(string)
+				if !ok {
+					return nil, fmt.Errorf("tsidp: request object %s must be an array of strings", name)
+				}
+				params.Add(name, es)
+			}
+		default:
+			// Parameters with JSON values, like claims.
+			b, err := json.Marshal(v)
+			if err != nil {
+				return nil, err
+			}
+			params.Set(name, string(b))
+		}
+	}
+	if id := params.Get("client_id"); id != client.ID {
+		return nil, fmt.Errorf("tsidp: request object client_id %q does not match %q", id, client.ID)
+	}
+	return params, nil
+}
+
+// fetchRequestObject fetches the request object of client from requestURI,
+// which must be one of the request_uris it registered.
+func (s *IDPServer) fetchRequestObject(ctx context.Context, client *FunnelClient, requestURI string) (string, error) {
+	if !slices.Contains(client.RequestURIs, requestURI) {
+		return "", fmt.Errorf("tsidp: request_uri %q is not registered for %q", requestURI, client.ID)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, jwksFetchTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "GET", requestURI, nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Accept", "application/oauth-authz-req+jwt")
+	resp, err := s.outboundHTTPClient().Do(req)
+	if err != nil {
+		return "", fmt.Errorf("tsidp: fetching request_uri of %q: %w", client.ID, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("tsidp: fetching request_uri of %q: unexpected status %s", client.ID, resp.Status)
+	}
+	b, err := io.ReadAll(io.LimitReader(resp.Body, maxRequestObjectSize))
+	if err != nil {
+		return "", fmt.Errorf("tsidp: reading request_uri of %q: %w", client.ID, err)
+	}
+	return strings.TrimSpace(string(b)), nil
+}
+
+// validateRequestObjectMetadata validates the request object metadata
+// registered by a client, along with its jwks and jwks_uri.
+func validateRequestObjectMetadata(requireSigned bool, requestURIs []string, jwks *jose.JSONWebKeySet, jwksURI string) error {
+	for _, uri := range requestURIs {
+		u, err := url.Parse(uri)
+		if err != nil || u.Scheme != "https" || u.Host == "" {
+			return errors.New("request_uris must be https URLs")
+		}
+	}
+	if (requireSigned || len(requestURIs) > 0) && (jwks == nil || len(jwks.Keys) == 0) && jwksURI == "" {
+		return errors.New("signed request objects require jwks or jwks_uri")
+	}
+	return nil
+}
@@ -0,0 +1,252 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package server
+
+import (
+	"crypto/ecdsa"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"gopkg.in/square/go-jose.v2"
+	"gopkg.in/square/go-jose.v2/jwt"
+)
+
+// mustSignRequestObject returns a request object with claims, signed with
+// key.
+func mustSignRequestObject(t *testing.T, key *ecdsa.PrivateKey, kid, typ string, claims map[string]any) string {
+	t.Helper()
+	signer, err := jose.NewSigner(jose.SigningKey{Algorithm: jose.ES256, Key: key},
+		(&jose.SignerOptions{}).WithType(jose.ContentType(typ)).WithHeader("kid", kid))
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, err := jwt.Signed(signer).Claims(claims).CompactSerialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+// requestObjectClaimsFor returns valid claims of a request object of
+// clientID for tsidp.
+func requestObjectClaimsFor(s *IDPServer, clientID string) map[string]any {
+	return map[string]any{
+		"iss":           clientID,
+		"aud":           s.serverURL,
+		"exp":           time.Now().Add(5 * time.Minute).Unix(),
+		"client_id":     clientID,
+		"response_type": "code",
+		"redirect_uri":  "https://rp.example.com/callback",
+		"scope":         "openid email",
+		"state":         "signed-state",
+		"nonce":         "signed-nonce",
+	}
+}
+
+// newJARTestServer returns a test server with a client that requires signed
+// request objects, and the key it signs them with.
+func newJARTestServer(t *testing.T) (*IDPServer, *ecdsa.PrivateKey) {
+	t.Helper()
+	key, jwks := newClientAssertionKey(t, "key-1")
+	s := newPARTestServer(t)
+	s.funnelClients["jar-client"] = &FunnelClient{
+		ID:                         "jar-client",
+		Secret:                     "jar-secret",
+		RedirectURIs:               []string{"https://rp.example.com/callback"},
+		JWKS:                       jwks,
+		RequireSignedRequestObject: true,
+	}
+	return s, key
+}
+
+// TestRequestObject tests authorization requests with request objects
+// passed by value, by reference and pushed to /par (RFC 9101)
+func TestRequestObject(t *testing.T) {
+	checkRedirect := func(t *testing.T, s *IDPServer, rr *httptest.ResponseRecorder) {
+		t.Helper()
+		if rr.Code != http.StatusFound {
+			t.Fatalf("authorize: expected redirect, got %d: %s", rr.Code, rr.Body.String())
+		}
+		loc, err := url.Parse(rr.Header().Get("Location"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if loc.Host != "rp.example.com" || loc.Query().Get("state") != "signed-state" {
+			t.Fatalf("unexpected redirect %s", loc)
+		}
+		ar, ok := s.code.Get(loc.Query().Get("code"))
+		if !ok {
+			t.Fatal("code not stored")
+		}
+		if ar.Nonce != "signed-nonce" || strings.Join(ar.Scopes, " ") != "openid email" {
+			t.Errorf("unexpected auth request: %+v", ar)
+		}
+	}
+
+	t.Run("by value", func(t *testing.T) {
+		s, key := newJARTestServer(t)
+		request := mustSignRequestObject(t, key, "key-1", "oauth-authz-req+jwt", requestObjectClaimsFor(s, "jar-client"))
+
+		// Parameters outside the request object are ignored.
+		rr := authorizeWithQuery(s, url.Values{
+			"client_id":    {"jar-client"},
+			"request":      {request},
+			"redirect_uri": {"https://evil.example.com/callback"},
+			"state":        {"query-state"},
+			"nonce":        {"query-nonce"},
+		})
+		checkRedirect(t, s, rr)
+	})
+
+	t.Run("by reference", func(t *testing.T) {
+		s, key := newJARTestServer(t)
+		request := mustSignRequestObject(t, key, "key-1", "oauth-authz-req+jwt", requestObjectClaimsFor(s, "jar-client"))
+		ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/oauth-authz-req+jwt")
+			w.Write([]byte(request))
+		}))
+		t.Cleanup(ts.Close)
+		s.SetHTTPClient(ts.Client())
+		requestURI := ts.URL + "/request.jwt"
+		s.funnelClients["jar-client"].RequestURIs = []string{requestURI}
+
+		rr := authorizeWithQuery(s, url.Values{"client_id": {"jar-client"}, "request_uri": {requestURI}})
+		checkRedirect(t, s, rr)
+
+		// Only registered request_uris are fetched.
+		rr = authorizeWithQuery(s, url.Values{"client_id": {"jar-client"}, "request_uri": {ts.URL + "/other.jwt"}})
+		if rr.Code != http.StatusBadRequest {
+			t.Errorf("unregistered request_uri: expected status 400, got %d", rr.Code)
+		}
+	})
+
+	t.Run("pushed", func(t *testing.T) {
+		s, key := newJARTestServer(t)
+		request := mustSignRequestObject(t, key, "key-1", "oauth-authz-req+jwt", requestObjectClaimsFor(s, "jar-client"))
+		rr := pushAuthRequest(s, url.Values{
+			"client_id":     {"jar-client"},
+			"client_secret": {"jar-secret"},
+			"request":       {request},
+		})
+		if rr.Code != http.StatusCreated {
+			t.Fatalf("par: expected status 201, got %d: %s", rr.Code, rr.Body.String())
+		}
+		var resp struct {
+			RequestURI string `json:"request_uri"`
+		}
+		if err := json.Unmarshal(rr.Body.Bytes(), &resp); err != nil {
+			t.Fatal(err)
+		}
+		rr = authorizeWithQuery(s, url.Values{"client_id": {"jar-client"}, "request_uri": {resp.RequestURI}})
+		checkRedirect(t, s, rr)
+	})
+}
+
+// TestRequestObjectErrors tests the request objects rejected at /authorize
+func TestRequestObjectErrors(t *testing.T) {
+	otherKey, _ := newClientAssertionKey(t, "key-1")
+
+	tests := []struct {
+		name     string
+		modify   func(map[string]any)
+		typ      string
+		otherKey bool
+	}{
+		{
+			name:     "other key",
+			otherKey: true,
+		},
+		{
+			name:   "wrong iss",
+			modify: func(c map[string]any) { c["iss"] = "public-client" },
+		},
+		{
+			name:   "wrong aud",
+			modify: func(c map[string]any) { c["aud"] = "https://other.example.com" },
+		},
+		{
+			name:   "no exp",
+			modify: func(c map[string]any) { delete(c, "exp") },
+		},
+		{
+			name:   "expired",
+			modify: func(c map[string]any) { c["exp"] = time.Now().Add(-time.Hour).Unix() },
+		},
+		{
+			name:   "exp too far",
+			modify: func(c map[string]any) { c["exp"] = time.Now().Add(24 * time.Hour).Unix() },
+		},
+		{
+			name:   "other client_id",
+			modify: func(c map[string]any) { c["client_id"] = "public-client" },
+		},
+		{
+			name:   "nested request_uri",
+			modify: func(c map[string]any) { c["request_uri"] = "https://rp.example.com/request.jwt" },
+		},
+		{
+			name: "wrong typ",
+			typ:  "dpop+jwt",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, key := newJARTestServer(t)
+			if tt.otherKey {
+				key = otherKey
+			}
+			claims := requestObjectClaimsFor(s, "jar-client")
+			if tt.modify != nil {
+				tt.modify(claims)
+			}
+			typ := "oauth-authz-req+jwt"
+			if tt.typ != "" {
+				typ = tt.typ
+			}
+			rr := authorizeWithQuery(s, url.Values{
+				"client_id": {"jar-client"},
+				"request":   {mustSignRequestObject(t, key, "key-1", typ, claims)},
+			})
+			if rr.Code != http.StatusBadRequest {
+				t.Errorf("expected status 400, got %d: %s", rr.Code, rr.Body.String())
+			}
+		})
+	}
+
+	t.Run("request and request_uri", func(t *testing.T) {
+		s, key := newJARTestServer(t)
+		rr := authorizeWithQuery(s, url.Values{
+			"client_id":   {"jar-client"},
+			"request":     {mustSignRequestObject(t, key, "key-1", "JWT", requestObjectClaimsFor(s, "jar-client"))},
+			"request_uri": {"https://rp.example.com/request.jwt"},
+		})
+		if rr.Code != http.StatusBadRequest {
+			t.Errorf("expected status 400, got %d: %s", rr.Code, rr.Body.String())
+		}
+	})
+
+	t.Run("signed request object required", func(t *testing.T) {
+		s, _ := newJARTestServer(t)
+		rr := authorizeWithQuery(s, url.Values{
+			"client_id":    {"jar-client"},
+			"redirect_uri": {"https://rp.example.com/callback"},
+		})
+		if rr.Code != http.StatusFound {
+			t.Fatalf("expected redirect, got %d: %s", rr.Code, rr.Body.String())
+		}
+		loc, err := url.Parse(rr.Header().Get("Location"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := loc.Query().Get("error"); got != ecInvalidRequest {
+			t.Errorf("expected error %q, got %q", ecInvalidRequest, got)
+		}
+	})
+}
@@ -0,0 +1,211 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package server
+
+import (
+	"context"
+	"log/slog"
+	"maps"
+	"net/url"
+	"path"
+	"slices"
+	"strings"
+
+	"tailscale.com/client/local"
+	"tailscale.com/ipn/ipnstate"
+)
+
+// resourceMatcher matches resources and audiences against the patterns of
+// capability rules and trust policies. A pattern matches:
+//
+//   - "*": anything;
+//   - any other string: the same string;
+//   - a URL: URLs with the same scheme, host and port. "*" in a host label
+//     or path segment matches within that label or segment. A path ending
+//     in "/" matches the paths under it, and a final "*" segment one or
+//     more segments, so https://*.example.ts.net/api/* matches
+//     https://team-a.example.ts.net/api/tools/list;
+//   - "tag:name": URLs served by tailnet nodes with the tag;
+//   - a MagicDNS name, short or full: URLs served by the node of that
+//     name.
+//
+// Tag and name patterns can also have "*", and are resolved with the
+// tailnet status of tailscaled, fetched once per matcher.
+type resourceMatcher struct {
+	ctx    context.Context
+	lc     *local.Client
+	status *ipnstate.Status
+	loaded bool
+}
+
+// newResourceMatcher returns a resourceMatcher that resolves tailnet nodes
+// within ctx.
+func (s *IDPServer) newResourceMatcher(ctx context.Context) *resourceMatcher {
+	return &resourceMatcher{ctx: ctx, lc: s.lc}
+}
+
+// matchAny reports whether resource matches any of patterns.
+func (m *resourceMatcher) matchAny(patterns []string, resource string) bool {
+	return slices.ContainsFunc(patterns, func(p string) bool { return m.match(p, resource) })
+}
+
+// match reports whether resource matches pattern.
+func (m *resourceMatcher) match(pattern, resource string) bool {
+	if pattern == "*" || pattern == resource {
+		return true
+	}
+	if strings.Contains(pattern, "://") {
+		u, ok := parseResourceURL(resource)
+		if !ok {
+			return false
+		}
+		p, err := url.Parse(pattern)
+		if err != nil || p.Host == "" || p.User != nil || p.Fragment != "" {
+			return false
+		}
+		return strings.EqualFold(p.Scheme, u.Scheme) &&
+			hostMatches(p.Hostname(), u.Hostname()) &&
+			p.Port() == u.Port() &&
+			pathMatches(p.Path, u.Path) &&
+			p.RawQuery == u.RawQuery
+	}
+	if tag, ok := strings.CutPrefix(pattern, "tag:"); ok {
+		return m.nodeMatches(resource, func(n *ipnstate.PeerStatus) bool {
+			return n.Tags != nil && slices.ContainsFunc(n.Tags.AsSlice(), func(t string) bool {
+				matched, _ := path.Match("tag:"+tag, t)
+				return matched
+			})
+		})
+	}
+	if strings.ContainsAny(pattern, ":/") {
+		return false
+	}
+	return m.nodeMatches(resource, func(n *ipnstate.PeerStatus) bool {
+		short, _, _ := strings.Cut(n.DNSName, ".")
+		return hostMatches(pattern, strings.TrimSuffix(n.DNSName, ".")) || hostMatches(pattern, short)
+	})
+}
+
+// allowedResources returns the resources among resources that rules grant
+// the user loginName.
+func (m *resourceMatcher) allowedResources(rules []capRule, loginName string, resources []string) []string {
+	var allowed []string
+	for _, resource := range resources {
+		for _, rule := range rules {
+			if !slices.Contains(rule.Users, "*") && !slices.Contains(rule.Users, loginName) {
+				continue
+			}
+			if m.matchAny(rule.Resources, resource) {
+				allowed = append(allowed, resource)
+				break
+			}
+		}
+	}
+	return allowed
+}
+
+// nodeMatches reports whether the URL resource is served by a tailnet node
+// for which f returns true.
+func (m *resourceMatcher) nodeMatches(resource string, f func(*ipnstate.PeerStatus) bool) bool {
+	u, ok := parseResourceURL(resource)
+	if !ok {
+		return false
+	}
+	st := m.tailnetStatus()
+	if st == nil {
+		return false
+	}
+	nodes := append(slices.Collect(maps.Values(st.Peer)), st.Self)
+	for _, n := range nodes {
+		if n != nil && strings.EqualFold(strings.TrimSuffix(n.DNSName, "."), u.Hostname()) {
+			return f(n)
+		}
+	}
+	return false
+}
+
+// tailnetStatus returns the tailnet status, or nil if it isn't available.
+func (m *resourceMatcher) tailnetStatus() *ipnstate.Status {
+	if m.loaded {
+		return m.status
+	}
+	m.loaded = true
+	if m.lc == nil {
+		return nil
+	}
+	st, err := m.lc.Status(m.ctx)
+	if err != nil {
+		slog.Warn("failed to get tailnet status for resource matching", slog.Any("error", err))
+		return nil
+	}
+	m.status = st
+	return st
+}
+
+// parseResourceURL parses resource as an absolute URL that patterns can
+// match. URLs with credentials or fragments, which RFC 8707 Section 2
+// rules out, or with dot path segments, that could escape a path prefix,
+// don't match any pattern but their own.
+func parseResourceURL(resource string) (*url.URL, bool) {
+	u, err := url.Parse(resource)
+	if err != nil || u.Scheme == "" || u.Host == "" || u.User != nil || u.Fragment != "" {
+		return nil, false
+	}
+	for seg := range strings.SplitSeq(u.Path, "/") {
+		if seg == "." || seg == ".." {
+			return nil, false
+		}
+	}
+	return u, true
+}
+
+// hostMatches reports whether host matches the host name pattern, in which
+// "*" matches within a label.
+func hostMatches(pattern, host string) bool {
+	pl := strings.Split(strings.ToLower(pattern), ".")
+	hl := strings.Split(strings.ToLower(host), ".")
+	if len(pl) != len(hl) {
+		return false
+	}
+	for i := range pl {
+		if hl[i] == "" {
+			return false
+		}
+		if matched, err := path.Match(pl[i], hl[i]); err != nil || !matched {
+			return false
+		}
+	}
+	return true
+}
+
+// pathMatches reports whether the URL path p matches the path pattern, in
+// which "*" matches within a segment. A pattern ending in "/" matches the
+// paths under it, and a final "*" segment one or more segments.
+func pathMatches(pattern, p string) bool {
+	if pattern == "" {
+		return p == "" || p == "/"
+	}
+	if p == "" {
+		p = "/"
+	}
+	ps := strings.Split(pattern, "/")
+	segs := strings.Split(p, "/")
+	for i, seg := range ps {
+		if i == len(ps)-1 {
+			switch seg {
+			case "":
+				return len(segs) > i
+			case "*":
+				return len(segs) > i && segs[i] != ""
+			}
+		}
+		if i >= len(segs) {
+			return false
+		}
+		if matched, err := path.Match(seg, segs[i]); err != nil || !matched {
+			return false
+		}
+	}
+	return len(segs) == len(ps)
+}
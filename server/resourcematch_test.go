@@ -0,0 +1,163 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"testing"
+
+	"tailscale.com/client/local"
+	"tailscale.com/client/tailscale/apitype"
+	"tailscale.com/ipn/ipnstate"
+	"tailscale.com/tailcfg"
+	"tailscale.com/types/key"
+	"tailscale.com/types/views"
+)
+
+// statusRoundTripper is an http.RoundTripper that returns a canned tailnet
+// status, for code that calls local.Client.Status.
+type statusRoundTripper struct {
+	status *ipnstate.Status
+	calls  int
+}
+
+func (rt *statusRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.URL.Path != "/localapi/v0/status" {
+		return &http.Response{
+			StatusCode: http.StatusNotFound,
+			Body:       io.NopCloser(bytes.NewReader(nil)),
+		}, nil
+	}
+	rt.calls++
+	b, _ := json.Marshal(rt.status)
+	return &http.Response{
+		StatusCode: http.StatusOK,
+		Header:     http.Header{"Content-Type": {"application/json"}},
+		Body:       io.NopCloser(bytes.NewReader(b)),
+	}, nil
+}
+
+// newTestTailnet returns a status round tripper for a tailnet with a node
+// mcp-team-a tagged tag:mcp and an untagged node laptop.
+func newTestTailnet() *statusRoundTripper {
+	tags := views.SliceOf([]string{"tag:mcp"})
+	return &statusRoundTripper{status: &ipnstate.Status{
+		Self: &ipnstate.PeerStatus{DNSName: "idp.example.ts.net."},
+		Peer: map[key.NodePublic]*ipnstate.PeerStatus{
+			key.NewNode().Public(): {DNSName: "mcp-team-a.example.ts.net.", Tags: &tags},
+			key.NewNode().Public(): {DNSName: "laptop.example.ts.net."},
+		},
+	}}
+}
+
+// TestResourceMatcher tests matching resources against the patterns of
+// capability rules
+func TestResourceMatcher(t *testing.T) {
+	tests := []struct {
+		name     string
+		pattern  string
+		resource string
+		want     bool
+	}{
+		{"wildcard", "*", "https://api.example.com", true},
+		{"exact", "https://api.example.com", "https://api.example.com", true},
+		{"exact non-URL", "urn:example:api", "urn:example:api", true},
+		{"different host", "https://api.example.com", "https://other.example.com", false},
+		{"no path pattern", "https://api.example.com", "https://api.example.com/", true},
+		{"no path pattern, path", "https://api.example.com", "https://api.example.com/v1", false},
+		{"prefix", "https://api.example.com/v1/", "https://api.example.com/v1/users/1", true},
+		{"prefix itself", "https://api.example.com/v1/", "https://api.example.com/v1/", true},
+		{"prefix without slash", "https://api.example.com/v1/", "https://api.example.com/v1", false},
+		{"prefix of segment", "https://api.example.com/v1/", "https://api.example.com/v10/users", false},
+		{"prefix escaped", "https://api.example.com/v1/", "https://api.example.com/v1/../admin", false},
+		{"other scheme", "https://api.example.com/", "http://api.example.com/", false},
+		{"other port", "https://api.example.com/", "https://api.example.com:8443/", false},
+		{"host glob", "https://*.example.ts.net/api/*", "https://team-a.example.ts.net/api/tools", true},
+		{"host glob, deeper path", "https://*.example.ts.net/api/*", "https://team-a.example.ts.net/api/tools/list", true},
+		{"host glob, no path under", "https://*.example.ts.net/api/*", "https://team-a.example.ts.net/api/", false},
+		{"host glob, one label only", "https://*.example.ts.net/api/*", "https://a.b.example.ts.net/api/tools", false},
+		{"host glob, other domain", "https://*.example.ts.net/api/*", "https://team-a.example.com/api/tools", false},
+		{"host glob, userinfo", "https://*.example.ts.net/", "https://team-a.example.ts.net@evil.example.com/", false},
+		{"label glob", "https://mcp-*.example.ts.net/", "https://mcp-team-a.example.ts.net/sse", true},
+		{"segment glob", "https://api.example.com/*/tools", "https://api.example.com/team-a/tools", true},
+		{"segment glob, extra segment", "https://api.example.com/*/tools", "https://api.example.com/team-a/tools/x", false},
+		{"fragment", "https://api.example.com/", "https://api.example.com/#x", false},
+		{"tag", "tag:mcp", "https://mcp-team-a.example.ts.net/sse", true},
+		{"tag glob", "tag:mc*", "https://mcp-team-a.example.ts.net/sse", true},
+		{"tag of another node", "tag:mcp", "https://laptop.example.ts.net/", false},
+		{"tag, not a tailnet node", "tag:mcp", "https://mcp-team-a.example.com/", false},
+		{"short name", "laptop", "https://laptop.example.ts.net/", true},
+		{"full name", "laptop.example.ts.net", "http://laptop.example.ts.net:8080/x", true},
+		{"name glob", "mcp-*", "https://mcp-team-a.example.ts.net/", true},
+		{"name of another node", "laptop", "https://mcp-team-a.example.ts.net/", false},
+		{"name, not a URL", "laptop", "laptop", true},
+		{"name, other resource", "laptop", "urn:laptop", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := &resourceMatcher{ctx: t.Context(), lc: &local.Client{Transport: newTestTailnet()}}
+			if got := m.match(tt.pattern, tt.resource); got != tt.want {
+				t.Errorf("match(%q, %q) = %v, want %v", tt.pattern, tt.resource, got, tt.want)
+			}
+		})
+	}
+}
+
+// TestResourceMatcherStatusOnce tests that a matcher gets the tailnet status
+// at most once, and matches without it
+func TestResourceMatcherStatusOnce(t *testing.T) {
+	rt := newTestTailnet()
+	m := &resourceMatcher{ctx: t.Context(), lc: &local.Client{Transport: rt}}
+	for range 3 {
+		if !m.matchAny([]string{"laptop", "tag:mcp"}, "https://mcp-team-a.example.ts.net/") {
+			t.Fatal("expected the tagged node to match")
+		}
+	}
+	if rt.calls != 1 {
+		t.Errorf("got the status %d times, want once", rt.calls)
+	}
+
+	m = &resourceMatcher{ctx: t.Context()}
+	if m.match("tag:mcp", "https://mcp-team-a.example.ts.net/") {
+		t.Error("tag matched without a tailnet status")
+	}
+	if !m.match("https://*.example.ts.net/", "https://mcp-team-a.example.ts.net/") {
+		t.Error("URL pattern did not match without a tailnet status")
+	}
+}
+
+// TestValidateResourcesPatterns tests resource validation with patterns in
+// capability rules
+func TestValidateResourcesPatterns(t *testing.T) {
+	s := setupTestServer(t, nil)
+	who := &apitype.WhoIsResponse{
+		UserProfile: &tailcfg.UserProfile{LoginName: "user@example.com"},
+		CapMap: tailcfg.PeerCapMap{
+			tailcfg.PeerCapabilityTsIDP: marshalCapRules([]capRule{
+				{Users: []string{"user@example.com"}, Resources: []string{"https://*.example.ts.net/mcp/*"}},
+				{Users: []string{"other@example.com"}, Resources: []string{"*"}},
+			}),
+		},
+	}
+
+	got, err := s.validateResourcesForUser(t.Context(), who, []string{
+		"https://team-a.example.ts.net/mcp/sse",
+		"https://team-a.example.ts.net/admin",
+		"https://api.example.com",
+	})
+	if err != nil {
+		t.Fatalf("validateResourcesForUser: %v", err)
+	}
+	if len(got) != 1 || got[0] != "https://team-a.example.ts.net/mcp/sse" {
+		t.Errorf("allowed resources = %v, want only the matching one", got)
+	}
+
+	if _, err := s.validateResourcesForUser(t.Context(), who, []string{"https://api.example.com"}); err == nil {
+		t.Error("expected an error for resources no pattern matches")
+	}
+}
@@ -0,0 +1,110 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package server
+
+import (
+	"log/slog"
+	"net/http"
+)
+
+// serveRevoke implements the OAuth 2.0 token revocation endpoint (RFC 7009).
+// Revoking a refresh token also revokes every token issued from the same
+// authorization grant.
+func (s *IDPServer) serveRevoke(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		writeHTTPError(w, r, http.StatusMethodNotAllowed, ecInvalidRequest, "method not allowed", nil)
+		return
+	}
+
+	if err := r.ParseForm(); err != nil {
+		writeHTTPError(w, r, http.StatusBadRequest, ecInvalidRequest, "failed to parse form", err)
+		return
+	}
+
+	token := r.FormValue("token")
+	if token == "" {
+		writeHTTPError(w, r, http.StatusBadRequest, ecInvalidRequest, "token is required", nil)
+		return
+	}
+
+	// token_type_hint only decides which store is searched first (RFC 7009
+	// Section 2.1), unknown hints are ignored.
+	s.mu.Lock()
+	stores := []tokenStore{s.accessToken, s.refreshToken}
+	if r.FormValue("token_type_hint") == "refresh_token" {
+		stores = []tokenStore{s.refreshToken, s.accessToken}
+	}
+	var (
+		ar        *AuthRequest
+		ok        bool
+		isRefresh bool
+	)
+	for _, ts := range stores {
+		if ar, ok = ts.Get(token); ok {
+			isRefresh = ts == s.refreshToken
+			break
+		}
+	}
+	s.mu.Unlock()
+
+	// Invalid and unknown tokens do not cause an error response, as the
+	// client can't handle them any differently (RFC 7009 Section 2.2).
+	if !ok {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	// The token must have been issued to the client revoking it.
+	if httpStatusCode, err := s.allowRelyingParty(r, ar); err != nil {
+		writeHTTPError(w, r, httpStatusCode, ecInvalidClient, "client authentication failed", err)
+		return
+	}
+
+	s.mu.Lock()
+	if isRefresh {
+		s.revokeGrantLocked(ar.GrantID)
+		if err := s.refreshToken.Delete(token); err != nil {
+			slog.Warn("failed to persist refresh token removal", slog.Any("error", err))
+		}
+	} else if err := s.accessToken.Delete(token); err != nil {
+		slog.Warn("failed to persist access token removal", slog.Any("error", err))
+	}
+	s.mu.Unlock()
+
+	// Revoking a refresh token ends the session.
+	if isRefresh {
+		s.backchannelLogout(ar)
+	}
+
+	slog.Info("token revoked",
+		slog.String("client_id", ar.ClientID),
+		slog.Bool("refresh_token", isRefresh),
+	)
+	w.WriteHeader(http.StatusOK)
+}
+
+// revokeGrantLocked removes every access and refresh token issued from the
+// authorization grant grantID. It returns one of the removed tokens, or nil
+// if there were none.
+// Caller must hold s.mu lock
+func (s *IDPServer) revokeGrantLocked(grantID string) *AuthRequest {
+	if grantID == "" {
+		return nil
+	}
+	var revoked *AuthRequest
+	fromGrant := func(_ string, ar *AuthRequest) bool {
+		if ar.GrantID != grantID {
+			return false
+		}
+		revoked = ar
+		return true
+	}
+	if err := s.accessToken.DeleteFunc(fromGrant); err != nil {
+		slog.Warn("failed to persist access token removal", slog.Any("error", err))
+	}
+	if err := s.refreshToken.DeleteFunc(fromGrant); err != nil {
+		slog.Warn("failed to persist refresh token removal", slog.Any("error", err))
+	}
+	return revoked
+}
@@ -0,0 +1,343 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"tailscale.com/client/tailscale/apitype"
+	"tailscale.com/tailcfg"
+)
+
+// TestServeRevoke tests the token revocation endpoint
+func TestServeRevoke(t *testing.T) {
+	client := &FunnelClient{ID: "test-client", Secret: "test-secret"}
+	other := &FunnelClient{ID: "other-client", Secret: "other-secret"}
+
+	tests := []struct {
+		name         string
+		method       string
+		token        string
+		hint         string
+		clientID     string
+		clientSecret string
+		expectStatus int
+		expectGone   []string // tokens removed by the request
+		expectKept   []string // tokens that must survive the request
+	}{
+		{
+			name:         "revoke access token",
+			token:        "at-1",
+			clientID:     "test-client",
+			clientSecret: "test-secret",
+			expectStatus: http.StatusOK,
+			expectGone:   []string{"at-1"},
+			expectKept:   []string{"at-2", "rt-1", "at-3", "rt-3"},
+		},
+		{
+			name:         "revoke refresh token revokes its grant",
+			token:        "rt-1",
+			hint:         "refresh_token",
+			clientID:     "test-client",
+			clientSecret: "test-secret",
+			expectStatus: http.StatusOK,
+			expectGone:   []string{"at-1", "at-2", "rt-1"},
+			expectKept:   []string{"at-3", "rt-3"},
+		},
+		{
+			name:         "wrong hint is ignored",
+			token:        "rt-1",
+			hint:         "access_token",
+			clientID:     "test-client",
+			clientSecret: "test-secret",
+			expectStatus: http.StatusOK,
+			expectGone:   []string{"at-1", "at-2", "rt-1"},
+			expectKept:   []string{"at-3", "rt-3"},
+		},
+		{
+			name:         "unknown token",
+			token:        "does-not-exist",
+			clientID:     "test-client",
+			clientSecret: "test-secret",
+			expectStatus: http.StatusOK,
+			expectKept:   []string{"at-1", "at-2", "rt-1", "at-3", "rt-3"},
+		},
+		{
+			name:         "token of another client",
+			token:        "rt-3",
+			clientID:     "test-client",
+			clientSecret: "test-secret",
+			expectStatus: http.StatusBadRequest,
+			expectKept:   []string{"at-1", "at-2", "rt-1", "at-3", "rt-3"},
+		},
+		{
+			name:         "invalid client secret",
+			token:        "at-1",
+			clientID:     "test-client",
+			clientSecret: "wrong-secret",
+			expectStatus: http.StatusUnauthorized,
+			expectKept:   []string{"at-1"},
+		},
+		{
+			name:         "missing token",
+			clientID:     "test-client",
+			clientSecret: "test-secret",
+			expectStatus: http.StatusBadRequest,
+		},
+		{
+			name:         "GET not allowed",
+			method:       "GET",
+			token:        "at-1",
+			expectStatus: http.StatusMethodNotAllowed,
+			expectKept:   []string{"at-1"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			validTill := time.Now().Add(time.Hour)
+			s := &IDPServer{
+				serverURL: "https://idp.test.ts.net",
+				code:      newMemTokenStore(),
+				accessToken: &memTokenStore{m: map[string]*AuthRequest{
+					"at-1": {ClientID: "test-client", FunnelRP: client, GrantID: "grant-1", ValidTill: validTill},
+					"at-2": {ClientID: "test-client", FunnelRP: client, GrantID: "grant-1", ValidTill: validTill},
+					"at-3": {ClientID: "other-client", FunnelRP: other, GrantID: "grant-3", ValidTill: validTill},
+				}},
+				refreshToken: &memTokenStore{m: map[string]*AuthRequest{
+					"rt-1": {ClientID: "test-client", FunnelRP: client, GrantID: "grant-1", ValidTill: validTill},
+					"rt-3": {ClientID: "other-client", FunnelRP: other, GrantID: "grant-3", ValidTill: validTill},
+				}},
+				usedRefreshTokens: newMemTokenStore(),
+			}
+
+			method := tt.method
+			if method == "" {
+				method = "POST"
+			}
+			form := url.Values{}
+			if tt.token != "" {
+				form.Set("token", tt.token)
+			}
+			if tt.hint != "" {
+				form.Set("token_type_hint", tt.hint)
+			}
+			req := httptest.NewRequest(method, "/revoke", strings.NewReader(form.Encode()))
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			if tt.clientID != "" {
+				req.SetBasicAuth(tt.clientID, tt.clientSecret)
+			}
+			rr := httptest.NewRecorder()
+			s.ServeHTTP(rr, req)
+
+			if rr.Code != tt.expectStatus {
+				t.Fatalf("expected status %d, got %d: %s", tt.expectStatus, rr.Code, rr.Body.String())
+			}
+
+			exists := func(token string) bool {
+				_, ok := s.accessToken.Get(token)
+				if !ok {
+					_, ok = s.refreshToken.Get(token)
+				}
+				return ok
+			}
+			for _, token := range tt.expectGone {
+				if exists(token) {
+					t.Errorf("token %s was not revoked", token)
+				}
+			}
+			for _, token := range tt.expectKept {
+				if !exists(token) {
+					t.Errorf("token %s was revoked", token)
+				}
+			}
+		})
+	}
+}
+
+// TestRevokeRefreshedGrant tests that revoking a rotated refresh token also
+// revokes the access tokens issued before the rotation
+func TestRevokeRefreshedGrant(t *testing.T) {
+	s := New(nil, t.TempDir(), false, false, false)
+	s.keys = oidcTestingKeyRing(t)
+	client := &FunnelClient{
+		ID:           "test-client",
+		Secret:       "test-secret",
+		RedirectURIs: []string{"https://rp.example.com/callback"},
+	}
+	s.SetFunnelClients(map[string]*FunnelClient{client.ID: client})
+	s.code.Set("code", &AuthRequest{
+		ClientID:    client.ID,
+		RedirectURI: "https://rp.example.com/callback",
+		ValidTill:   time.Now().Add(5 * time.Minute),
+		FunnelRP:    client,
+		RemoteUser: &apitype.WhoIsResponse{
+			Node:        &tailcfg.Node{ID: 1, Name: "node.test.ts.net.", User: 1},
+			UserProfile: &tailcfg.UserProfile{LoginName: "user@example.com"},
+		},
+	})
+
+	type tokenResponse struct {
+		AccessToken  string `json:"access_token"`
+		RefreshToken string `json:"refresh_token"`
+	}
+	post := func(path string, form url.Values) *httptest.ResponseRecorder {
+		form.Set("client_id", client.ID)
+		form.Set("client_secret", client.Secret)
+		req := httptest.NewRequest("POST", path, strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		rr := httptest.NewRecorder()
+		s.ServeHTTP(rr, req)
+		if rr.Code != http.StatusOK {
+			t.Fatalf("POST %s: expected 200, got %d: %s", path, rr.Code, rr.Body.String())
+		}
+		return rr
+	}
+
+	var first, second tokenResponse
+	rr := post("/token", url.Values{
+		"grant_type":   {"authorization_code"},
+		"code":         {"code"},
+		"redirect_uri": {"https://rp.example.com/callback"},
+	})
+	if err := json.Unmarshal(rr.Body.Bytes(), &first); err != nil {
+		t.Fatal(err)
+	}
+	rr = post("/token", url.Values{
+		"grant_type":    {"refresh_token"},
+		"refresh_token": {first.RefreshToken},
+	})
+	if err := json.Unmarshal(rr.Body.Bytes(), &second); err != nil {
+		t.Fatal(err)
+	}
+
+	post("/revoke", url.Values{
+		"token":           {second.RefreshToken},
+		"token_type_hint": {"refresh_token"},
+	})
+
+	for _, at := range []string{first.AccessToken, second.AccessToken} {
+		if _, ok := s.accessToken.Get(at); ok {
+			t.Errorf("access token %s of the revoked grant is still valid", at)
+		}
+	}
+	if n := tokenCount(s.refreshToken); n != 0 {
+		t.Errorf("expected no refresh tokens after revocation, got %d", n)
+	}
+}
+
+// TestRefreshTokenReuse tests that replaying a rotated refresh token
+// revokes every token issued from its grant
+func TestRefreshTokenReuse(t *testing.T) {
+	s := New(nil, t.TempDir(), false, false, false)
+	s.keys = oidcTestingKeyRing(t)
+	client := &FunnelClient{
+		ID:           "test-client",
+		Secret:       "test-secret",
+		RedirectURIs: []string{"https://rp.example.com/callback"},
+	}
+	s.SetFunnelClients(map[string]*FunnelClient{client.ID: client})
+	s.code.Set("code", &AuthRequest{
+		ClientID:    client.ID,
+		RedirectURI: "https://rp.example.com/callback",
+		ValidTill:   time.Now().Add(5 * time.Minute),
+		FunnelRP:    client,
+		RemoteUser: &apitype.WhoIsResponse{
+			Node:        &tailcfg.Node{ID: 1, Name: "node.test.ts.net.", User: 1},
+			UserProfile: &tailcfg.UserProfile{LoginName: "user@example.com"},
+		},
+	})
+
+	type tokenResponse struct {
+		AccessToken  string `json:"access_token"`
+		RefreshToken string `json:"refresh_token"`
+	}
+	token := func(form url.Values) (*httptest.ResponseRecorder, tokenResponse) {
+		if !form.Has("client_id") {
+			form.Set("client_id", client.ID)
+			form.Set("client_secret", client.Secret)
+		}
+		req := httptest.NewRequest("POST", "/token", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.Header.Set("Accept", "application/json")
+		rr := httptest.NewRecorder()
+		s.ServeHTTP(rr, req)
+		var resp tokenResponse
+		if rr.Code == http.StatusOK {
+			if err := json.Unmarshal(rr.Body.Bytes(), &resp); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return rr, resp
+	}
+
+	rr, first := token(url.Values{
+		"grant_type":   {"authorization_code"},
+		"code":         {"code"},
+		"redirect_uri": {"https://rp.example.com/callback"},
+	})
+	if rr.Code != http.StatusOK {
+		t.Fatalf("authorization_code: expected 200, got %d: %s", rr.Code, rr.Body.String())
+	}
+	rr, second := token(url.Values{"grant_type": {"refresh_token"}, "refresh_token": {first.RefreshToken}})
+	if rr.Code != http.StatusOK {
+		t.Fatalf("refresh: expected 200, got %d: %s", rr.Code, rr.Body.String())
+	}
+
+	// Callers that can't authenticate as the client neither use nor
+	// revoke its tokens.
+	for _, rt := range []string{first.RefreshToken, second.RefreshToken} {
+		rr, _ = token(url.Values{
+			"grant_type":    {"refresh_token"},
+			"refresh_token": {rt},
+			"client_id":     {client.ID},
+			"client_secret": {"wrong-secret"},
+		})
+		if rr.Code != http.StatusUnauthorized {
+			t.Fatalf("wrong secret: expected 401, got %d: %s", rr.Code, rr.Body.String())
+		}
+	}
+	if _, ok := s.accessToken.Get(second.AccessToken); !ok {
+		t.Fatal("unauthenticated replay revoked the grant")
+	}
+	if _, ok := s.refreshToken.Get(second.RefreshToken); !ok {
+		t.Fatal("unauthenticated refresh used up the refresh token")
+	}
+
+	// Replaying the first refresh token revokes the tokens it was rotated
+	// into.
+	rr, _ = token(url.Values{"grant_type": {"refresh_token"}, "refresh_token": {first.RefreshToken}})
+	if rr.Code != http.StatusBadRequest || !strings.Contains(rr.Body.String(), ecInvalidGrant) {
+		t.Fatalf("replay: expected invalid_grant, got %d: %s", rr.Code, rr.Body.String())
+	}
+	for _, at := range []string{first.AccessToken, second.AccessToken} {
+		if _, ok := s.accessToken.Get(at); ok {
+			t.Errorf("access token %s of the reused grant is still valid", at)
+		}
+	}
+	if n := tokenCount(s.refreshToken); n != 0 {
+		t.Errorf("expected no refresh tokens after reuse, got %d", n)
+	}
+	rr, _ = token(url.Values{"grant_type": {"refresh_token"}, "refresh_token": {second.RefreshToken}})
+	if rr.Code != http.StatusBadRequest {
+		t.Errorf("refresh token of the reused grant: expected 400, got %d", rr.Code)
+	}
+
+	// Used refresh tokens are forgotten once they expire.
+	s.mu.Lock()
+	for _, ar := range s.usedRefreshTokens.All() {
+		ar.ValidTill = time.Now().Add(-time.Minute)
+	}
+	s.mu.Unlock()
+	s.CleanupExpiredTokens()
+	if n := tokenCount(s.usedRefreshTokens); n != 0 {
+		t.Errorf("expected no used refresh tokens after cleanup, got %d", n)
+	}
+}
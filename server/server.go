@@ -6,20 +6,14 @@ package server
 
 import (
 	"context"
-	"crypto/rand"
-	"crypto/rsa"
 	"crypto/tls"
 	"crypto/x509"
-	"encoding/binary"
 	"encoding/json"
-	"encoding/pem"
 	"fmt"
-	"io"
 	"log/slog"
+	"maps"
 	"net"
 	"net/http"
-	"os"
-	"path/filepath"
 	"strconv"
 	"strings"
 	"sync"
@@ -50,15 +44,71 @@ type IDPServer struct {
 	localTSMode bool // use local tailscaled instead of tsnet
 	enableSTS   bool
 
-	lazyMux        lazy.SyncValue[http.Handler]
-	lazySigningKey lazy.SyncValue[*signingKey]
-	lazySigner     lazy.SyncValue[jose.Signer]
-
-	mu            sync.Mutex               // guards the fields below
-	code          map[string]*AuthRequest  // keyed by random hex
-	accessToken   map[string]*AuthRequest  // keyed by random hex
-	refreshToken  map[string]*AuthRequest  // keyed by random hex
-	funnelClients map[string]*FunnelClient // keyed by client ID
+	// httpClient is used for requests to relying parties. If nil,
+	// http.DefaultClient is used.
+	httpClient *http.Client
+
+	docMu sync.Mutex                // guards docs
+	docs  map[string]cachedDocument // fetched key sets and discovery documents, keyed by URL
+
+	// mtlsURL is the URL of the listener that requests TLS client
+	// certificates, if any, and mtlsClientCAs the CAs trusted to issue
+	// them for tls_client_auth (RFC 8705).
+	mtlsURL       string
+	mtlsClientCAs *x509.CertPool
+
+	// jwtAccessTokenResources are the resources that get JWT access tokens
+	// (RFC 9068) whichever client requests them.
+	jwtAccessTokenResources []string
+
+	// trustedIssuers are the external issuers whose JWTs can be exchanged
+	// for tsidp access tokens, see SetTrustedIssuers.
+	trustedIssuers []TrustedIssuer
+
+	lazyMux lazy.SyncValue[http.Handler]
+
+	// Back-channel logout deliveries run with logoutCtx, which Close
+	// cancels, and hold a slot of logoutSem while they do. See
+	// logoutDeliveries.
+	logoutOnce   sync.Once
+	logoutCtx    context.Context
+	logoutCancel context.CancelFunc
+	logoutSem    chan struct{}
+
+	keyMu       sync.Mutex                // guards the fields below
+	keys        *signingKeyRing           // loaded lazily by loadSigningKeysLocked
+	signers     map[signerKey]jose.Signer // built on demand
+	keyRotation time.Duration             // zero disables scheduled rotation
+
+	mu            sync.Mutex                      // guards the fields below
+	code          tokenStore                      // keyed by random hex
+	accessToken   tokenStore                      // keyed by random hex or JWT
+	refreshToken  tokenStore                      // keyed by random hex
+	funnelClients map[string]*FunnelClient        // keyed by client ID
+	deviceAuths   map[string]*deviceAuthorization // keyed by device code
+
+	pushedAuthRequests map[string]*pushedAuthRequest // keyed by request_uri
+
+	// usedRefreshTokens holds refresh tokens that were already exchanged
+	// for new tokens, keyed by the token, until they expire. Presenting one
+	// again revokes the grant it was issued from. Created on first use if
+	// nil.
+	usedRefreshTokens tokenStore
+
+	// clientAssertionJTIs holds the jti of used private_key_jwt client
+	// assertions, keyed by client ID and jti, until they expire.
+	clientAssertionJTIs map[string]time.Time
+
+	// dpopJTIs holds the jti of used DPoP proofs, keyed by key thumbprint
+	// and jti, until they expire. dpopNonce is the nonce DPoP proofs must
+	// carry at the token endpoint, see currentDPoPNonce.
+	dpopJTIs         map[string]time.Time
+	dpopNonce        string
+	prevDPoPNonce    string
+	dpopNonceRotated time.Time
+
+	// lifetimes are the server-wide token lifetimes, see SetTokenLifetimes.
+	lifetimes TokenLifetimes
 
 	// for bypassing application capability checks for testing
 	// see issue #44
@@ -68,18 +118,19 @@ type IDPServer struct {
 // AuthRequest represents an authorization request
 type AuthRequest struct {
 	// localRP is true if the request is from a relying party running on the
-	// same machine as the idp server. It is mutually exclusive with rpNodeID
-	// and funnelRP.
+	// same machine as the idp server. It is mutually exclusive with funnelRP.
+	// Unlike localRP, rpNodeID may be set along with funnelRP, when the
+	// client's tokens are bound to a node.
 	LocalRP bool
 
 	// rpNodeID is the NodeID of the relying party (who requested the auth, such
-	// as Proxmox or Synology), not the user node who is being authenticated. It
-	// is mutually exclusive with localRP and funnelRP.
+	// as Proxmox or Synology), not the user node who is being authenticated.
+	// Tokens with a non-zero rpNodeID can only be used from that node, see
+	// FunnelClient.BindTokensToNode.
 	RPNodeID tailcfg.NodeID
 
 	// funnelRP is non-nil if the request is from a relying party outside the
-	// tailnet, via Tailscale Funnel. It is mutually exclusive with rpNodeID
-	// and localRP.
+	// tailnet, via Tailscale Funnel. It is mutually exclusive with localRP.
 	FunnelRP *FunnelClient
 
 	// clientID is the "client_id" sent in the authorized request.
@@ -126,6 +177,16 @@ type AuthRequest struct {
 	// This is used for token introspection to return the jti claim.
 	JTI string
 
+	// GrantID identifies the authorization grant the token was issued from.
+	// It is shared by all access and refresh tokens obtained from the same
+	// authorization code, so they can be revoked together.
+	GrantID string
+
+	// SessionExpiry is when the tokens issued from the grant stop being
+	// refreshed, set from the client's absolute refresh token lifetime when
+	// the grant is first used. Zero if there is no limit.
+	SessionExpiry time.Time
+
 	// Token exchange specific fields (RFC 8693)
 	IsExchangedToken bool     // Indicates if this token was created via exchange
 	OriginalClientID string   // The client that originally authenticated the user
@@ -134,6 +195,26 @@ type AuthRequest struct {
 
 	// Delegation support (RFC 8693 act claim)
 	ActorInfo *ActorClaim // For delegation scenarios
+
+	// IsClientCredentials is true if the token was issued to FunnelRP itself
+	// with the client credentials grant. The client is the subject of such
+	// tokens and RemoteUser is nil.
+	IsClientCredentials bool
+
+	// CertThumbprint is the x5t#S256 thumbprint of the TLS client
+	// certificate the token is bound to (RFC 8705 Section 3). Bound tokens
+	// can only be used over connections with that certificate.
+	CertThumbprint string
+
+	// DPoPJKT is the JWK SHA-256 thumbprint of the DPoP key the token is
+	// bound to (RFC 9449 Section 6). Bound tokens must be presented with a
+	// DPoP proof signed by that key.
+	DPoPJKT string
+
+	// ExternalSubject is the identity a trust policy mapped the subject
+	// token of a trusted external issuer to, for tokens exchanged from such
+	// a token. It is their subject, and RemoteUser is nil.
+	ExternalSubject string
 }
 
 // ActorClaim represents the 'act' claim structure defined in RFC 8693 Section 4.1
@@ -144,22 +225,30 @@ type ActorClaim struct {
 	Actor    *ActorClaim `json:"act,omitempty"` // Nested for delegation chains
 }
 
-// signingKey represents a JWT signing key
-type signingKey struct {
-	Kid uint64          `json:"kid"`
-	Key *rsa.PrivateKey `json:"-"`
-}
-
 // for use with writeHTTPError() errorCode parameter
 const (
-	ecAccessDenied     = "access_denied"
-	ecInvalidRequest   = "invalid_request"
-	ecInvalidClient    = "invalid_client"
-	ecInvalidGrant     = "invalid_grant"
-	ecInvalidScope     = "invalid_scope"
-	ecServerError      = "server_error"
-	ecNotFound         = "not_found"
-	ecUnsupportedGrant = "unsupported_grant_type"
+	ecAccessDenied       = "access_denied"
+	ecInvalidRequest     = "invalid_request"
+	ecInvalidClient      = "invalid_client"
+	ecInvalidGrant       = "invalid_grant"
+	ecInvalidScope       = "invalid_scope"
+	ecServerError        = "server_error"
+	ecNotFound           = "not_found"
+	ecUnsupportedGrant   = "unsupported_grant_type"
+	ecUnauthorizedClient = "unauthorized_client"
+	ecInvalidRequestURI  = "invalid_request_uri"
+
+	// request object errors (RFC 9101 Section 6.3)
+	ecInvalidRequestObject = "invalid_request_object"
+
+	// device authorization grant errors (RFC 8628 Section 3.5)
+	ecAuthorizationPending = "authorization_pending"
+	ecSlowDown             = "slow_down"
+	ecExpiredToken         = "expired_token"
+
+	// DPoP errors (RFC 9449 Section 12.2)
+	ecInvalidDPoPProof = "invalid_dpop_proof"
+	ecUseDPoPNonce     = "use_dpop_nonce"
 )
 
 // New creates a new IDPServer instance
@@ -170,13 +259,22 @@ func New(lc *local.Client, stateDir string, funnel, localTSMode, enableSTS bool)
 		funnel:        funnel,
 		localTSMode:   localTSMode,
 		enableSTS:     enableSTS,
-		code:          make(map[string]*AuthRequest),
-		accessToken:   make(map[string]*AuthRequest),
-		refreshToken:  make(map[string]*AuthRequest),
+		code:          newMemTokenStore(),
+		accessToken:   newMemTokenStore(),
+		refreshToken:  newMemTokenStore(),
 		funnelClients: make(map[string]*FunnelClient),
+
+		usedRefreshTokens: newMemTokenStore(),
 	}
 }
 
+// Close stops the server's background work, such as back-channel logout
+// deliveries.
+func (s *IDPServer) Close() {
+	s.logoutDeliveries()
+	s.logoutCancel()
+}
+
 // SetServerURL sets the server URL
 func (s *IDPServer) SetServerURL(hostname string, port int) {
 	s.hostname = hostname
@@ -197,7 +295,22 @@ func (s *IDPServer) SetLoopbackURL(url string) {
 	s.loopbackURL = url
 }
 
-// CleanupExpiredTokens removes expired tokens from memory
+// SetHTTPClient sets the HTTP client used for requests to relying parties,
+// such as back-channel logout notifications. In tsnet mode this must be a
+// client that can reach the tailnet.
+func (s *IDPServer) SetHTTPClient(c *http.Client) {
+	s.httpClient = c
+}
+
+// outboundHTTPClient returns the HTTP client for requests to relying parties
+func (s *IDPServer) outboundHTTPClient() *http.Client {
+	if s.httpClient != nil {
+		return s.httpClient
+	}
+	return http.DefaultClient
+}
+
+// CleanupExpiredTokens removes expired tokens from the token stores
 func (s *IDPServer) CleanupExpiredTokens() {
 	s.mu.Lock()
 	defer s.mu.Unlock()
@@ -205,25 +318,50 @@ func (s *IDPServer) CleanupExpiredTokens() {
 	now := time.Now()
 
 	// Clean up authorization codes (they should be short-lived)
-	for code, ar := range s.code {
-		if now.After(ar.ValidTill) {
-			delete(s.code, code)
-		}
+	if err := s.code.DeleteFunc(func(_ string, ar *AuthRequest) bool {
+		return now.After(ar.ValidTill)
+	}); err != nil {
+		slog.Warn("failed to persist authorization code cleanup", slog.Any("error", err))
 	}
 
 	// Clean up access tokens
-	for token, ar := range s.accessToken {
-		if now.After(ar.ValidTill) {
-			delete(s.accessToken, token)
-		}
+	if err := s.accessToken.DeleteFunc(func(_ string, ar *AuthRequest) bool {
+		return now.After(ar.ValidTill)
+	}); err != nil {
+		slog.Warn("failed to persist access token cleanup", slog.Any("error", err))
 	}
 
 	// Clean up refresh tokens (if they have an expiry)
-	for token, ar := range s.refreshToken {
-		if !ar.ValidTill.IsZero() && now.After(ar.ValidTill) {
-			delete(s.refreshToken, token)
-		}
+	if err := s.refreshToken.DeleteFunc(func(_ string, ar *AuthRequest) bool {
+		return !ar.ValidTill.IsZero() && now.After(ar.ValidTill)
+	}); err != nil {
+		slog.Warn("failed to persist refresh token cleanup", slog.Any("error", err))
+	}
+	if err := s.usedRefreshTokens.DeleteFunc(func(_ string, ar *AuthRequest) bool {
+		return now.After(ar.ValidTill)
+	}); err != nil {
+		slog.Warn("failed to persist used refresh token cleanup", slog.Any("error", err))
 	}
+
+	// Clean up device authorization requests
+	maps.DeleteFunc(s.deviceAuths, func(_ string, da *deviceAuthorization) bool {
+		return now.After(da.ar.ValidTill)
+	})
+
+	// Clean up pushed authorization requests
+	maps.DeleteFunc(s.pushedAuthRequests, func(_ string, par *pushedAuthRequest) bool {
+		return now.After(par.ar.ValidTill)
+	})
+
+	// Clean up used client assertion IDs
+	maps.DeleteFunc(s.clientAssertionJTIs, func(_ string, exp time.Time) bool {
+		return now.After(exp)
+	})
+
+	// Clean up used DPoP proof IDs
+	maps.DeleteFunc(s.dpopJTIs, func(_ string, exp time.Time) bool {
+		return now.After(exp)
+	})
 }
 
 // ServeHTTP implements http.Handler
@@ -244,15 +382,34 @@ func (s *IDPServer) newMux() http.Handler {
 	// Register /authorize endpoint
 	mux.HandleFunc("/authorize", s.serveAuthorize)
 
+	// Register pushed authorization request endpoint (RFC 9126)
+	mux.HandleFunc("/par", s.servePushedAuthorizationRequest)
+
 	// Register /token endpoint
 	mux.HandleFunc("/token", s.serveToken)
 
 	// Register /introspect endpoint
 	mux.HandleFunc("/introspect", s.serveIntrospect)
 
+	// Register /revoke endpoint
+	mux.HandleFunc("/revoke", s.serveRevoke)
+
+	// Register /end_session endpoint for RP-initiated logout
+	mux.HandleFunc("/end_session", s.serveEndSession)
+
 	// Register /userinfo endpoint
 	mux.HandleFunc("/userinfo", s.serveUserInfo)
 
+	// Register device authorization grant endpoints (RFC 8628)
+	mux.HandleFunc("/device_authorization", s.serveDeviceAuthorization)
+	mux.HandleFunc("/device", s.serveDevice)
+
+	// The stylesheet is shared by the admin UI and the device page
+	mux.HandleFunc("/style.css", serveStyleCSS)
+
+	// Register /workload-token endpoint for tagged node identity tokens
+	mux.HandleFunc("/workload-token", s.serveWorkloadToken)
+
 	// Register /register endpoint for Dynamic Client Registration
 	mux.HandleFunc("/register", s.addGrantAccessContext(s.serveDynamicClientRegistration))
 
@@ -260,6 +417,9 @@ func (s *IDPServer) newMux() http.Handler {
 	// wrap it in a cross origin protection handler to prevent CSRF
 	mux.Handle("/clients/", s.addGrantAccessContext(s.serveClients))
 
+	// Register /keys/ - API access to inspect and rotate signing keys
+	mux.Handle("/keys/", s.addGrantAccessContext(s.serveSigningKeys))
+
 	// Register UI handler - must be last as it handles "/"
 	mux.Handle("/", s.addGrantAccessContext(s.handleUI))
 
@@ -268,59 +428,6 @@ func (s *IDPServer) newMux() http.Handler {
 	return protect.Handler(mux)
 }
 
-// oidcSigner returns a JOSE signer for signing JWT tokens
-func (s *IDPServer) oidcSigner() (jose.Signer, error) {
-	return s.lazySigner.GetErr(func() (jose.Signer, error) {
-		sk, err := s.oidcPrivateKey()
-		if err != nil {
-			return nil, err
-		}
-		return jose.NewSigner(jose.SigningKey{
-			Algorithm: jose.RS256,
-			Key:       sk.Key,
-		}, &jose.SignerOptions{EmbedJWK: false, ExtraHeaders: map[jose.HeaderKey]any{
-			jose.HeaderType: "JWT",
-			"kid":           fmt.Sprint(sk.Kid),
-		}})
-	})
-}
-
-// oidcPrivateKey returns the private key used for signing JWT tokens
-func (s *IDPServer) oidcPrivateKey() (*signingKey, error) {
-	return s.lazySigningKey.GetErr(func() (*signingKey, error) {
-		var sk signingKey
-		keyPath := "oidc-key.json"
-		if s.stateDir != "" {
-			keyPath = filepath.Join(s.stateDir, "oidc-key.json")
-		}
-		b, err := os.ReadFile(keyPath)
-		if err == nil {
-			if err := json.Unmarshal(b, &sk); err == nil {
-				return &sk, nil
-			} else {
-				slog.Warn("Error unmarshaling oidc key, recreating it", slog.Any("error", err))
-			}
-		}
-		id, k, err := genRSAKey(2048)
-		if err != nil {
-			slog.Error("Error generating RSA key", slog.Any("error", err))
-			return nil, fmt.Errorf("could not generate rsa key: %s", err.Error())
-		}
-		sk.Key = k
-		sk.Kid = id
-		b, err = json.Marshal(&sk)
-		if err != nil {
-			slog.Error("Error marshaling signing key", slog.Any("error", err))
-			return nil, fmt.Errorf("could not marshal signing key, %s", err.Error())
-		}
-		if err := os.WriteFile(keyPath, b, 0600); err != nil {
-			slog.Error("Error writing oidc key", slog.Any("error", err))
-			return nil, fmt.Errorf("could not write oidc key, %s", err.Error())
-		}
-		return &sk, nil
-	})
-}
-
 // realishEmail converts emailish addresses ending in @github or @passkey to
 // a more email-like format by appending the hostname
 func (s *IDPServer) realishEmail(email string) string {
@@ -331,67 +438,6 @@ func (s *IDPServer) realishEmail(email string) string {
 	return email
 }
 
-// genRSAKey generates an RSA key of the specified size
-func genRSAKey(bits int) (kid uint64, k *rsa.PrivateKey, err error) {
-	k, err = rsa.GenerateKey(rand.Reader, bits)
-	if err != nil {
-		return
-	}
-	kid, err = readUint64(rand.Reader)
-	return
-}
-
-// readUint64 reads a uint64 from the given reader
-func readUint64(r io.Reader) (uint64, error) {
-	b := make([]byte, 8)
-	if _, err := r.Read(b); err != nil {
-		return 0, err
-	}
-	return binary.BigEndian.Uint64(b), nil
-}
-
-// rsaPrivateKeyJSONWrapper wraps an RSA private key for JSON serialization
-type rsaPrivateKeyJSONWrapper struct {
-	Kid uint64 `json:"kid"`
-	Key string `json:"key"` // PEM-encoded RSA private key
-}
-
-// MarshalJSON serializes the signing key to JSON
-func (sk *signingKey) MarshalJSON() ([]byte, error) {
-	if sk.Key == nil {
-		return nil, fmt.Errorf("signing key is nil")
-	}
-	keyBytes := x509.MarshalPKCS1PrivateKey(sk.Key)
-	pemBlock := &pem.Block{
-		Type:  "RSA PRIVATE KEY",
-		Bytes: keyBytes,
-	}
-	wrapper := rsaPrivateKeyJSONWrapper{
-		Kid: sk.Kid,
-		Key: string(pem.EncodeToMemory(pemBlock)),
-	}
-	return json.Marshal(wrapper)
-}
-
-// UnmarshalJSON deserializes the signing key from JSON
-func (sk *signingKey) UnmarshalJSON(b []byte) error {
-	var wrapper rsaPrivateKeyJSONWrapper
-	if err := json.Unmarshal(b, &wrapper); err != nil {
-		return err
-	}
-	block, _ := pem.Decode([]byte(wrapper.Key))
-	if block == nil {
-		return fmt.Errorf("failed to decode PEM block")
-	}
-	key, err := x509.ParsePKCS1PrivateKey(block.Bytes)
-	if err != nil {
-		return err
-	}
-	sk.Kid = wrapper.Kid
-	sk.Key = key
-	return nil
-}
-
 // ServeOnLocalTailscaled starts a serve session using an already-running tailscaled
 func ServeOnLocalTailscaled(ctx context.Context, lc *local.Client, st *ipnstate.Status, dstPort uint16, shouldFunnel bool) (cleanup func(), watcherChan chan error, err error) {
 	// In order to support funneling out in local tailscaled mode, we need
@@ -35,15 +35,15 @@ func TestNew(t *testing.T) {
 	}
 
 	if srv.code == nil {
-		t.Error("code map not initialized")
+		t.Error("code store not initialized")
 	}
 
 	if srv.accessToken == nil {
-		t.Error("accessToken map not initialized")
+		t.Error("accessToken store not initialized")
 	}
 
 	if srv.refreshToken == nil {
-		t.Error("refreshToken map not initialized")
+		t.Error("refreshToken store not initialized")
 	}
 
 	if srv.funnelClients == nil {
@@ -125,52 +125,52 @@ func TestCleanupExpiredTokens(t *testing.T) {
 	now := time.Now()
 
 	// Add expired authorization code
-	srv.code["expired-code"] = &AuthRequest{
+	srv.code.Set("expired-code", &AuthRequest{
 		ClientID:  "test-client",
 		ValidTill: now.Add(-1 * time.Hour),
-	}
+	})
 
 	// Add valid authorization code
-	srv.code["valid-code"] = &AuthRequest{
+	srv.code.Set("valid-code", &AuthRequest{
 		ClientID:  "test-client",
 		ValidTill: now.Add(1 * time.Hour),
-	}
+	})
 
 	// Add expired access token
-	srv.accessToken["expired-token"] = &AuthRequest{
+	srv.accessToken.Set("expired-token", &AuthRequest{
 		ClientID:  "test-client",
 		ValidTill: now.Add(-1 * time.Hour),
-	}
+	})
 
 	// Add valid access token
-	srv.accessToken["valid-token"] = &AuthRequest{
+	srv.accessToken.Set("valid-token", &AuthRequest{
 		ClientID:  "test-client",
 		ValidTill: now.Add(1 * time.Hour),
-	}
+	})
 
 	// Add expired refresh token
-	srv.refreshToken["expired-refresh"] = &AuthRequest{
+	srv.refreshToken.Set("expired-refresh", &AuthRequest{
 		ClientID:  "test-client",
 		ValidTill: now.Add(-1 * time.Hour),
-	}
+	})
 
 	// Add another expired refresh token for more coverage
-	srv.refreshToken["expired-refresh-2"] = &AuthRequest{
+	srv.refreshToken.Set("expired-refresh-2", &AuthRequest{
 		ClientID:  "test-client",
 		ValidTill: now.Add(-24 * time.Hour),
-	}
+	})
 
 	// Add valid refresh token (no expiry)
-	srv.refreshToken["valid-refresh"] = &AuthRequest{
+	srv.refreshToken.Set("valid-refresh", &AuthRequest{
 		ClientID: "test-client",
 		// No ValidTill set means no expiry
-	}
+	})
 
 	// Add valid refresh token with explicit expiry
-	srv.refreshToken["valid-refresh-2"] = &AuthRequest{
+	srv.refreshToken.Set("valid-refresh-2", &AuthRequest{
 		ClientID:  "test-client",
 		ValidTill: now.Add(24 * time.Hour),
-	}
+	})
 
 	// Run cleanup
 	srv.CleanupExpiredTokens()
@@ -179,47 +179,47 @@ func TestCleanupExpiredTokens(t *testing.T) {
 	srv.mu.Lock()
 	defer srv.mu.Unlock()
 
-	if _, exists := srv.code["expired-code"]; exists {
+	if _, exists := srv.code.Get("expired-code"); exists {
 		t.Error("Expired authorization code was not removed")
 	}
 
-	if _, exists := srv.code["valid-code"]; !exists {
+	if _, exists := srv.code.Get("valid-code"); !exists {
 		t.Error("Valid authorization code was incorrectly removed")
 	}
 
-	if _, exists := srv.accessToken["expired-token"]; exists {
+	if _, exists := srv.accessToken.Get("expired-token"); exists {
 		t.Error("Expired access token was not removed")
 	}
 
-	if _, exists := srv.accessToken["valid-token"]; !exists {
+	if _, exists := srv.accessToken.Get("valid-token"); !exists {
 		t.Error("Valid access token was incorrectly removed")
 	}
 
-	if _, exists := srv.refreshToken["expired-refresh"]; exists {
+	if _, exists := srv.refreshToken.Get("expired-refresh"); exists {
 		t.Error("Expired refresh token was not removed")
 	}
 
-	if _, exists := srv.refreshToken["expired-refresh-2"]; exists {
+	if _, exists := srv.refreshToken.Get("expired-refresh-2"); exists {
 		t.Error("Second expired refresh token was not removed")
 	}
 
-	if _, exists := srv.refreshToken["valid-refresh"]; !exists {
+	if _, exists := srv.refreshToken.Get("valid-refresh"); !exists {
 		t.Error("Valid refresh token was incorrectly removed")
 	}
 
-	if _, exists := srv.refreshToken["valid-refresh-2"]; !exists {
+	if _, exists := srv.refreshToken.Get("valid-refresh-2"); !exists {
 		t.Error("Second valid refresh token was incorrectly removed")
 	}
 
 	// Verify final counts match expectations
-	if len(srv.code) != 1 {
-		t.Errorf("Expected 1 valid authorization code, got %d", len(srv.code))
+	if tokenCount(srv.code) != 1 {
+		t.Errorf("Expected 1 valid authorization code, got %d", tokenCount(srv.code))
 	}
-	if len(srv.accessToken) != 1 {
-		t.Errorf("Expected 1 valid access token, got %d", len(srv.accessToken))
+	if tokenCount(srv.accessToken) != 1 {
+		t.Errorf("Expected 1 valid access token, got %d", tokenCount(srv.accessToken))
 	}
-	if len(srv.refreshToken) != 2 {
-		t.Errorf("Expected 2 valid refresh tokens, got %d", len(srv.refreshToken))
+	if tokenCount(srv.refreshToken) != 2 {
+		t.Errorf("Expected 2 valid refresh tokens, got %d", tokenCount(srv.refreshToken))
 	}
 }
 
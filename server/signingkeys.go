@@ -0,0 +1,635 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package server
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"gopkg.in/square/go-jose.v2"
+	"tailscale.com/atomicfile"
+)
+
+const (
+	// signingKeysFile holds the signing key ring.
+	signingKeysFile = "oidc-keys.json"
+
+	// legacySigningKeyFile held the single signing key used by older
+	// versions of tsidp. It is migrated into the key ring on first load.
+	legacySigningKeyFile = "oidc-key.json"
+
+	// SigningKeyPublishLead is how long a new signing key is published in
+	// the JWKS before tsidp starts signing tokens with it, so that relying
+	// parties with a cached JWKS pick it up before they see it in use.
+	SigningKeyPublishLead = 24 * time.Hour
+
+	// signedUntilStep is how far past the expiry of a token a key's
+	// SignedUntil is moved when the token outlives it, so that the key ring
+	// is written about once per step rather than for every token.
+	signedUntilStep = time.Hour
+)
+
+// signingAlgs are the algorithms tsidp keeps a signing key for. Every
+// rotation generates a new key for each of them.
+var signingAlgs = []jose.SignatureAlgorithm{jose.RS256, jose.ES256, jose.EdDSA}
+
+// signingKey represents a JWT signing key
+type signingKey struct {
+	Kid uint64                  `json:"kid"`
+	Alg jose.SignatureAlgorithm `json:"-"`
+	Key crypto.Signer           `json:"-"` // *rsa.PrivateKey, *ecdsa.PrivateKey or ed25519.PrivateKey
+
+	// CreatedAt is when the key was generated and first published.
+	CreatedAt time.Time `json:"-"`
+
+	// ActivateAt is when the key starts signing tokens. A zero value means
+	// the key has been active since it was created.
+	ActivateAt time.Time `json:"-"`
+
+	// SignedUntil is no earlier than the expiry of every token the key
+	// signed. It is zero for keys that retired before it was recorded.
+	SignedUntil time.Time `json:"-"`
+}
+
+// signingKeyRing is the set of signing keys published in the JWKS, ordered by
+// ActivateAt. For each algorithm, the last key whose ActivateAt has passed
+// signs new tokens. Keys activating later are pending, and earlier keys of
+// the same algorithm are retired and kept until every token they signed has
+// expired.
+type signingKeyRing struct {
+	Keys []*signingKey `json:"keys"`
+}
+
+// active returns the key for alg that signs tokens at now, or nil if there
+// is none.
+func (kr *signingKeyRing) active(alg jose.SignatureAlgorithm, now time.Time) *signingKey {
+	for i := len(kr.Keys) - 1; i >= 0; i-- {
+		if k := kr.Keys[i]; k.Alg == alg && !k.ActivateAt.After(now) {
+			return k
+		}
+	}
+	return nil
+}
+
+// pending returns a published key that has not started signing yet, or nil
+// if no rotation is scheduled.
+func (kr *signingKeyRing) pending(now time.Time) *signingKey {
+	for _, k := range kr.Keys {
+		if k.ActivateAt.After(now) {
+			return k
+		}
+	}
+	return nil
+}
+
+// retiredAt returns when Keys[i] stopped signing tokens, which is when the
+// next key of the same algorithm was activated. It reports false if Keys[i]
+// has not been superseded yet.
+func (kr *signingKeyRing) retiredAt(i int, now time.Time) (time.Time, bool) {
+	for _, k := range kr.Keys[i+1:] {
+		if k.Alg == kr.Keys[i].Alg {
+			return k.ActivateAt, !k.ActivateAt.After(now)
+		}
+	}
+	return time.Time{}, false
+}
+
+// status returns "pending", "active" or "retired" for Keys[i].
+func (kr *signingKeyRing) status(i int, now time.Time) string {
+	if kr.Keys[i].ActivateAt.After(now) {
+		return "pending"
+	}
+	if _, ok := kr.retiredAt(i, now); ok {
+		return "retired"
+	}
+	return "active"
+}
+
+// prune removes retired keys once the tokens they signed have expired,
+// allowing for clock skew. Keys that didn't record when that is are removed
+// once they were superseded more than grace ago. It reports whether any key
+// was removed.
+func (kr *signingKeyRing) prune(now time.Time, grace time.Duration) bool {
+	keep := make([]*signingKey, 0, len(kr.Keys))
+	for i, k := range kr.Keys {
+		if at, ok := kr.retiredAt(i, now); ok {
+			until := at.Add(grace)
+			if !k.SignedUntil.IsZero() {
+				until = k.SignedUntil.Add(NotValidBeforeClockSkew)
+			}
+			if now.After(until) {
+				continue
+			}
+		}
+		keep = append(keep, k)
+	}
+	if len(keep) == len(kr.Keys) {
+		return false
+	}
+	kr.Keys = keep
+	return true
+}
+
+// add adds k to the ring, keeping the ring ordered by ActivateAt.
+func (kr *signingKeyRing) add(k *signingKey) {
+	kr.Keys = append(kr.Keys, k)
+	slices.SortStableFunc(kr.Keys, func(a, b *signingKey) int {
+		return a.ActivateAt.Compare(b.ActivateAt)
+	})
+}
+
+// SetSigningKeyRotation sets how long a signing key is used before it is
+// rotated by MaintainSigningKeys. A zero interval disables scheduled rotation.
+func (s *IDPServer) SetSigningKeyRotation(interval time.Duration) {
+	s.keyMu.Lock()
+	defer s.keyMu.Unlock()
+	s.keyRotation = interval
+}
+
+// RotateSigningKey generates a new signing key for every algorithm and
+// publishes them in the JWKS. The keys start signing tokens after
+// SigningKeyPublishLead, at which point the current keys are retired. It
+// returns the kid of the new RS256 key. If a rotation is already pending,
+// the pending key is returned instead of creating another one.
+func (s *IDPServer) RotateSigningKey() (kid uint64, activateAt time.Time, err error) {
+	s.keyMu.Lock()
+	defer s.keyMu.Unlock()
+
+	k, err := s.rotateSigningKeyLocked(time.Now())
+	if err != nil {
+		return 0, time.Time{}, err
+	}
+	return k.Kid, k.ActivateAt, nil
+}
+
+// rotateSigningKeyLocked adds a pending key for every signing algorithm to
+// the key ring and persists it. It returns the pending RS256 key.
+// Caller must hold s.keyMu lock
+func (s *IDPServer) rotateSigningKeyLocked(now time.Time) (*signingKey, error) {
+	kr, err := s.loadSigningKeysLocked()
+	if err != nil {
+		return nil, err
+	}
+	if k := kr.pending(now); k != nil {
+		return k, nil
+	}
+
+	var rsaKey *signingKey
+	for _, alg := range signingAlgs {
+		k, err := genSigningKey(alg, now)
+		if err != nil {
+			return nil, err
+		}
+		k.ActivateAt = now.Add(SigningKeyPublishLead)
+		kr.add(k)
+		if alg == jose.RS256 {
+			rsaKey = k
+		}
+	}
+	if err := s.storeSigningKeysLocked(); err != nil {
+		return nil, err
+	}
+	slog.Info("signing key rotation scheduled",
+		slog.String("kid", fmt.Sprint(rsaKey.Kid)),
+		slog.Time("activate_at", rsaKey.ActivateAt),
+	)
+	return rsaKey, nil
+}
+
+// MaintainSigningKeys schedules a key rotation once the active signing key
+// has been in use for the configured rotation interval, and removes retired
+// keys once every token they signed has expired. It is meant to be called
+// periodically.
+func (s *IDPServer) MaintainSigningKeys() error {
+	gracePeriod := s.retiredSigningKeyGracePeriod()
+
+	s.keyMu.Lock()
+	defer s.keyMu.Unlock()
+
+	now := time.Now()
+	kr, err := s.loadSigningKeysLocked()
+	if err != nil {
+		return err
+	}
+
+	if kr.prune(now, gracePeriod) {
+		if err := s.storeSigningKeysLocked(); err != nil {
+			return err
+		}
+		slog.Info("retired signing keys removed from JWKS")
+	}
+
+	if s.keyRotation <= 0 || kr.pending(now) != nil {
+		return nil
+	}
+	active := kr.active(jose.RS256, now)
+	if active == nil {
+		return nil
+	}
+	since := active.ActivateAt
+	if since.IsZero() {
+		since = active.CreatedAt
+	}
+	// Publish the next key ahead of time so that it takes over when the
+	// active key reaches the end of its rotation interval.
+	if now.Before(since.Add(s.keyRotation - SigningKeyPublishLead)) {
+		return nil
+	}
+	_, err = s.rotateSigningKeyLocked(now)
+	return err
+}
+
+// signerKey identifies a cached signer: the kid of its key and the typ
+// header it sets.
+type signerKey struct {
+	kid uint64
+	typ string
+}
+
+// idTokenType is the typ header of ID tokens. Other JWTs tsidp signs have
+// their own type, so that they can't pass for ID tokens.
+const idTokenType = "JWT"
+
+// oidcSigner returns a JOSE signer for signing ID tokens valid until exp
+// with the active signing key for alg
+func (s *IDPServer) oidcSigner(alg jose.SignatureAlgorithm, exp time.Time) (jose.Signer, error) {
+	return s.signerWithType(alg, idTokenType, exp)
+}
+
+// accessTokenSigner returns a JOSE signer for signing JWT access tokens
+// (RFC 9068) valid until exp with the active signing key for alg
+func (s *IDPServer) accessTokenSigner(alg jose.SignatureAlgorithm, exp time.Time) (jose.Signer, error) {
+	return s.signerWithType(alg, "at+jwt", exp)
+}
+
+// signerWithType returns a JOSE signer for the active signing key for alg
+// that sets the typ header to typ, for signing tokens valid until exp. The
+// key stays published until then once it is retired.
+func (s *IDPServer) signerWithType(alg jose.SignatureAlgorithm, typ string, exp time.Time) (jose.Signer, error) {
+	s.keyMu.Lock()
+	defer s.keyMu.Unlock()
+
+	kr, err := s.loadSigningKeysLocked()
+	if err != nil {
+		return nil, err
+	}
+	sk := kr.active(alg, time.Now())
+	if sk == nil {
+		return nil, fmt.Errorf("no active %s signing key", alg)
+	}
+	if exp.After(sk.SignedUntil) {
+		prev := sk.SignedUntil
+		sk.SignedUntil = exp.Add(signedUntilStep)
+		if err := s.storeSigningKeysLocked(); err != nil {
+			sk.SignedUntil = prev
+			return nil, err
+		}
+	}
+	key := signerKey{kid: sk.Kid, typ: typ}
+	if sig, ok := s.signers[key]; ok {
+		return sig, nil
+	}
+	sig, err := jose.NewSigner(jose.SigningKey{
+		Algorithm: sk.Alg,
+		Key:       sk.Key,
+	}, &jose.SignerOptions{EmbedJWK: false, ExtraHeaders: map[jose.HeaderKey]any{
+		jose.HeaderType: typ,
+		"kid":           fmt.Sprint(sk.Kid),
+	}})
+	if err != nil {
+		return nil, err
+	}
+	if s.signers == nil {
+		s.signers = make(map[signerKey]jose.Signer)
+	}
+	s.signers[key] = sig
+	return sig, nil
+}
+
+// publishedSigningKeys returns the keys to publish in the JWKS: pending,
+// active and retired keys.
+func (s *IDPServer) publishedSigningKeys() ([]*signingKey, error) {
+	s.keyMu.Lock()
+	defer s.keyMu.Unlock()
+
+	kr, err := s.loadSigningKeysLocked()
+	if err != nil {
+		return nil, err
+	}
+	return slices.Clone(kr.Keys), nil
+}
+
+// loadSigningKeysLocked returns the signing key ring, loading it from the state
+// directory on first use. A key written by older versions of tsidp is
+// migrated into the ring, and a new key is generated if there is none.
+// Caller must hold s.keyMu lock
+func (s *IDPServer) loadSigningKeysLocked() (*signingKeyRing, error) {
+	if s.keys != nil {
+		return s.keys, nil
+	}
+
+	var kr signingKeyRing
+	dirty := false
+	b, err := os.ReadFile(s.statePath(signingKeysFile))
+	switch {
+	case err == nil:
+		// Replacing the keys would invalidate every token in circulation.
+		if err := json.Unmarshal(b, &kr); err != nil {
+			return nil, fmt.Errorf("could not read oidc key ring %s: %w", signingKeysFile, err)
+		}
+	case !os.IsNotExist(err):
+		return nil, fmt.Errorf("could not read oidc key ring %s: %w", signingKeysFile, err)
+	}
+
+	// Migrate the single key used by older versions, so that tokens they
+	// issued keep verifying. The old file is left in place for downgrades.
+	if len(kr.Keys) == 0 {
+		if b, err := os.ReadFile(s.statePath(legacySigningKeyFile)); err == nil {
+			var sk signingKey
+			if err := json.Unmarshal(b, &sk); err == nil {
+				slog.Info("Migrating oidc key into key ring",
+					slog.String("from", legacySigningKeyFile),
+					slog.String("to", signingKeysFile),
+				)
+				kr.add(&sk)
+				dirty = true
+			} else {
+				slog.Warn("Error unmarshaling oidc key, recreating it", slog.Any("error", err))
+			}
+		}
+	}
+
+	// Generate a key for every algorithm that has none yet, such as on
+	// first start or after upgrading from a version that only used RS256.
+	now := time.Now()
+	for _, alg := range signingAlgs {
+		if slices.ContainsFunc(kr.Keys, func(k *signingKey) bool { return k.Alg == alg }) {
+			continue
+		}
+		k, err := genSigningKey(alg, now)
+		if err != nil {
+			return nil, err
+		}
+		kr.add(k)
+		dirty = true
+	}
+
+	s.keys = &kr
+	if dirty {
+		if err := s.storeSigningKeysLocked(); err != nil {
+			s.keys = nil
+			return nil, err
+		}
+	}
+	return s.keys, nil
+}
+
+// storeSigningKeysLocked persists the signing key ring to disk
+// Caller must hold s.keyMu lock
+func (s *IDPServer) storeSigningKeysLocked() error {
+	b, err := json.Marshal(s.keys)
+	if err != nil {
+		slog.Error("Error marshaling signing keys", slog.Any("error", err))
+		return fmt.Errorf("could not marshal signing keys, %s", err.Error())
+	}
+	if err := atomicfile.WriteFile(s.statePath(signingKeysFile), b, 0600); err != nil {
+		slog.Error("Error writing oidc key ring", slog.Any("error", err))
+		return fmt.Errorf("could not write oidc key ring, %s", err.Error())
+	}
+	return nil
+}
+
+// genSigningKey generates a new active signing key for alg
+func genSigningKey(alg jose.SignatureAlgorithm, now time.Time) (*signingKey, error) {
+	var key crypto.Signer
+	var err error
+	switch alg {
+	case jose.RS256:
+		key, err = rsa.GenerateKey(rand.Reader, 2048)
+	case jose.ES256:
+		key, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	case jose.EdDSA:
+		_, key, err = ed25519.GenerateKey(rand.Reader)
+	default:
+		return nil, fmt.Errorf("unsupported signing algorithm %q", alg)
+	}
+	if err != nil {
+		slog.Error("Error generating signing key", slog.String("alg", string(alg)), slog.Any("error", err))
+		return nil, fmt.Errorf("could not generate %s key: %w", alg, err)
+	}
+	kid, err := readUint64(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	return &signingKey{Kid: kid, Alg: alg, Key: key, CreatedAt: now}, nil
+}
+
+// readUint64 reads a uint64 from the given reader
+func readUint64(r io.Reader) (uint64, error) {
+	b := make([]byte, 8)
+	if _, err := r.Read(b); err != nil {
+		return 0, err
+	}
+	return binary.BigEndian.Uint64(b), nil
+}
+
+// signingKeyJSONWrapper wraps a signing key for JSON serialization
+type signingKeyJSONWrapper struct {
+	Kid         uint64    `json:"kid"`
+	Alg         string    `json:"alg,omitempty"` // RS256 if empty
+	Key         string    `json:"key"`           // PEM-encoded private key
+	CreatedAt   time.Time `json:"created_at,omitzero"`
+	ActivateAt  time.Time `json:"activate_at,omitzero"`
+	SignedUntil time.Time `json:"signed_until,omitzero"`
+}
+
+// MarshalJSON serializes the signing key to JSON. RSA keys are encoded as
+// PKCS #1 so that older versions can read them; other keys use PKCS #8.
+func (sk *signingKey) MarshalJSON() ([]byte, error) {
+	if sk.Key == nil {
+		return nil, fmt.Errorf("signing key is nil")
+	}
+	var pemBlock *pem.Block
+	if k, ok := sk.Key.(*rsa.PrivateKey); ok {
+		pemBlock = &pem.Block{
+			Type:  "RSA PRIVATE KEY",
+			Bytes: x509.MarshalPKCS1PrivateKey(k),
+		}
+	} else {
+		keyBytes, err := x509.MarshalPKCS8PrivateKey(sk.Key)
+		if err != nil {
+			return nil, err
+		}
+		pemBlock = &pem.Block{
+			Type:  "PRIVATE KEY",
+			Bytes: keyBytes,
+		}
+	}
+	wrapper := signingKeyJSONWrapper{
+		Kid:         sk.Kid,
+		Alg:         string(sk.Alg),
+		Key:         string(pem.EncodeToMemory(pemBlock)),
+		CreatedAt:   sk.CreatedAt,
+		ActivateAt:  sk.ActivateAt,
+		SignedUntil: sk.SignedUntil,
+	}
+	return json.Marshal(wrapper)
+}
+
+// UnmarshalJSON deserializes the signing key from JSON
+func (sk *signingKey) UnmarshalJSON(b []byte) error {
+	var wrapper signingKeyJSONWrapper
+	if err := json.Unmarshal(b, &wrapper); err != nil {
+		return err
+	}
+	block, _ := pem.Decode([]byte(wrapper.Key))
+	if block == nil {
+		return fmt.Errorf("failed to decode PEM block")
+	}
+	alg := jose.SignatureAlgorithm(wrapper.Alg)
+	if alg == "" {
+		alg = jose.RS256
+	}
+	var key crypto.Signer
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		k, err := x509.ParsePKCS1PrivateKey(block.Bytes)
+		if err != nil {
+			return err
+		}
+		key = k
+	case "PRIVATE KEY":
+		k, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return err
+		}
+		signer, ok := k.(crypto.Signer)
+		if !ok {
+			return fmt.Errorf("unsupported private key type %T", k)
+		}
+		key = signer
+	default:
+		return fmt.Errorf("unsupported PEM block type %q", block.Type)
+	}
+	if !keyMatchesAlg(key, alg) {
+		return fmt.Errorf("%T cannot be used with %s", key, alg)
+	}
+	sk.Kid = wrapper.Kid
+	sk.Alg = alg
+	sk.Key = key
+	sk.CreatedAt = wrapper.CreatedAt
+	sk.ActivateAt = wrapper.ActivateAt
+	sk.SignedUntil = wrapper.SignedUntil
+	return nil
+}
+
+// keyMatchesAlg reports whether key can sign tokens with alg
+func keyMatchesAlg(key crypto.Signer, alg jose.SignatureAlgorithm) bool {
+	switch key.(type) {
+	case *rsa.PrivateKey:
+		return alg == jose.RS256
+	case *ecdsa.PrivateKey:
+		return alg == jose.ES256
+	case ed25519.PrivateKey:
+		return alg == jose.EdDSA
+	}
+	return false
+}
+
+// signingKeyInfo is the public description of a signing key returned by the
+// /keys/ API.
+type signingKeyInfo struct {
+	Kid        string    `json:"kid"`
+	Alg        string    `json:"alg"`
+	Status     string    `json:"status"` // "pending", "active" or "retired"
+	CreatedAt  time.Time `json:"created_at,omitzero"`
+	ActivateAt time.Time `json:"activate_at,omitzero"`
+}
+
+// serveSigningKeys handles the /keys/ endpoints for inspecting and rotating
+// signing keys
+func (s *IDPServer) serveSigningKeys(w http.ResponseWriter, r *http.Request) {
+	if isFunnelRequest(r) {
+		writeHTTPError(w, r, http.StatusUnauthorized, ecAccessDenied, "not available over funnel", nil)
+		return
+	}
+
+	access, ok := r.Context().Value(appCapCtxKey).(*accessGrantedRules)
+	if !ok {
+		writeHTTPError(w, r, http.StatusForbidden, ecAccessDenied, "application capability not found", nil)
+		return
+	}
+
+	// signing keys are managed with the same level of access as clients.
+	if !access.allowAdminUI {
+		writeHTTPError(w, r, http.StatusForbidden, ecAccessDenied, "application capability not granted", nil)
+		return
+	}
+
+	switch path := strings.TrimPrefix(r.URL.Path, "/keys/"); path {
+	case "":
+		if r.Method != "GET" {
+			writeHTTPError(w, r, http.StatusMethodNotAllowed, ecInvalidRequest, "method not allowed", nil)
+			return
+		}
+	case "rotate":
+		if r.Method != "POST" {
+			writeHTTPError(w, r, http.StatusMethodNotAllowed, ecInvalidRequest, "method not allowed", nil)
+			return
+		}
+		if _, _, err := s.RotateSigningKey(); err != nil {
+			writeHTTPError(w, r, http.StatusInternalServerError, ecServerError, "failed to rotate signing key", err)
+			return
+		}
+	default:
+		writeHTTPError(w, r, http.StatusNotFound, ecNotFound, "not found", nil)
+		return
+	}
+
+	keys, err := s.publishedSigningKeys()
+	if err != nil {
+		writeHTTPError(w, r, http.StatusInternalServerError, ecServerError, "failed to load signing keys", err)
+		return
+	}
+
+	kr := signingKeyRing{Keys: keys}
+	now := time.Now()
+	infos := make([]signingKeyInfo, 0, len(keys))
+	for i, k := range keys {
+		infos = append(infos, signingKeyInfo{
+			Kid:        fmt.Sprint(k.Kid),
+			Alg:        string(k.Alg),
+			Status:     kr.status(i, now),
+			CreatedAt:  k.CreatedAt,
+			ActivateAt: k.ActivateAt,
+		})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(infos)
+}
+
+// retiredSigningKeyGracePeriod returns how long a superseded signing key
+// that didn't record the expiry of its tokens stays published after it
+// signed its last token. It covers the lifetime of those tokens with the
+// current settings plus clock skew.
+func (s *IDPServer) retiredSigningKeyGracePeriod() time.Duration {
+	return s.longestSignedTokenLifetime() + NotValidBeforeClockSkew
+}
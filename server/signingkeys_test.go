@@ -0,0 +1,365 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"gopkg.in/square/go-jose.v2"
+	"gopkg.in/square/go-jose.v2/jwt"
+)
+
+// TestSigningKeyRing tests which key of a ring is active, pending or retired
+func TestSigningKeyRing(t *testing.T) {
+	now := time.Now()
+	kr := &signingKeyRing{}
+	kr.add(&signingKey{Kid: 1, Alg: jose.RS256})
+	kr.add(&signingKey{Kid: 3, Alg: jose.RS256, ActivateAt: now.Add(time.Hour)})
+	kr.add(&signingKey{Kid: 2, Alg: jose.RS256, ActivateAt: now.Add(-time.Hour)})
+	kr.add(&signingKey{Kid: 4, Alg: jose.ES256})
+
+	for i, want := range []uint64{1, 4, 2, 3} {
+		if kr.Keys[i].Kid != want {
+			t.Fatalf("Keys[%d].Kid = %d, want %d", i, kr.Keys[i].Kid, want)
+		}
+	}
+
+	if k := kr.active(jose.RS256, now); k == nil || k.Kid != 2 {
+		t.Errorf("active RS256 = %v, want kid 2", k)
+	}
+	if k := kr.active(jose.ES256, now); k == nil || k.Kid != 4 {
+		t.Errorf("active ES256 = %v, want kid 4", k)
+	}
+	if k := kr.active(jose.EdDSA, now); k != nil {
+		t.Errorf("active EdDSA = %v, want nil", k)
+	}
+	if k := kr.pending(now); k == nil || k.Kid != 3 {
+		t.Errorf("pending = %v, want kid 3", k)
+	}
+	if k := kr.active(jose.RS256, now.Add(2*time.Hour)); k == nil || k.Kid != 3 {
+		t.Errorf("active after activation = %v, want kid 3", k)
+	}
+	if k := kr.pending(now.Add(2 * time.Hour)); k != nil {
+		t.Errorf("pending after activation = %v, want nil", k)
+	}
+
+	var statuses []string
+	for i := range kr.Keys {
+		statuses = append(statuses, kr.status(i, now))
+	}
+	if got, want := fmt.Sprint(statuses), "[retired active active pending]"; got != want {
+		t.Errorf("statuses = %s, want %s", got, want)
+	}
+
+	// kid 1 was retired an hour ago; keep it while its tokens may be valid.
+	if kr.prune(now, 2*time.Hour) {
+		t.Error("prune removed a key still within the grace period")
+	}
+	if !kr.prune(now, 30*time.Minute) {
+		t.Error("prune did not remove a key past the grace period")
+	}
+	if len(kr.Keys) != 3 || kr.Keys[0].Kid != 4 {
+		t.Errorf("unexpected keys after prune: %v", kr.Keys)
+	}
+
+	// Keys that recorded the expiry of their tokens are kept until then,
+	// whatever the grace period.
+	kr.add(&signingKey{Kid: 5, Alg: jose.ES256, ActivateAt: now.Add(-2 * time.Hour)})
+	kr.Keys[0].SignedUntil = now.Add(time.Hour)
+	if kr.prune(now, 0) {
+		t.Errorf("prune removed a key whose tokens are still valid: %v", kr.Keys)
+	}
+	kr.Keys[0].SignedUntil = now.Add(-NotValidBeforeClockSkew - time.Minute)
+	if !kr.prune(now, 24*time.Hour) || len(kr.Keys) != 3 || kr.Keys[0].Kid != 5 {
+		t.Errorf("prune did not remove a key whose tokens have expired: %v", kr.Keys)
+	}
+}
+
+// TestRotateSigningKey tests that a rotated key is published before it
+// signs tokens, and that the retired key stays published until pruned
+func TestRotateSigningKey(t *testing.T) {
+	s := New(nil, t.TempDir(), false, false, false)
+
+	oldKids := make(map[jose.SignatureAlgorithm]string)
+	for _, alg := range signingAlgs {
+		oldKids[alg] = signedKid(t, s, alg)
+	}
+	if got := jwksKids(t, s); len(got) != len(signingAlgs) {
+		t.Fatalf("JWKS kids = %v, want one key per algorithm", got)
+	}
+
+	newKid, activateAt, err := s.RotateSigningKey()
+	if err != nil {
+		t.Fatalf("RotateSigningKey: %v", err)
+	}
+	if want := time.Now().Add(SigningKeyPublishLead); activateAt.After(want) || activateAt.Before(want.Add(-time.Minute)) {
+		t.Errorf("activateAt = %v, want about %v", activateAt, want)
+	}
+
+	// Rotating again while a rotation is pending returns the pending key.
+	if again, _, err := s.RotateSigningKey(); err != nil || again != newKid {
+		t.Errorf("second RotateSigningKey = %d, %v; want %d", again, err, newKid)
+	}
+
+	got := jwksKids(t, s)
+	if len(got) != 2*len(signingAlgs) || got[fmt.Sprint(newKid)] != string(jose.RS256) {
+		t.Errorf("JWKS kids = %v, want old and new keys", got)
+	}
+	for _, alg := range signingAlgs {
+		if kid := signedKid(t, s, alg); kid != oldKids[alg] {
+			t.Errorf("%s token signed with kid %s before activation, want %s", alg, kid, oldKids[alg])
+		}
+	}
+
+	// Activate the new keys.
+	setPendingActivateAt(s, time.Now().Add(-time.Minute))
+
+	if got := signedKid(t, s, jose.RS256); got != fmt.Sprint(newKid) {
+		t.Errorf("token signed with kid %s after activation, want %d", got, newKid)
+	}
+	for _, alg := range signingAlgs {
+		if kid := signedKid(t, s, alg); kid == oldKids[alg] {
+			t.Errorf("%s token signed with retired kid %s", alg, kid)
+		}
+	}
+
+	// The retired keys are still needed to verify tokens they signed.
+	if err := s.MaintainSigningKeys(); err != nil {
+		t.Fatalf("MaintainSigningKeys: %v", err)
+	}
+	if got := jwksKids(t, s); len(got) != 2*len(signingAlgs) {
+		t.Errorf("JWKS kids = %v, want retired keys still published", got)
+	}
+
+	// The retired keys recorded the expiry of the tokens they signed, and
+	// are kept until then even if they were superseded long ago.
+	s.keyMu.Lock()
+	for _, k := range s.keys.Keys {
+		if !k.ActivateAt.IsZero() {
+			k.ActivateAt = time.Now().Add(-s.retiredSigningKeyGracePeriod() - time.Minute)
+		} else if k.SignedUntil.Before(time.Now()) {
+			t.Errorf("retired kid %d signed until %v, want after its last token", k.Kid, k.SignedUntil)
+		}
+	}
+	s.keyMu.Unlock()
+	if err := s.MaintainSigningKeys(); err != nil {
+		t.Fatalf("MaintainSigningKeys: %v", err)
+	}
+	if got := jwksKids(t, s); len(got) != 2*len(signingAlgs) {
+		t.Errorf("JWKS kids = %v, want retired keys still published", got)
+	}
+
+	// Once their tokens have expired, the retired keys are removed.
+	s.keyMu.Lock()
+	for _, k := range s.keys.Keys {
+		if k.ActivateAt.IsZero() {
+			k.SignedUntil = time.Now().Add(-NotValidBeforeClockSkew - time.Minute)
+		}
+	}
+	s.keyMu.Unlock()
+	if err := s.MaintainSigningKeys(); err != nil {
+		t.Fatalf("MaintainSigningKeys: %v", err)
+	}
+	got = jwksKids(t, s)
+	if len(got) != len(signingAlgs) || got[fmt.Sprint(newKid)] == "" {
+		t.Errorf("JWKS kids = %v, want only the new keys", got)
+	}
+
+	// The key ring is persisted.
+	s2 := New(nil, s.stateDir, false, false, false)
+	if got2 := jwksKids(t, s2); fmt.Sprint(got2) != fmt.Sprint(got) {
+		t.Errorf("JWKS kids after reload = %v, want %v", got2, got)
+	}
+}
+
+// TestScheduledSigningKeyRotation tests that MaintainSigningKeys publishes a
+// new key ahead of the end of the rotation interval
+func TestScheduledSigningKeyRotation(t *testing.T) {
+	s := New(nil, t.TempDir(), false, false, false)
+	s.SetSigningKeyRotation(90 * 24 * time.Hour)
+
+	if err := s.MaintainSigningKeys(); err != nil {
+		t.Fatalf("MaintainSigningKeys: %v", err)
+	}
+	if got := jwksKids(t, s); len(got) != len(signingAlgs) {
+		t.Fatalf("rotated fresh keys: JWKS kids = %v", got)
+	}
+
+	// Age the active keys to just within the publish lead of their rotation.
+	s.keyMu.Lock()
+	for _, k := range s.keys.Keys {
+		k.CreatedAt = time.Now().Add(-90*24*time.Hour + SigningKeyPublishLead - time.Minute)
+	}
+	s.keyMu.Unlock()
+
+	if err := s.MaintainSigningKeys(); err != nil {
+		t.Fatalf("MaintainSigningKeys: %v", err)
+	}
+	if got := jwksKids(t, s); len(got) != 2*len(signingAlgs) {
+		t.Fatalf("expected pending keys to be published, JWKS kids = %v", got)
+	}
+	s.keyMu.Lock()
+	pending := s.keys.pending(time.Now())
+	s.keyMu.Unlock()
+	if pending == nil {
+		t.Fatal("expected a pending signing key")
+	}
+}
+
+// TestSigningKeyMigration tests that the single key used by older versions
+// is migrated into the key ring
+func TestSigningKeyMigration(t *testing.T) {
+	stateDir := t.TempDir()
+	legacy := &signingKey{Kid: 42, Key: mustGeneratePrivateKey(t)}
+	b, err := json.Marshal(legacy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(stateDir, legacySigningKeyFile), b, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	s := New(nil, stateDir, false, false, false)
+	if got := signedKid(t, s, jose.RS256); got != "42" {
+		t.Errorf("signed with kid %s, want migrated kid 42", got)
+	}
+	// Keys for the other algorithms are generated alongside it.
+	for _, alg := range []jose.SignatureAlgorithm{jose.ES256, jose.EdDSA} {
+		if got := signedKid(t, s, alg); got == "" || got == "42" {
+			t.Errorf("%s signed with kid %q, want a new key", alg, got)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(stateDir, signingKeysFile)); err != nil {
+		t.Errorf("key ring not written: %v", err)
+	}
+}
+
+// TestCorruptSigningKeyRing tests that a key ring that can't be read is
+// reported rather than replaced
+func TestCorruptSigningKeyRing(t *testing.T) {
+	stateDir := t.TempDir()
+	path := filepath.Join(stateDir, signingKeysFile)
+	if err := os.WriteFile(path, []byte(`{"keys": [`), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	s := New(nil, stateDir, false, false, false)
+	if _, err := s.oidcSigner(jose.RS256, time.Now()); err == nil {
+		t.Error("oidcSigner succeeded with a corrupt key ring")
+	}
+	if b, err := os.ReadFile(path); err != nil || string(b) != `{"keys": [` {
+		t.Errorf("corrupt key ring was overwritten: %q, %v", b, err)
+	}
+}
+
+// TestServeSigningKeys tests the /keys/ API
+func TestServeSigningKeys(t *testing.T) {
+	s := &IDPServer{
+		serverURL: "https://idp.test.ts.net",
+		stateDir:  t.TempDir(),
+	}
+
+	// Deny by default
+	req := httptest.NewRequest("POST", "/keys/rotate", nil)
+	rr := httptest.NewRecorder()
+	s.ServeHTTP(rr, req)
+	if rr.Code != http.StatusForbidden {
+		t.Fatalf("expected 403 without app cap, got %d", rr.Code)
+	}
+
+	s.bypassAppCapCheck = true
+
+	req = httptest.NewRequest("POST", "/keys/rotate", nil)
+	rr = httptest.NewRecorder()
+	s.ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("rotate: expected 200, got %d: %s", rr.Code, rr.Body.String())
+	}
+
+	req = httptest.NewRequest("GET", "/keys/", nil)
+	rr = httptest.NewRecorder()
+	s.ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("list: expected 200, got %d: %s", rr.Code, rr.Body.String())
+	}
+	var infos []signingKeyInfo
+	if err := json.Unmarshal(rr.Body.Bytes(), &infos); err != nil {
+		t.Fatalf("decoding key list: %v", err)
+	}
+	counts := make(map[string]int)
+	for _, info := range infos {
+		counts[info.Status]++
+	}
+	if counts["active"] != len(signingAlgs) || counts["pending"] != len(signingAlgs) || len(infos) != 2*len(signingAlgs) {
+		t.Errorf("unexpected key list: %+v", infos)
+	}
+
+	req = httptest.NewRequest("GET", "/keys/rotate", nil)
+	rr = httptest.NewRecorder()
+	s.ServeHTTP(rr, req)
+	if rr.Code != http.StatusMethodNotAllowed {
+		t.Errorf("GET /keys/rotate: expected 405, got %d", rr.Code)
+	}
+}
+
+// signedKid issues a JWT with the server's signer for alg and returns its
+// kid header.
+func signedKid(t *testing.T, s *IDPServer, alg jose.SignatureAlgorithm) string {
+	t.Helper()
+	signer, err := s.oidcSigner(alg, time.Now().Add(time.Minute))
+	if err != nil {
+		t.Fatalf("oidcSigner(%s): %v", alg, err)
+	}
+	tok, err := jwt.Signed(signer).Claims(jwt.Claims{Subject: "test"}).CompactSerialize()
+	if err != nil {
+		t.Fatalf("signing token: %v", err)
+	}
+	parsed, err := jwt.ParseSigned(tok)
+	if err != nil {
+		t.Fatalf("parsing token: %v", err)
+	}
+	if got := parsed.Headers[0].Algorithm; got != string(alg) {
+		t.Errorf("token alg = %s, want %s", got, alg)
+	}
+	return parsed.Headers[0].KeyID
+}
+
+// jwksKids returns the kids published by the server's JWKS endpoint, mapped
+// to their algorithm.
+func jwksKids(t *testing.T, s *IDPServer) map[string]string {
+	t.Helper()
+	rr := httptest.NewRecorder()
+	s.serveJWKS(rr, httptest.NewRequest("GET", "/.well-known/jwks.json", nil))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("JWKS status %d: %s", rr.Code, rr.Body.String())
+	}
+	var jwks jose.JSONWebKeySet
+	if err := json.Unmarshal(rr.Body.Bytes(), &jwks); err != nil {
+		t.Fatalf("decoding JWKS: %v", err)
+	}
+	kids := make(map[string]string)
+	for _, k := range jwks.Keys {
+		kids[k.KeyID] = k.Algorithm
+	}
+	return kids
+}
+
+// setPendingActivateAt moves the activation of all pending keys to at.
+func setPendingActivateAt(s *IDPServer, at time.Time) {
+	s.keyMu.Lock()
+	defer s.keyMu.Unlock()
+	now := time.Now()
+	for _, k := range s.keys.Keys {
+		if k.ActivateAt.After(now) {
+			k.ActivateAt = at
+		}
+	}
+}
@@ -0,0 +1,207 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"gopkg.in/square/go-jose.v2"
+	"gopkg.in/square/go-jose.v2/jwt"
+)
+
+// Token type identifiers of token exchange (RFC 8693 Section 3)
+const (
+	tokenTypeAccessToken  = "urn:ietf:params:oauth:token-type:access_token"
+	tokenTypeRefreshToken = "urn:ietf:params:oauth:token-type:refresh_token"
+	tokenTypeIDToken      = "urn:ietf:params:oauth:token-type:id_token"
+	tokenTypeJWT          = "urn:ietf:params:oauth:token-type:jwt"
+)
+
+// exchangeError is a rejected token exchange request.
+type exchangeError struct {
+	status      int
+	code        string
+	description string
+	err         error // cause, logged but not shown
+}
+
+// write reports the error in response to r.
+func (e *exchangeError) write(w http.ResponseWriter, r *http.Request) {
+	writeHTTPError(w, r, e.status, e.code, e.description, e.err)
+}
+
+// exchangeSubject validates the subject_token of a token exchange by the
+// client clientID and returns the AuthRequest of the user it identifies.
+//
+// Tokens of trusted external issuers don't identify a tailnet user. For
+// them, the returned AuthRequest only carries the identity and expiry, and
+// the trust policy that mapped the token to the identity is returned too.
+func (s *IDPServer) exchangeSubject(r *http.Request, token, tokenType, clientID string) (*AuthRequest, *TrustPolicy, *exchangeError) {
+	var (
+		ar            *AuthRequest
+		isAccessToken bool
+	)
+	switch tokenType {
+	case tokenTypeAccessToken, tokenTypeJWT:
+		// JWT access tokens are stored like opaque ones.
+		s.mu.Lock()
+		ar, _ = s.accessToken.Get(token)
+		s.mu.Unlock()
+		isAccessToken = ar != nil
+		if ar == nil && tokenType == tokenTypeAccessToken {
+			return nil, nil, &exchangeError{http.StatusUnauthorized, ecInvalidGrant, "invalid subject token", nil}
+		}
+	case tokenTypeIDToken:
+	default:
+		return nil, nil, &exchangeError{http.StatusBadRequest, ecInvalidRequest, "unsupported subject_token_type", nil}
+	}
+	if ar == nil {
+		var policy *TrustPolicy
+		var xerr *exchangeError
+		ar, policy, xerr = s.jwtSubject(r.Context(), token, clientID)
+		if xerr != nil || policy != nil {
+			return ar, policy, xerr
+		}
+	}
+
+	if ar.ValidTill.Before(time.Now()) {
+		return nil, nil, &exchangeError{http.StatusUnauthorized, ecInvalidGrant, "subject token expired", nil}
+	}
+	if ar.RemoteUser == nil {
+		return nil, nil, &exchangeError{http.StatusBadRequest, ecInvalidGrant, "subject token does not identify a user", nil}
+	}
+	if !s.nodeBindingMatches(r, ar.RPNodeID) {
+		return nil, nil, &exchangeError{http.StatusBadRequest, ecInvalidGrant, "subject token is bound to another node", nil}
+	}
+	// ID tokens are not bound, even when the tokens of their grant are.
+	if isAccessToken && !senderBindingMatches(r, ar) {
+		return nil, nil, &exchangeError{http.StatusBadRequest, ecInvalidGrant, "subject token is bound to another client certificate or DPoP key", nil}
+	}
+	return ar, nil, nil
+}
+
+// senderBindingMatches reports whether r proves possession of the client
+// certificate and DPoP key the access token of ar is bound to, if any, as
+// resource servers require (RFC 8705 Section 3, RFC 9449 Section 7). DPoP
+// proofs sent to /token are verified by serveToken.
+func senderBindingMatches(r *http.Request, ar *AuthRequest) bool {
+	if !certBindingMatches(r, ar.CertThumbprint) {
+		return false
+	}
+	return ar.DPoPJKT == "" || dpopJKT(r) == ar.DPoPJKT
+}
+
+// jwtSubject validates a JWT subject token: an ID token tsidp issued to
+// clientID, or a token of a trusted external issuer. See exchangeSubject.
+func (s *IDPServer) jwtSubject(ctx context.Context, token, clientID string) (*AuthRequest, *TrustPolicy, *exchangeError) {
+	invalid := func(err error) (*AuthRequest, *TrustPolicy, *exchangeError) {
+		return nil, nil, &exchangeError{http.StatusUnauthorized, ecInvalidGrant, "invalid subject token", err}
+	}
+	tok, err := jwt.ParseSigned(token)
+	if err != nil {
+		return invalid(err)
+	}
+	if len(tok.Headers) != 1 {
+		return invalid(fmt.Errorf("expected a single signature, got %d", len(tok.Headers)))
+	}
+	var unverified jwt.Claims
+	if err := tok.UnsafeClaimsWithoutVerification(&unverified); err != nil {
+		return invalid(err)
+	}
+
+	if unverified.Issuer == s.serverURL {
+		ar, err := s.idTokenSubject(tok, clientID)
+		if err != nil {
+			return invalid(err)
+		}
+		return ar, nil, nil
+	}
+
+	ti := s.trustedIssuer(unverified.Issuer)
+	if ti == nil {
+		return nil, nil, &exchangeError{http.StatusUnauthorized, ecInvalidGrant, "subject token issuer is not trusted",
+			fmt.Errorf("issuer %q", unverified.Issuer)}
+	}
+	claims, err := s.verifyIssuerToken(ctx, ti, tok)
+	if err != nil {
+		return invalid(err)
+	}
+	policy := ti.policyFor(claims)
+	if policy == nil {
+		return nil, nil, &exchangeError{http.StatusForbidden, ecAccessDenied, "no trust policy matches the subject token",
+			fmt.Errorf("issuer %q, subject %q", ti.Issuer, claims["sub"])}
+	}
+	slog.Info("external subject token accepted",
+		slog.String("issuer", ti.Issuer),
+		slog.Any("sub", claims["sub"]),
+		slog.String("identity", policy.Identity),
+		slog.String("client_id", clientID),
+	)
+	return &AuthRequest{
+		ExternalSubject: policy.Identity,
+		ValidTill:       unverified.Expiry.Time(),
+	}, policy, nil
+}
+
+// subjectIDTokenClaims are the claims of an ID token used as subject token.
+type subjectIDTokenClaims struct {
+	jwt.Claims
+	SessionID string         `json:"sid,omitempty"`
+	Events    map[string]any `json:"events,omitempty"` // only in logout tokens
+}
+
+// idTokenSubject verifies that tok is a current ID token issued by tsidp to
+// clientID, and returns a token of the authorization grant it was issued
+// from. The grant must not have ended, by revocation or logout.
+func (s *IDPServer) idTokenSubject(tok *jwt.JSONWebToken, clientID string) (*AuthRequest, error) {
+	// Logout, access, workload tokens and introspection responses have
+	// their own type.
+	if !isIDToken(tok) {
+		return nil, fmt.Errorf("unexpected token type %v", tok.Headers[0].ExtraHeaders[jose.HeaderType])
+	}
+	var claims subjectIDTokenClaims
+	if err := s.verifyOwnSignature(tok, &claims); err != nil {
+		return nil, err
+	}
+	if claims.Events != nil || claims.SessionID == "" {
+		return nil, errors.New("not an ID token")
+	}
+	if err := claims.Validate(jwt.Expected{Issuer: s.serverURL, Time: time.Now()}); err != nil {
+		return nil, err
+	}
+	if !claims.Audience.Contains(clientID) {
+		return nil, fmt.Errorf("ID token was not issued to %q", clientID)
+	}
+
+	s.mu.Lock()
+	ar := s.grantTokenLocked(claims.SessionID)
+	s.mu.Unlock()
+	if ar == nil {
+		return nil, errors.New("the session of the ID token has ended")
+	}
+	if ar.subject() != claims.Subject {
+		return nil, errors.New("ID token subject does not match its session")
+	}
+	return ar, nil
+}
+
+// grantTokenLocked returns a live access or refresh token of the
+// authorization grant grantID, or nil if there is none.
+// Caller must hold s.mu lock
+func (s *IDPServer) grantTokenLocked(grantID string) *AuthRequest {
+	now := time.Now()
+	for _, ts := range []tokenStore{s.accessToken, s.refreshToken} {
+		for _, ar := range ts.All() {
+			if ar.GrantID == grantID && ar.ValidTill.After(now) {
+				return ar
+			}
+		}
+	}
+	return nil
+}
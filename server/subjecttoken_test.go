@@ -0,0 +1,402 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package server
+
+import (
+	"cmp"
+	"crypto/ecdsa"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"gopkg.in/square/go-jose.v2"
+	"gopkg.in/square/go-jose.v2/jwt"
+	"tailscale.com/client/tailscale/apitype"
+	"tailscale.com/tailcfg"
+	"tailscale.com/util/rands"
+)
+
+// exchangeToken posts a token exchange request by clientID for the
+// api.example.com audience to s.
+func exchangeToken(t *testing.T, s *IDPServer, clientID, subjectToken, subjectTokenType string) *httptest.ResponseRecorder {
+	t.Helper()
+	form := url.Values{
+		"grant_type":         {"urn:ietf:params:oauth:grant-type:token-exchange"},
+		"subject_token":      {subjectToken},
+		"subject_token_type": {subjectTokenType},
+		"audience":           {"https://api.example.com"},
+		"client_id":          {clientID},
+		"client_secret":      {s.funnelClients[clientID].Secret},
+	}
+	req := httptest.NewRequest("POST", "/token", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	rr := httptest.NewRecorder()
+	s.serveTokenExchange(rr, req)
+	return rr
+}
+
+// exchangedToken returns the stored token of a successful token exchange
+// response.
+func exchangedToken(t *testing.T, s *IDPServer, rr *httptest.ResponseRecorder) *AuthRequest {
+	t.Helper()
+	var resp map[string]any
+	if err := json.Unmarshal(rr.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	at, _ := resp["access_token"].(string)
+	ar, ok := s.accessToken.Get(at)
+	if !ok {
+		t.Fatalf("exchanged access token not stored: %s", rr.Body.String())
+	}
+	return ar
+}
+
+// TestIDTokenSubject tests exchanging ID tokens issued by tsidp
+func TestIDTokenSubject(t *testing.T) {
+	s := setupTestServer(t, nil)
+	client := s.funnelClients["test-client"]
+	client.RedirectURIs = []string{"https://rp.example.com/callback"}
+	s.funnelClients["other-client"] = &FunnelClient{ID: "other-client", Secret: "other-secret"}
+	s.code.Set("code", &AuthRequest{
+		ClientID:    client.ID,
+		FunnelRP:    client,
+		RedirectURI: "https://rp.example.com/callback",
+		ValidTill:   time.Now().Add(5 * time.Minute),
+		RemoteUser: &apitype.WhoIsResponse{
+			Node:        &tailcfg.Node{ID: 1, Name: "node.test.ts.net.", User: 1},
+			UserProfile: &tailcfg.UserProfile{LoginName: "user@example.com"},
+			CapMap: tailcfg.PeerCapMap{
+				tailcfg.PeerCapabilityTsIDP: marshalCapRules([]capRule{{
+					Users:     []string{"*"},
+					Resources: []string{"https://api.example.com"},
+				}}),
+			},
+		},
+	})
+
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {"code"},
+		"redirect_uri":  {"https://rp.example.com/callback"},
+		"client_id":     {client.ID},
+		"client_secret": {client.Secret},
+	}
+	req := httptest.NewRequest("POST", "/token", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	rr := httptest.NewRecorder()
+	s.serveToken(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("token: expected status 200, got %d: %s", rr.Code, rr.Body.String())
+	}
+	var resp oidcTokenResponse
+	if err := json.Unmarshal(rr.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	grant, _ := s.accessToken.Get(resp.AccessToken)
+	logoutToken, err := s.newLogoutToken(client, "1", grant.GrantID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tokenType := range []string{tokenTypeIDToken, tokenTypeJWT} {
+		rr := exchangeToken(t, s, client.ID, resp.IDToken, tokenType)
+		if rr.Code != http.StatusOK {
+			t.Fatalf("%s: expected status 200, got %d: %s", tokenType, rr.Code, rr.Body.String())
+		}
+		ar := exchangedToken(t, s, rr)
+		if ar.RemoteUser == nil || ar.subject() != "userid:1" || ar.OriginalClientID != client.ID {
+			t.Errorf("%s: exchanged token for %q from %q", tokenType, ar.subject(), ar.OriginalClientID)
+		}
+	}
+
+	if rr := exchangeToken(t, s, "other-client", resp.IDToken, tokenTypeIDToken); rr.Code != http.StatusUnauthorized {
+		t.Errorf("ID token of another client: expected status 401, got %d: %s", rr.Code, rr.Body.String())
+	}
+	if rr := exchangeToken(t, s, client.ID, logoutToken, tokenTypeJWT); rr.Code != http.StatusUnauthorized {
+		t.Errorf("logout token: expected status 401, got %d: %s", rr.Code, rr.Body.String())
+	}
+	workloadToken, err := s.newWorkloadToken(&apitype.WhoIsResponse{
+		Node: &tailcfg.Node{ID: 7, StableID: "nStable7", Name: "server.test.ts.net.", Tags: []string{"tag:server"}},
+	}, client.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rr := exchangeToken(t, s, client.ID, workloadToken, tokenTypeJWT); rr.Code != http.StatusUnauthorized {
+		t.Errorf("workload token: expected status 401, got %d: %s", rr.Code, rr.Body.String())
+	}
+
+	// Once the session has ended, the ID token can't be exchanged anymore.
+	s.mu.Lock()
+	s.revokeGrantLocked(grant.GrantID)
+	s.mu.Unlock()
+	if rr := exchangeToken(t, s, client.ID, resp.IDToken, tokenTypeIDToken); rr.Code != http.StatusUnauthorized {
+		t.Errorf("ended session: expected status 401, got %d: %s", rr.Code, rr.Body.String())
+	}
+}
+
+// TestTrustedIssuerSubject tests exchanging JWTs of trusted external issuers
+func TestTrustedIssuerSubject(t *testing.T) {
+	key, jwks := newClientAssertionKey(t, "ci-key")
+	otherKey, _ := newClientAssertionKey(t, "ci-key")
+	var issuer string
+	fetches := map[string]int{}
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetches[r.URL.Path]++
+		switch r.URL.Path {
+		case "/.well-known/openid-configuration":
+			json.NewEncoder(w).Encode(map[string]string{
+				"issuer":   issuer,
+				"jwks_uri": issuer + "/jwks",
+			})
+		case "/jwks":
+			json.NewEncoder(w).Encode(jwks)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer ts.Close()
+	issuer = ts.URL
+
+	s := setupTestServer(t, nil)
+	s.SetHTTPClient(ts.Client())
+	if err := s.SetTrustedIssuers([]TrustedIssuer{{
+		Issuer: issuer,
+		Policies: []TrustPolicy{
+			{
+				Subjects:  []string{"repo:example/app:ref:refs/heads/main"},
+				Claims:    map[string]string{"workflow": "deploy"},
+				Identity:  "github:example/app",
+				Resources: []string{"https://api.example.com"},
+			},
+			{
+				Subjects:  []string{"*"},
+				Identity:  "github:any",
+				Resources: []string{"https://docs.example.com"},
+			},
+		},
+	}}); err != nil {
+		t.Fatalf("SetTrustedIssuers: %v", err)
+	}
+
+	sign := func(key *ecdsa.PrivateKey, claims map[string]any) string {
+		t.Helper()
+		now := time.Now()
+		std := jwt.Claims{
+			Issuer:   issuer,
+			Subject:  "repo:example/app:ref:refs/heads/main",
+			Audience: jwt.Audience{s.serverURL},
+			Expiry:   jwt.NewNumericDate(now.Add(5 * time.Minute)),
+			IssuedAt: jwt.NewNumericDate(now),
+		}
+		signer, err := jose.NewSigner(jose.SigningKey{Algorithm: jose.ES256, Key: key},
+			(&jose.SignerOptions{}).WithType("JWT").WithHeader("kid", "ci-key"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		token, err := jwt.Signed(signer).Claims(std).Claims(claims).CompactSerialize()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return token
+	}
+
+	tests := []struct {
+		name         string
+		token        string
+		tokenType    string // default jwt
+		expectStatus int
+	}{
+		{
+			name:         "matching policy",
+			token:        sign(key, map[string]any{"workflow": "deploy"}),
+			expectStatus: http.StatusOK,
+		},
+		{
+			name:         "audience not allowed by the matching policy",
+			token:        sign(key, map[string]any{"workflow": "test"}),
+			expectStatus: http.StatusForbidden,
+		},
+		{
+			name:         "wrong aud",
+			token:        sign(key, map[string]any{"workflow": "deploy", "aud": "https://other.example.com"}),
+			expectStatus: http.StatusUnauthorized,
+		},
+		{
+			name:         "expired",
+			token:        sign(key, map[string]any{"workflow": "deploy", "exp": time.Now().Add(-time.Hour).Unix()}),
+			expectStatus: http.StatusUnauthorized,
+		},
+		{
+			name:         "untrusted issuer",
+			token:        sign(key, map[string]any{"workflow": "deploy", "iss": "https://evil.example.com"}),
+			expectStatus: http.StatusUnauthorized,
+		},
+		{
+			name:         "signed with another key",
+			token:        sign(otherKey, map[string]any{"workflow": "deploy"}),
+			expectStatus: http.StatusUnauthorized,
+		},
+		{
+			name:         "as access token",
+			token:        sign(key, map[string]any{"workflow": "deploy"}),
+			tokenType:    tokenTypeAccessToken,
+			expectStatus: http.StatusUnauthorized,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rr := exchangeToken(t, s, "test-client", tt.token, cmp.Or(tt.tokenType, tokenTypeJWT))
+			if rr.Code != tt.expectStatus {
+				t.Fatalf("expected status %d, got %d: %s", tt.expectStatus, rr.Code, rr.Body.String())
+			}
+			if tt.expectStatus != http.StatusOK {
+				return
+			}
+			ar := exchangedToken(t, s, rr)
+			if ar.RemoteUser != nil || ar.subject() != "github:example/app" {
+				t.Errorf("exchanged token for %q", ar.subject())
+			}
+			if len(ar.Audiences) != 1 || ar.Audiences[0] != "https://api.example.com" {
+				t.Errorf("audiences = %v", ar.Audiences)
+			}
+		})
+	}
+
+	// The discovery document and keys are cached.
+	if fetches["/.well-known/openid-configuration"] != 1 || fetches["/jwks"] != 1 {
+		t.Errorf("fetches = %v, want one of each", fetches)
+	}
+}
+
+// TestSetTrustedIssuers tests the validation of trusted issuers
+func TestSetTrustedIssuers(t *testing.T) {
+	policy := TrustPolicy{Subjects: []string{"*"}, Identity: "ci", Resources: []string{"*"}}
+	tests := []struct {
+		name    string
+		issuers []TrustedIssuer
+		wantErr bool
+	}{
+		{
+			name:    "valid",
+			issuers: []TrustedIssuer{{Issuer: "https://ci.example.com", Policies: []TrustPolicy{policy}}},
+		},
+		{
+			name:    "http issuer",
+			issuers: []TrustedIssuer{{Issuer: "http://ci.example.com", Policies: []TrustPolicy{policy}}},
+			wantErr: true,
+		},
+		{
+			name:    "http jwks_uri",
+			issuers: []TrustedIssuer{{Issuer: "https://ci.example.com", JWKSURI: "http://ci.example.com/jwks", Policies: []TrustPolicy{policy}}},
+			wantErr: true,
+		},
+		{
+			name:    "no policies",
+			issuers: []TrustedIssuer{{Issuer: "https://ci.example.com"}},
+			wantErr: true,
+		},
+		{
+			name:    "policy without identity",
+			issuers: []TrustedIssuer{{Issuer: "https://ci.example.com", Policies: []TrustPolicy{{Subjects: []string{"*"}, Resources: []string{"*"}}}}},
+			wantErr: true,
+		},
+		{
+			name: "duplicate issuer",
+			issuers: []TrustedIssuer{
+				{Issuer: "https://ci.example.com", Policies: []TrustPolicy{policy}},
+				{Issuer: "https://ci.example.com", Policies: []TrustPolicy{policy}},
+			},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := New(nil, t.TempDir(), false, false, true)
+			if err := s.SetTrustedIssuers(tt.issuers); (err != nil) != tt.wantErr {
+				t.Errorf("SetTrustedIssuers() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+// TestBoundTokenExchange tests that DPoP and certificate bound subject and
+// actor tokens are only exchanged with proof of their key
+func TestBoundTokenExchange(t *testing.T) {
+	ca, caKey := newTestCA(t)
+	cert := newTestClientCert(t, ca, caKey, "rp.example.com")
+	s := setupTestServer(t, nil)
+	user := &apitype.WhoIsResponse{
+		Node:        &tailcfg.Node{ID: 1, Name: "node.test.ts.net.", User: 1},
+		UserProfile: &tailcfg.UserProfile{LoginName: "user@example.com"},
+		CapMap: tailcfg.PeerCapMap{
+			tailcfg.PeerCapabilityTsIDP: marshalCapRules([]capRule{{
+				Users:      []string{"*"},
+				Resources:  []string{"https://api.example.com"},
+				Delegation: []delegationRule{{ActorClients: []string{"test-client"}, Audiences: []string{"*"}}},
+			}}),
+		},
+	}
+	newToken := func(ar *AuthRequest) string {
+		ar.ClientID = "test-client"
+		ar.ValidTill = time.Now().Add(time.Hour)
+		token := rands.HexString(32)
+		s.accessToken.Set(token, ar)
+		return token
+	}
+	certThumbprint := certThumbprint(withClientCert(httptest.NewRequest("GET", "/", nil), cert))
+	unbound := func() string { return newToken(&AuthRequest{RemoteUser: user}) }
+	dpopBound := func() string { return newToken(&AuthRequest{RemoteUser: user, DPoPJKT: "jkt"}) }
+	certBound := func() string { return newToken(&AuthRequest{RemoteUser: user, CertThumbprint: certThumbprint}) }
+	withDPoP := func(r *http.Request) *http.Request { return withDPoPJKT(r, "jkt") }
+	withCert := func(r *http.Request) *http.Request { return withClientCert(r, cert) }
+
+	tests := []struct {
+		name         string
+		subjectToken string
+		actorToken   string
+		proof        func(*http.Request) *http.Request
+		wantStatus   int
+	}{
+		{"DPoP bound subject with proof", dpopBound(), "", withDPoP, http.StatusOK},
+		{"DPoP bound subject without proof", dpopBound(), "", nil, http.StatusBadRequest},
+		{"certificate bound subject with certificate", certBound(), "", withCert, http.StatusOK},
+		{"certificate bound subject without certificate", certBound(), "", nil, http.StatusBadRequest},
+		{"DPoP bound actor with proof", unbound(), dpopBound(), withDPoP, http.StatusOK},
+		{"DPoP bound actor without proof", unbound(), dpopBound(), nil, http.StatusBadRequest},
+		{"certificate bound actor with certificate", unbound(), certBound(), withCert, http.StatusOK},
+		{"certificate bound actor without certificate", unbound(), certBound(), nil, http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			form := url.Values{
+				"grant_type":         {"urn:ietf:params:oauth:grant-type:token-exchange"},
+				"subject_token":      {tt.subjectToken},
+				"subject_token_type": {tokenTypeAccessToken},
+				"audience":           {"https://api.example.com"},
+				"client_id":          {"test-client"},
+				"client_secret":      {"test-secret"},
+			}
+			if tt.actorToken != "" {
+				form.Set("actor_token", tt.actorToken)
+				form.Set("actor_token_type", tokenTypeAccessToken)
+			}
+			req := httptest.NewRequest("POST", "/token", strings.NewReader(form.Encode()))
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			if tt.proof != nil {
+				req = tt.proof(req)
+			}
+			rr := httptest.NewRecorder()
+			s.serveTokenExchange(rr, req)
+			if rr.Code != tt.wantStatus {
+				t.Errorf("expected status %d, got %d: %s", tt.wantStatus, rr.Code, rr.Body.String())
+			}
+		})
+	}
+}
@@ -4,10 +4,13 @@
 package server
 
 import (
+	"cmp"
+	"context"
 	"crypto/sha256"
 	"crypto/subtle"
 	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log/slog"
 	"net/http"
@@ -21,11 +24,12 @@ import (
 	"tailscale.com/tailcfg"
 	"tailscale.com/types/key"
 	"tailscale.com/types/views"
-	"tailscale.com/util/mak"
 	"tailscale.com/util/rands"
 )
 
 const (
+	// TokenDuration and RefreshTokenDuration are the default lifetime of
+	// access tokens and idle timeout of refresh tokens, see TokenLifetimes.
 	TokenDuration        = 5 * time.Minute
 	RefreshTokenDuration = 30 * 24 * time.Hour
 
@@ -33,6 +37,10 @@ const (
 	// claims to account for clock skew between servers and clients
 	// 5 minutes is a typical value with 10 seconds being a common minimum
 	NotValidBeforeClockSkew = 5 * time.Minute
+
+	// authorizationCodeDuration is how long an authorization code can be
+	// redeemed. RFC 6749 Section 4.1.2 recommends at most 10 minutes.
+	authorizationCodeDuration = 5 * time.Minute
 )
 
 // Token endpoint types
@@ -72,6 +80,10 @@ type tailscaleClaims struct {
 	// AuthorizedParty is the azp claim for multi-audience scenarios
 	AuthorizedParty string `json:"azp,omitempty"`
 
+	// SessionID is the sid claim. It identifies the authorization grant
+	// and is used for logout.
+	SessionID string `json:"sid,omitempty"`
+
 	// UserName is the local part of Email (without '@' and domain).
 	// It is a temporary (2023-11-15) hack during development.
 	// We should probably let this be configured via grants.
@@ -135,6 +147,9 @@ func (tc tailscaleClaims) toMap() map[string]any {
 	if tc.AuthorizedParty != "" {
 		m["azp"] = tc.AuthorizedParty
 	}
+	if tc.SessionID != "" {
+		m["sid"] = tc.SessionID
+	}
 	if tc.UserName != "" {
 		m["username"] = tc.UserName
 	}
@@ -148,6 +163,7 @@ func (s *IDPServer) serveToken(w http.ResponseWriter, r *http.Request) {
 	h.Set("Access-Control-Allow-Origin", "*")
 	h.Set("Access-Control-Allow-Methods", "POST, OPTIONS")
 	h.Set("Access-Control-Allow-Headers", "*")
+	h.Set("Access-Control-Expose-Headers", "DPoP-Nonce")
 
 	if r.Method == "OPTIONS" {
 		w.WriteHeader(http.StatusNoContent)
@@ -159,12 +175,31 @@ func (s *IDPServer) serveToken(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// RFC 9449: tokens requested with a DPoP proof are bound to its key.
+	if len(r.Header.Values("DPoP")) > 0 {
+		jkt, err := s.verifyDPoPProof(r, "", true)
+		h.Set("DPoP-Nonce", s.currentDPoPNonce())
+		if errors.Is(err, errUseDPoPNonce) {
+			writeHTTPError(w, r, http.StatusBadRequest, ecUseDPoPNonce, "DPoP proof must carry the nonce in the DPoP-Nonce header", err)
+			return
+		}
+		if err != nil {
+			writeHTTPError(w, r, http.StatusBadRequest, ecInvalidDPoPProof, "invalid DPoP proof", err)
+			return
+		}
+		r = withDPoPJKT(r, jkt)
+	}
+
 	grantType := r.FormValue("grant_type")
 	switch grantType {
 	case "authorization_code":
 		s.handleAuthorizationCodeGrant(w, r)
 	case "refresh_token":
 		s.handleRefreshTokenGrant(w, r)
+	case "client_credentials":
+		s.handleClientCredentialsGrant(w, r)
+	case deviceCodeGrantType:
+		s.handleDeviceCodeGrant(w, r)
 	case "urn:ietf:params:oauth:grant-type:token-exchange":
 		if !s.enableSTS {
 			writeHTTPError(w, r, http.StatusBadRequest, ecUnsupportedGrant, "token exchange not enabled", nil)
@@ -185,16 +220,22 @@ func (s *IDPServer) handleAuthorizationCodeGrant(w http.ResponseWriter, r *http.
 		return
 	}
 	s.mu.Lock()
-	ar, ok := s.code[code]
+	ar, ok := s.code.Get(code)
 	if ok {
-		delete(s.code, code)
+		if err := s.code.Delete(code); err != nil {
+			slog.Warn("failed to persist authorization code removal", slog.Any("error", err))
+		}
 	}
 	s.mu.Unlock()
 	if !ok {
 		writeHTTPError(w, r, http.StatusBadRequest, ecInvalidGrant, "code not found", nil)
 		return
 	}
-	if httpStatusCode, err := ar.allowRelyingParty(r); err != nil {
+	if time.Now().After(ar.ValidTill) {
+		writeHTTPError(w, r, http.StatusBadRequest, ecInvalidGrant, "code expired", nil)
+		return
+	}
+	if httpStatusCode, err := s.allowRelyingParty(r, ar); err != nil {
 		writeHTTPError(w, r, httpStatusCode, ecInvalidClient, "client authentication failed", err)
 		return
 	}
@@ -205,6 +246,10 @@ func (s *IDPServer) handleAuthorizationCodeGrant(w http.ResponseWriter, r *http.
 	}
 
 	// PKCE validation (RFC 7636)
+	if ar.FunnelRP.isPublic() && ar.CodeChallengeMethod != "S256" {
+		writeHTTPError(w, r, http.StatusBadRequest, ecInvalidGrant, "public clients must use PKCE with S256", nil)
+		return
+	}
 	if ar.CodeChallenge != "" {
 		codeVerifier := r.FormValue("code_verifier")
 		if codeVerifier == "" {
@@ -222,7 +267,7 @@ func (s *IDPServer) handleAuthorizationCodeGrant(w http.ResponseWriter, r *http.
 	resources := r.Form["resource"]
 	if len(resources) > 0 {
 		// Validate requested resources using the same capability would be used for STS
-		validatedResources, err := s.validateResourcesForUser(ar.RemoteUser, resources)
+		validatedResources, err := s.validateResourcesForUser(r.Context(), ar.RemoteUser, resources)
 		if err != nil {
 			writeHTTPError(w, r, http.StatusBadRequest, ecInvalidRequest, "invalid resource", err)
 			return
@@ -242,35 +287,99 @@ func (s *IDPServer) handleRefreshTokenGrant(w http.ResponseWriter, r *http.Reque
 		return
 	}
 
+	// Look the token up among used ones too, so that its reuse is detected
+	// once the client is authenticated.
+	now := time.Now()
 	s.mu.Lock()
-	ar, ok := s.refreshToken[rt]
-	if ok && ar.ValidTill.Before(time.Now()) {
-		ok = false
+	ar, ok := s.refreshToken.Get(rt)
+	if !ok {
+		ar, ok = s.usedRefreshTokens.Get(rt)
 	}
-
-	// Delete the refresh token so it can not be reused. It is intentional that
-	// refresh tokens can only be used once to prevent various race conditions.
-	// If the response is an error the user will have to reauthenticate.
-	delete(s.refreshToken, rt)
-
 	s.mu.Unlock()
-
+	if ok && ar.ValidTill.Before(now) {
+		ok = false
+	}
 	if !ok {
 		writeHTTPError(w, r, http.StatusBadRequest, ecInvalidGrant, "invalid refresh token", nil)
 		return
 	}
 
-	// Validate client authentication
-	if httpStatusCode, err := ar.allowRelyingParty(r); err != nil {
+	// Only the client the token was issued to can use it, or have a reuse
+	// revoke its grant.
+	if httpStatusCode, err := s.allowRelyingParty(r, ar); err != nil {
 		writeHTTPError(w, r, httpStatusCode, ecInvalidClient, "client authentication failed", err)
 		return
 	}
+	// Refresh tokens of public clients are bound to the certificate and
+	// DPoP key they were issued with (RFC 8705 Section 4, RFC 9449 Section
+	// 5); confidential clients are already bound by authenticating.
+	if ar.FunnelRP.isPublic() && !certBindingMatches(r, ar.CertThumbprint) {
+		writeHTTPError(w, r, http.StatusBadRequest, ecInvalidGrant, "refresh token is bound to another client certificate", nil)
+		return
+	}
+	if ar.FunnelRP.isPublic() && ar.DPoPJKT != "" && dpopJKT(r) != ar.DPoPJKT {
+		writeHTTPError(w, r, http.StatusBadRequest, ecInvalidGrant, "refresh token is bound to another DPoP key", nil)
+		return
+	}
+	if !s.nodeBindingMatches(r, ar.RPNodeID) {
+		writeHTTPError(w, r, http.StatusBadRequest, ecInvalidGrant, "refresh token is bound to another node", nil)
+		return
+	}
+
+	s.mu.Lock()
+	ar, ok = s.refreshToken.Get(rt)
+	if ok {
+		// Delete the refresh token so it can not be reused. It is
+		// intentional that refresh tokens can only be used once to
+		// prevent various race conditions. If the response is an error
+		// the user will have to reauthenticate.
+		if err := s.refreshToken.Delete(rt); err != nil {
+			slog.Warn("failed to persist refresh token removal", slog.Any("error", err))
+		}
+		if ar.ValidTill.Before(now) {
+			ok = false
+		} else {
+			// Remember the token until it expires so that a replay is
+			// detected.
+			used := *ar
+			if err := s.usedRefreshTokens.Set(rt, &used); err != nil {
+				slog.Warn("failed to persist used refresh token", slog.Any("error", err))
+			}
+		}
+	}
+
+	// A refresh token that was already used has leaked, and either the
+	// client or an attacker holds the tokens it was exchanged for. Revoke
+	// all tokens issued from its grant (RFC 9700 Section 4.14.2).
+	var reused *AuthRequest
+	if !ok {
+		if used, found := s.usedRefreshTokens.Get(rt); found && used.ValidTill.After(now) {
+			reused = used
+			s.revokeGrantLocked(used.GrantID)
+		}
+	}
+
+	s.mu.Unlock()
+
+	if reused != nil {
+		slog.Warn("refresh token reuse detected, revoked its grant",
+			slog.String("client_id", reused.ClientID),
+			slog.String("remote_addr", r.RemoteAddr),
+		)
+		s.backchannelLogout(reused)
+		writeHTTPError(w, r, http.StatusBadRequest, ecInvalidGrant, "refresh token was already used", nil)
+		return
+	}
+	if !ok {
+		writeHTTPError(w, r, http.StatusBadRequest, ecInvalidGrant, "invalid refresh token", nil)
+		return
+	}
 
 	// RFC 8707: Check for resource parameter in refresh token request
 	resources := r.Form["resource"]
 	if len(resources) > 0 {
 		// Validate requested resources are a subset of original grant
-		validatedResources, err := s.validateResourcesForUser(ar.RemoteUser, resources)
+		validatedResources, err := s.validateResourcesForUser(r.Context(), ar.RemoteUser, resources)
 		if err != nil {
 			writeHTTPError(w, r, http.StatusBadRequest, ecInvalidRequest, "resource validation failed", err)
 			return
@@ -295,6 +404,94 @@ func (s *IDPServer) handleRefreshTokenGrant(w http.ResponseWriter, r *http.Reque
 	s.issueTokens(w, r, ar)
 }
 
+// handleClientCredentialsGrant handles the client credentials grant type
+// (RFC 6749 Section 4.4). The access token is issued to the funnel client
+// itself, limited to the scopes and resources configured on the client. No
+// ID token or refresh token is issued.
+func (s *IDPServer) handleClientCredentialsGrant(w http.ResponseWriter, r *http.Request) {
+	client, err := s.authenticateFunnelClient(r)
+	if err != nil {
+		writeHTTPError(w, r, http.StatusUnauthorized, ecInvalidClient, "client authentication failed", err)
+		return
+	}
+	if !client.allowsGrantType("client_credentials") {
+		writeHTTPError(w, r, http.StatusBadRequest, ecUnauthorizedClient, "client is not allowed to use the client_credentials grant", nil)
+		return
+	}
+
+	// Without a scope parameter the client gets all of its configured
+	// scopes (RFC 6749 Section 3.3).
+	allowedScopes := strings.Fields(client.Scope)
+	scopes := allowedScopes
+	if requested := strings.Fields(r.FormValue("scope")); len(requested) > 0 {
+		for _, scope := range requested {
+			if !slices.Contains(allowedScopes, scope) {
+				writeHTTPError(w, r, http.StatusBadRequest, ecInvalidScope, "scope not allowed for client",
+					fmt.Errorf("scope %q not configured for client %s", scope, client.ID))
+				return
+			}
+		}
+		scopes = requested
+	}
+
+	// RFC 8707: resources must be configured on the client
+	resources := r.Form["resource"]
+	for _, resource := range resources {
+		if !slices.Contains(client.Resources, resource) {
+			writeHTTPError(w, r, http.StatusBadRequest, ecInvalidRequest, "invalid resource",
+				fmt.Errorf("resource %q not configured for client %s", resource, client.ID))
+			return
+		}
+	}
+
+	lifetime := s.tokenLifetimes(client).AccessToken
+	iat := time.Now()
+	ar := &AuthRequest{
+		ClientID:            client.ID,
+		FunnelRP:            client,
+		Scopes:              scopes,
+		Resources:           resources,
+		IssuedAt:            iat,
+		ValidTill:           iat.Add(lifetime),
+		NotValidBefore:      iat.Add(-NotValidBeforeClockSkew),
+		JTI:                 rands.HexString(32),
+		IsClientCredentials: true,
+		CertThumbprint:      certThumbprint(r),
+		DPoPJKT:             dpopJKT(r),
+	}
+	at, err := s.newAccessToken(ar)
+	if err != nil {
+		writeHTTPError(w, r, http.StatusInternalServerError, ecServerError, "failed to create access token", err)
+		return
+	}
+
+	s.mu.Lock()
+	err = s.accessToken.Set(at, ar)
+	s.mu.Unlock()
+	if err != nil {
+		writeHTTPError(w, r, http.StatusInternalServerError, ecServerError, "failed to store access token", err)
+		return
+	}
+
+	slog.Info("client credentials token issued",
+		slog.String("client_id", client.ID),
+		slog.String("scope", strings.Join(scopes, " ")),
+	)
+
+	w.Header().Set("Content-Type", "application/json")
+	response := map[string]any{
+		"access_token": at,
+		"token_type":   ar.tokenType(),
+		"expires_in":   int(lifetime.Seconds()),
+	}
+	if len(scopes) > 0 {
+		response["scope"] = strings.Join(scopes, " ")
+	}
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		writeHTTPError(w, r, http.StatusInternalServerError, ecServerError, "internal server error", err)
+	}
+}
+
 // serveTokenExchange implements the OIDC STS token exchange flow per RFC 8693
 func (s *IDPServer) serveTokenExchange(w http.ResponseWriter, r *http.Request) {
 	if r.Method != "POST" {
@@ -316,13 +513,19 @@ func (s *IDPServer) serveTokenExchange(w http.ResponseWriter, r *http.Request) {
 	}
 
 	subjectTokenType := r.FormValue("subject_token_type")
-	if subjectTokenType != "urn:ietf:params:oauth:token-type:access_token" {
+	switch subjectTokenType {
+	case tokenTypeAccessToken, tokenTypeIDToken, tokenTypeJWT:
+	default:
 		writeHTTPError(w, r, http.StatusBadRequest, ecInvalidRequest, "unsupported subject_token_type", nil)
 		return
 	}
 
 	requestedTokenType := r.FormValue("requested_token_type")
-	if requestedTokenType != "" && requestedTokenType != "urn:ietf:params:oauth:token-type:access_token" {
+	switch requestedTokenType {
+	case "":
+		requestedTokenType = tokenTypeAccessToken
+	case tokenTypeAccessToken, tokenTypeIDToken, tokenTypeRefreshToken:
+	default:
 		writeHTTPError(w, r, http.StatusBadRequest, ecInvalidRequest, "unsupported requested_token_type", nil)
 		return
 	}
@@ -350,58 +553,45 @@ func (s *IDPServer) serveTokenExchange(w http.ResponseWriter, r *http.Request) {
 	s.mu.Unlock()
 
 	// Validate subject token
-	s.mu.Lock()
-	ar, ok := s.accessToken[subjectToken]
-	s.mu.Unlock()
-	if !ok {
-		writeHTTPError(w, r, http.StatusUnauthorized, ecInvalidGrant, "invalid subject token", nil)
+	ar, policy, xerr := s.exchangeSubject(r, subjectToken, subjectTokenType, exchangingClientID)
+	if xerr != nil {
+		xerr.write(w, r)
 		return
 	}
 
-	if ar.ValidTill.Before(time.Now()) {
-		writeHTTPError(w, r, http.StatusUnauthorized, ecInvalidGrant, "subject token expired", nil)
+	// Check ACL grant for STS token exchange, or the trust policy for
+	// subject tokens of external issuers
+	// External subjects have no capability rules, only their policy.
+	who := ar.RemoteUser
+
+	// ID and refresh tokens describe a tailnet user. Refresh tokens are
+	// only issued to registered clients, which must authenticate to use
+	// them.
+	if requestedTokenType != tokenTypeAccessToken && who == nil {
+		writeHTTPError(w, r, http.StatusBadRequest, ecInvalidRequest, "only access tokens are issued for external subject tokens", nil)
 		return
 	}
-
-	// Check ACL grant for STS token exchange
-	who := ar.RemoteUser
-	rules, err := tailcfg.UnmarshalCapJSON[capRule](who.CapMap, "tailscale.com/cap/tsidp")
-	if err != nil {
-		writeHTTPError(w, r, http.StatusForbidden, ecAccessDenied, "failed to unmarshal STS capability", err)
+	if requestedTokenType == tokenTypeRefreshToken && exchangingFunnelClient == nil {
+		writeHTTPError(w, r, http.StatusBadRequest, ecInvalidRequest, "refresh tokens are only issued to registered clients", nil)
 		return
 	}
+	var rules []capRule
+	if policy == nil {
+		var err error
+		rules, err = tailcfg.UnmarshalCapJSON[capRule](who.CapMap, "tailscale.com/cap/tsidp")
+		if err != nil {
+			writeHTTPError(w, r, http.StatusForbidden, ecAccessDenied, "failed to unmarshal STS capability", err)
+			return
+		}
+	}
 
 	// Check if user is allowed to exchange tokens for the requested audiences
-	allowedAudiences := []string{}
-	for _, audience := range audiences {
-		allowed := false
-		for _, rule := range rules {
-			// Check if user matches (support wildcard or specific user)
-			userMatches := false
-			for _, user := range rule.Users {
-				if user == "*" || user == who.UserProfile.LoginName {
-					userMatches = true
-					break
-				}
-			}
-
-			if userMatches {
-				// Check if audience/resource matches
-				for _, resource := range rule.Resources {
-					if resource == audience || resource == "*" {
-						allowed = true
-						break
-					}
-				}
-			}
-
-			if allowed {
-				break
-			}
-		}
-		if allowed {
-			allowedAudiences = append(allowedAudiences, audience)
-		}
+	matcher := s.newResourceMatcher(r.Context())
+	var allowedAudiences []string
+	if policy != nil {
+		allowedAudiences = policy.allowedAudiences(matcher, audiences)
+	} else {
+		allowedAudiences = matcher.allowedResources(rules, who.UserProfile.LoginName, audiences)
 	}
 
 	if len(allowedAudiences) == 0 {
@@ -409,37 +599,59 @@ func (s *IDPServer) serveTokenExchange(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Handle actor token for delegation (RFC 8693 Section 4.1)
-	var actorInfo *ActorClaim
+	// Handle actor token for delegation (RFC 8693 Section 4.1). The actors
+	// of a delegated subject token stay in the chain, as prior actors.
+	actorInfo := ar.ActorInfo
 	if actorTokenParam := r.FormValue("actor_token"); actorTokenParam != "" {
 		actorTokenType := r.FormValue("actor_token_type")
-		if actorTokenType != "" && actorTokenType != "urn:ietf:params:oauth:token-type:access_token" {
+		if actorTokenType != "" && actorTokenType != tokenTypeAccessToken {
 			writeHTTPError(w, r, http.StatusBadRequest, ecInvalidRequest, "unsupported actor_token_type", nil)
 			return
 		}
 
 		// Validate and add actor information
 		s.mu.Lock()
-		actorAR, ok := s.accessToken[actorTokenParam]
+		actorAR, ok := s.accessToken.Get(actorTokenParam)
 		s.mu.Unlock()
 		if !ok || actorAR.ValidTill.Before(time.Now()) {
 			writeHTTPError(w, r, http.StatusBadRequest, ecInvalidRequest, "invalid or expired actor_token", nil)
 			return
 		}
+		if !s.nodeBindingMatches(r, actorAR.RPNodeID) {
+			writeHTTPError(w, r, http.StatusBadRequest, ecInvalidRequest, "actor_token is bound to another node", nil)
+			return
+		}
+		if !senderBindingMatches(r, actorAR) {
+			writeHTTPError(w, r, http.StatusBadRequest, ecInvalidRequest, "actor_token is bound to another client certificate or DPoP key", nil)
+			return
+		}
 
 		actorInfo = &ActorClaim{
-			Subject:  actorAR.RemoteUser.Node.User.String(),
+			Subject:  actorAR.subject(),
 			ClientID: actorAR.ClientID,
-			// Check if actor token itself has an actor (delegation chain)
-			Actor: actorAR.ActorInfo,
+			Actor:    ar.ActorInfo,
 		}
+
+		// The subject's delegation rules decide who may act for them, and
+		// for which audiences.
+		if who == nil {
+			writeHTTPError(w, r, http.StatusForbidden, ecAccessDenied, "external subject tokens can't be delegated", nil)
+			return
+		}
+		delegated, err := delegatedAudiences(matcher, rules, who.UserProfile.LoginName, actorAR, actorInfo, allowedAudiences)
+		if err != nil {
+			writeHTTPError(w, r, http.StatusForbidden, ecAccessDenied, "delegation not allowed", err)
+			return
+		}
+		allowedAudiences = delegated
 	}
 
-	// Generate new access token
-	newAccessToken := rands.HexString(32)
+	// The exchanged token is valid for as long as the exchanging client's
+	// tokens of its type, but not beyond the session of the subject token.
+	lifetimes := s.tokenLifetimes(exchangingFunnelClient)
 	iat := time.Now()
 	nbf := iat.Add(-NotValidBeforeClockSkew)
-	exp := iat.Add(TokenDuration)
+	exp := ar.capToSession(iat.Add(lifetimes.AccessToken))
 
 	// Create new auth request with proper metadata for exchanged token
 	newAR := &AuthRequest{
@@ -451,10 +663,15 @@ func (s *IDPServer) serveTokenExchange(w http.ResponseWriter, r *http.Request) {
 		IssuedAt:         iat,
 		ValidTill:        exp,
 		NotValidBefore:   nbf,
+		JTI:              rands.HexString(32),
+		SessionExpiry:    ar.SessionExpiry,
 		RemoteUser:       who,
+		ExternalSubject:  ar.ExternalSubject,
 		Resources:        allowedAudiences, // RFC 8707 resource indicators
 		Scopes:           ar.Scopes,        // Preserve original scopes
 		ActorInfo:        actorInfo,
+		CertThumbprint:   certThumbprint(r),
+		DPoPJKT:          dpopJKT(r),
 
 		// Preserve original RP context
 		LocalRP:  ar.LocalRP,
@@ -474,17 +691,66 @@ func (s *IDPServer) serveTokenExchange(w http.ResponseWriter, r *http.Request) {
 		newAR.RedirectURI = ar.RedirectURI
 	}
 
-	s.mu.Lock()
-	mak.Set(&s.accessToken, newAccessToken, newAR)
-	s.mu.Unlock()
+	// The issued token is returned as access_token whatever its type, with
+	// the token_type N_A if it isn't an access token (RFC 8693 Section
+	// 2.2.1).
+	var (
+		issuedToken string
+		tokenType   = "N_A"
+		err         error
+	)
+	switch requestedTokenType {
+	case tokenTypeIDToken:
+		exp = newAR.capToSession(iat.Add(lifetimes.IDToken))
+		issuedToken, err = s.newExchangedIDToken(newAR, exchangingFunnelClient, iat, exp)
+		if err != nil {
+			writeHTTPError(w, r, http.StatusInternalServerError, ecServerError, "failed to create ID token", err)
+			return
+		}
+
+	case tokenTypeRefreshToken:
+		// The exchanging client refreshes the token like its own. It
+		// belongs to the grant of the subject token, if any, so that it is
+		// revoked with it.
+		newAR.FunnelRP = exchangingFunnelClient
+		newAR.GrantID = cmp.Or(ar.GrantID, rands.HexString(32))
+		if lifetimes.RefreshTokenAbsolute > 0 {
+			newAR.SessionExpiry = newAR.capToSession(iat.Add(lifetimes.RefreshTokenAbsolute))
+		}
+		exp = newAR.capToSession(iat.Add(lifetimes.RefreshTokenIdle))
+		newAR.ValidTill = exp
+		issuedToken = rands.HexString(32)
+		s.mu.Lock()
+		err = s.refreshToken.Set(issuedToken, newAR)
+		s.mu.Unlock()
+		if err != nil {
+			writeHTTPError(w, r, http.StatusInternalServerError, ecServerError, "failed to store refresh token", err)
+			return
+		}
+
+	default:
+		issuedToken, err = s.newAccessToken(newAR)
+		if err != nil {
+			writeHTTPError(w, r, http.StatusInternalServerError, ecServerError, "failed to create access token", err)
+			return
+		}
+		s.mu.Lock()
+		err = s.accessToken.Set(issuedToken, newAR)
+		s.mu.Unlock()
+		if err != nil {
+			writeHTTPError(w, r, http.StatusInternalServerError, ecServerError, "failed to store access token", err)
+			return
+		}
+		tokenType = newAR.tokenType()
+	}
 
 	// Return RFC 8693 compliant response
 	w.Header().Set("Content-Type", "application/json")
 	response := map[string]any{
-		"access_token":      newAccessToken,
-		"issued_token_type": "urn:ietf:params:oauth:token-type:access_token",
-		"token_type":        "Bearer",
-		"expires_in":        300, // 5 minutes
+		"access_token":      issuedToken,
+		"issued_token_type": requestedTokenType,
+		"token_type":        tokenType,
+		"expires_in":        int(exp.Sub(iat).Seconds()),
 	}
 
 	// Only include scope if different from requested (RFC 8693)
@@ -502,13 +768,42 @@ func (s *IDPServer) serveTokenExchange(w http.ResponseWriter, r *http.Request) {
 
 // issueTokens issues access and refresh tokens
 func (s *IDPServer) issueTokens(w http.ResponseWriter, r *http.Request, ar *AuthRequest) {
-	signer, err := s.oidcSigner()
+	jti := rands.HexString(32)
+	who := ar.RemoteUser
+	lifetimes := s.tokenLifetimes(ar.FunnelRP)
+
+	// values for exp, nbp and iat claims
+	iat := time.Now()
+	nbf := iat.Add(-NotValidBeforeClockSkew)
+
+	// All tokens issued from one authorization grant share its ID, which is
+	// also the session ID of the ID token. The session ends after the
+	// absolute refresh token lifetime, counted from the first token.
+	if ar.GrantID == "" {
+		ar.GrantID = rands.HexString(32)
+		if lifetimes.RefreshTokenAbsolute > 0 {
+			ar.SessionExpiry = iat.Add(lifetimes.RefreshTokenAbsolute)
+		}
+	}
+	exp := ar.capToSession(iat.Add(lifetimes.AccessToken))
+	idTokenExp := ar.capToSession(iat.Add(lifetimes.IDToken))
+	signer, err := s.oidcSigner(ar.FunnelRP.idTokenSigningAlg(), idTokenExp)
 	if err != nil {
 		writeHTTPError(w, r, http.StatusInternalServerError, ecServerError, "internal server error - could not get signer", err)
 		return
 	}
-	jti := rands.HexString(32)
-	who := ar.RemoteUser
+
+	// Tokens of clients that opted in only work from the node that
+	// requested them, which must then be known.
+	var rpNodeID tailcfg.NodeID
+	if ar.FunnelRP.bindsTokensToNode() {
+		id, ok := s.callerNodeID(r)
+		if !ok {
+			writeHTTPError(w, r, http.StatusBadRequest, ecInvalidRequest, "tokens of this client can only be requested from a tailnet node", nil)
+			return
+		}
+		rpNodeID = id
+	}
 
 	n := who.Node.View()
 	if n.IsTagged() {
@@ -516,15 +811,85 @@ func (s *IDPServer) issueTokens(w http.ResponseWriter, r *http.Request, ar *Auth
 		return
 	}
 
-	// Build audience claim - for exchanged tokens use audiences, otherwise use clientID + resources
+	tsClaims, err := s.idTokenClaims(ar, jti, iat, idTokenExp)
+	if err != nil {
+		writeHTTPError(w, r, http.StatusBadRequest, ecInvalidRequest, "failed to build ID token claims", err)
+		return
+	}
+
+	// Create an OIDC token using this issuer's signer.
+	token, err := jwt.Signed(signer).Claims(tsClaims).CompactSerialize()
+	if err != nil {
+		writeHTTPError(w, r, http.StatusInternalServerError, ecServerError, "error creating JWT token", err)
+		return
+	}
+
+	s.mu.Lock()
+	ar.IssuedAt = iat
+	ar.ValidTill = exp
+	ar.NotValidBefore = nbf
+	ar.JTI = jti // Store the JWT ID for introspection
+	ar.CertThumbprint = certThumbprint(r)
+	ar.DPoPJKT = dpopJKT(r)
+	ar.RPNodeID = rpNodeID
+	s.mu.Unlock()
+
+	// Add new access token and refresh token to the token store
+	at, err := s.newAccessToken(ar)
+	if err != nil {
+		writeHTTPError(w, r, http.StatusInternalServerError, ecServerError, "failed to create access token", err)
+		return
+	}
+	rt := rands.HexString(32)
+
+	s.mu.Lock()
+	err = s.accessToken.Set(at, ar)
+
+	// Create a refresh token from the access token with longer validity
+	rtAuth := *ar // copy the authRequest
+	rtAuth.ValidTill = ar.capToSession(iat.Add(lifetimes.RefreshTokenIdle))
+	if err == nil {
+		err = s.refreshToken.Set(rt, &rtAuth)
+	}
+	s.mu.Unlock()
+	if err != nil {
+		writeHTTPError(w, r, http.StatusInternalServerError, ecServerError, "failed to store tokens", err)
+		return
+	}
+
+	slog.Info("token issued",
+		slog.String("for", who.UserProfile.LoginName),
+		slog.String("uid", n.User().String()),
+		slog.String("client_id", ar.ClientID),
+		slog.String("redirect_uri", ar.RedirectURI),
+	)
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(oidcTokenResponse{
+		AccessToken:  at,
+		TokenType:    ar.tokenType(),
+		ExpiresIn:    int(exp.Sub(iat).Seconds()),
+		IDToken:      token,
+		RefreshToken: rt,
+	}); err != nil {
+		writeHTTPError(w, r, http.StatusInternalServerError, ecServerError, "internal server error", err)
+	}
+}
+
+// idTokenClaims returns the claims of an ID token for ar with the given
+// jti, issued at iat and valid until exp: the standard and Tailscale
+// claims, the extra claims granted to the user and the act claim of
+// exchanged tokens. The user of ar must not be on a tagged node.
+func (s *IDPServer) idTokenClaims(ar *AuthRequest, jti string, iat, exp time.Time) (map[string]any, error) {
+	who := ar.RemoteUser
+	n := who.Node.View()
+	nbf := iat.Add(-NotValidBeforeClockSkew)
+
+	// Build audience claim - for exchanged tokens use the audiences the
+	// exchange allowed, otherwise use clientID + resources
 	var audience jwt.Audience
 	if ar.IsExchangedToken && len(ar.Audiences) > 0 {
-		// For exchanged tokens, use the audiences directly
 		audience = jwt.Audience(ar.Audiences)
-		// Also include the original client if not already in audiences
-		if hasOriginal := slices.Contains(ar.Audiences, ar.OriginalClientID); !hasOriginal && ar.OriginalClientID != "" {
-			audience = append(audience, ar.OriginalClientID)
-		}
 	} else {
 		// Original behavior for non-exchanged tokens
 		audience = jwt.Audience{ar.ClientID}
@@ -534,11 +899,6 @@ func (s *IDPServer) issueTokens(w http.ResponseWriter, r *http.Request, ar *Auth
 		}
 	}
 
-	// values for exp, nbp and iat claims
-	iat := time.Now()
-	exp := iat.Add(TokenDuration)
-	nbf := iat.Add(-NotValidBeforeClockSkew)
-
 	_, tcd, _ := strings.Cut(n.Name(), ".")
 
 	tsClaims := tailscaleClaims{
@@ -558,6 +918,7 @@ func (s *IDPServer) issueTokens(w http.ResponseWriter, r *http.Request, ar *Auth
 		NodeName:  n.Name(),
 		Tailnet:   tcd,
 		UserID:    n.User(),
+		SessionID: ar.GrantID,
 	}
 
 	// Only include email and preferred_username if the appropriate scopes were granted
@@ -581,90 +942,48 @@ func (s *IDPServer) issueTokens(w http.ResponseWriter, r *http.Request, ar *Auth
 
 	rules, err := tailcfg.UnmarshalCapJSON[capRule](who.CapMap, tailcfg.PeerCapabilityTsIDP)
 	if err != nil {
-		writeHTTPError(w, r, http.StatusBadRequest, ecInvalidRequest, "failed to unmarshal capability", err)
-		return
+		return nil, fmt.Errorf("failed to unmarshal capability: %w", err)
 	}
 
 	tsClaimsWithExtra, err := withExtraClaims(tsClaims.toMap(), rules)
 	if err != nil {
-		writeHTTPError(w, r, http.StatusBadRequest, ecInvalidRequest, "failed to merge extra claims", err)
-		return
+		return nil, fmt.Errorf("failed to merge extra claims: %w", err)
 	}
 
 	// Include act claim if present (RFC 8693 Section 4.1)
 	if ar.ActorInfo != nil {
 		tsClaimsWithExtra["act"] = ar.ActorInfo
 	}
-
-	// Create an OIDC token using this issuer's signer.
-	token, err := jwt.Signed(signer).Claims(tsClaimsWithExtra).CompactSerialize()
-	if err != nil {
-		writeHTTPError(w, r, http.StatusInternalServerError, ecServerError, "error creating JWT token", err)
-		return
+	if mayAct := mayActClaim(rules, who.UserProfile.LoginName); mayAct != nil {
+		tsClaimsWithExtra["may_act"] = mayAct
 	}
 
-	// Add new access token and refresh token to the token store
-	at := rands.HexString(32)
-	rt := rands.HexString(32)
-
-	s.mu.Lock()
-	ar.IssuedAt = iat
-	ar.ValidTill = exp
-	ar.NotValidBefore = nbf
-	ar.JTI = jti // Store the JWT ID for introspection
-	mak.Set(&s.accessToken, at, ar)
-
-	// Create a refresh token from the access token with longer validity
-	rtAuth := *ar // copy the authRequest
-	rtAuth.ValidTill = iat.Add(RefreshTokenDuration)
-	mak.Set(&s.refreshToken, rt, &rtAuth)
-	s.mu.Unlock()
-
-	slog.Info("token issued",
-		slog.String("for", who.UserProfile.LoginName),
-		slog.String("uid", n.User().String()),
-		slog.String("client_id", ar.ClientID),
-		slog.String("redirect_uri", ar.RedirectURI),
-	)
+	return tsClaimsWithExtra, nil
+}
 
-	w.Header().Set("Content-Type", "application/json")
-	if err := json.NewEncoder(w).Encode(oidcTokenResponse{
-		AccessToken:  at,
-		TokenType:    "Bearer",
-		ExpiresIn:    5 * 60,
-		IDToken:      token,
-		RefreshToken: rt,
-	}); err != nil {
-		writeHTTPError(w, r, http.StatusInternalServerError, ecServerError, "internal server error", err)
+// newExchangedIDToken returns an ID token for the exchanged token ar, issued
+// at iat and valid until exp, signed with the algorithm client uses for ID
+// tokens.
+func (s *IDPServer) newExchangedIDToken(ar *AuthRequest, client *FunnelClient, iat, exp time.Time) (string, error) {
+	if ar.RemoteUser.Node.IsTagged() {
+		return "", errors.New("tagged nodes not supported")
 	}
+	signer, err := s.oidcSigner(client.idTokenSigningAlg(), exp)
+	if err != nil {
+		return "", err
+	}
+	claims, err := s.idTokenClaims(ar, ar.JTI, iat, exp)
+	if err != nil {
+		return "", err
+	}
+	return jwt.Signed(signer).Claims(claims).CompactSerialize()
 }
 
 // identifyClient identifies the client making the request
 func (s *IDPServer) identifyClient(r *http.Request) string {
-	// Check funnel client with Basic Auth
-	if clientID, clientSecret, ok := r.BasicAuth(); ok {
-		s.mu.Lock()
-		client, ok := s.funnelClients[clientID]
-		s.mu.Unlock()
-		if ok {
-			if subtle.ConstantTimeCompare([]byte(client.Secret), []byte(clientSecret)) == 1 {
-				return clientID
-			}
-		}
-	}
-
-	// Check funnel client with form parameters
-	clientID := r.FormValue("client_id")
-	clientSecret := r.FormValue("client_secret")
-	if clientID != "" && clientSecret != "" {
-		s.mu.Lock()
-		client, ok := s.funnelClients[clientID]
-		s.mu.Unlock()
-		if ok {
-			if subtle.ConstantTimeCompare([]byte(client.Secret), []byte(clientSecret)) == 1 {
-				return clientID
-			}
-		}
+	// Check funnel client
+	if client, err := s.authenticateFunnelClient(r); err == nil {
+		return client.ID
 	}
 
 	// Check local client
@@ -684,8 +1003,25 @@ func (s *IDPServer) identifyClient(r *http.Request) string {
 	return ""
 }
 
+// identifyIntrospectionCaller is identifyClient for /introspect, where
+// "local:" callers see every token. With a local tailscaled, tailnet
+// requests are proxied from loopback too, so they are identified by node
+// instead.
+func (s *IDPServer) identifyIntrospectionCaller(r *http.Request) string {
+	if !s.localTSMode {
+		return s.identifyClient(r)
+	}
+	if client, err := s.authenticateFunnelClient(r); err == nil {
+		return client.ID
+	}
+	if id, ok := s.callerNodeID(r); ok {
+		return fmt.Sprintf("node:%d", id)
+	}
+	return ""
+}
+
 // validateResourcesForUser checks if the user is allowed to access the requested resources
-func (s *IDPServer) validateResourcesForUser(who *apitype.WhoIsResponse, requestedResources []string) ([]string, error) {
+func (s *IDPServer) validateResourcesForUser(ctx context.Context, who *apitype.WhoIsResponse, requestedResources []string) ([]string, error) {
 	// Check ACL grant using the same capability as we would use for STS token exchange
 	rules, err := tailcfg.UnmarshalCapJSON[capRule](who.CapMap, "tailscale.com/cap/tsidp")
 	if err != nil {
@@ -693,37 +1029,7 @@ func (s *IDPServer) validateResourcesForUser(who *apitype.WhoIsResponse, request
 	}
 
 	// Filter resources based on what the user is allowed to access
-	var allowedResources []string
-	for _, resource := range requestedResources {
-		allowed := false
-		for _, rule := range rules {
-			// Check if user matches (support wildcard or specific user)
-			userMatches := false
-			for _, user := range rule.Users {
-				if user == "*" || user == who.UserProfile.LoginName {
-					userMatches = true
-					break
-				}
-			}
-
-			if userMatches {
-				// Check if resource matches
-				for _, allowedResource := range rule.Resources {
-					if allowedResource == resource || allowedResource == "*" {
-						allowed = true
-						break
-					}
-				}
-			}
-
-			if allowed {
-				break
-			}
-		}
-		if allowed {
-			allowedResources = append(allowedResources, resource)
-		}
-	}
+	allowedResources := s.newResourceMatcher(ctx).allowedResources(rules, who.UserProfile.LoginName, requestedResources)
 
 	if len(allowedResources) == 0 {
 		return nil, fmt.Errorf("no valid resources")
@@ -774,6 +1080,15 @@ func generateCodeChallenge(verifier, method string) (string, error) {
 	}
 }
 
+// tokenStoreFor returns the store of refresh tokens if refresh is set and
+// the store of access tokens otherwise.
+func (s *IDPServer) tokenStoreFor(refresh bool) tokenStore {
+	if refresh {
+		return s.refreshToken
+	}
+	return s.accessToken
+}
+
 // serveIntrospect handles the /introspect endpoint for token introspection (RFC 7662)
 func (s *IDPServer) serveIntrospect(w http.ResponseWriter, r *http.Request) {
 	if r.Method != "POST" {
@@ -788,12 +1103,27 @@ func (s *IDPServer) serveIntrospect(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// token_type_hint is optional, we can ignore it for now
-	// since we only have one type of token (access tokens)
+	callerID := s.identifyIntrospectionCaller(r)
 
-	// Look up the token
+	// A signed response is addressed to the caller, so it must be
+	// authenticated (RFC 9701 Section 4).
+	signed := wantsSignedIntrospection(r)
+	if signed && callerID == "" {
+		writeHTTPError(w, r, http.StatusUnauthorized, ecInvalidClient, "client authentication failed", nil)
+		return
+	}
+
+	// Look up the token, starting with the kind named by token_type_hint
+	// (RFC 7662 Section 2.1)
+	isRefreshToken := r.FormValue("token_type_hint") == "refresh_token"
 	s.mu.Lock()
-	ar, tokenExists := s.accessToken[token]
+	store := s.tokenStoreFor(isRefreshToken)
+	ar, tokenExists := store.Get(token)
+	if !tokenExists {
+		isRefreshToken = !isRefreshToken
+		store = s.tokenStoreFor(isRefreshToken)
+		ar, tokenExists = store.Get(token)
+	}
 	s.mu.Unlock()
 
 	// Initialize response with active: false (default for invalid/expired tokens)
@@ -807,7 +1137,9 @@ func (s *IDPServer) serveIntrospect(w http.ResponseWriter, r *http.Request) {
 		if ar.ValidTill.Before(now) {
 			// Token expired, clean it up
 			s.mu.Lock()
-			delete(s.accessToken, token)
+			if err := store.Delete(token); err != nil {
+				slog.Warn("failed to persist token removal", slog.Any("error", err))
+			}
 			s.mu.Unlock()
 			tokenExists = false
 		}
@@ -815,13 +1147,23 @@ func (s *IDPServer) serveIntrospect(w http.ResponseWriter, r *http.Request) {
 
 	// If token exists and is not expired, we need to authenticate the client
 	if tokenExists {
-		// Check if the client is properly authenticated
-		// Any authenticated client can introspect any token
-		if s.identifyClient(r) == "" {
+		// Check if the client is properly authenticated and allowed to see
+		// the token
+		if callerID == "" || !s.mayIntrospect(r, callerID, ar) {
 			// Return inactive token for unauthorized clients
 			// This prevents token scanning attacks
-			w.Header().Set("Content-Type", "application/json")
-			json.NewEncoder(w).Encode(resp)
+			s.writeIntrospectionResponse(w, r, callerID, signed, resp)
+			return
+		}
+		// A token bound to a certificate is not active for a connection
+		// presenting another one (RFC 8705 Section 3).
+		if ar.CertThumbprint != "" && certThumbprint(r) != "" && certThumbprint(r) != ar.CertThumbprint {
+			s.writeIntrospectionResponse(w, r, callerID, signed, resp)
+			return
+		}
+		// Likewise a token bound to a node is only active for that node.
+		if !s.nodeBindingMatches(r, ar.RPNodeID) {
+			s.writeIntrospectionResponse(w, r, callerID, signed, resp)
 			return
 		}
 
@@ -831,7 +1173,9 @@ func (s *IDPServer) serveIntrospect(w http.ResponseWriter, r *http.Request) {
 		resp["exp"] = ar.ValidTill.Unix()
 		resp["iat"] = ar.IssuedAt.Unix()
 		resp["nbf"] = ar.NotValidBefore.Unix()
-		resp["token_type"] = "Bearer"
+		if !isRefreshToken {
+			resp["token_type"] = ar.tokenType()
+		}
 		resp["iss"] = s.serverURL
 
 		// Add jti if available
@@ -839,6 +1183,17 @@ func (s *IDPServer) serveIntrospect(w http.ResponseWriter, r *http.Request) {
 			resp["jti"] = ar.JTI
 		}
 
+		// Confirmation of the key the token is bound to, if any
+		if cnf := ar.confirmation(); cnf != nil {
+			resp["cnf"] = cnf
+		}
+
+		if ar.IsClientCredentials {
+			resp["sub"] = ar.ClientID
+		}
+		if ar.ExternalSubject != "" {
+			resp["sub"] = ar.ExternalSubject
+		}
 		if ar.RemoteUser != nil && ar.RemoteUser.Node != nil {
 			resp["sub"] = fmt.Sprintf("%d", ar.RemoteUser.Node.User)
 
@@ -890,37 +1245,127 @@ func (s *IDPServer) serveIntrospect(w http.ResponseWriter, r *http.Request) {
 		if ar.ActorInfo != nil {
 			resp["act"] = ar.ActorInfo
 		}
+		if mayAct := ar.mayAct(); mayAct != nil {
+			resp["may_act"] = mayAct
+		}
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	if err := json.NewEncoder(w).Encode(resp); err != nil {
-		writeHTTPError(w, r, http.StatusInternalServerError, ecServerError, "failed to encode response", err)
+	s.writeIntrospectionResponse(w, r, callerID, signed, resp)
+}
+
+// mayIntrospect reports whether the caller callerID of r may see the details
+// of the token of ar. Besides processes on tsidp's own host (see
+// identifyIntrospectionCaller), that is the client the token was issued to, the resource
+// servers in its audience, and tailnet nodes granted allow_introspection in
+// the tsidp application capability.
+func (s *IDPServer) mayIntrospect(r *http.Request, callerID string, ar *AuthRequest) bool {
+	if strings.HasPrefix(callerID, "local:") {
+		return true
+	}
+	if callerID == ar.ClientID || slices.Contains(ar.accessTokenAudience(), callerID) {
+		return true
+	}
+
+	if !strings.HasPrefix(callerID, "node:") {
+		return false
+	}
+	who := s.callerWhoIs(r)
+	if who == nil {
+		return false
+	}
+	rules, err := tailcfg.UnmarshalCapJSON[capRule](who.CapMap, "tailscale.com/cap/tsidp")
+	if err != nil {
+		slog.Warn("failed unmarshaling app cap rule", slog.Any("error", err))
+		return false
+	}
+	return slices.ContainsFunc(rules, func(rule capRule) bool {
+		return rule.AllowIntrospection
+	})
+}
+
+// subject returns the subject of the token ar: the user it was issued for,
+// the identity of an external subject token it was exchanged from, or the
+// client for tokens from the client credentials grant.
+func (ar *AuthRequest) subject() string {
+	if ar.RemoteUser != nil && ar.RemoteUser.Node != nil {
+		return ar.RemoteUser.Node.User.String()
+	}
+	if ar.ExternalSubject != "" {
+		return ar.ExternalSubject
+	}
+	return ar.ClientID
+}
+
+// authenticateFunnelClient returns the funnel client identified by the
+// client credentials in r, authenticated with the method it registered.
+func (s *IDPServer) authenticateFunnelClient(r *http.Request) (*FunnelClient, error) {
+	clientID, clientSecret := clientCredentials(r)
+	if clientID == "" {
+		return nil, fmt.Errorf("tsidp: missing client credentials")
 	}
+
+	s.mu.Lock()
+	client, ok := s.funnelClients[clientID]
+	s.mu.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("tsidp: unknown client %q", clientID)
+	}
+	if err := s.authenticateClient(r, client, clientSecret); err != nil {
+		return nil, err
+	}
+	return client, nil
+}
+
+// identifyFunnelClient is like authenticateFunnelClient, except that public
+// clients only identify themselves with their client_id, as they have no
+// credentials to authenticate with.
+func (s *IDPServer) identifyFunnelClient(r *http.Request) (*FunnelClient, error) {
+	clientID, clientSecret := clientCredentials(r)
+	if clientID == "" {
+		return nil, fmt.Errorf("tsidp: missing client credentials")
+	}
+
+	s.mu.Lock()
+	client, ok := s.funnelClients[clientID]
+	s.mu.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("tsidp: unknown client %q", clientID)
+	}
+	if client.isPublic() {
+		return client, nil
+	}
+	if err := s.authenticateClient(r, client, clientSecret); err != nil {
+		return nil, err
+	}
+	return client, nil
 }
 
 // allowRelyingParty checks if the relying party is allowed to access the token
-func (ar *AuthRequest) allowRelyingParty(r *http.Request) (int, error) {
+func (s *IDPServer) allowRelyingParty(r *http.Request, ar *AuthRequest) (int, error) {
 	if ar.FunnelRP == nil {
 		return http.StatusUnauthorized, fmt.Errorf("tsidp: no relying party configured")
 	}
 
-	clientID, clientSecret, ok := r.BasicAuth()
-	if !ok {
-		clientID = r.FormValue("client_id")
-		clientSecret = r.FormValue("client_secret")
+	clientID, clientSecret := clientCredentials(r)
+
+	// Public clients only identify themselves; the grant is bound to them
+	// with PKCE instead of a secret.
+	if ar.FunnelRP.isPublic() {
+		if subtle.ConstantTimeCompare([]byte(clientID), []byte(ar.FunnelRP.ID)) != 1 {
+			return http.StatusBadRequest, fmt.Errorf("tsidp: client_id mismatch")
+		}
+		return http.StatusOK, nil
 	}
 
-	if clientID == "" || clientSecret == "" {
+	if clientID == "" || (clientSecret == "" && r.FormValue("client_assertion") == "" && len(clientCertificates(r)) == 0) {
 		return http.StatusUnauthorized, fmt.Errorf("tsidp: missing client credentials")
 	}
 
-	clientIDcmp := subtle.ConstantTimeCompare([]byte(clientID), []byte(ar.FunnelRP.ID))
-	clientSecretcmp := subtle.ConstantTimeCompare([]byte(clientSecret), []byte(ar.FunnelRP.Secret))
-	if clientIDcmp != 1 {
+	if subtle.ConstantTimeCompare([]byte(clientID), []byte(ar.FunnelRP.ID)) != 1 {
 		return http.StatusBadRequest, fmt.Errorf("tsidp: client_id mismatch")
 	}
-	if clientSecretcmp != 1 {
-		return http.StatusUnauthorized, fmt.Errorf("tsidp: invalid client secret: [%s] [%s]", clientID, clientSecret)
+	if err := s.authenticateClient(r, ar.FunnelRP, clientSecret); err != nil {
+		return http.StatusUnauthorized, err
 	}
 	return http.StatusOK, nil
 }
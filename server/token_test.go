@@ -14,6 +14,7 @@ import (
 	"testing"
 	"time"
 
+	"gopkg.in/square/go-jose.v2"
 	"gopkg.in/square/go-jose.v2/jwt"
 	"tailscale.com/client/tailscale/apitype"
 	"tailscale.com/tailcfg"
@@ -150,11 +151,13 @@ func TestResourceIndicators(t *testing.T) {
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 			s := &IDPServer{
-				serverURL:     "https://idp.test.ts.net",
-				code:          make(map[string]*AuthRequest),
-				accessToken:   make(map[string]*AuthRequest),
-				refreshToken:  make(map[string]*AuthRequest),
-				funnelClients: make(map[string]*FunnelClient),
+				serverURL:         "https://idp.test.ts.net",
+				stateDir:          t.TempDir(),
+				code:              newMemTokenStore(),
+				accessToken:       newMemTokenStore(),
+				refreshToken:      newMemTokenStore(),
+				usedRefreshTokens: newMemTokenStore(),
+				funnelClients:     make(map[string]*FunnelClient),
 			}
 
 			// Parse authorization query
@@ -193,7 +196,7 @@ func TestResourceIndicators(t *testing.T) {
 			}
 
 			s.funnelClients["test-client"] = ar.FunnelRP
-			s.code[code] = ar
+			s.code.Set(code, ar)
 
 			// Add code to form data
 			tt.tokenFormData.Set("code", code)
@@ -220,21 +223,25 @@ func TestResourceIndicators(t *testing.T) {
 // TestIntrospectTokenExpiration tests introspection of expired tokens
 func TestIntrospectTokenExpiration(t *testing.T) {
 	s := &IDPServer{
-		serverURL:     "https://idp.test.ts.net",
-		accessToken:   make(map[string]*AuthRequest),
-		funnelClients: make(map[string]*FunnelClient),
+		serverURL:         "https://idp.test.ts.net",
+		stateDir:          t.TempDir(),
+		code:              newMemTokenStore(),
+		accessToken:       newMemTokenStore(),
+		refreshToken:      newMemTokenStore(),
+		usedRefreshTokens: newMemTokenStore(),
+		funnelClients:     make(map[string]*FunnelClient),
 	}
 
 	// Create an expired token
 	expiredToken := "expired-token"
-	s.accessToken[expiredToken] = &AuthRequest{
+	s.accessToken.Set(expiredToken, &AuthRequest{
 		ValidTill: time.Now().Add(-10 * time.Minute), // expired
 		FunnelRP: &FunnelClient{
 			ID:     "test-client",
 			Secret: "test-secret",
 		},
 		ClientID: "test-client",
-	}
+	})
 
 	// Set up the funnel client
 	s.funnelClients["test-client"] = &FunnelClient{
@@ -268,7 +275,7 @@ func TestIntrospectTokenExpiration(t *testing.T) {
 	}
 
 	// Verify token was deleted
-	if _, exists := s.accessToken[expiredToken]; exists {
+	if _, exists := s.accessToken.Get(expiredToken); exists {
 		t.Error("expected expired token to be deleted")
 	}
 }
@@ -276,14 +283,18 @@ func TestIntrospectTokenExpiration(t *testing.T) {
 // TestIntrospectWithResources tests introspection with resources
 func TestIntrospectWithResources(t *testing.T) {
 	s := &IDPServer{
-		serverURL:     "https://idp.test.ts.net",
-		accessToken:   make(map[string]*AuthRequest),
-		funnelClients: make(map[string]*FunnelClient),
+		serverURL:         "https://idp.test.ts.net",
+		stateDir:          t.TempDir(),
+		code:              newMemTokenStore(),
+		accessToken:       newMemTokenStore(),
+		refreshToken:      newMemTokenStore(),
+		usedRefreshTokens: newMemTokenStore(),
+		funnelClients:     make(map[string]*FunnelClient),
 	}
 
 	// Create a token with resources
 	activeToken := "active-token-with-resources"
-	s.accessToken[activeToken] = &AuthRequest{
+	s.accessToken.Set(activeToken, &AuthRequest{
 		ValidTill: time.Now().Add(10 * time.Minute), // not expired
 		FunnelRP: &FunnelClient{
 			ID:     "test-client",
@@ -301,7 +312,7 @@ func TestIntrospectWithResources(t *testing.T) {
 				LoginName: "user@example.com",
 			},
 		},
-	}
+	})
 
 	// Set up the funnel client
 	s.funnelClients["test-client"] = &FunnelClient{
@@ -348,15 +359,19 @@ func TestIntrospectWithResources(t *testing.T) {
 // TestIntrospectionRFC7662Compliance tests RFC 7662 compliance
 func TestIntrospectionRFC7662Compliance(t *testing.T) {
 	s := &IDPServer{
-		serverURL:     "https://idp.test.ts.net",
-		accessToken:   make(map[string]*AuthRequest),
-		funnelClients: make(map[string]*FunnelClient),
+		serverURL:         "https://idp.test.ts.net",
+		stateDir:          t.TempDir(),
+		code:              newMemTokenStore(),
+		accessToken:       newMemTokenStore(),
+		refreshToken:      newMemTokenStore(),
+		usedRefreshTokens: newMemTokenStore(),
+		funnelClients:     make(map[string]*FunnelClient),
 	}
 
 	// Create a token with all fields populated
 	activeToken := "test-token-rfc-compliance"
 	now := time.Now()
-	s.accessToken[activeToken] = &AuthRequest{
+	s.accessToken.Set(activeToken, &AuthRequest{
 		ValidTill:      now.Add(10 * time.Minute),
 		IssuedAt:       now,
 		NotValidBefore: now.Add(-NotValidBeforeClockSkew),
@@ -378,7 +393,7 @@ func TestIntrospectionRFC7662Compliance(t *testing.T) {
 				ProfilePicURL: "https://example.com/pic.jpg",
 			},
 		},
-	}
+	})
 
 	// Set up the funnel client
 	s.funnelClients["test-client"] = &FunnelClient{
@@ -456,6 +471,166 @@ func TestIntrospectionRFC7662Compliance(t *testing.T) {
 	}
 }
 
+// TestIntrospectionCallers tests who may see the details of a token, and
+// the introspection of refresh tokens
+func TestIntrospectionCallers(t *testing.T) {
+	tests := []struct {
+		name       string
+		token      string
+		hint       string
+		clientID   string // funnel client to authenticate as; a node if empty
+		remoteAddr string
+		localTS    bool      // tsidp runs with a local tailscaled, see localTSMode
+		capRules   []capRule // rules granted to the calling node
+		wantActive bool
+	}{
+		{
+			name:       "own client",
+			token:      "access-token",
+			clientID:   "test-client",
+			wantActive: true,
+		},
+		{
+			name:       "client in audience",
+			token:      "access-token",
+			clientID:   "api-client",
+			wantActive: true,
+		},
+		{
+			name:       "other client",
+			token:      "access-token",
+			clientID:   "other-client",
+			wantActive: false,
+		},
+		{
+			name:       "node without grant",
+			token:      "access-token",
+			wantActive: false,
+		},
+		{
+			name:       "node with grant",
+			token:      "access-token",
+			capRules:   []capRule{{AllowIntrospection: true}},
+			wantActive: true,
+		},
+		{
+			name:       "localhost",
+			token:      "access-token",
+			remoteAddr: "127.0.0.1:1234",
+			wantActive: true,
+		},
+		{
+			name:       "node through local tailscaled",
+			token:      "access-token",
+			remoteAddr: "127.0.0.1:1234",
+			localTS:    true,
+			wantActive: false,
+		},
+		{
+			name:       "node with grant through local tailscaled",
+			token:      "access-token",
+			remoteAddr: "127.0.0.1:1234",
+			localTS:    true,
+			capRules:   []capRule{{AllowIntrospection: true}},
+			wantActive: true,
+		},
+		{
+			name:       "refresh token with hint",
+			token:      "refresh-token",
+			hint:       "refresh_token",
+			clientID:   "test-client",
+			wantActive: true,
+		},
+		{
+			name:       "refresh token without hint",
+			token:      "refresh-token",
+			clientID:   "test-client",
+			wantActive: true,
+		},
+		{
+			name:       "refresh token of other client",
+			token:      "refresh-token",
+			hint:       "refresh_token",
+			clientID:   "other-client",
+			wantActive: false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			lc := newTestWhoIsClient(t, &apitype.WhoIsResponse{
+				Node:        &tailcfg.Node{ID: 7, Name: "node.test.ts.net."},
+				UserProfile: &tailcfg.UserProfile{LoginName: "user@example.com"},
+				CapMap: tailcfg.PeerCapMap{
+					"tailscale.com/cap/tsidp": marshalCapRules(tt.capRules),
+				},
+			}, false)
+			s := setupTestServer(t, lc)
+			for _, id := range []string{"api-client", "other-client"} {
+				s.funnelClients[id] = &FunnelClient{ID: id, Secret: id + "-secret"}
+			}
+			client := s.funnelClients["test-client"]
+			now := time.Now()
+			ar := &AuthRequest{
+				ClientID:         client.ID,
+				FunnelRP:         client,
+				IsExchangedToken: true,
+				Audiences:        []string{"api-client"},
+				Scopes:           []string{"openid"},
+				IssuedAt:         now,
+				ValidTill:        now.Add(5 * time.Minute),
+				NotValidBefore:   now,
+			}
+			s.accessToken.Set("access-token", ar)
+			s.refreshToken.Set("refresh-token", ar)
+
+			form := url.Values{"token": {tt.token}}
+			if tt.hint != "" {
+				form.Set("token_type_hint", tt.hint)
+			}
+			if tt.clientID != "" {
+				form.Set("client_id", tt.clientID)
+				form.Set("client_secret", s.funnelClients[tt.clientID].Secret)
+			}
+			req := httptest.NewRequest("POST", "/introspect", strings.NewReader(form.Encode()))
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			if tt.remoteAddr != "" {
+				req.RemoteAddr = tt.remoteAddr
+			}
+			if tt.localTS {
+				s.localTSMode = true
+				req.Header.Set("X-Forwarded-For", "100.64.0.7")
+			}
+			rr := httptest.NewRecorder()
+			s.serveIntrospect(rr, req)
+			if addr := lc.Transport.(*whoisRoundTripper).addr; tt.localTS && addr != "100.64.0.7" {
+				t.Errorf("WhoIs called for %q, want the forwarded address", addr)
+			}
+			if rr.Code != http.StatusOK {
+				t.Fatalf("expected status 200, got %d: %s", rr.Code, rr.Body.String())
+			}
+
+			var resp map[string]any
+			if err := json.Unmarshal(rr.Body.Bytes(), &resp); err != nil {
+				t.Fatalf("failed to unmarshal response: %v", err)
+			}
+			if active, _ := resp["active"].(bool); active != tt.wantActive {
+				t.Fatalf("active = %v, want %v: %v", active, tt.wantActive, resp)
+			}
+			if !tt.wantActive {
+				if len(resp) != 1 {
+					t.Errorf("inactive response leaks token details: %v", resp)
+				}
+				return
+			}
+			_, hasType := resp["token_type"]
+			if isRefresh := tt.token == "refresh-token"; hasType == isRefresh {
+				t.Errorf("token_type = %v for refresh token %v", resp["token_type"], isRefresh)
+			}
+		})
+	}
+}
+
 // TestRefreshTokenFlow tests refresh token grant flow
 func TestRefreshTokenFlow(t *testing.T) {
 	tests := []struct {
@@ -577,14 +752,18 @@ func TestRefreshTokenFlow(t *testing.T) {
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 			s := &IDPServer{
-				serverURL:     "https://idp.test.ts.net",
-				refreshToken:  make(map[string]*AuthRequest),
-				funnelClients: make(map[string]*FunnelClient),
+				serverURL:         "https://idp.test.ts.net",
+				stateDir:          t.TempDir(),
+				code:              newMemTokenStore(),
+				accessToken:       newMemTokenStore(),
+				refreshToken:      newMemTokenStore(),
+				usedRefreshTokens: newMemTokenStore(),
+				funnelClients:     make(map[string]*FunnelClient),
 			}
 
 			// Set up test data
 			if tt.refreshToken == "valid-refresh-token" {
-				s.refreshToken[tt.refreshToken] = &AuthRequest{
+				s.refreshToken.Set(tt.refreshToken, &AuthRequest{
 					FunnelRP: &FunnelClient{
 						ID:     "test-client",
 						Secret: "test-secret",
@@ -606,7 +785,7 @@ func TestRefreshTokenFlow(t *testing.T) {
 							ProfilePicURL: "https://example.com/pic.jpg",
 						},
 					},
-				}
+				})
 				// Always set up the correct client for this refresh token
 				s.funnelClients["test-client"] = &FunnelClient{
 					ID:     "test-client",
@@ -615,14 +794,14 @@ func TestRefreshTokenFlow(t *testing.T) {
 
 				// Don't set up the wrong client - it should be rejected as unknown
 			} else if tt.refreshToken == "expired-token" {
-				s.refreshToken[tt.refreshToken] = &AuthRequest{
+				s.refreshToken.Set(tt.refreshToken, &AuthRequest{
 					FunnelRP: &FunnelClient{
 						ID:     "test-client",
 						Secret: "test-secret",
 					},
 					ClientID:  "test-client",
 					ValidTill: time.Now().Add(-time.Hour), // expired
-				}
+				})
 			}
 
 			// Create request
@@ -668,11 +847,6 @@ func TestTokenEndpointUnsupportedGrantType(t *testing.T) {
 			grantType:    "password",
 			expectStatus: http.StatusBadRequest,
 		},
-		{
-			name:         "client_credentials grant type",
-			grantType:    "client_credentials",
-			expectStatus: http.StatusBadRequest,
-		},
 		{
 			name:         "implicit grant type",
 			grantType:    "implicit",
@@ -689,6 +863,7 @@ func TestTokenEndpointUnsupportedGrantType(t *testing.T) {
 		t.Run(tt.name, func(t *testing.T) {
 			s := &IDPServer{
 				serverURL: "https://idp.test.ts.net",
+				stateDir:  t.TempDir(),
 			}
 
 			form := url.Values{
@@ -747,13 +922,17 @@ func TestTokenExpiration(t *testing.T) {
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 			s := &IDPServer{
-				serverURL:   "https://idp.test.ts.net",
-				accessToken: make(map[string]*AuthRequest),
+				serverURL:         "https://idp.test.ts.net",
+				stateDir:          t.TempDir(),
+				code:              newMemTokenStore(),
+				accessToken:       newMemTokenStore(),
+				refreshToken:      newMemTokenStore(),
+				usedRefreshTokens: newMemTokenStore(),
 			}
 
 			// Create a test token
 			testToken := "test-access-token"
-			s.accessToken[testToken] = &AuthRequest{
+			s.accessToken.Set(testToken, &AuthRequest{
 				ValidTill: time.Now().Add(-tt.tokenAge),
 				RemoteUser: &apitype.WhoIsResponse{
 					Node: &tailcfg.Node{
@@ -766,7 +945,7 @@ func TestTokenExpiration(t *testing.T) {
 						DisplayName: "Test User",
 					},
 				},
-			}
+			})
 
 			req := httptest.NewRequest("GET", "/userinfo", nil)
 			req.Header.Set("Accept", "application/json")
@@ -792,7 +971,7 @@ func TestTokenExpiration(t *testing.T) {
 					t.Errorf("expected error description containing %q in WWW-Authenticate header, got: %s", tt.expectError, authHeader)
 				}
 				// Verify token was deleted
-				if _, exists := s.accessToken[testToken]; exists {
+				if _, exists := s.accessToken.Get(testToken); exists {
 					t.Error("expected expired token to be deleted")
 				}
 			}
@@ -851,7 +1030,7 @@ func TestRefreshTokenWithResources(t *testing.T) {
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			s := New(nil, "", false, false, false)
+			s := New(nil, t.TempDir(), false, false, false)
 
 			// Create refresh token
 			rt := "test-refresh-token"
@@ -879,7 +1058,7 @@ func TestRefreshTokenWithResources(t *testing.T) {
 					},
 				},
 			}
-			s.refreshToken[rt] = ar
+			s.refreshToken.Set(rt, ar)
 			s.funnelClients["test-client"] = ar.FunnelRP
 
 			// Create request
@@ -912,12 +1091,12 @@ func TestRefreshTokenWithResources(t *testing.T) {
 
 // TestRefreshTokenScopePreservation tests scope preservation in refresh tokens
 func TestRefreshTokenScopePreservation(t *testing.T) {
-	s := New(nil, "", false, false, false)
+	s := New(nil, t.TempDir(), false, false, false)
 
 	// Create refresh token with specific scopes
 	rt := "test-refresh-token-scopes"
 	originalScopes := []string{"openid", "profile"}
-	s.refreshToken[rt] = &AuthRequest{
+	s.refreshToken.Set(rt, &AuthRequest{
 		FunnelRP: &FunnelClient{
 			ID:     "test-client",
 			Secret: "test-secret",
@@ -936,7 +1115,7 @@ func TestRefreshTokenScopePreservation(t *testing.T) {
 				DisplayName: "Test User",
 			},
 		},
-	}
+	})
 	s.funnelClients["test-client"] = &FunnelClient{
 		ID:     "test-client",
 		Secret: "test-secret",
@@ -967,7 +1146,7 @@ func TestRefreshTokenScopePreservation(t *testing.T) {
 	}
 
 	// Verify the new access token has the same scopes
-	if newAR, ok := s.accessToken[tokenResp.AccessToken]; ok {
+	if newAR, ok := s.accessToken.Get(tokenResp.AccessToken); ok {
 		if len(newAR.Scopes) != len(originalScopes) {
 			t.Errorf("new access token has %d scopes, expected %d", len(newAR.Scopes), len(originalScopes))
 		}
@@ -981,7 +1160,7 @@ func TestRefreshTokenScopePreservation(t *testing.T) {
 	}
 
 	// Verify the new refresh token also has the same scopes
-	if newRT, ok := s.refreshToken[tokenResp.RefreshToken]; ok {
+	if newRT, ok := s.refreshToken.Get(tokenResp.RefreshToken); ok {
 		if len(newRT.Scopes) != len(originalScopes) {
 			t.Errorf("new refresh token has %d scopes, expected %d", len(newRT.Scopes), len(originalScopes))
 		}
@@ -1020,7 +1199,7 @@ func TestAZPClaimWithMultipleAudiences(t *testing.T) {
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			s := New(nil, "", false, false, false)
+			s := New(nil, t.TempDir(), false, false, false)
 
 			// Set up funnel client
 			s.funnelClients["test-client"] = &FunnelClient{
@@ -1049,7 +1228,7 @@ func TestAZPClaimWithMultipleAudiences(t *testing.T) {
 				},
 				ValidTill: time.Now().Add(5 * time.Minute),
 			}
-			s.code[code] = ar
+			s.code.Set(code, ar)
 
 			// Exchange code for token
 			form := url.Values{
@@ -1270,7 +1449,8 @@ func TestServeToken(t *testing.T) {
 			}
 
 			s := &IDPServer{
-				code: map[string]*AuthRequest{
+				stateDir: t.TempDir(),
+				code: &memTokenStore{m: map[string]*AuthRequest{
 					"valid-code": {
 						ClientID:    "test-client",
 						Nonce:       "nonce123",
@@ -1294,10 +1474,13 @@ func TestServeToken(t *testing.T) {
 							RedirectURIs: []string{"https://rp.example.com"},
 						},
 					},
-				},
+				}},
+				accessToken:       newMemTokenStore(),
+				refreshToken:      newMemTokenStore(),
+				usedRefreshTokens: newMemTokenStore(),
 			}
-			// Inject a working signer
-			s.lazySigner.Set(oidcTestingSigner(t))
+			// Inject a working signing key
+			s.keys = oidcTestingKeyRing(t)
 
 			form := url.Values{}
 			form.Set("grant_type", tt.grantType)
@@ -1498,14 +1681,14 @@ func TestServeTokenWithClientValidation(t *testing.T) {
 					srv.funnelClients[tt.authRequestClient] = funnelClientPtr
 				}
 
-				srv.code["valid-code"] = &AuthRequest{
+				srv.code.Set("valid-code", &AuthRequest{
 					ClientID:    tt.authRequestClient,
 					Nonce:       "nonce123",
 					RedirectURI: tt.authRequestRedirect,
 					ValidTill:   now.Add(5 * time.Minute),
 					RemoteUser:  remoteUser,
 					FunnelRP:    funnelClientPtr,
-				}
+				})
 			}
 
 			// Create form data
@@ -1569,7 +1752,7 @@ func TestServeTokenWithClientValidation(t *testing.T) {
 
 				// Verify access token was stored
 				srv.mu.Lock()
-				_, ok := srv.accessToken[resp.AccessToken]
+				_, ok := srv.accessToken.Get(resp.AccessToken)
 				srv.mu.Unlock()
 
 				if !ok {
@@ -1578,7 +1761,7 @@ func TestServeTokenWithClientValidation(t *testing.T) {
 
 				// Verify authorization code was consumed
 				srv.mu.Lock()
-				_, ok = srv.code[tt.code]
+				_, ok = srv.code.Get(tt.code)
 				srv.mu.Unlock()
 
 				if ok {
@@ -1592,6 +1775,7 @@ func TestServeTokenWithClientValidation(t *testing.T) {
 func TestTokenCORSHeaders(t *testing.T) {
 	s := &IDPServer{
 		serverURL: "https://idp.test.ts.net",
+		stateDir:  t.TempDir(),
 	}
 	req := httptest.NewRequest("OPTIONS", "/token", nil)
 	rr := httptest.NewRecorder()
@@ -1613,3 +1797,454 @@ func TestTokenCORSHeaders(t *testing.T) {
 		t.Errorf("expected AccessControl-Allow-Headers to be '*', got %s", ah)
 	}
 }
+
+// TestAuthorizationCodeExpiry tests that expired authorization codes are
+// rejected
+func TestAuthorizationCodeExpiry(t *testing.T) {
+	s := New(nil, t.TempDir(), false, false, false)
+	client := &FunnelClient{
+		ID:           "test-client",
+		Secret:       "test-secret",
+		RedirectURIs: []string{"https://rp.example.com/callback"},
+	}
+	s.SetFunnelClients(map[string]*FunnelClient{client.ID: client})
+	s.code.Set("code", &AuthRequest{
+		ClientID:    client.ID,
+		RedirectURI: "https://rp.example.com/callback",
+		ValidTill:   time.Now().Add(-time.Second),
+		FunnelRP:    client,
+		RemoteUser: &apitype.WhoIsResponse{
+			Node:        &tailcfg.Node{ID: 1, Name: "node.test.ts.net.", User: 1},
+			UserProfile: &tailcfg.UserProfile{LoginName: "user@example.com"},
+		},
+	})
+
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {"code"},
+		"redirect_uri":  {"https://rp.example.com/callback"},
+		"client_id":     {client.ID},
+		"client_secret": {client.Secret},
+	}
+	req := httptest.NewRequest("POST", "/token", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	rr := httptest.NewRecorder()
+	s.serveToken(rr, req)
+	if rr.Code != http.StatusBadRequest || !strings.Contains(rr.Body.String(), "invalid_grant") {
+		t.Errorf("expected invalid_grant, got %d: %s", rr.Code, rr.Body.String())
+	}
+	if _, ok := s.code.Get("code"); ok {
+		t.Error("expired code was not removed")
+	}
+}
+
+// TestIDTokenSigningAlg tests that ID tokens are signed with the algorithm
+// registered for the client, and verify against the published JWKS
+func TestIDTokenSigningAlg(t *testing.T) {
+	tests := []struct {
+		name    string
+		alg     string
+		wantAlg jose.SignatureAlgorithm
+	}{
+		{name: "default", alg: "", wantAlg: jose.RS256},
+		{name: "RS256", alg: "RS256", wantAlg: jose.RS256},
+		{name: "ES256", alg: "ES256", wantAlg: jose.ES256},
+		{name: "EdDSA", alg: "EdDSA", wantAlg: jose.EdDSA},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := New(nil, t.TempDir(), false, false, false)
+			client := &FunnelClient{
+				ID:                       "test-client",
+				Secret:                   "test-secret",
+				RedirectURIs:             []string{"https://rp.example.com/callback"},
+				IDTokenSignedResponseAlg: tt.alg,
+			}
+			s.SetFunnelClients(map[string]*FunnelClient{client.ID: client})
+			s.code.Set("code", &AuthRequest{
+				ClientID:    client.ID,
+				RedirectURI: "https://rp.example.com/callback",
+				ValidTill:   time.Now().Add(5 * time.Minute),
+				FunnelRP:    client,
+				RemoteUser: &apitype.WhoIsResponse{
+					Node:        &tailcfg.Node{ID: 1, Name: "node.test.ts.net.", User: 1},
+					UserProfile: &tailcfg.UserProfile{LoginName: "user@example.com"},
+				},
+			})
+
+			form := url.Values{}
+			form.Set("grant_type", "authorization_code")
+			form.Set("code", "code")
+			form.Set("redirect_uri", "https://rp.example.com/callback")
+			form.Set("client_id", client.ID)
+			form.Set("client_secret", client.Secret)
+			req := httptest.NewRequest("POST", "/token", strings.NewReader(form.Encode()))
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			rr := httptest.NewRecorder()
+			s.serveToken(rr, req)
+			if rr.Code != http.StatusOK {
+				t.Fatalf("expected 200 OK, got %d: %s", rr.Code, rr.Body.String())
+			}
+
+			var resp struct {
+				IDToken string `json:"id_token"`
+			}
+			if err := json.Unmarshal(rr.Body.Bytes(), &resp); err != nil {
+				t.Fatalf("failed to unmarshal response: %v", err)
+			}
+			tok, err := jwt.ParseSigned(resp.IDToken)
+			if err != nil {
+				t.Fatalf("failed to parse ID token: %v", err)
+			}
+			if got := tok.Headers[0].Algorithm; got != string(tt.wantAlg) {
+				t.Errorf("ID token alg = %s, want %s", got, tt.wantAlg)
+			}
+
+			rr = httptest.NewRecorder()
+			s.serveJWKS(rr, httptest.NewRequest("GET", "/.well-known/jwks.json", nil))
+			var jwks jose.JSONWebKeySet
+			if err := json.Unmarshal(rr.Body.Bytes(), &jwks); err != nil {
+				t.Fatalf("decoding JWKS: %v", err)
+			}
+			keys := jwks.Key(tok.Headers[0].KeyID)
+			if len(keys) != 1 {
+				t.Fatalf("kid %s not published in JWKS", tok.Headers[0].KeyID)
+			}
+			if keys[0].Algorithm != string(tt.wantAlg) {
+				t.Errorf("JWK alg = %s, want %s", keys[0].Algorithm, tt.wantAlg)
+			}
+			var claims jwt.Claims
+			if err := tok.Claims(keys[0].Key, &claims); err != nil {
+				t.Fatalf("ID token does not verify against JWKS: %v", err)
+			}
+		})
+	}
+}
+
+// TestClientCredentialsGrant tests the client credentials grant (RFC 6749
+// Section 4.4)
+func TestClientCredentialsGrant(t *testing.T) {
+	machine := &FunnelClient{
+		ID:         "ci-client",
+		Secret:     "ci-secret",
+		GrantTypes: []string{"client_credentials"},
+		Scope:      "read write",
+		Resources:  []string{"https://api.example.com"},
+	}
+	webApp := &FunnelClient{
+		ID:           "web-client",
+		Secret:       "web-secret",
+		RedirectURIs: []string{"https://rp.example.com/callback"},
+	}
+
+	tests := []struct {
+		name           string
+		clientID       string
+		clientSecret   string
+		basicAuth      bool
+		scope          string
+		resources      []string
+		expectStatus   int
+		expectError    string
+		expectScope    string
+		expectAudience []string
+	}{
+		{
+			name:           "all configured scopes by default",
+			clientID:       "ci-client",
+			clientSecret:   "ci-secret",
+			basicAuth:      true,
+			expectStatus:   http.StatusOK,
+			expectScope:    "read write",
+			expectAudience: []string{"ci-client"},
+		},
+		{
+			name:           "subset of scopes and a resource",
+			clientID:       "ci-client",
+			clientSecret:   "ci-secret",
+			scope:          "read",
+			resources:      []string{"https://api.example.com"},
+			expectStatus:   http.StatusOK,
+			expectScope:    "read",
+			expectAudience: []string{"ci-client", "https://api.example.com"},
+		},
+		{
+			name:         "scope not configured",
+			clientID:     "ci-client",
+			clientSecret: "ci-secret",
+			scope:        "read admin",
+			expectStatus: http.StatusBadRequest,
+			expectError:  "invalid_scope",
+		},
+		{
+			name:         "resource not configured",
+			clientID:     "ci-client",
+			clientSecret: "ci-secret",
+			resources:    []string{"https://other.example.com"},
+			expectStatus: http.StatusBadRequest,
+			expectError:  "invalid_request",
+		},
+		{
+			name:         "wrong secret",
+			clientID:     "ci-client",
+			clientSecret: "wrong",
+			basicAuth:    true,
+			expectStatus: http.StatusUnauthorized,
+			expectError:  "invalid_client",
+		},
+		{
+			name:         "unknown client",
+			clientID:     "nobody",
+			clientSecret: "ci-secret",
+			expectStatus: http.StatusUnauthorized,
+			expectError:  "invalid_client",
+		},
+		{
+			name:         "missing credentials",
+			expectStatus: http.StatusUnauthorized,
+			expectError:  "invalid_client",
+		},
+		{
+			name:         "grant not registered for client",
+			clientID:     "web-client",
+			clientSecret: "web-secret",
+			expectStatus: http.StatusBadRequest,
+			expectError:  "unauthorized_client",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := New(nil, t.TempDir(), false, false, false)
+			s.serverURL = "https://idp.test.ts.net"
+			s.SetFunnelClients(map[string]*FunnelClient{machine.ID: machine, webApp.ID: webApp})
+
+			form := url.Values{"grant_type": {"client_credentials"}}
+			if tt.scope != "" {
+				form.Set("scope", tt.scope)
+			}
+			for _, res := range tt.resources {
+				form.Add("resource", res)
+			}
+			if !tt.basicAuth && tt.clientID != "" {
+				form.Set("client_id", tt.clientID)
+				form.Set("client_secret", tt.clientSecret)
+			}
+			req := httptest.NewRequest("POST", "/token", strings.NewReader(form.Encode()))
+			req.Header.Set("Accept", "application/json")
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			if tt.basicAuth {
+				req.SetBasicAuth(tt.clientID, tt.clientSecret)
+			}
+			rr := httptest.NewRecorder()
+			s.serveToken(rr, req)
+
+			if rr.Code != tt.expectStatus {
+				t.Fatalf("expected status %d, got %d: %s", tt.expectStatus, rr.Code, rr.Body.String())
+			}
+			var resp map[string]any
+			if err := json.Unmarshal(rr.Body.Bytes(), &resp); err != nil {
+				t.Fatalf("failed to unmarshal response: %v", err)
+			}
+			if tt.expectError != "" {
+				if resp["error"] != tt.expectError {
+					t.Errorf("error = %v, want %s", resp["error"], tt.expectError)
+				}
+				if n := tokenCount(s.accessToken); n != 0 {
+					t.Errorf("expected no access tokens, got %d", n)
+				}
+				return
+			}
+
+			if _, ok := resp["id_token"]; ok {
+				t.Error("client credentials response must not include an id_token")
+			}
+			if _, ok := resp["refresh_token"]; ok {
+				t.Error("client credentials response must not include a refresh_token")
+			}
+			if resp["token_type"] != "Bearer" || resp["scope"] != tt.expectScope {
+				t.Errorf("unexpected response %v", resp)
+			}
+
+			// The token is introspected as belonging to the client.
+			at, _ := resp["access_token"].(string)
+			form = url.Values{"token": {at}}
+			req = httptest.NewRequest("POST", "/introspect", strings.NewReader(form.Encode()))
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			req.SetBasicAuth(machine.ID, machine.Secret)
+			rr = httptest.NewRecorder()
+			s.serveIntrospect(rr, req)
+
+			var intro map[string]any
+			if err := json.Unmarshal(rr.Body.Bytes(), &intro); err != nil {
+				t.Fatalf("failed to unmarshal introspection: %v", err)
+			}
+			if intro["active"] != true || intro["sub"] != machine.ID || intro["client_id"] != machine.ID {
+				t.Errorf("unexpected introspection response %v", intro)
+			}
+			if intro["scope"] != tt.expectScope {
+				t.Errorf("introspected scope = %v, want %s", intro["scope"], tt.expectScope)
+			}
+			var aud []string
+			for _, a := range intro["aud"].([]any) {
+				aud = append(aud, a.(string))
+			}
+			if !reflect.DeepEqual(aud, tt.expectAudience) {
+				t.Errorf("introspected aud = %v, want %v", aud, tt.expectAudience)
+			}
+
+			// There is no user to return claims for.
+			req = httptest.NewRequest("GET", "/userinfo", nil)
+			req.Header.Set("Authorization", "Bearer "+at)
+			rr = httptest.NewRecorder()
+			s.serveUserInfo(rr, req)
+			if rr.Code != http.StatusForbidden {
+				t.Errorf("userinfo: expected status 403, got %d", rr.Code)
+			}
+		})
+	}
+}
+
+// TestTokenExchangeRequestedTokenType tests exchanging tokens for ID and
+// refresh tokens
+func TestTokenExchangeRequestedTokenType(t *testing.T) {
+	s := setupTestServer(t, nil)
+	client := s.funnelClients["test-client"]
+	now := time.Now()
+	user := &apitype.WhoIsResponse{
+		Node:        &tailcfg.Node{ID: 1, Name: "node.test.ts.net.", User: 1},
+		UserProfile: &tailcfg.UserProfile{LoginName: "user@example.com"},
+		CapMap: tailcfg.PeerCapMap{
+			tailcfg.PeerCapabilityTsIDP: marshalCapRules([]capRule{{
+				Users:       []string{"*"},
+				Resources:   []string{"https://api.example.com"},
+				ExtraClaims: map[string]any{"groups": []string{"eng"}},
+				Delegation:  []delegationRule{{ActorClients: []string{"agent"}, Audiences: []string{"*"}}},
+			}}),
+		},
+	}
+	s.accessToken.Set("subject-token", &AuthRequest{
+		ClientID:   client.ID,
+		FunnelRP:   client,
+		GrantID:    "grant-1",
+		Scopes:     []string{"openid", "email"},
+		RemoteUser: user,
+		ValidTill:  now.Add(5 * time.Minute),
+	})
+	s.accessToken.Set("actor-token", &AuthRequest{
+		ClientID:            "agent",
+		IsClientCredentials: true,
+		ValidTill:           now.Add(5 * time.Minute),
+	})
+
+	exchange := func(requestedTokenType string) (*httptest.ResponseRecorder, map[string]any) {
+		t.Helper()
+		form := url.Values{
+			"grant_type":           {"urn:ietf:params:oauth:grant-type:token-exchange"},
+			"subject_token":        {"subject-token"},
+			"subject_token_type":   {tokenTypeAccessToken},
+			"requested_token_type": {requestedTokenType},
+			"actor_token":          {"actor-token"},
+			"audience":             {"https://api.example.com", "https://other.example.com"},
+			"client_id":            {client.ID},
+			"client_secret":        {client.Secret},
+		}
+		req := httptest.NewRequest("POST", "/token", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		rr := httptest.NewRecorder()
+		s.serveTokenExchange(rr, req)
+		var resp map[string]any
+		json.Unmarshal(rr.Body.Bytes(), &resp)
+		return rr, resp
+	}
+	verifyIDToken := func(token string) map[string]any {
+		t.Helper()
+		tok, err := jwt.ParseSigned(token)
+		if err != nil {
+			t.Fatalf("parsing ID token: %v", err)
+		}
+		var claims map[string]any
+		if err := s.verifyOwnSignature(tok, &claims); err != nil {
+			t.Fatalf("verifying ID token: %v", err)
+		}
+		return claims
+	}
+
+	t.Run("id_token", func(t *testing.T) {
+		rr, resp := exchange(tokenTypeIDToken)
+		if rr.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d: %s", rr.Code, rr.Body.String())
+		}
+		if resp["issued_token_type"] != tokenTypeIDToken || resp["token_type"] != "N_A" {
+			t.Errorf("unexpected response %v", resp)
+		}
+		claims := verifyIDToken(resp["access_token"].(string))
+		if claims["sub"] != "userid:1" || claims["email"] != "user@example.com" {
+			t.Errorf("unexpected user claims %v", claims)
+		}
+		if aud, _ := claims["aud"].([]any); len(aud) != 1 || aud[0] != "https://api.example.com" {
+			t.Errorf("aud = %v, want only the allowed audience", claims["aud"])
+		}
+		if groups, _ := claims["groups"].([]any); len(groups) != 1 || groups[0] != "eng" {
+			t.Errorf("groups = %v, want the extra claims of the user", claims["groups"])
+		}
+		if act, _ := claims["act"].(map[string]any); act["sub"] != "agent" {
+			t.Errorf("act = %v, want the actor", claims["act"])
+		}
+		if mayAct, _ := claims["may_act"].(map[string]any); mayAct["sub"] != "agent" || mayAct["client_id"] != "agent" {
+			t.Errorf("may_act = %v, want the allowed actor", claims["may_act"])
+		}
+	})
+
+	t.Run("refresh_token", func(t *testing.T) {
+		rr, resp := exchange(tokenTypeRefreshToken)
+		if rr.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d: %s", rr.Code, rr.Body.String())
+		}
+		if resp["issued_token_type"] != tokenTypeRefreshToken || resp["token_type"] != "N_A" {
+			t.Errorf("unexpected response %v", resp)
+		}
+		rt := resp["access_token"].(string)
+		ar, ok := s.refreshToken.Get(rt)
+		if !ok {
+			t.Fatal("refresh token not stored")
+		}
+		if ar.GrantID != "grant-1" || ar.FunnelRP != client {
+			t.Errorf("refresh token of grant %q for %v", ar.GrantID, ar.FunnelRP)
+		}
+
+		// The exchanging client can refresh it.
+		form := url.Values{
+			"grant_type":    {"refresh_token"},
+			"refresh_token": {rt},
+			"client_id":     {client.ID},
+			"client_secret": {client.Secret},
+		}
+		req := httptest.NewRequest("POST", "/token", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		rr = httptest.NewRecorder()
+		s.serveToken(rr, req)
+		if rr.Code != http.StatusOK {
+			t.Fatalf("refresh: expected status 200, got %d: %s", rr.Code, rr.Body.String())
+		}
+		var refreshed oidcTokenResponse
+		if err := json.Unmarshal(rr.Body.Bytes(), &refreshed); err != nil {
+			t.Fatal(err)
+		}
+		claims := verifyIDToken(refreshed.IDToken)
+		if aud, _ := claims["aud"].([]any); len(aud) != 1 || aud[0] != "https://api.example.com" {
+			t.Errorf("refreshed ID token aud = %v, want only the allowed audience", claims["aud"])
+		}
+		if at, _ := s.accessToken.Get(refreshed.AccessToken); at == nil || at.ActorInfo == nil {
+			t.Error("refreshed access token lost the actor")
+		}
+	})
+
+	t.Run("unsupported", func(t *testing.T) {
+		rr, _ := exchange("urn:ietf:params:oauth:token-type:saml2")
+		if rr.Code != http.StatusBadRequest {
+			t.Errorf("expected status 400, got %d: %s", rr.Code, rr.Body.String())
+		}
+	})
+}
@@ -0,0 +1,299 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"iter"
+	"log/slog"
+	"maps"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"tailscale.com/atomicfile"
+)
+
+// tokenStore holds authorization codes, access tokens or refresh tokens,
+// keyed by the random token value handed out to clients.
+//
+// Implementations are not safe for concurrent use; IDPServer serializes
+// access with s.mu. Set, Delete and DeleteFunc always update the store's
+// in-memory view. A returned error only reports a failure to persist it.
+type tokenStore interface {
+	// Get returns the AuthRequest stored for token, if any.
+	Get(token string) (*AuthRequest, bool)
+
+	// Set stores ar under token, replacing any existing entry.
+	Set(token string, ar *AuthRequest) error
+
+	// Delete removes token from the store. Deleting a missing token is a no-op.
+	Delete(token string) error
+
+	// DeleteFunc removes every entry for which del returns true.
+	DeleteFunc(del func(token string, ar *AuthRequest) bool) error
+
+	// All iterates over all entries in the store. The store must not be
+	// modified during iteration.
+	All() iter.Seq2[string, *AuthRequest]
+}
+
+// memTokenStore is a tokenStore that only keeps tokens in memory.
+// Its contents are lost when tsidp restarts.
+type memTokenStore struct {
+	m map[string]*AuthRequest
+}
+
+func newMemTokenStore() *memTokenStore {
+	return &memTokenStore{m: make(map[string]*AuthRequest)}
+}
+
+func (ms *memTokenStore) Get(token string) (*AuthRequest, bool) {
+	ar, ok := ms.m[token]
+	return ar, ok
+}
+
+func (ms *memTokenStore) Set(token string, ar *AuthRequest) error {
+	ms.m[token] = ar
+	return nil
+}
+
+func (ms *memTokenStore) Delete(token string) error {
+	delete(ms.m, token)
+	return nil
+}
+
+func (ms *memTokenStore) DeleteFunc(del func(token string, ar *AuthRequest) bool) error {
+	maps.DeleteFunc(ms.m, del)
+	return nil
+}
+
+func (ms *memTokenStore) All() iter.Seq2[string, *AuthRequest] {
+	return maps.All(ms.m)
+}
+
+// fileTokenStore is a tokenStore that keeps tokens in memory and writes
+// the whole set to a JSON file in the state directory on every change,
+// so that sessions survive a tsidp restart.
+//
+// Changes are encoded synchronously but written in the background, so that
+// callers holding s.mu don't wait for the disk. Only the latest contents
+// are written, atomically, and write failures are logged.
+type fileTokenStore struct {
+	memTokenStore
+	path string
+
+	writeMu sync.Mutex
+	idle    *sync.Cond // signaled when writing becomes false
+	pending []byte     // contents not yet written, or nil
+	writing bool       // whether writeLoop is running
+}
+
+// storedAuthRequest is the on-disk form of an AuthRequest. The funnel client
+// is stored by ID only, so client secrets are not copied into the token
+// files; it is reattached to the live FunnelClient by LoadTokens.
+type storedAuthRequest struct {
+	*AuthRequest
+	FunnelRP string `json:",omitempty"`
+}
+
+// newFileTokenStore returns a fileTokenStore backed by path, loading any
+// tokens previously persisted there. A missing file yields an empty store,
+// an unreadable one an error.
+// Loaded entries with a funnel client only have FunnelRP.ID populated.
+func newFileTokenStore(path string) (*fileTokenStore, error) {
+	fs := &fileTokenStore{
+		memTokenStore: *newMemTokenStore(),
+		path:          path,
+	}
+	fs.idle = sync.NewCond(&fs.writeMu)
+
+	b, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return fs, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var stored map[string]storedAuthRequest
+	if err := json.Unmarshal(b, &stored); err != nil {
+		return nil, fmt.Errorf("decoding %s: %w", path, err)
+	}
+	for token, sar := range stored {
+		if sar.AuthRequest == nil {
+			continue
+		}
+		ar := sar.AuthRequest
+		if sar.FunnelRP != "" {
+			ar.FunnelRP = &FunnelClient{ID: sar.FunnelRP}
+		}
+		fs.m[token] = ar
+	}
+	return fs, nil
+}
+
+func (fs *fileTokenStore) Set(token string, ar *AuthRequest) error {
+	fs.memTokenStore.Set(token, ar)
+	return fs.save()
+}
+
+func (fs *fileTokenStore) Delete(token string) error {
+	if _, ok := fs.m[token]; !ok {
+		return nil
+	}
+	fs.memTokenStore.Delete(token)
+	return fs.save()
+}
+
+func (fs *fileTokenStore) DeleteFunc(del func(token string, ar *AuthRequest) bool) error {
+	n := len(fs.m)
+	fs.memTokenStore.DeleteFunc(del)
+	if len(fs.m) == n {
+		return nil
+	}
+	return fs.save()
+}
+
+// save schedules the current contents of the store to be written to
+// fs.path.
+func (fs *fileTokenStore) save() error {
+	stored := make(map[string]storedAuthRequest, len(fs.m))
+	for token, ar := range fs.m {
+		sar := storedAuthRequest{AuthRequest: ar}
+		if ar.FunnelRP != nil {
+			sar.FunnelRP = ar.FunnelRP.ID
+		}
+		stored[token] = sar
+	}
+
+	var buf bytes.Buffer
+	if err := json.NewEncoder(&buf).Encode(stored); err != nil {
+		return fmt.Errorf("encoding token store: %w", err)
+	}
+
+	fs.writeMu.Lock()
+	defer fs.writeMu.Unlock()
+	fs.pending = buf.Bytes()
+	if !fs.writing {
+		fs.writing = true
+		go fs.writeLoop()
+	}
+	return nil
+}
+
+// writeLoop writes pending contents until there are none left.
+func (fs *fileTokenStore) writeLoop() {
+	fs.writeMu.Lock()
+	defer fs.writeMu.Unlock()
+	for fs.pending != nil {
+		b := fs.pending
+		fs.pending = nil
+		fs.writeMu.Unlock()
+		if err := atomicfile.WriteFile(fs.path, b, 0600); err != nil {
+			slog.Warn("failed to persist token store", slog.String("path", fs.path), slog.Any("error", err))
+		}
+		fs.writeMu.Lock()
+	}
+	fs.writing = false
+	fs.idle.Broadcast()
+}
+
+// flush waits until all changes so far are written.
+func (fs *fileTokenStore) flush() {
+	fs.writeMu.Lock()
+	defer fs.writeMu.Unlock()
+	for fs.writing {
+		fs.idle.Wait()
+	}
+}
+
+// Files in the state directory used to persist tokens.
+const (
+	codesFile         = "oidc-codes.json"
+	accessTokensFile  = "oidc-access-tokens.json"
+	refreshTokensFile = "oidc-refresh-tokens.json"
+
+	usedRefreshTokensFile = "oidc-used-refresh-tokens.json"
+)
+
+// statePath returns the path of name inside the state directory.
+func (s *IDPServer) statePath(name string) string {
+	if s.stateDir != "" {
+		return filepath.Join(s.stateDir, name)
+	}
+	return name
+}
+
+// LoadTokens switches the server to file-backed token stores in the state
+// directory and loads any authorization codes, access tokens, refresh
+// tokens and used refresh tokens persisted by a previous run.
+//
+// It must be called after LoadFunnelClients so that loaded tokens can be
+// reattached to their funnel clients. Tokens whose client no longer exists
+// are dropped.
+func (s *IDPServer) LoadTokens() error {
+	code, err := newFileTokenStore(s.statePath(codesFile))
+	if err != nil {
+		return fmt.Errorf("loading authorization codes: %w", err)
+	}
+	accessToken, err := newFileTokenStore(s.statePath(accessTokensFile))
+	if err != nil {
+		return fmt.Errorf("loading access tokens: %w", err)
+	}
+	refreshToken, err := newFileTokenStore(s.statePath(refreshTokensFile))
+	if err != nil {
+		return fmt.Errorf("loading refresh tokens: %w", err)
+	}
+	usedRefreshTokens, err := newFileTokenStore(s.statePath(usedRefreshTokensFile))
+	if err != nil {
+		return fmt.Errorf("loading used refresh tokens: %w", err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, ts := range []*fileTokenStore{code, accessToken, refreshToken, usedRefreshTokens} {
+		if err := ts.DeleteFunc(s.reattachFunnelClientLocked); err != nil {
+			return fmt.Errorf("pruning tokens of deleted clients: %w", err)
+		}
+	}
+
+	s.code = code
+	s.accessToken = accessToken
+	s.refreshToken = refreshToken
+	s.usedRefreshTokens = usedRefreshTokens
+	return nil
+}
+
+// FlushTokens waits until the changes to persisted tokens so far are
+// written to the state directory. It is meant to be called before exiting.
+func (s *IDPServer) FlushTokens() {
+	s.mu.Lock()
+	stores := []tokenStore{s.code, s.accessToken, s.refreshToken, s.usedRefreshTokens}
+	s.mu.Unlock()
+	for _, ts := range stores {
+		if fs, ok := ts.(*fileTokenStore); ok {
+			fs.flush()
+		}
+	}
+}
+
+// reattachFunnelClientLocked points a loaded AuthRequest at the live
+// FunnelClient it was issued for. It reports true if that client no longer
+// exists and the token should be dropped.
+// Caller must hold s.mu lock
+func (s *IDPServer) reattachFunnelClientLocked(_ string, ar *AuthRequest) bool {
+	if ar.FunnelRP == nil {
+		return false
+	}
+	c, ok := s.funnelClients[ar.FunnelRP.ID]
+	if !ok {
+		return true
+	}
+	ar.FunnelRP = c
+	return false
+}
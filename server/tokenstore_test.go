@@ -0,0 +1,175 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package server
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"tailscale.com/client/tailscale/apitype"
+	"tailscale.com/tailcfg"
+)
+
+// TestFileTokenStorePersistence tests that tokens written to a fileTokenStore
+// are loaded again by a new store backed by the same file
+func TestFileTokenStorePersistence(t *testing.T) {
+	path := filepath.Join(t.TempDir(), accessTokensFile)
+
+	ts, err := newFileTokenStore(path)
+	if err != nil {
+		t.Fatalf("newFileTokenStore: %v", err)
+	}
+
+	validTill := time.Now().Add(time.Hour).Truncate(time.Second)
+	ar := &AuthRequest{
+		ClientID:    "test-client",
+		RedirectURI: "https://rp.example.com/callback",
+		Scopes:      []string{"openid", "email"},
+		ValidTill:   validTill,
+		JTI:         "jti-1",
+		FunnelRP: &FunnelClient{
+			ID:     "test-client",
+			Secret: "super-secret",
+		},
+		RemoteUser: &apitype.WhoIsResponse{
+			Node:        &tailcfg.Node{ID: 123, User: 456, Name: "node.test.ts.net."},
+			UserProfile: &tailcfg.UserProfile{LoginName: "user@example.com"},
+		},
+		ActorInfo: &ActorClaim{Subject: "actor", ClientID: "actor-client"},
+	}
+	if err := ts.Set("token-1", ar); err != nil {
+		t.Fatalf("Set: %v", err)
+	}
+	if err := ts.Set("token-2", &AuthRequest{ClientID: "other"}); err != nil {
+		t.Fatalf("Set: %v", err)
+	}
+	if err := ts.Delete("token-2"); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+
+	ts.flush()
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("reading token file: %v", err)
+	}
+	if strings.Contains(string(b), "super-secret") {
+		t.Error("client secret was written to the token file")
+	}
+
+	ts2, err := newFileTokenStore(path)
+	if err != nil {
+		t.Fatalf("newFileTokenStore reload: %v", err)
+	}
+	if n := tokenCount(ts2); n != 1 {
+		t.Fatalf("expected 1 token after reload, got %d", n)
+	}
+
+	got, ok := ts2.Get("token-1")
+	if !ok {
+		t.Fatal("token-1 not found after reload")
+	}
+	if got.ClientID != ar.ClientID || got.RedirectURI != ar.RedirectURI || got.JTI != ar.JTI {
+		t.Errorf("reloaded AuthRequest mismatch: got %+v", got)
+	}
+	if !got.ValidTill.Equal(validTill) {
+		t.Errorf("ValidTill = %v, want %v", got.ValidTill, validTill)
+	}
+	if strings.Join(got.Scopes, " ") != "openid email" {
+		t.Errorf("Scopes = %v", got.Scopes)
+	}
+	if got.RemoteUser == nil || got.RemoteUser.Node.ID != 123 || got.RemoteUser.UserProfile.LoginName != "user@example.com" {
+		t.Errorf("RemoteUser not restored: %+v", got.RemoteUser)
+	}
+	if got.ActorInfo == nil || got.ActorInfo.Subject != "actor" {
+		t.Errorf("ActorInfo not restored: %+v", got.ActorInfo)
+	}
+	if got.FunnelRP == nil || got.FunnelRP.ID != "test-client" || got.FunnelRP.Secret != "" {
+		t.Errorf("expected FunnelRP placeholder with ID only, got %+v", got.FunnelRP)
+	}
+}
+
+// TestFileTokenStoreCorruptFile tests that a corrupt token file is an
+// error rather than an empty store, which would end every session
+func TestFileTokenStoreCorruptFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), refreshTokensFile)
+	if err := os.WriteFile(path, []byte("{not json"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := newFileTokenStore(path); err == nil {
+		t.Error("expected an error for a corrupt token file")
+	}
+}
+
+// TestLoadTokens tests that tokens survive a server restart and are
+// reattached to the current funnel clients
+func TestLoadTokens(t *testing.T) {
+	stateDir := t.TempDir()
+	client := &FunnelClient{
+		ID:           "test-client",
+		Secret:       "test-secret",
+		RedirectURIs: []string{"https://rp.example.com/callback"},
+	}
+
+	s := New(nil, stateDir, false, false, false)
+	s.SetFunnelClients(map[string]*FunnelClient{
+		"test-client":    client,
+		"deleted-client": {ID: "deleted-client", Secret: "gone"},
+	})
+	if err := s.LoadTokens(); err != nil {
+		t.Fatalf("LoadTokens: %v", err)
+	}
+	t.Cleanup(s.FlushTokens)
+
+	validTill := time.Now().Add(time.Hour)
+	s.mu.Lock()
+	s.accessToken.Set("at", &AuthRequest{ClientID: "test-client", FunnelRP: client, ValidTill: validTill})
+	s.refreshToken.Set("rt", &AuthRequest{ClientID: "test-client", FunnelRP: client, ValidTill: validTill})
+	s.refreshToken.Set("orphan", &AuthRequest{
+		ClientID:  "deleted-client",
+		FunnelRP:  s.funnelClients["deleted-client"],
+		ValidTill: validTill,
+	})
+	s.refreshToken.Set("local", &AuthRequest{ClientID: "local:127.0.0.1", LocalRP: true, ValidTill: validTill})
+	s.mu.Unlock()
+
+	s.FlushTokens()
+
+	// Simulate a restart where deleted-client no longer exists and the
+	// secret of test-client has been rotated.
+	restartedClient := *client
+	restartedClient.Secret = "rotated-secret"
+	s2 := New(nil, stateDir, false, false, false)
+	s2.SetFunnelClients(map[string]*FunnelClient{"test-client": &restartedClient})
+	if err := s2.LoadTokens(); err != nil {
+		t.Fatalf("LoadTokens after restart: %v", err)
+	}
+	t.Cleanup(s2.FlushTokens)
+
+	at, ok := s2.accessToken.Get("at")
+	if !ok {
+		t.Fatal("access token lost across restart")
+	}
+	if at.FunnelRP != &restartedClient {
+		t.Errorf("access token not reattached to live funnel client")
+	}
+
+	rt, ok := s2.refreshToken.Get("rt")
+	if !ok {
+		t.Fatal("refresh token lost across restart")
+	}
+	if rt.FunnelRP != &restartedClient {
+		t.Errorf("refresh token not reattached to live funnel client")
+	}
+
+	if _, ok := s2.refreshToken.Get("orphan"); ok {
+		t.Error("expected token of deleted client to be dropped")
+	}
+	if _, ok := s2.refreshToken.Get("local"); !ok {
+		t.Error("expected token without funnel client to be kept")
+	}
+}
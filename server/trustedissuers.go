@@ -0,0 +1,224 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package server
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+
+	"gopkg.in/square/go-jose.v2"
+	"gopkg.in/square/go-jose.v2/jwt"
+)
+
+// TrustedIssuer is an external OpenID Connect issuer, such as a CI
+// provider, whose JWTs clients can exchange for tsidp access tokens.
+type TrustedIssuer struct {
+	// Issuer is the iss claim of the issuer's tokens. Its signing keys are
+	// discovered from Issuer/.well-known/openid-configuration unless
+	// JWKSURI is set.
+	Issuer  string `json:"issuer"`
+	JWKSURI string `json:"jwks_uri,omitempty"`
+
+	// Audience is the aud claim the issuer's tokens must have. It defaults
+	// to the tsidp issuer URL.
+	Audience string `json:"audience,omitempty"`
+
+	// Policies map the issuer's tokens to identities. The first policy that
+	// matches a token decides; tokens no policy matches are rejected.
+	Policies []TrustPolicy `json:"policies"`
+}
+
+// TrustPolicy maps the tokens of a trusted issuer to an identity and the
+// audiences it may get tokens for, like the users and resources of a
+// tsidp capability grant.
+type TrustPolicy struct {
+	// Subjects are the sub claims the policy applies to ("*" for any).
+	Subjects []string `json:"subjects"`
+
+	// Claims are other claims the token must have, with these values.
+	Claims map[string]string `json:"claims,omitempty"`
+
+	// Identity is the subject of the tokens exchanged for matching tokens.
+	Identity string `json:"identity"`
+
+	// Resources are the audiences the identity may get tokens for, as
+	// patterns like those of capability rules.
+	Resources []string `json:"resources"`
+}
+
+// SetTrustedIssuers sets the external issuers whose JWTs can be exchanged
+// for tsidp access tokens.
+func (s *IDPServer) SetTrustedIssuers(issuers []TrustedIssuer) error {
+	seen := map[string]bool{}
+	for _, ti := range issuers {
+		if err := ti.validate(); err != nil {
+			return fmt.Errorf("trusted issuer %q: %w", ti.Issuer, err)
+		}
+		if seen[ti.Issuer] {
+			return fmt.Errorf("trusted issuer %q is listed twice", ti.Issuer)
+		}
+		seen[ti.Issuer] = true
+	}
+	s.trustedIssuers = issuers
+	return nil
+}
+
+// validate returns an error if ti isn't a usable trusted issuer.
+func (ti *TrustedIssuer) validate() error {
+	if !isHTTPSURL(ti.Issuer) {
+		return errors.New("issuer must be an https URL")
+	}
+	if ti.JWKSURI != "" && !isHTTPSURL(ti.JWKSURI) {
+		return errors.New("jwks_uri must be an https URL")
+	}
+	if len(ti.Policies) == 0 {
+		return errors.New("at least one policy is required")
+	}
+	for i, p := range ti.Policies {
+		switch {
+		case len(p.Subjects) == 0:
+			return fmt.Errorf("policy %d: subjects are required", i)
+		case p.Identity == "":
+			return fmt.Errorf("policy %d: identity is required", i)
+		case len(p.Resources) == 0:
+			return fmt.Errorf("policy %d: resources are required", i)
+		}
+	}
+	return nil
+}
+
+// trustedIssuer returns the trusted issuer iss, or nil if it isn't trusted.
+func (s *IDPServer) trustedIssuer(iss string) *TrustedIssuer {
+	for i := range s.trustedIssuers {
+		if s.trustedIssuers[i].Issuer == iss {
+			return &s.trustedIssuers[i]
+		}
+	}
+	return nil
+}
+
+// policyFor returns the first policy of ti that matches the token with the
+// given claims, or nil if none does.
+func (ti *TrustedIssuer) policyFor(claims map[string]any) *TrustPolicy {
+	sub, _ := claims["sub"].(string)
+	for i, p := range ti.Policies {
+		if !slices.Contains(p.Subjects, sub) && !slices.Contains(p.Subjects, "*") {
+			continue
+		}
+		if !claimsMatch(claims, p.Claims) {
+			continue
+		}
+		return &ti.Policies[i]
+	}
+	return nil
+}
+
+// claimsMatch reports whether claims has all the want claims. Only string,
+// boolean and number claims can match.
+func claimsMatch(claims map[string]any, want map[string]string) bool {
+	for name, value := range want {
+		switch v := claims[name].(type) {
+		case string, bool, float64:
+			if fmt.Sprint(v) != value {
+				return false
+			}
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// allowedAudiences returns the audiences p allows the identity to get
+// tokens for, as matched by m.
+func (p *TrustPolicy) allowedAudiences(m *resourceMatcher, audiences []string) []string {
+	var allowed []string
+	for _, aud := range audiences {
+		if m.matchAny(p.Resources, aud) {
+			allowed = append(allowed, aud)
+		}
+	}
+	return allowed
+}
+
+// verifyIssuerToken verifies that tok is signed by the trusted issuer ti,
+// currently valid and meant for tsidp, and returns its claims.
+func (s *IDPServer) verifyIssuerToken(ctx context.Context, ti *TrustedIssuer, tok *jwt.JSONWebToken) (map[string]any, error) {
+	kid := tok.Headers[0].KeyID
+	jwks, err := s.issuerJWKS(ctx, ti, kid)
+	if err != nil {
+		return nil, err
+	}
+	keys := jwks.Keys
+	if kid != "" {
+		keys = jwks.Key(kid)
+	}
+	var (
+		claims    jwt.Claims
+		allClaims map[string]any
+		verified  bool
+	)
+	for _, k := range keys {
+		// Only public signing keys are accepted.
+		if k.Use == "enc" || !k.IsPublic() {
+			continue
+		}
+		if err := tok.Claims(k.Key, &claims, &allClaims); err == nil {
+			verified = true
+			break
+		}
+	}
+	if !verified {
+		return nil, fmt.Errorf("signature does not verify for issuer %q", ti.Issuer)
+	}
+
+	if err := claims.Validate(jwt.Expected{
+		Issuer:   ti.Issuer,
+		Audience: jwt.Audience{cmp.Or(ti.Audience, s.serverURL)},
+		Time:     time.Now(),
+	}); err != nil {
+		return nil, err
+	}
+	if claims.Expiry == nil {
+		return nil, errors.New("token has no exp claim")
+	}
+	if claims.Subject == "" {
+		return nil, errors.New("token has no sub claim")
+	}
+	return allClaims, nil
+}
+
+// issuerJWKS returns the signing keys of the trusted issuer ti, discovering
+// its jwks_uri if needed. kid is the key ID of the token to verify, if any,
+// see fetchJWKS.
+func (s *IDPServer) issuerJWKS(ctx context.Context, ti *TrustedIssuer, kid string) (*jose.JSONWebKeySet, error) {
+	jwksURI := ti.JWKSURI
+	if jwksURI == "" {
+		var meta struct {
+			Issuer  string `json:"issuer"`
+			JWKSURI string `json:"jwks_uri"`
+		}
+		if err := s.fetchCachedJSON(ctx, strings.TrimSuffix(ti.Issuer, "/")+"/.well-known/openid-configuration", jwksCacheTTL, &meta); err != nil {
+			return nil, err
+		}
+		// OpenID Connect Discovery Section 4.3
+		if meta.Issuer != ti.Issuer {
+			return nil, fmt.Errorf("tsidp: discovery document of %q is for issuer %q", ti.Issuer, meta.Issuer)
+		}
+		jwksURI = meta.JWKSURI
+	}
+	return s.fetchJWKS(ctx, jwksURI, kid)
+}
+
+// isHTTPSURL reports whether s is an absolute https URL.
+func isHTTPSURL(s string) bool {
+	u, err := url.Parse(s)
+	return err == nil && u.Scheme == "https" && u.Host != ""
+}
@@ -15,6 +15,7 @@ import (
 	"strings"
 	"time"
 
+	"tailscale.com/types/views"
 	"tailscale.com/util/rands"
 )
 
@@ -30,6 +31,9 @@ var listHTML string
 //go:embed ui-edit.html
 var editHTML string
 
+//go:embed ui-device.html
+var deviceHTML string
+
 //go:embed ui-footer.html
 var footerHTML string
 
@@ -39,11 +43,13 @@ var styleCSS string
 var tmplFuncs = template.FuncMap{
 	"joinRedirectURIs": joinRedirectURIs,
 	"GetAppVersion":    GetVersion,
+	"signingAlgs":      openIDSupportedSigningAlgos.AsSlice,
 }
 
 var (
-	listTmpl *template.Template
-	editTmpl *template.Template
+	listTmpl   *template.Template
+	editTmpl   *template.Template
+	deviceTmpl *template.Template
 )
 
 func init() {
@@ -62,10 +68,19 @@ func init() {
 	e := newBase()
 	template.Must(e.New("edit").Parse(editHTML))
 	editTmpl = e
+
+	d := newBase()
+	template.Must(d.New("device").Parse(deviceHTML))
+	deviceTmpl = d
 }
 
 var processStart = time.Now()
 
+// serveStyleCSS serves the stylesheet of the UI pages
+func serveStyleCSS(w http.ResponseWriter, r *http.Request) {
+	http.ServeContent(w, r, "ui-style.css", processStart, strings.NewReader(styleCSS))
+}
+
 // handleUI serves the UI for managing OAuth/OIDC clients
 // Migrated from legacy/ui.go:61-85
 func (s *IDPServer) handleUI(w http.ResponseWriter, r *http.Request) {
@@ -92,9 +107,6 @@ func (s *IDPServer) handleUI(w http.ResponseWriter, r *http.Request) {
 	case "/new":
 		s.handleNewClient(w, r)
 		return
-	case "/style.css":
-		http.ServeContent(w, r, "ui-style.css", processStart, strings.NewReader(styleCSS))
-		return
 	}
 
 	if strings.HasPrefix(r.URL.Path, "/edit/") {
@@ -116,6 +128,7 @@ func (s *IDPServer) handleClientsList(w http.ResponseWriter, r *http.Request) {
 			Name:         c.Name,
 			RedirectURIs: c.RedirectURIs,
 			HasSecret:    c.Secret != "",
+			Public:       c.isPublic(),
 		})
 	}
 	s.mu.Unlock()
@@ -161,18 +174,47 @@ func (s *IDPServer) handleNewClient(w http.ResponseWriter, r *http.Request) {
 		name := strings.TrimSpace(r.FormValue("name"))
 		redirectURIsText := strings.TrimSpace(r.FormValue("redirect_uris"))
 		redirectURIs := splitRedirectURIs(redirectURIsText)
+		signingAlg := r.FormValue("id_token_signed_response_alg")
+		postLogoutRedirectURIs := splitRedirectURIs(strings.TrimSpace(r.FormValue("post_logout_redirect_uris")))
+		backchannelLogoutURI := strings.TrimSpace(r.FormValue("backchannel_logout_uri"))
+		clientCredentials := r.FormValue("client_credentials") == "on"
+		deviceCode := r.FormValue("device_code") == "on"
+		requirePAR := r.FormValue("require_par") == "on"
+		jwtAccessTokens := r.FormValue("jwt_access_tokens") == "on"
+		bindTokensToNode := r.FormValue("bind_tokens_to_node") == "on"
+		public := r.FormValue("public") == "on"
+		scope := strings.Join(strings.Fields(r.FormValue("scope")), " ")
+		resources := splitRedirectURIs(strings.TrimSpace(r.FormValue("resources")))
+		lifetimeFields := lifetimeFieldsFromForm(r)
 
 		baseData := clientDisplayData{
-			IsNew:        true,
-			Name:         name,
-			RedirectURIs: redirectURIs,
+			IsNew:                  true,
+			Public:                 public,
+			Name:                   name,
+			RedirectURIs:           redirectURIs,
+			SigningAlg:             signingAlg,
+			PostLogoutRedirectURIs: postLogoutRedirectURIs,
+			BackchannelLogoutURI:   backchannelLogoutURI,
+			ClientCredentials:      clientCredentials,
+			DeviceCode:             deviceCode,
+			RequirePAR:             requirePAR,
+			JWTAccessTokens:        jwtAccessTokens,
+			BindTokensToNode:       bindTokensToNode,
+			tokenLifetimeFields:    lifetimeFields,
+			Scope:                  scope,
+			Resources:              resources,
 		}
 
-		if len(redirectURIs) == 0 {
+		if len(redirectURIs) == 0 && !clientCredentials && !deviceCode {
 			s.renderFormError(w, r, baseData, "At least one redirect URI is required")
 			return
 		}
 
+		if public && clientCredentials {
+			s.renderFormError(w, r, baseData, "Public clients can't use the client credentials grant")
+			return
+		}
+
 		for _, uri := range redirectURIs {
 			if errMsg := validateRedirectURI(uri); errMsg != "" {
 				s.renderFormError(w, r, baseData, fmt.Sprintf("Invalid redirect URI '%s': %s", uri, errMsg))
@@ -180,21 +222,62 @@ func (s *IDPServer) handleNewClient(w http.ResponseWriter, r *http.Request) {
 			}
 		}
 
+		for _, uri := range postLogoutRedirectURIs {
+			if errMsg := validateRedirectURI(uri); errMsg != "" {
+				s.renderFormError(w, r, baseData, fmt.Sprintf("Invalid post logout redirect URI '%s': %s", uri, errMsg))
+				return
+			}
+		}
+
+		if backchannelLogoutURI != "" {
+			if errMsg := validateBackchannelLogoutURI(backchannelLogoutURI); errMsg != "" {
+				s.renderFormError(w, r, baseData, fmt.Sprintf("Invalid back-channel logout URI '%s': %s", backchannelLogoutURI, errMsg))
+				return
+			}
+		}
+
+		if signingAlg != "" && !views.SliceContains(openIDSupportedSigningAlgos, signingAlg) {
+			s.renderFormError(w, r, baseData, fmt.Sprintf("Unsupported ID token signing algorithm '%s'", signingAlg))
+			return
+		}
+
+		lifetimes, err := lifetimeFields.parse()
+		if err != nil {
+			s.renderFormError(w, r, baseData, fmt.Sprintf("Invalid token lifetime: %v", err))
+			return
+		}
+
 		clientID := rands.HexString(32)
 		clientSecret := rands.HexString(64)
+		authMethod := ""
+		if public {
+			clientSecret = ""
+			authMethod = "none"
+		}
 		newClient := FunnelClient{
-			ID:           clientID,
-			Secret:       clientSecret,
-			Name:         name,
-			RedirectURIs: redirectURIs,
+			ID:                       clientID,
+			Secret:                   clientSecret,
+			Name:                     name,
+			RedirectURIs:             redirectURIs,
+			IDTokenSignedResponseAlg: signingAlg,
+			PostLogoutRedirectURIs:   postLogoutRedirectURIs,
+			BackchannelLogoutURI:     backchannelLogoutURI,
+			GrantTypes:               setGrantType(setGrantType(nil, "client_credentials", clientCredentials), deviceCodeGrantType, deviceCode),
+			Scope:                    scope,
+			Resources:                resources,
+			TokenEndpointAuthMethod:  authMethod,
+			RequirePAR:               requirePAR,
+			JWTAccessTokens:          jwtAccessTokens,
+			BindTokensToNode:         bindTokensToNode,
 		}
+		newClient.setTokenLifetimes(lifetimes)
 
 		s.mu.Lock()
 		if s.funnelClients == nil {
 			s.funnelClients = make(map[string]*FunnelClient)
 		}
 		s.funnelClients[clientID] = &newClient
-		err := s.storeFunnelClientsLocked()
+		err = s.storeFunnelClientsLocked()
 		s.mu.Unlock()
 
 		if err != nil {
@@ -204,11 +287,27 @@ func (s *IDPServer) handleNewClient(w http.ResponseWriter, r *http.Request) {
 		}
 
 		successData := clientDisplayData{
-			ID:           clientID,
-			Name:         name,
-			RedirectURIs: redirectURIs,
-			Secret:       clientSecret,
-			IsNew:        true,
+			ID:                     clientID,
+			Name:                   name,
+			RedirectURIs:           redirectURIs,
+			SigningAlg:             signingAlg,
+			PostLogoutRedirectURIs: postLogoutRedirectURIs,
+			BackchannelLogoutURI:   backchannelLogoutURI,
+			ClientCredentials:      clientCredentials,
+			DeviceCode:             deviceCode,
+			RequirePAR:             requirePAR,
+			JWTAccessTokens:        jwtAccessTokens,
+			BindTokensToNode:       bindTokensToNode,
+			tokenLifetimeFields:    lifetimeFields,
+			Scope:                  scope,
+			Resources:              resources,
+			Secret:                 clientSecret,
+			Public:                 public,
+			IsNew:                  true,
+		}
+		if public {
+			s.renderFormSuccess(w, r, successData, "Public client created successfully!")
+			return
 		}
 		s.renderFormSuccess(w, r, successData, "Client created successfully! Save the client secret - it won't be shown again.")
 		return
@@ -237,11 +336,23 @@ func (s *IDPServer) handleEditClient(w http.ResponseWriter, r *http.Request) {
 
 	if r.Method == "GET" {
 		data := clientDisplayData{
-			ID:           client.ID,
-			Name:         client.Name,
-			RedirectURIs: client.RedirectURIs,
-			HasSecret:    client.Secret != "",
-			IsEdit:       true,
+			ID:                     client.ID,
+			Name:                   client.Name,
+			RedirectURIs:           client.RedirectURIs,
+			SigningAlg:             client.IDTokenSignedResponseAlg,
+			PostLogoutRedirectURIs: client.PostLogoutRedirectURIs,
+			BackchannelLogoutURI:   client.BackchannelLogoutURI,
+			ClientCredentials:      client.allowsGrantType("client_credentials"),
+			DeviceCode:             client.allowsGrantType(deviceCodeGrantType),
+			RequirePAR:             client.RequirePAR,
+			JWTAccessTokens:        client.JWTAccessTokens,
+			BindTokensToNode:       client.BindTokensToNode,
+			tokenLifetimeFields:    lifetimeFieldsOf(client),
+			Scope:                  client.Scope,
+			Resources:              client.Resources,
+			HasSecret:              client.Secret != "",
+			Public:                 client.isPublic(),
+			IsEdit:                 true,
 		}
 		if err := s.renderClientForm(w, data); err != nil {
 			writeHTTPError(w, r, http.StatusInternalServerError, ecServerError, "failed to render form", err)
@@ -265,11 +376,23 @@ func (s *IDPServer) handleEditClient(w http.ResponseWriter, r *http.Request) {
 				s.mu.Unlock()
 
 				baseData := clientDisplayData{
-					ID:           client.ID,
-					Name:         client.Name,
-					RedirectURIs: client.RedirectURIs,
-					HasSecret:    client.Secret != "",
-					IsEdit:       true,
+					ID:                     client.ID,
+					Name:                   client.Name,
+					RedirectURIs:           client.RedirectURIs,
+					SigningAlg:             client.IDTokenSignedResponseAlg,
+					PostLogoutRedirectURIs: client.PostLogoutRedirectURIs,
+					BackchannelLogoutURI:   client.BackchannelLogoutURI,
+					ClientCredentials:      client.allowsGrantType("client_credentials"),
+					DeviceCode:             client.allowsGrantType(deviceCodeGrantType),
+					RequirePAR:             client.RequirePAR,
+					JWTAccessTokens:        client.JWTAccessTokens,
+					BindTokensToNode:       client.BindTokensToNode,
+					tokenLifetimeFields:    lifetimeFieldsOf(client),
+					Scope:                  client.Scope,
+					Resources:              client.Resources,
+					HasSecret:              client.Secret != "",
+					Public:                 client.isPublic(),
+					IsEdit:                 true,
 				}
 				s.renderFormError(w, r, baseData, "Failed to delete client. Please try again.")
 				return
@@ -280,6 +403,10 @@ func (s *IDPServer) handleEditClient(w http.ResponseWriter, r *http.Request) {
 		}
 
 		if action == "regenerate_secret" {
+			if client.isPublic() {
+				writeHTTPError(w, r, http.StatusBadRequest, ecInvalidRequest, "Public clients don't have a secret", nil)
+				return
+			}
 			newSecret := rands.HexString(64)
 			s.mu.Lock()
 			s.funnelClients[clientID].Secret = newSecret
@@ -287,11 +414,23 @@ func (s *IDPServer) handleEditClient(w http.ResponseWriter, r *http.Request) {
 			s.mu.Unlock()
 
 			baseData := clientDisplayData{
-				ID:           client.ID,
-				Name:         client.Name,
-				RedirectURIs: client.RedirectURIs,
-				HasSecret:    true,
-				IsEdit:       true,
+				ID:                     client.ID,
+				Name:                   client.Name,
+				RedirectURIs:           client.RedirectURIs,
+				SigningAlg:             client.IDTokenSignedResponseAlg,
+				PostLogoutRedirectURIs: client.PostLogoutRedirectURIs,
+				BackchannelLogoutURI:   client.BackchannelLogoutURI,
+				ClientCredentials:      client.allowsGrantType("client_credentials"),
+				DeviceCode:             client.allowsGrantType(deviceCodeGrantType),
+				RequirePAR:             client.RequirePAR,
+				JWTAccessTokens:        client.JWTAccessTokens,
+				BindTokensToNode:       client.BindTokensToNode,
+				tokenLifetimeFields:    lifetimeFieldsOf(client),
+				Scope:                  client.Scope,
+				Resources:              client.Resources,
+				HasSecret:              true,
+				Public:                 client.isPublic(),
+				IsEdit:                 true,
 			}
 
 			if err != nil {
@@ -313,19 +452,47 @@ func (s *IDPServer) handleEditClient(w http.ResponseWriter, r *http.Request) {
 		name := strings.TrimSpace(r.FormValue("name"))
 		redirectURIsText := strings.TrimSpace(r.FormValue("redirect_uris"))
 		redirectURIs := splitRedirectURIs(redirectURIsText)
+		signingAlg := r.FormValue("id_token_signed_response_alg")
+		postLogoutRedirectURIs := splitRedirectURIs(strings.TrimSpace(r.FormValue("post_logout_redirect_uris")))
+		backchannelLogoutURI := strings.TrimSpace(r.FormValue("backchannel_logout_uri"))
+		clientCredentials := r.FormValue("client_credentials") == "on"
+		deviceCode := r.FormValue("device_code") == "on"
+		requirePAR := r.FormValue("require_par") == "on"
+		jwtAccessTokens := r.FormValue("jwt_access_tokens") == "on"
+		bindTokensToNode := r.FormValue("bind_tokens_to_node") == "on"
+		scope := strings.Join(strings.Fields(r.FormValue("scope")), " ")
+		resources := splitRedirectURIs(strings.TrimSpace(r.FormValue("resources")))
+		lifetimeFields := lifetimeFieldsFromForm(r)
 		baseData := clientDisplayData{
-			ID:           client.ID,
-			Name:         name,
-			RedirectURIs: redirectURIs,
-			HasSecret:    client.Secret != "",
-			IsEdit:       true,
+			ID:                     client.ID,
+			Name:                   name,
+			RedirectURIs:           redirectURIs,
+			SigningAlg:             signingAlg,
+			PostLogoutRedirectURIs: postLogoutRedirectURIs,
+			BackchannelLogoutURI:   backchannelLogoutURI,
+			ClientCredentials:      clientCredentials,
+			DeviceCode:             deviceCode,
+			RequirePAR:             requirePAR,
+			JWTAccessTokens:        jwtAccessTokens,
+			BindTokensToNode:       bindTokensToNode,
+			tokenLifetimeFields:    lifetimeFields,
+			Scope:                  scope,
+			Resources:              resources,
+			HasSecret:              client.Secret != "",
+			Public:                 client.isPublic(),
+			IsEdit:                 true,
 		}
 
-		if len(redirectURIs) == 0 {
+		if len(redirectURIs) == 0 && !clientCredentials && !deviceCode {
 			s.renderFormError(w, r, baseData, "At least one redirect URI is required")
 			return
 		}
 
+		if client.isPublic() && clientCredentials {
+			s.renderFormError(w, r, baseData, "Public clients can't use the client credentials grant")
+			return
+		}
+
 		for _, uri := range redirectURIs {
 			if errMsg := validateRedirectURI(uri); errMsg != "" {
 				s.renderFormError(w, r, baseData, fmt.Sprintf("Invalid redirect URI '%s': %s", uri, errMsg))
@@ -333,10 +500,45 @@ func (s *IDPServer) handleEditClient(w http.ResponseWriter, r *http.Request) {
 			}
 		}
 
+		for _, uri := range postLogoutRedirectURIs {
+			if errMsg := validateRedirectURI(uri); errMsg != "" {
+				s.renderFormError(w, r, baseData, fmt.Sprintf("Invalid post logout redirect URI '%s': %s", uri, errMsg))
+				return
+			}
+		}
+
+		if backchannelLogoutURI != "" {
+			if errMsg := validateBackchannelLogoutURI(backchannelLogoutURI); errMsg != "" {
+				s.renderFormError(w, r, baseData, fmt.Sprintf("Invalid back-channel logout URI '%s': %s", backchannelLogoutURI, errMsg))
+				return
+			}
+		}
+
+		if signingAlg != "" && !views.SliceContains(openIDSupportedSigningAlgos, signingAlg) {
+			s.renderFormError(w, r, baseData, fmt.Sprintf("Unsupported ID token signing algorithm '%s'", signingAlg))
+			return
+		}
+
+		lifetimes, err := lifetimeFields.parse()
+		if err != nil {
+			s.renderFormError(w, r, baseData, fmt.Sprintf("Invalid token lifetime: %v", err))
+			return
+		}
+
 		s.mu.Lock()
 		s.funnelClients[clientID].Name = name
 		s.funnelClients[clientID].RedirectURIs = redirectURIs
-		err := s.storeFunnelClientsLocked()
+		s.funnelClients[clientID].IDTokenSignedResponseAlg = signingAlg
+		s.funnelClients[clientID].PostLogoutRedirectURIs = postLogoutRedirectURIs
+		s.funnelClients[clientID].BackchannelLogoutURI = backchannelLogoutURI
+		s.funnelClients[clientID].GrantTypes = setGrantType(setGrantType(client.GrantTypes, "client_credentials", clientCredentials), deviceCodeGrantType, deviceCode)
+		s.funnelClients[clientID].Scope = scope
+		s.funnelClients[clientID].Resources = resources
+		s.funnelClients[clientID].RequirePAR = requirePAR
+		s.funnelClients[clientID].JWTAccessTokens = jwtAccessTokens
+		s.funnelClients[clientID].BindTokensToNode = bindTokensToNode
+		s.funnelClients[clientID].setTokenLifetimes(lifetimes)
+		err = s.storeFunnelClientsLocked()
 		s.mu.Unlock()
 
 		if err != nil {
@@ -355,15 +557,99 @@ func (s *IDPServer) handleEditClient(w http.ResponseWriter, r *http.Request) {
 // clientDisplayData holds data for rendering client forms
 // Migrated from legacy/ui.go:321-331
 type clientDisplayData struct {
-	ID           string
-	Name         string
-	RedirectURIs []string
-	Secret       string
-	HasSecret    bool
-	IsNew        bool
-	IsEdit       bool
-	Success      string
-	Error        string
+	ID                     string
+	Name                   string
+	RedirectURIs           []string
+	PostLogoutRedirectURIs []string
+	BackchannelLogoutURI   string
+	ClientCredentials      bool // client may use the client credentials grant
+	DeviceCode             bool // client may use the device authorization grant
+	RequirePAR             bool // client must use pushed authorization requests
+	JWTAccessTokens        bool // client gets JWT access tokens (RFC 9068)
+	BindTokensToNode       bool // client's tokens only work from the node that requested them
+	tokenLifetimeFields
+	Scope      string
+	Resources  []string
+	SigningAlg string // ID token signing algorithm, RS256 if empty
+	Secret     string
+	HasSecret  bool
+	Public     bool // public client without a secret, see FunnelClient.isPublic
+	IsNew      bool
+	IsEdit     bool
+	Success    string
+	Error      string
+}
+
+// tokenLifetimeFields are the token lifetimes of a client as shown in the
+// client form, as durations such as "1h". Empty fields use the server-wide
+// setting.
+type tokenLifetimeFields struct {
+	AccessTokenLifetime     string
+	IDTokenLifetime         string
+	RefreshTokenIdleTimeout string
+	RefreshTokenLifetime    string
+}
+
+// lifetimeFieldsOf returns the token lifetimes configured on c.
+func lifetimeFieldsOf(c *FunnelClient) tokenLifetimeFields {
+	return tokenLifetimeFields{
+		AccessTokenLifetime:     formatLifetime(c.AccessTokenLifetime),
+		IDTokenLifetime:         formatLifetime(c.IDTokenLifetime),
+		RefreshTokenIdleTimeout: formatLifetime(c.RefreshTokenIdleTimeout),
+		RefreshTokenLifetime:    formatLifetime(c.RefreshTokenLifetime),
+	}
+}
+
+// lifetimeFieldsFromForm returns the token lifetimes submitted in the
+// client form.
+func lifetimeFieldsFromForm(r *http.Request) tokenLifetimeFields {
+	return tokenLifetimeFields{
+		AccessTokenLifetime:     strings.TrimSpace(r.FormValue("access_token_lifetime")),
+		IDTokenLifetime:         strings.TrimSpace(r.FormValue("id_token_lifetime")),
+		RefreshTokenIdleTimeout: strings.TrimSpace(r.FormValue("refresh_token_idle_timeout")),
+		RefreshTokenLifetime:    strings.TrimSpace(r.FormValue("refresh_token_lifetime")),
+	}
+}
+
+// parse parses and validates the lifetimes in f.
+func (f tokenLifetimeFields) parse() (TokenLifetimes, error) {
+	var l TokenLifetimes
+	for _, field := range []struct {
+		name  string
+		value string
+		dst   *time.Duration
+	}{
+		{"access token lifetime", f.AccessTokenLifetime, &l.AccessToken},
+		{"ID token lifetime", f.IDTokenLifetime, &l.IDToken},
+		{"refresh token idle timeout", f.RefreshTokenIdleTimeout, &l.RefreshTokenIdle},
+		{"refresh token lifetime", f.RefreshTokenLifetime, &l.RefreshTokenAbsolute},
+	} {
+		if field.value == "" {
+			continue
+		}
+		d, err := time.ParseDuration(field.value)
+		if err != nil {
+			return TokenLifetimes{}, fmt.Errorf("%s %q is not a duration such as 1h", field.name, field.value)
+		}
+		*field.dst = d.Truncate(time.Second)
+	}
+	return l, l.validate()
+}
+
+// formatLifetime formats a lifetime in seconds for the client form, or
+// returns "" if it isn't set.
+func formatLifetime(seconds int) string {
+	if seconds <= 0 {
+		return ""
+	}
+	s := (time.Duration(seconds) * time.Second).String()
+	if strings.HasSuffix(s, "m0s") {
+		s = strings.TrimSuffix(s, "0s")
+	}
+	if strings.HasSuffix(s, "h0m") {
+		s = strings.TrimSuffix(s, "0m")
+	}
+	return s
 }
 
 // listPageData holds data for rendering the clients list page
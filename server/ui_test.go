@@ -6,6 +6,10 @@ package server
 import (
 	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"slices"
+	"strings"
 	"testing"
 )
 
@@ -164,3 +168,238 @@ func TestUserInterfaceCSRF(t *testing.T) {
 		})
 	}
 }
+
+// TestClientFormSigningAlg tests setting the ID token signing algorithm of a
+// client from the admin UI
+func TestClientFormSigningAlg(t *testing.T) {
+	s := &IDPServer{
+		serverURL:         "https://idp.test.ts.net",
+		stateDir:          t.TempDir(),
+		bypassAppCapCheck: true,
+	}
+
+	post := func(path string, form url.Values) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", path, strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		rr := httptest.NewRecorder()
+		s.ServeHTTP(rr, req)
+		return rr
+	}
+
+	rr := post("/new", url.Values{
+		"redirect_uris":                {"https://rp.example.com/callback"},
+		"id_token_signed_response_alg": {"HS256"},
+	})
+	if !strings.Contains(rr.Body.String(), "Unsupported ID token signing algorithm") {
+		t.Errorf("expected unsupported algorithm error, got: %s", rr.Body.String())
+	}
+	if len(s.funnelClients) != 0 {
+		t.Fatalf("client created with unsupported algorithm")
+	}
+
+	rr = post("/new", url.Values{
+		"redirect_uris":                {"https://rp.example.com/callback"},
+		"id_token_signed_response_alg": {"ES256"},
+	})
+	if rr.Code != http.StatusOK || len(s.funnelClients) != 1 {
+		t.Fatalf("expected client to be created, got %d: %s", rr.Code, rr.Body.String())
+	}
+	var client *FunnelClient
+	for _, c := range s.funnelClients {
+		client = c
+	}
+	if client.IDTokenSignedResponseAlg != "ES256" {
+		t.Errorf("IDTokenSignedResponseAlg = %q, want ES256", client.IDTokenSignedResponseAlg)
+	}
+
+	rr = post("/edit/"+client.ID, url.Values{
+		"redirect_uris":                {"https://rp.example.com/callback"},
+		"id_token_signed_response_alg": {"EdDSA"},
+	})
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected client to be updated, got %d: %s", rr.Code, rr.Body.String())
+	}
+	if client.IDTokenSignedResponseAlg != "EdDSA" {
+		t.Errorf("IDTokenSignedResponseAlg = %q, want EdDSA", client.IDTokenSignedResponseAlg)
+	}
+	if !strings.Contains(rr.Body.String(), `<option value="EdDSA" selected>`) {
+		t.Errorf("edit form does not select the client's algorithm")
+	}
+}
+
+// TestClientFormPostLogoutRedirectURIs tests editing the post logout
+// redirect URIs of a client from the admin UI
+func TestClientFormPostLogoutRedirectURIs(t *testing.T) {
+	client := &FunnelClient{
+		ID:           "test-client",
+		Secret:       "test-secret",
+		RedirectURIs: []string{"https://rp.example.com/callback"},
+	}
+	s := &IDPServer{
+		serverURL:         "https://idp.test.ts.net",
+		stateDir:          t.TempDir(),
+		bypassAppCapCheck: true,
+		funnelClients:     map[string]*FunnelClient{client.ID: client},
+	}
+
+	post := func(postLogoutURIs string) *httptest.ResponseRecorder {
+		form := url.Values{
+			"redirect_uris":             {"https://rp.example.com/callback"},
+			"post_logout_redirect_uris": {postLogoutURIs},
+		}
+		req := httptest.NewRequest("POST", "/edit/"+client.ID, strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		rr := httptest.NewRecorder()
+		s.ServeHTTP(rr, req)
+		return rr
+	}
+
+	rr := post("javascript:alert(1)")
+	if !strings.Contains(rr.Body.String(), "Invalid post logout redirect URI") {
+		t.Errorf("expected invalid URI error, got: %s", rr.Body.String())
+	}
+	if len(client.PostLogoutRedirectURIs) != 0 {
+		t.Fatalf("invalid post logout redirect URI was saved: %v", client.PostLogoutRedirectURIs)
+	}
+
+	rr = post("https://rp.example.com/signed-out\nhttps://rp.example.com/bye")
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected client to be updated, got %d: %s", rr.Code, rr.Body.String())
+	}
+	if got := strings.Join(client.PostLogoutRedirectURIs, " "); got != "https://rp.example.com/signed-out https://rp.example.com/bye" {
+		t.Errorf("PostLogoutRedirectURIs = %v", client.PostLogoutRedirectURIs)
+	}
+	if !strings.Contains(rr.Body.String(), "https://rp.example.com/bye</textarea>") {
+		t.Errorf("edit form does not show the post logout redirect URIs")
+	}
+}
+
+// TestClientFormClientCredentials tests configuring the client credentials
+// grant of a client from the admin UI
+func TestClientFormClientCredentials(t *testing.T) {
+	client := &FunnelClient{
+		ID:           "test-client",
+		Secret:       "test-secret",
+		RedirectURIs: []string{"https://rp.example.com/callback"},
+		GrantTypes:   []string{"authorization_code"},
+	}
+	s := &IDPServer{
+		serverURL:         "https://idp.test.ts.net",
+		stateDir:          t.TempDir(),
+		bypassAppCapCheck: true,
+		funnelClients:     map[string]*FunnelClient{client.ID: client},
+	}
+
+	post := func(form url.Values) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/edit/"+client.ID, strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		rr := httptest.NewRecorder()
+		s.ServeHTTP(rr, req)
+		return rr
+	}
+
+	// Redirect URIs are still required without the client credentials grant.
+	rr := post(url.Values{"scope": {"read"}})
+	if !strings.Contains(rr.Body.String(), "At least one redirect URI is required") {
+		t.Errorf("expected redirect URI error, got: %s", rr.Body.String())
+	}
+
+	rr = post(url.Values{
+		"client_credentials": {"on"},
+		"scope":              {" read   write "},
+		"resources":          {"https://api.example.com\nhttps://api2.example.com"},
+	})
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected client to be updated, got %d: %s", rr.Code, rr.Body.String())
+	}
+	if !slices.Equal(client.GrantTypes, []string{"authorization_code", "client_credentials"}) {
+		t.Errorf("GrantTypes = %v", client.GrantTypes)
+	}
+	if client.Scope != "read write" {
+		t.Errorf("Scope = %q, want %q", client.Scope, "read write")
+	}
+	if !slices.Equal(client.Resources, []string{"https://api.example.com", "https://api2.example.com"}) {
+		t.Errorf("Resources = %v", client.Resources)
+	}
+	if !regexp.MustCompile(`name="client_credentials"\s+checked`).MatchString(rr.Body.String()) {
+		t.Errorf("edit form does not show the client credentials grant as enabled")
+	}
+
+	rr = post(url.Values{"redirect_uris": {"https://rp.example.com/callback"}})
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected client to be updated, got %d: %s", rr.Code, rr.Body.String())
+	}
+	if client.allowsGrantType("client_credentials") {
+		t.Errorf("client credentials grant was not disabled: %v", client.GrantTypes)
+	}
+
+	// Device clients don't need redirect URIs either.
+	rr = post(url.Values{"device_code": {"on"}})
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected client to be updated, got %d: %s", rr.Code, rr.Body.String())
+	}
+	if !client.allowsGrantType(deviceCodeGrantType) {
+		t.Errorf("device authorization grant was not enabled: %v", client.GrantTypes)
+	}
+	if !regexp.MustCompile(`name="device_code"\s+checked`).MatchString(rr.Body.String()) {
+		t.Errorf("edit form does not show the device authorization grant as enabled")
+	}
+}
+
+// TestClientFormPublicClient tests creating a public client in the admin UI
+func TestClientFormPublicClient(t *testing.T) {
+	s := &IDPServer{
+		serverURL:         "https://idp.test.ts.net",
+		stateDir:          t.TempDir(),
+		bypassAppCapCheck: true,
+		funnelClients:     make(map[string]*FunnelClient),
+	}
+
+	post := func(path string, form url.Values) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", path, strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		rr := httptest.NewRecorder()
+		s.ServeHTTP(rr, req)
+		return rr
+	}
+
+	rr := post("/new", url.Values{
+		"name":               {"Desktop App"},
+		"redirect_uris":      {"http://127.0.0.1:33418/callback"},
+		"public":             {"on"},
+		"client_credentials": {"on"},
+	})
+	if !strings.Contains(rr.Body.String(), "Public clients can&#39;t use the client credentials grant") {
+		t.Errorf("expected client credentials error, got: %s", rr.Body.String())
+	}
+	if len(s.funnelClients) != 0 {
+		t.Fatalf("client should not have been created: %v", s.funnelClients)
+	}
+
+	rr = post("/new", url.Values{
+		"name":          {"Desktop App"},
+		"redirect_uris": {"http://127.0.0.1:33418/callback"},
+		"public":        {"on"},
+	})
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected client to be created, got %d: %s", rr.Code, rr.Body.String())
+	}
+	if len(s.funnelClients) != 1 {
+		t.Fatalf("expected one client, got %d", len(s.funnelClients))
+	}
+	var client *FunnelClient
+	for _, c := range s.funnelClients {
+		client = c
+	}
+	if !client.isPublic() || client.Secret != "" {
+		t.Errorf("expected a public client without a secret, got %+v", client)
+	}
+	if !strings.Contains(rr.Body.String(), client.ID) {
+		t.Errorf("created client ID not shown: %s", rr.Body.String())
+	}
+
+	rr = post("/edit/"+client.ID, url.Values{"action": {"regenerate_secret"}})
+	if rr.Code != http.StatusBadRequest || client.Secret != "" {
+		t.Errorf("public client secret regenerated: %d, %q", rr.Code, client.Secret)
+	}
+}
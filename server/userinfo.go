@@ -5,7 +5,9 @@ package server
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
+	"log/slog"
 	"net/http"
 	"strings"
 	"time"
@@ -53,14 +55,20 @@ func (s *IDPServer) serveUserInfo(w http.ResponseWriter, r *http.Request) {
 		writeHTTPError(w, r, http.StatusMethodNotAllowed, ecInvalidRequest, "method not allowed", nil)
 		return
 	}
-	tk, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	authz := r.Header.Get("Authorization")
+	tk, ok := strings.CutPrefix(authz, "Bearer ")
+	isDPoP := false
+	if !ok {
+		tk, ok = strings.CutPrefix(authz, "DPoP ")
+		isDPoP = ok
+	}
 	if !ok {
 		writeBearerError(w, http.StatusBadRequest, ecInvalidRequest, "invalid Authorization header")
 		return
 	}
 
 	s.mu.Lock()
-	ar, ok := s.accessToken[tk]
+	ar, ok := s.accessToken.Get(tk)
 	s.mu.Unlock()
 	if !ok {
 		writeBearerError(w, http.StatusUnauthorized, "invalid_token", "invalid token")
@@ -70,10 +78,48 @@ func (s *IDPServer) serveUserInfo(w http.ResponseWriter, r *http.Request) {
 	if ar.ValidTill.Before(time.Now()) {
 		writeBearerError(w, http.StatusUnauthorized, "invalid_token", "token expired")
 		s.mu.Lock()
-		delete(s.accessToken, tk)
+		if err := s.accessToken.Delete(tk); err != nil {
+			slog.Warn("failed to persist access token removal", slog.Any("error", err))
+		}
 		s.mu.Unlock()
 		return
 	}
+	if !certBindingMatches(r, ar.CertThumbprint) {
+		writeBearerError(w, http.StatusUnauthorized, "invalid_token", "token is bound to another client certificate")
+		return
+	}
+	if !s.nodeBindingMatches(r, ar.RPNodeID) {
+		writeBearerError(w, http.StatusUnauthorized, "invalid_token", "token is bound to another node")
+		return
+	}
+	// DPoP-bound tokens must be presented with the DPoP scheme and a proof
+	// signed by the key they are bound to (RFC 9449 Section 7).
+	if ar.DPoPJKT != "" || isDPoP {
+		if !isDPoP {
+			writeDPoPError(w, http.StatusUnauthorized, "invalid_token", "token is bound to a DPoP key")
+			return
+		}
+		jkt, err := s.verifyDPoPProof(r, tk, false)
+		if errors.Is(err, errUseDPoPNonce) {
+			w.Header().Set("DPoP-Nonce", s.currentDPoPNonce())
+			writeDPoPError(w, http.StatusUnauthorized, ecUseDPoPNonce, "DPoP proof must carry the nonce in the DPoP-Nonce header")
+			return
+		}
+		if err != nil {
+			writeDPoPError(w, http.StatusUnauthorized, ecInvalidDPoPProof, "invalid DPoP proof")
+			return
+		}
+		if jkt != ar.DPoPJKT {
+			writeDPoPError(w, http.StatusUnauthorized, "invalid_token", "token is not bound to the DPoP proof key")
+			return
+		}
+	}
+
+	// Tokens from the client credentials grant have no user.
+	if ar.RemoteUser == nil {
+		writeBearerError(w, http.StatusForbidden, "insufficient_scope", "token does not identify a user")
+		return
+	}
 
 	ui := userInfo{}
 	if ar.RemoteUser.Node.IsTagged() {
@@ -154,12 +154,12 @@ func TestExtraUserInfo(t *testing.T) {
 
 			// Insert a valid token into the idpServer
 			s := &IDPServer{
-				accessToken: map[string]*AuthRequest{
+				accessToken: &memTokenStore{m: map[string]*AuthRequest{
 					token: {
 						ValidTill:  tt.tokenValidTill,
 						RemoteUser: remoteUser,
 					},
-				},
+				}},
 			}
 
 			// Construct request
@@ -227,12 +227,12 @@ func TestUserInfoRealishEmail(t *testing.T) {
 
 			// Insert a valid token into the idpServer
 			s := &IDPServer{
-				accessToken: map[string]*AuthRequest{
+				accessToken: &memTokenStore{m: map[string]*AuthRequest{
 					token: {
 						ValidTill:  time.Now().Add(1 * time.Minute),
 						RemoteUser: remoteUser,
 					},
-				},
+				}},
 			}
 			s.SetServerURL("test-idp.test.ts.net", 443)
 
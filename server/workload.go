@@ -0,0 +1,182 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/netip"
+	"slices"
+	"strings"
+	"time"
+
+	"gopkg.in/square/go-jose.v2"
+	"gopkg.in/square/go-jose.v2/jwt"
+	"tailscale.com/client/tailscale/apitype"
+	"tailscale.com/tailcfg"
+	"tailscale.com/types/key"
+	"tailscale.com/types/views"
+	"tailscale.com/util/rands"
+)
+
+// workloadTokenType is the typ header of workload identity tokens, which
+// keeps them from passing for ID tokens.
+const workloadTokenType = "workload+jwt"
+
+// workloadClaims are the claims of a workload identity token. They describe
+// the tagged node the token was issued to.
+type workloadClaims struct {
+	jwt.Claims `json:",inline"`
+	Key        key.NodePublic            `json:"key"`       // the node public key
+	Addresses  views.Slice[netip.Prefix] `json:"addresses"` // the Tailscale IPs of the node
+	NodeID     tailcfg.NodeID            `json:"nid"`       // the node ID
+	NodeName   string                    `json:"node"`      // name of the node
+	Tailnet    string                    `json:"tailnet"`   // tailnet (like tail-scale.ts.net)
+	Tags       []string                  `json:"tags"`      // ACL tags of the node
+}
+
+// serveWorkloadToken issues workload identity tokens: JWTs that let a
+// tagged node prove its tailnet identity to a third party, such as a cloud
+// provider or Vault. The node is identified with WhoIs and the audience it
+// asks for must be allowed for one of its tags by the workloadAudiences of
+// the tsidp application capability. The subject of the token is the stable
+// node ID.
+func (s *IDPServer) serveWorkloadToken(w http.ResponseWriter, r *http.Request) {
+	if isFunnelRequest(r) {
+		writeHTTPError(w, r, http.StatusUnauthorized, ecAccessDenied, "not allowed over funnel", nil)
+		return
+	}
+
+	if r.Method != "POST" {
+		writeHTTPError(w, r, http.StatusMethodNotAllowed, ecInvalidRequest, "method not allowed", nil)
+		return
+	}
+
+	if err := r.ParseForm(); err != nil {
+		writeHTTPError(w, r, http.StatusBadRequest, ecInvalidRequest, "failed to parse form", err)
+		return
+	}
+
+	audience := r.FormValue("audience")
+	if audience == "" {
+		writeHTTPError(w, r, http.StatusBadRequest, ecInvalidRequest, "audience is required", nil)
+		return
+	}
+
+	// A token for a client would be accepted by it as if tsidp had
+	// authenticated a user.
+	s.mu.Lock()
+	_, isClient := s.funnelClients[audience]
+	s.mu.Unlock()
+	if isClient {
+		writeHTTPError(w, r, http.StatusForbidden, ecAccessDenied, "audience is an OIDC client",
+			fmt.Errorf("audience %q", audience))
+		return
+	}
+
+	if s.lc == nil {
+		writeHTTPError(w, r, http.StatusInternalServerError, ecServerError, "WhoIs not available", nil)
+		return
+	}
+
+	var remoteAddr string
+	if s.localTSMode {
+		remoteAddr = lastForwardedForAddr(r)
+	} else {
+		remoteAddr = r.RemoteAddr
+	}
+	who, err := s.lc.WhoIs(r.Context(), remoteAddr)
+	if err != nil {
+		writeHTTPError(w, r, http.StatusInternalServerError, ecServerError, "failed to identify node with WhoIs", err)
+		return
+	}
+
+	n := who.Node.View()
+	if !n.IsTagged() {
+		writeHTTPError(w, r, http.StatusForbidden, ecAccessDenied, "workload identity tokens are only issued to tagged nodes", nil)
+		return
+	}
+
+	rules, err := tailcfg.UnmarshalCapJSON[capRule](who.CapMap, tailcfg.PeerCapabilityTsIDP)
+	if err != nil {
+		writeHTTPError(w, r, http.StatusForbidden, ecAccessDenied, "failed to unmarshal capability", err)
+		return
+	}
+	tags := n.Tags().AsSlice()
+	if !workloadAudienceAllowed(s.newResourceMatcher(r.Context()), rules, tags, audience) {
+		writeHTTPError(w, r, http.StatusForbidden, ecAccessDenied, "audience not allowed for node",
+			fmt.Errorf("audience %q not allowed for tags %v", audience, tags))
+		return
+	}
+
+	token, err := s.newWorkloadToken(who, audience)
+	if err != nil {
+		writeHTTPError(w, r, http.StatusInternalServerError, ecServerError, "error creating workload identity token", err)
+		return
+	}
+
+	slog.Info("workload identity token issued",
+		slog.String("node", n.Name()),
+		slog.String("tags", strings.Join(tags, ",")),
+		slog.String("audience", audience),
+	)
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(map[string]any{
+		"token":      token,
+		"expires_in": int(TokenDuration.Seconds()),
+	}); err != nil {
+		writeHTTPError(w, r, http.StatusInternalServerError, ecServerError, "internal server error", err)
+	}
+}
+
+// newWorkloadToken returns a signed workload identity token for the tagged
+// node who, valid for audience.
+func (s *IDPServer) newWorkloadToken(who *apitype.WhoIsResponse, audience string) (string, error) {
+	iat := time.Now()
+	signer, err := s.signerWithType(jose.RS256, workloadTokenType, iat.Add(TokenDuration))
+	if err != nil {
+		return "", err
+	}
+
+	n := who.Node.View()
+	_, tcd, _ := strings.Cut(n.Name(), ".")
+	claims := workloadClaims{
+		Claims: jwt.Claims{
+			Audience:  jwt.Audience{audience},
+			IssuedAt:  jwt.NewNumericDate(iat),
+			Expiry:    jwt.NewNumericDate(iat.Add(TokenDuration)),
+			NotBefore: jwt.NewNumericDate(iat.Add(-NotValidBeforeClockSkew)),
+			ID:        rands.HexString(32),
+			Issuer:    s.serverURL,
+			Subject:   string(n.StableID()),
+		},
+		Key:       n.Key(),
+		Addresses: n.Addresses(),
+		NodeID:    n.ID(),
+		NodeName:  n.Name(),
+		Tailnet:   tcd,
+		Tags:      n.Tags().AsSlice(),
+	}
+	return jwt.Signed(signer).Claims(claims).CompactSerialize()
+}
+
+// workloadAudienceAllowed reports whether any of rules allows a node with
+// the given tags to get a workload identity token for audience, as matched
+// by m.
+func workloadAudienceAllowed(m *resourceMatcher, rules []capRule, tags []string, audience string) bool {
+	for _, rule := range rules {
+		for tag, audiences := range rule.WorkloadAudiences {
+			if tag != "*" && !slices.Contains(tags, tag) {
+				continue
+			}
+			if m.matchAny(audiences, audience) {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,214 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"net/url"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"gopkg.in/square/go-jose.v2"
+	"gopkg.in/square/go-jose.v2/jwt"
+	"tailscale.com/client/tailscale/apitype"
+	"tailscale.com/tailcfg"
+)
+
+// TestServeWorkloadToken tests issuing workload identity tokens to tagged
+// nodes
+func TestServeWorkloadToken(t *testing.T) {
+	rule := capRule{
+		WorkloadAudiences: map[string][]string{
+			"tag:server": {"sts.amazonaws.com", "https://vault.example.com"},
+			"tag:ci":     {"*"},
+		},
+	}
+
+	tests := []struct {
+		name         string
+		tags         []string
+		rules        []capRule
+		audience     string
+		method       string
+		funnel       bool
+		whoisErr     bool
+		expectStatus int
+	}{
+		{
+			name:         "allowed audience for tag",
+			tags:         []string{"tag:server"},
+			rules:        []capRule{rule},
+			audience:     "sts.amazonaws.com",
+			expectStatus: http.StatusOK,
+		},
+		{
+			name:         "wildcard audience",
+			tags:         []string{"tag:web", "tag:ci"},
+			rules:        []capRule{rule},
+			audience:     "https://anything.example.com",
+			expectStatus: http.StatusOK,
+		},
+		{
+			name: "wildcard tag",
+			tags: []string{"tag:web"},
+			rules: []capRule{{WorkloadAudiences: map[string][]string{
+				"*": {"https://vault.example.com"},
+			}}},
+			audience:     "https://vault.example.com",
+			expectStatus: http.StatusOK,
+		},
+		{
+			name:         "audience not allowed for tag",
+			tags:         []string{"tag:server"},
+			rules:        []capRule{rule},
+			audience:     "https://other.example.com",
+			expectStatus: http.StatusForbidden,
+		},
+		{
+			name:         "audience is a client",
+			tags:         []string{"tag:ci"},
+			rules:        []capRule{rule},
+			audience:     "test-client",
+			expectStatus: http.StatusForbidden,
+		},
+		{
+			name:         "tag without rule",
+			tags:         []string{"tag:web"},
+			rules:        []capRule{rule},
+			audience:     "sts.amazonaws.com",
+			expectStatus: http.StatusForbidden,
+		},
+		{
+			name:         "no capability",
+			tags:         []string{"tag:server"},
+			audience:     "sts.amazonaws.com",
+			expectStatus: http.StatusForbidden,
+		},
+		{
+			name:         "untagged node",
+			rules:        []capRule{rule},
+			audience:     "sts.amazonaws.com",
+			expectStatus: http.StatusForbidden,
+		},
+		{
+			name:         "missing audience",
+			tags:         []string{"tag:server"},
+			rules:        []capRule{rule},
+			expectStatus: http.StatusBadRequest,
+		},
+		{
+			name:         "GET not allowed",
+			method:       "GET",
+			tags:         []string{"tag:server"},
+			rules:        []capRule{rule},
+			audience:     "sts.amazonaws.com",
+			expectStatus: http.StatusMethodNotAllowed,
+		},
+		{
+			name:         "funnel request",
+			funnel:       true,
+			tags:         []string{"tag:server"},
+			rules:        []capRule{rule},
+			audience:     "sts.amazonaws.com",
+			expectStatus: http.StatusUnauthorized,
+		},
+		{
+			name:         "WhoIs error",
+			whoisErr:     true,
+			audience:     "sts.amazonaws.com",
+			expectStatus: http.StatusInternalServerError,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			who := &apitype.WhoIsResponse{
+				Node: &tailcfg.Node{
+					ID:        7,
+					StableID:  "nStable7",
+					Name:      "server.test.ts.net.",
+					Tags:      tt.tags,
+					Addresses: []netip.Prefix{netip.MustParsePrefix("100.64.0.7/32")},
+				},
+				CapMap: tailcfg.PeerCapMap{},
+			}
+			for _, rule := range tt.rules {
+				who.CapMap[tailcfg.PeerCapabilityTsIDP] = append(who.CapMap[tailcfg.PeerCapabilityTsIDP], mustMarshalJSON(t, rule))
+			}
+			s := setupTestServer(t, newTestWhoIsClient(t, who, tt.whoisErr))
+
+			method := tt.method
+			if method == "" {
+				method = "POST"
+			}
+			form := url.Values{}
+			if tt.audience != "" {
+				form.Set("audience", tt.audience)
+			}
+			req := httptest.NewRequest(method, "/workload-token", strings.NewReader(form.Encode()))
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			req.RemoteAddr = "100.64.0.7:12345"
+			if tt.funnel {
+				req.Header.Set("Tailscale-Funnel-Request", "true")
+			}
+			rr := httptest.NewRecorder()
+			s.serveWorkloadToken(rr, req)
+
+			if rr.Code != tt.expectStatus {
+				t.Fatalf("expected status %d, got %d: %s", tt.expectStatus, rr.Code, rr.Body.String())
+			}
+			if tt.expectStatus != http.StatusOK {
+				return
+			}
+
+			var resp struct {
+				Token     string `json:"token"`
+				ExpiresIn int    `json:"expires_in"`
+			}
+			if err := json.Unmarshal(rr.Body.Bytes(), &resp); err != nil {
+				t.Fatalf("failed to unmarshal response: %v", err)
+			}
+			if resp.ExpiresIn != int(TokenDuration.Seconds()) {
+				t.Errorf("expires_in = %d, want %d", resp.ExpiresIn, int(TokenDuration.Seconds()))
+			}
+
+			tok, err := jwt.ParseSigned(resp.Token)
+			if err != nil {
+				t.Fatalf("failed to parse token: %v", err)
+			}
+			if typ := tok.Headers[0].ExtraHeaders[jose.HeaderType]; typ != workloadTokenType {
+				t.Errorf("typ = %v, want %q", typ, workloadTokenType)
+			}
+			var claims struct {
+				jwt.Claims
+				NodeID   tailcfg.NodeID `json:"nid"`
+				NodeName string         `json:"node"`
+				Tailnet  string         `json:"tailnet"`
+				Tags     []string       `json:"tags"`
+			}
+			if err := tok.Claims(oidcTestingPublicKey(t), &claims); err != nil {
+				t.Fatalf("token does not verify: %v", err)
+			}
+			if err := claims.ValidateWithLeeway(jwt.Expected{
+				Issuer:   s.serverURL,
+				Subject:  "nStable7",
+				Audience: jwt.Audience{tt.audience},
+				Time:     time.Now(),
+			}, 0); err != nil {
+				t.Errorf("invalid claims: %v", err)
+			}
+			if claims.NodeID != 7 || claims.NodeName != "server.test.ts.net." || claims.Tailnet != "test.ts.net." {
+				t.Errorf("unexpected node claims: %+v", claims)
+			}
+			if !slices.Equal(claims.Tags, tt.tags) {
+				t.Errorf("tags = %v, want %v", claims.Tags, tt.tags)
+			}
+		})
+	}
+}
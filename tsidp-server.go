@@ -11,6 +11,8 @@ import (
 	"cmp"
 	"context"
 	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
@@ -21,6 +23,7 @@ import (
 	"os"
 	"os/signal"
 	"strings"
+	"syscall"
 	"time"
 
 	"github.com/tailscale/tsidp/server"
@@ -44,6 +47,15 @@ var (
 	flagHostname           = flag.String("hostname", cmp.Or(envknob.String("TS_HOSTNAME"), "idp"), "tsnet hostname to use instead of idp")
 	flagDir                = flag.String("dir", envknob.String("TS_STATE_DIR"), "tsnet state directory; a default one will be created if not provided")
 	flagEnableSTS          = flag.Bool("enable-sts", envknob.Bool("TSIDP_ENABLE_STS"), "enable OIDC STS token exchange support")
+	flagKeyRotation        = flag.Duration("signing-key-rotation", envDurationOr("TSIDP_SIGNING_KEY_ROTATION", 0), "rotate the token signing key after this long (e.g. 2160h for 90 days); 0 disables scheduled rotation")
+	flagMTLSPort           = flag.Int("mtls-port", envIntOr("TSIDP_MTLS_PORT", -1), "also listen on this port for mutual-TLS client authentication and certificate-bound tokens (RFC 8705)")
+	flagMTLSClientCA       = flag.String("mtls-client-ca", envknob.String("TSIDP_MTLS_CLIENT_CA"), "PEM file of the CAs trusted to issue client certificates for tls_client_auth")
+	flagJWTATResources     = flag.String("jwt-access-token-resources", envknob.String("TSIDP_JWT_ACCESS_TOKEN_RESOURCES"), "comma-separated resources that get JWT access tokens (RFC 9068) instead of opaque ones")
+	flagATLifetime         = flag.Duration("access-token-lifetime", envDurationOr("TSIDP_ACCESS_TOKEN_LIFETIME", server.TokenDuration), "how long access tokens are valid, at most 24h; clients can override it")
+	flagIDTokenLifetime    = flag.Duration("id-token-lifetime", envDurationOr("TSIDP_ID_TOKEN_LIFETIME", 0), "how long ID tokens are valid, at most 24h; 0 uses the access token lifetime")
+	flagRTIdleTimeout      = flag.Duration("refresh-token-idle-timeout", envDurationOr("TSIDP_REFRESH_TOKEN_IDLE_TIMEOUT", server.RefreshTokenDuration), "how long an unused refresh token stays valid")
+	flagRTLifetime         = flag.Duration("refresh-token-lifetime", envDurationOr("TSIDP_REFRESH_TOKEN_LIFETIME", 0), "how long after sign-in tokens can be refreshed (e.g. 8h); 0 means no limit")
+	flagTrustedIssuers     = flag.String("trusted-issuers", envknob.String("TSIDP_TRUSTED_ISSUERS"), "JSON file of external issuers whose JWTs can be exchanged for tsidp access tokens with -enable-sts")
 	flagAdvertiseTags      = flag.String("advertise-tags", envknob.String("TS_ADVERTISE_TAGS"), "comma-separated advertise tags (e.g. tag:tsidp,tag:server); required when using OAuth client secrets")
 
 	// application logging levels
@@ -85,6 +97,7 @@ func main() {
 		err         error
 		watcherChan chan error
 		cleanup     func()
+		httpClient  *http.Client // for outbound requests, nil to use the default
 
 		lns []net.Listener
 	)
@@ -122,6 +135,17 @@ func main() {
 			slog.Error("failed to listen on any ip", slog.Any("ips", st.TailscaleIPs))
 			os.Exit(1)
 		}
+		if *flagMTLSPort != -1 {
+			mtlsPortStr := fmt.Sprint(*flagMTLSPort)
+			for _, ip := range st.TailscaleIPs {
+				ln, err := net.Listen("tcp", net.JoinHostPort(ip.String(), mtlsPortStr))
+				if err != nil {
+					slog.Error("failed to listen for mTLS", slog.String("ip", ip.String()), slog.Any("error", err))
+					os.Exit(1)
+				}
+				lns = append(lns, tls.NewListener(ln, mtlsConfig(lc)))
+			}
+		}
 
 		// tailscaled needs to be setting an HTTP header for funneled requests
 		// that older versions don't provide.
@@ -189,6 +213,17 @@ func main() {
 		}
 
 		lns = append(lns, ln)
+		httpClient = ts.HTTPClient()
+
+		// The mTLS listener is only reachable over the tailnet.
+		if *flagMTLSPort != -1 {
+			ln, err := ts.Listen("tcp", fmt.Sprintf(":%d", *flagMTLSPort))
+			if err != nil {
+				slog.Error("failed to listen for mTLS", slog.Any("error", err))
+				os.Exit(1)
+			}
+			lns = append(lns, tls.NewListener(ln, mtlsConfig(lc)))
+		}
 	}
 
 	srv := server.New(
@@ -200,6 +235,53 @@ func main() {
 	)
 
 	srv.SetServerURL(strings.TrimSuffix(st.Self.DNSName, "."), *flagPort)
+	if httpClient != nil {
+		srv.SetHTTPClient(httpClient)
+	}
+	if *flagMTLSPort != -1 {
+		srv.SetMTLSURL(strings.TrimSuffix(st.Self.DNSName, "."), *flagMTLSPort)
+		if *flagMTLSClientCA != "" {
+			pool, err := loadCertPool(*flagMTLSClientCA)
+			if err != nil {
+				slog.Error("could not load mTLS client CAs", slog.Any("error", err))
+				os.Exit(1)
+			}
+			srv.SetMTLSClientCAs(pool)
+		}
+	} else if *flagMTLSClientCA != "" {
+		slog.Error("-mtls-client-ca requires -mtls-port")
+		os.Exit(1)
+	}
+	if *flagJWTATResources != "" {
+		srv.SetJWTAccessTokenResources(strings.Split(*flagJWTATResources, ","))
+	}
+	if *flagKeyRotation != 0 && *flagKeyRotation < server.SigningKeyPublishLead {
+		slog.Error("signing key rotation interval too short",
+			slog.Duration("interval", *flagKeyRotation),
+			slog.Duration("minimum", server.SigningKeyPublishLead))
+		os.Exit(1)
+	}
+	srv.SetSigningKeyRotation(*flagKeyRotation)
+	if err := srv.SetTokenLifetimes(server.TokenLifetimes{
+		AccessToken:          *flagATLifetime,
+		IDToken:              *flagIDTokenLifetime,
+		RefreshTokenIdle:     *flagRTIdleTimeout,
+		RefreshTokenAbsolute: *flagRTLifetime,
+	}); err != nil {
+		slog.Error("invalid token lifetimes", slog.Any("error", err))
+		os.Exit(1)
+	}
+	if *flagTrustedIssuers != "" {
+		issuers, err := loadTrustedIssuers(*flagTrustedIssuers)
+		if err != nil {
+			slog.Error("could not load trusted issuers", slog.Any("error", err))
+			os.Exit(1)
+		}
+		if err := srv.SetTrustedIssuers(issuers); err != nil {
+			slog.Error("invalid trusted issuers", slog.Any("error", err))
+			os.Exit(1)
+		}
+	}
 
 	// Load funnel clients from disk if they exist, regardless of whether funnel is enabled
 	// This ensures OIDC clients persist across restarts
@@ -208,6 +290,15 @@ func main() {
 		os.Exit(1)
 	}
 
+	// Load persisted tokens so relying party sessions survive restarts.
+	// This must happen after the funnel clients are loaded.
+	if err := srv.LoadTokens(); err != nil {
+		slog.Error("could not load tokens", slog.Any("error", err))
+		os.Exit(1)
+	}
+	defer srv.FlushTokens()
+	defer srv.Close()
+
 	slog.Info("tsidp server started", slog.String("server_url", srv.ServerURL()))
 
 	if *flagLocalPort != -1 {
@@ -222,7 +313,14 @@ func main() {
 		lns = append(lns, ln)
 	}
 
-	// Start token cleanup routine
+	// Make sure the signing key ring is loaded (or created) at startup and
+	// bring it up to date with the rotation schedule.
+	if err := srv.MaintainSigningKeys(); err != nil {
+		slog.Error("could not load signing keys", slog.Any("error", err))
+		os.Exit(1)
+	}
+
+	// Start token cleanup and signing key maintenance routine
 	cleanupCtx, cleanupCancel := context.WithCancel(ctx)
 	defer cleanupCancel()
 
@@ -235,6 +333,9 @@ func main() {
 			case <-ticker.C:
 				srv.CleanupExpiredTokens()
 				slog.Debug("Cleaned up expired tokens")
+				if err := srv.MaintainSigningKeys(); err != nil {
+					slog.Error("signing key maintenance failed", slog.Any("error", err))
+				}
 			case <-cleanupCtx.Done():
 				return
 			}
@@ -257,12 +358,13 @@ func main() {
 		}
 		go httpServer.Serve(ln)
 	}
-	// need to catch os.Interrupt, otherwise deferred cleanup code doesn't run
+	// need to catch os.Interrupt and SIGTERM (sent by container runtimes),
+	// otherwise deferred cleanup code doesn't run
 	exitChan := make(chan os.Signal, 1)
-	signal.Notify(exitChan, os.Interrupt)
+	signal.Notify(exitChan, os.Interrupt, syscall.SIGTERM)
 	select {
-	case <-exitChan:
-		slog.Info("interrupt, exiting")
+	case sig := <-exitChan:
+		slog.Info("signal received, exiting", slog.String("signal", sig.String()))
 		return
 	case <-watcherChan:
 		if errors.Is(err, io.EOF) || errors.Is(err, context.Canceled) {
@@ -270,6 +372,8 @@ func main() {
 			return
 		}
 		slog.Error("watcher error", slog.Any("error", err))
+		// os.Exit skips the deferred flush.
+		srv.FlushTokens()
 		os.Exit(1)
 	}
 }
@@ -370,6 +474,42 @@ func (rw *responseWrapper) Write(b []byte) (int, error) {
 	return rw.ResponseWriter.Write(b)
 }
 
+// mtlsConfig returns the TLS config of the mTLS listener. Client
+// certificates are requested but verified by tsidp per client, so that
+// self-signed certificates can be used too.
+func mtlsConfig(lc *local.Client) *tls.Config {
+	return &tls.Config{
+		GetCertificate: lc.GetCertificate,
+		ClientAuth:     tls.RequestClientCert,
+	}
+}
+
+// loadCertPool loads the PEM encoded certificates in path.
+func loadCertPool(path string) (*x509.CertPool, error) {
+	pem, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates found in %s", path)
+	}
+	return pool, nil
+}
+
+// loadTrustedIssuers loads the JSON list of trusted issuers in path.
+func loadTrustedIssuers(path string) ([]server.TrustedIssuer, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var issuers []server.TrustedIssuer
+	if err := json.Unmarshal(b, &issuers); err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", path, err)
+	}
+	return issuers, nil
+}
+
 func envIntOr(envVar string, implicitValue int) int {
 	val, ok := envknob.LookupInt(envVar)
 	if !ok {
@@ -377,3 +517,16 @@ func envIntOr(envVar string, implicitValue int) int {
 	}
 	return val
 }
+
+func envDurationOr(envVar string, implicitValue time.Duration) time.Duration {
+	s := envknob.String(envVar)
+	if s == "" {
+		return implicitValue
+	}
+	val, err := time.ParseDuration(s)
+	if err != nil {
+		slog.Error("invalid duration", slog.String("env", envVar), slog.String("value", s))
+		os.Exit(1)
+	}
+	return val
+}